@@ -2,4 +2,23 @@ module github.com/t0saki/GreenCloud-FileServer
 
 go 1.21
 
-require golang.org/x/sync v0.6.0
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/golang-jwt/jwt/v5 v5.2.0
+	github.com/klauspost/compress v1.17.7
+	github.com/quic-go/quic-go v0.42.0
+	golang.org/x/crypto v0.19.0
+	golang.org/x/image v0.15.0
+	golang.org/x/net v0.21.0
+	golang.org/x/sync v0.6.0
+	golang.org/x/sys v0.17.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/quic-go/qpack v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
@@ -1,67 +1,92 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"path"
+	"syscall"
 	"time"
+
+	"github.com/t0saki/GreenCloud-FileServer/pkg/fileserver"
 )
 
 func main() {
-	// Setup command line arguments for configuration
-	dirPtr := flag.String("dir", "./data", "Directory to serve files from")
-	portPtr := flag.Int("port", 8080, "Port to listen on")
-	maxBytesPtr := flag.Int64("cacheSizeBytes", 1024*1024*1024, "Maximum memory cache size in bytes (default 1GB)")
-	checkTimePtr := flag.Duration("checkTime", 1*time.Second, "Time to check speed after")
-	minSpeedPtr := flag.Float64("minSpeedMbps", 5.0, "Minimum speed in Mbps before aborting")
-	hedgedDelayPtr := flag.Duration("hedgedDelay", 100*time.Millisecond, "Time to wait before second read attempt")
+	// "sign" mints signed links instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(runSign(os.Args[2:]))
+	}
 
+	// Setup command line arguments for configuration
+	configPathPtr := flag.String("config", "", "Path to a YAML config file (reloaded on SIGHUP)")
+	fileserver.DefaultConfig().RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	// Environment variable overrides
-	if envDir := os.Getenv("SERVE_DIR"); envDir != "" {
-		*dirPtr = envDir
-	}
-	if envPort := os.Getenv("PORT"); envPort != "" {
-		if p, err := strconv.Atoi(envPort); err == nil {
-			*portPtr = p
-		}
-	}
-	if envCacheSize := os.Getenv("CACHE_SIZE_BYTES"); envCacheSize != "" {
-		if c, err := strconv.ParseInt(envCacheSize, 10, 64); err == nil {
-			*maxBytesPtr = c
-		}
+	cfg, err := fileserver.LoadConfig(*configPathPtr, flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Ensure the base directory exists
-	if _, err := os.Stat(*dirPtr); os.IsNotExist(err) {
-		log.Printf("Warning: Serving directory %s does not exist, creating it.", *dirPtr)
-		os.MkdirAll(*dirPtr, 0755)
+	srv, err := fileserver.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
 	}
 
-	// Initialize the memory cache
-	log.Printf("Initializing memory cache (Max Size: %d bytes)", *maxBytesPtr)
-	cache := NewMemoryCache(*maxBytesPtr)
-
-	// Initialize the file handler
-	log.Printf("Initializing file handler (Hedged threshold: %.2f Mbps after %v)", *minSpeedPtr, *checkTimePtr)
-	handler := NewFileHandler(*dirPtr, cache, *checkTimePtr, *minSpeedPtr, *hedgedDelayPtr)
+	// Reload the config file on SIGHUP without dropping the listener
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			newCfg, err := fileserver.LoadConfig(*configPathPtr, flag.CommandLine)
+			if err == nil {
+				err = srv.Reload(newCfg)
+			}
+			if err != nil {
+				log.Printf("Config reload failed, keeping current settings: %v", err)
+			}
+		}
+	}()
 
-	// Setup HTTP server
-	mux := http.NewServeMux()
-	mux.Handle("/", handler)
+	// Stop accepting connections on SIGINT/SIGTERM and let in-flight downloads drain
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.Serve(ctx); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
 
-	addr := ":" + strconv.Itoa(*portPtr)
-	log.Printf("Server listening on %s", addr)
-	
-	server := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+// runSign implements the "sign" subcommand, printing one signed link per path.
+func runSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	key := fs.String("key", os.Getenv("SIGN_KEY"), "Shared secret; must match the server's -signKey (default $SIGN_KEY)")
+	ttl := fs.Duration("ttl", time.Hour, "How long the link stays valid")
+	base := fs.String("base", "", "URL prefix for the printed links (e.g. https://files.example.com)")
+	refresh := fs.Bool("refresh", false, "Make links that also refresh the server's cached copy (?refresh=1)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sign [flags] PATH...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *key == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
 	}
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server failed: %v", err)
+	expires := time.Now().Add(*ttl)
+	for _, p := range fs.Args() {
+		urlPath := path.Clean("/" + p)
+		query := fileserver.SignPath(*key, urlPath, expires)
+		if *refresh {
+			query = fileserver.SignRefreshPath(*key, urlPath, expires)
+		}
+		fmt.Printf("%s%s?%s\n", *base, (&url.URL{Path: urlPath}).EscapedPath(), query)
 	}
+	return 0
 }
@@ -0,0 +1,232 @@
+package fileserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Cache status values reported in the access log.
+const (
+	CacheHit     = "HIT"
+	CacheMiss    = "MISS"
+	CacheHedged  = "HEDGED"
+	CacheStale   = "STALE"   // served expired while being refreshed in the background
+	CacheBypass  = "BYPASS"  // read from disk without using the cache
+	CacheRefresh = "REFRESH" // re-read on request, replacing the cached copy
+	CacheOrigin  = "ORIGIN"  // fetched from -originURL
+	CachePeer    = "PEER"    // fetched from the owning peer's cache
+	CacheShared  = "SHARED"  // fetched from the -redis cache tier
+)
+
+// requestInfo carries per-request details from the handler back to the access
+// logger and the diagnostic response headers.
+type requestInfo struct {
+	CacheStatus string
+	Timing      requestTiming
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns r with a requestInfo attached, unless the access
+// logger already attached one.
+func withRequestInfo(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{}))
+}
+
+// setCacheStatus records how the request was served, if an access logger is installed.
+func setCacheStatus(r *http.Request, status string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.CacheStatus = status
+	}
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's io.ReaderFrom reachable, so files
+// streamed through ServeContent can still go out with sendfile.
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := io.Copy(sr.ResponseWriter, src)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// writerOnly hides every method but Write, so io.Copy into it doesn't loop
+// back into the ReadFrom of the writer it wraps.
+type writerOnly struct {
+	io.Writer
+}
+
+// AccessLog wraps next and emits one structured log record per request.
+func AccessLog(next http.Handler, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientIP(r)),
+		}
+		if info.CacheStatus != "" {
+			attrs = append(attrs, slog.String("cache", info.CacheStatus))
+		}
+		if id := requestIDOf(r); id != "" {
+			attrs = append(attrs, slog.String("request_id", id))
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+	})
+}
+
+// clientIP returns the client address of r: the one resolved by
+// ClientIPResolver if it ran, otherwise the connection's remote address.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the host part of the connection's remote address.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedClientIP returns the client address for r, following Forwarded or
+// X-Forwarded-For only through proxies in trusted. Hops are walked right to
+// left and the first untrusted address wins, so clients can't spoof their IP
+// by prepending entries. A hop that isn't an IP (e.g. "unknown") ends the walk
+// at the proxy that added it.
+func forwardedClientIP(r *http.Request, trusted []netip.Prefix) string {
+	ip := remoteIP(r)
+	if len(trusted) == 0 || !isTrustedProxy(ip, trusted) {
+		return ip
+	}
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap().String()
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedHops lists the client addresses recorded by proxies, oldest first:
+// the for= parameters of RFC 7239 Forwarded headers if present, otherwise
+// X-Forwarded-For.
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				// for="[2001:db8::1]:4711", for=192.0.2.60:80 or for=unknown
+				value = strings.Trim(value, `"`)
+				if host, _, err := net.SplitHostPort(value); err == nil {
+					value = host
+				}
+				hops = append(hops, strings.Trim(value, "[]"))
+			}
+		}
+		return hops
+	}
+	for _, hop := range strings.Split(strings.Join(header.Values("X-Forwarded-For"), ","), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// isTrustedProxy reports whether ip lies within one of the trusted prefixes.
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses CIDRs or single IPs into prefixes.
+func parseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: expected an IP or CIDR", v)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,287 @@
+package fileserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AdminHandler exposes cache management endpoints under /admin/.
+// Every request must carry "Authorization: Bearer <token>".
+// Purges and flushes are passed on to virtual hosts and peers, if any.
+type AdminHandler struct {
+	baseDir string
+	cache   *MemoryCache
+	token   string
+	peers   *PeerPool
+	tier    CacheTier
+	files   *FileHandler
+	hosts   map[string]*FileHandler // virtual hosts, each with its own cache
+}
+
+func NewAdminHandler(baseDir string, cache *MemoryCache, token string, peers *PeerPool, tier CacheTier, files *FileHandler, hosts map[string]*FileHandler) *AdminHandler {
+	return &AdminHandler{
+		baseDir: baseDir,
+		cache:   cache,
+		token:   token,
+		peers:   peers,
+		tier:    tier,
+		files:   files,
+		hosts:   hosts,
+	}
+}
+
+type adminCacheEntry struct {
+	Path       string     `json:"path"`
+	Variant    string     `json:"variant,omitempty"`
+	Negative   bool       `json:"negative,omitempty"`
+	Protected  bool       `json:"protected,omitempty"`
+	Pinned     bool       `json:"pinned,omitempty"`
+	Size       int64      `json:"size"`
+	RawSize    int64      `json:"rawSize,omitempty"`
+	AgeSeconds float64    `json:"ageSeconds"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/admin/stats":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.cache.GetStats())
+
+	case r.URL.Path == "/admin/vars":
+		// Runtime and cache counters in expvar format, for metrics scrapers
+		expvar.Handler().ServeHTTP(w, r)
+
+	case r.URL.Path == "/admin/cache":
+		switch r.Method {
+		case http.MethodGet:
+			a.listCache(w)
+		case http.MethodDelete:
+			a.cache.Clear()
+			if a.peers != nil {
+				a.peers.Invalidate("/", true)
+			}
+			if a.tier != nil {
+				if err := a.tier.DeletePrefix(""); err != nil {
+					log.Printf("Admin: flushing the cache tier failed: %v", err)
+				}
+			}
+			for host, h := range a.hosts {
+				h.cache.Clear()
+				if h.tier != nil {
+					if err := h.tier.DeletePrefix(""); err != nil {
+						log.Printf("Admin: flushing the cache tier of %s failed: %v", host, err)
+					}
+				}
+			}
+			log.Printf("Admin: flushed entire cache")
+			writeJSON(w, http.StatusOK, map[string]bool{"flushed": true})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/admin/cache/"):
+		if r.Method != "PURGE" && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.purge(w, strings.TrimPrefix(r.URL.Path, "/admin/cache"))
+
+	case r.URL.Path == "/admin/pins":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.files.Pins())
+
+	case strings.HasPrefix(r.URL.Path, "/admin/pins/"):
+		urlPath := filepath.Clean("/" + strings.TrimPrefix(r.URL.Path, "/admin/pins/"))
+		switch r.Method {
+		case http.MethodPut:
+			a.files.Pin(urlPath)
+			log.Printf("Admin: pinned %s", urlPath)
+			writeJSON(w, http.StatusOK, map[string]bool{"pinned": true})
+		case http.MethodDelete:
+			if !a.files.Unpin(urlPath) {
+				writeJSON(w, http.StatusNotFound, map[string]bool{"unpinned": false})
+				return
+			}
+			log.Printf("Admin: unpinned %s", urlPath)
+			writeJSON(w, http.StatusOK, map[string]bool{"unpinned": true})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case r.URL.Path == "/admin/trash":
+		switch r.Method {
+		case http.MethodGet:
+			entries, err := a.files.Trash()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, entries)
+		case http.MethodDelete:
+			purged, err := a.files.purgeTrash(0)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Admin: emptied the trash (%d files)", purged)
+			writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/admin/trash/"):
+		a.trashEntry(w, r, strings.TrimPrefix(r.URL.Path, "/admin/trash/"))
+
+	case strings.HasPrefix(r.URL.Path, "/admin/debug/pprof/"):
+		// Profiling endpoints, e.g. go tool pprof on /admin/debug/pprof/heap
+		http.StripPrefix("/admin", pprofMux).ServeHTTP(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// pprofMux serves net/http/pprof at its usual paths. The package also
+// registers itself on http.DefaultServeMux, which is never served.
+var pprofMux = func() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}()
+
+func (a *AdminHandler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *AdminHandler) listCache(w http.ResponseWriter) {
+	now := time.Now()
+	entries := a.cache.Entries()
+	out := make([]adminCacheEntry, 0, len(entries))
+	for _, e := range entries {
+		key, variant, _ := strings.Cut(e.Key, variantSep)
+		entry := adminCacheEntry{
+			Path:       a.urlPath(key),
+			Variant:    variant,
+			Negative:   e.Negative,
+			Protected:  e.Protected,
+			Pinned:     e.Pinned,
+			Size:       e.Size,
+			RawSize:    e.RawSize,
+			AgeSeconds: now.Sub(e.Stored).Seconds(),
+		}
+		if !e.Expires.IsZero() {
+			expires := e.Expires
+			entry.Expires = &expires
+		}
+		out = append(out, entry)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *AdminHandler) purge(w http.ResponseWriter, urlPath string) {
+	cleanPath := filepath.Clean("/" + urlPath)
+	if a.peers != nil {
+		// Peers may hold the file even if this instance doesn't
+		a.peers.Invalidate(cleanPath, false)
+	}
+	if a.tier != nil {
+		if err := a.tier.Delete(strings.TrimPrefix(cleanPath, "/")); err != nil {
+			log.Printf("Admin: purging %s from the cache tier failed: %v", cleanPath, err)
+		}
+	}
+	purged := a.cache.Delete(filepath.Join(a.baseDir, cleanPath))
+	for host, h := range a.hosts {
+		if h.tier != nil {
+			if err := h.tier.Delete(strings.TrimPrefix(cleanPath, "/")); err != nil {
+				log.Printf("Admin: purging %s from the cache tier of %s failed: %v", cleanPath, host, err)
+			}
+		}
+		if h.cache.Delete(filepath.Join(h.baseDir, cleanPath)) {
+			purged = true
+		}
+	}
+	if !purged {
+		writeJSON(w, http.StatusNotFound, map[string]bool{"purged": false})
+		return
+	}
+	log.Printf("Admin: purged %s", cleanPath)
+	writeJSON(w, http.StatusOK, map[string]bool{"purged": true})
+}
+
+// trashEntry restores (POST) or purges (DELETE) the trash entry id.
+func (a *AdminHandler) trashEntry(w http.ResponseWriter, r *http.Request, id string) {
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		var urlPath string
+		if urlPath, err = a.files.RestoreTrash(id); err == nil {
+			log.Printf("Admin: restored %s from the trash", urlPath)
+			writeJSON(w, http.StatusOK, map[string]string{"restored": urlPath})
+			return
+		}
+	case http.MethodDelete:
+		if err = a.files.PurgeTrash(id); err == nil {
+			log.Printf("Admin: purged %s from the trash", id)
+			writeJSON(w, http.StatusOK, map[string]bool{"purged": true})
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case errors.Is(err, errNotInTrash):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errRestoreExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Admin: trash entry %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// urlPath maps a cache key (a filesystem path) back to the request path it serves.
+func (a *AdminHandler) urlPath(key string) string {
+	rel, err := filepath.Rel(a.baseDir, key)
+	if err != nil {
+		return key
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
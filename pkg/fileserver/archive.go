@@ -0,0 +1,252 @@
+package fileserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveEntry is a file or directory to be added to an archive.
+type archiveEntry struct {
+	name    string // relative to the archived directory, slash-separated
+	urlPath string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// archiveFormats maps ?archive= values to the file extension they are served with.
+var archiveFormats = map[string]string{
+	"zip":    ".zip",
+	"tar":    ".tar",
+	"tar.gz": ".tar.gz",
+	"tgz":    ".tar.gz",
+}
+
+// serveArchive answers /dir?archive=zip|tar|tar.gz with the directory's
+// contents packed on the fly. Only what the client could download one by one
+// is included: hidden, denied and auth-only paths (without credentials) are
+// left out. ?include= and ?exclude= take comma-separated globs, matched like
+// path rules against paths relative to the directory.
+func (h *FileHandler) serveArchive(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, dirPath string) {
+	query := r.URL.Query()
+	format := query.Get("archive")
+	ext, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, "Unsupported archive format (want zip, tar or tar.gz)", http.StatusBadRequest)
+		return
+	}
+
+	// Walk first, so limits are enforced before anything is sent
+	walker := &archiveWalker{
+		h:          h,
+		r:          r,
+		cfg:        cfg,
+		include:    splitQueryList(query["include"]),
+		exclude:    splitQueryList(query["exclude"]),
+		maxFiles:   cfg.ArchiveMaxFiles,
+		maxBytes:   cfg.ArchiveMaxBytes,
+		authorized: authorizePaths(r),
+	}
+	if err := walker.walk(urlPath, dirPath, ""); err != nil {
+		switch {
+		case errors.Is(err, errArchiveTooLarge):
+			http.Error(w, fmt.Sprintf("Directory exceeds the archive limits (%d files, %d bytes)", cfg.ArchiveMaxFiles, cfg.ArchiveMaxBytes), http.StatusRequestEntityTooLarge)
+		case os.IsNotExist(err):
+			http.NotFound(w, r)
+		default:
+			serveReadError(w, r, urlPath, err)
+		}
+		return
+	}
+
+	name := path.Base(urlPath)
+	if urlPath == "/" {
+		name = "files"
+	}
+	contentTypes := map[string]string{".zip": "application/zip", ".tar": "application/x-tar", ".tar.gz": "application/gzip"}
+	w.Header().Set("Content-Type", contentTypes[ext])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+ext))
+	setCacheStatus(r, CacheBypass)
+
+	var err error
+	if format == "zip" {
+		err = h.writeZip(w, cfg, walker.entries)
+	} else {
+		err = h.writeTar(w, walker.entries, format != "tar")
+	}
+	if err != nil {
+		// The status line is long gone; cut the response short so the client
+		// sees a broken archive rather than a silently incomplete one
+		logf(r, "Error archiving %s: %v", urlPath, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+var errArchiveTooLarge = errors.New("archive too large")
+
+// splitQueryList flattens repeated and comma-separated query values.
+func splitQueryList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+// archiveWalker collects the entries of an archive.
+type archiveWalker struct {
+	h                *FileHandler
+	r                *http.Request
+	cfg              *Config
+	include, exclude []string
+	maxFiles         int
+	maxBytes         int64
+	authorized       func(urlPath string) error
+
+	entries []archiveEntry
+	files   int
+	bytes   int64
+}
+
+func (aw *archiveWalker) walk(urlPath, dirPath, rel string) error {
+	des, err := aw.h.storage.List(aw.h.storageName(dirPath))
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		childURL := path.Join(urlPath, de.Name())
+		childRel := path.Join(rel, de.Name())
+		childPath := filepath.Join(dirPath, de.Name())
+		if isInternalPath(childURL) || isHiddenPath(aw.cfg, childURL) || !aw.allowed(childURL) {
+			continue
+		}
+		if matchesAny(aw.exclude, "/"+childRel) || !aw.h.symlinkAllowed(aw.cfg, childPath) {
+			continue
+		}
+		info, err := aw.h.storage.Stat(aw.h.storageName(childPath))
+		if err != nil {
+			continue // Removed since List, or a dangling symlink
+		}
+		if info.IsDir() {
+			if de.Type()&fs.ModeSymlink != 0 {
+				continue // Could loop back into the tree
+			}
+			aw.entries = append(aw.entries, archiveEntry{name: childRel + "/", urlPath: childURL, modTime: info.ModTime(), dir: true})
+			if err := aw.walk(childURL, childPath, childRel); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() || (len(aw.include) > 0 && !matchesAny(aw.include, "/"+childRel)) {
+			continue
+		}
+		aw.files++
+		aw.bytes += info.Size()
+		if (aw.maxFiles > 0 && aw.files > aw.maxFiles) || (aw.maxBytes > 0 && aw.bytes > aw.maxBytes) {
+			return errArchiveTooLarge
+		}
+		aw.entries = append(aw.entries, archiveEntry{name: childRel, urlPath: childURL, size: info.Size(), modTime: info.ModTime()})
+	}
+	return nil
+}
+
+// allowed applies the ACL and the auth rules to a path inside the archived
+// directory. Entries the client couldn't download on their own are left out.
+func (aw *archiveWalker) allowed(urlPath string) bool {
+	return aclError(aw.r, aw.cfg, urlPath) == nil && aw.authorized(urlPath) == nil
+}
+
+func matchesAny(patterns []string, urlPath string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeZip streams entries as a zip file. Compressible types are deflated,
+// everything else is stored as is.
+func (h *FileHandler) writeZip(w io.Writer, cfg *Config, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Modified: e.modTime, Method: zip.Store}
+		if e.dir {
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+		if isCompressibleType(mimeTypeFor(cfg, e.name), cfg.CompressTypes) {
+			header.Method = zip.Deflate
+		}
+		dst, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := h.copyArchiveEntry(dst, e); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTar streams entries as a tar file, gzip-compressed if requested.
+func (h *FileHandler) writeTar(w io.Writer, entries []archiveEntry, compress bool) error {
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, ModTime: e.modTime, Mode: 0644, Size: e.size, Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+		if e.dir {
+			header.Mode, header.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !e.dir {
+			if err := h.copyArchiveEntry(tw, e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// copyArchiveEntry copies exactly e.size bytes of the file, as recorded when
+// walking; a file that shrank since then fails the archive.
+func (h *FileHandler) copyArchiveEntry(dst io.Writer, e archiveEntry) error {
+	file, err := h.storage.Open(h.storageName(filepath.Join(h.baseDir, filepath.FromSlash(e.urlPath))))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.CopyN(dst, file, e.size); err != nil {
+		return fmt.Errorf("%s: %w", e.urlPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package fileserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Archives hold only the files the client could download one by one.
+func TestArchiveRules(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.Archives = true
+		cfg.ACL = []ACLRule{{Pattern: "*.key", Action: ACLDeny}}
+		cfg.AuthRules = []AuthRule{{Prefix: "/private/", Tokens: []string{"s3cret"}}}
+	})
+	for _, name := range []string{"a.txt", "server.key", "private/s.txt"} {
+		writeTestFile(t, h.baseDir, name, "x")
+	}
+	a, err := NewAuthenticator(h.cfg.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := a.Wrap(h)
+
+	for token, want := range map[string]string{
+		"":       "a.txt",
+		"wrong":  "a.txt",
+		"s3cret": "a.txt,private/,private/s.txt",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?archive=zip", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /?archive=zip with token %q = %d", token, w.Code)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, ","); got != want {
+			t.Errorf("archive with token %q holds %s, want %s", token, got, want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package fileserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// compiledAuthRule is an AuthRule with its htpasswd file and JWT keys loaded.
+type compiledAuthRule struct {
+	AuthRule
+	users map[string]string // user -> password hash
+	jwt   *jwtVerifier
+}
+
+// Authenticator enforces AuthRules in front of the whole server. The rule
+// with the longest matching prefix decides; paths matching no rule are open.
+type Authenticator struct {
+	rules atomic.Pointer[[]compiledAuthRule]
+	fold  atomic.Bool // match paths ignoring case (-caseInsensitivePaths)
+	dav   atomic.Bool // /dav/ serves the tree over WebDAV (-webdav)
+}
+
+// NewAuthenticator loads the auth rules of cfg, failing if an htpasswd file or
+// JWT key can't be read.
+func NewAuthenticator(cfg *Config) (*Authenticator, error) {
+	a := &Authenticator{}
+	if err := a.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload swaps in new rules, re-reading their htpasswd files and JWT keys.
+// On error the current rules stay in effect.
+func (a *Authenticator) Reload(cfg *Config) error {
+	verifier, err := newJWTVerifier(cfg)
+	if err != nil {
+		return err
+	}
+	compiled := make([]compiledAuthRule, 0, len(cfg.AuthRules))
+	for _, rule := range cfg.AuthRules {
+		c := compiledAuthRule{AuthRule: rule}
+		c.Prefix = foldPath(cfg, rule.Prefix)
+		if rule.JWT {
+			c.jwt = verifier
+		}
+		if rule.Htpasswd != "" {
+			users, err := loadHtpasswd(rule.Htpasswd)
+			if err != nil {
+				return err
+			}
+			c.users = users
+		}
+		compiled = append(compiled, c)
+	}
+	// Longest prefix first, so the first match is the most specific rule
+	sort.SliceStable(compiled, func(i, j int) bool {
+		return len(compiled[i].Prefix) > len(compiled[j].Prefix)
+	})
+	a.rules.Store(&compiled)
+	a.fold.Store(cfg.CaseInsensitivePaths)
+	a.dav.Store(cfg.WebDAV)
+	return nil
+}
+
+// Wrap returns next guarded by the authentication rules. The admin API keeps
+// its own token check and is not affected. WebDAV requests are checked
+// against the path they serve, without the /dav prefix.
+func (a *Authenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := path.Clean("/" + r.URL.Path)
+		if urlPath == "/admin" || strings.HasPrefix(urlPath, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.dav.Load() && (urlPath == "/dav" || strings.HasPrefix(urlPath, "/dav/")) {
+			urlPath = path.Clean("/" + strings.TrimPrefix(urlPath, "/dav"))
+		}
+
+		rule, folded := a.ruleFor(urlPath)
+		ctx := context.WithValue(r.Context(), authGrantKey{}, &authGrant{a: a, rule: rule})
+		if rule != nil {
+			user, signedIn, ok := rule.admits(r, folded)
+			if !ok {
+				rule.challenge(w)
+				return
+			}
+			if signedIn {
+				ctx = context.WithValue(ctx, authenticatedKey{}, user)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ruleFor returns the rule deciding urlPath, or nil if no rule covers it,
+// and urlPath as the rules match it.
+func (a *Authenticator) ruleFor(urlPath string) (*compiledAuthRule, string) {
+	if a.fold.Load() {
+		urlPath = strings.ToLower(urlPath)
+	}
+	rules := *a.rules.Load()
+	for i := range rules {
+		if rules[i].matches(urlPath) {
+			return &rules[i], urlPath
+		}
+	}
+	return nil, urlPath
+}
+
+// authGrantKey is the context key under which requests carry the
+// *authGrant that let them through.
+type authGrantKey struct{}
+
+// authGrant records the Authenticator that let a request through and the
+// rule that decided, if any.
+type authGrant struct {
+	a    *Authenticator
+	rule *compiledAuthRule
+}
+
+// authorizePaths returns a check of further paths a request reaches besides
+// the one in its URL (WebDAV destinations, tus uploads, archive entries)
+// against the auth rules, with the credentials r carries. A JWT must also
+// name the path in its paths claim, as it would in the URL. Outcomes are
+// kept per rule, so a password is hashed once however many paths share it.
+func authorizePaths(r *http.Request) func(urlPath string) error {
+	grant, _ := r.Context().Value(authGrantKey{}).(*authGrant)
+	admitted := make(map[*compiledAuthRule]bool)
+	return func(urlPath string) error {
+		if grant == nil {
+			return nil
+		}
+		rule, folded := grant.a.ruleFor(path.Clean("/" + urlPath))
+		if grant.rule != nil && !grant.rule.scopes(r, folded) {
+			return errAuthRequired
+		}
+		if rule == nil {
+			return nil
+		}
+		ok, seen := admitted[rule]
+		if !seen {
+			_, _, ok = rule.admits(r, folded)
+			if rule.jwt == nil {
+				admitted[rule] = ok
+			}
+		}
+		if !ok {
+			return errAuthRequired
+		}
+		return nil
+	}
+}
+
+// errAuthRequired reports a path whose auth rule refused the credentials of
+// the request reaching it.
+var errAuthRequired = errors.New("authentication required")
+
+type authenticatedKey struct{}
+
+// isAuthenticated reports whether r passed the credential check of an auth rule.
+func isAuthenticated(r *http.Request) bool {
+	_, ok := r.Context().Value(authenticatedKey{}).(string)
+	return ok
+}
+
+// authenticatedUser returns the name r was authenticated as: the Basic auth
+// user or the JWT subject. It is empty for anonymous requests and static tokens.
+func authenticatedUser(r *http.Request) string {
+	user, _ := r.Context().Value(authenticatedKey{}).(string)
+	return user
+}
+
+// hasCredentials reports whether the rule has any way to authenticate a request.
+func (rule *compiledAuthRule) hasCredentials() bool {
+	return rule.users != nil || len(rule.Tokens) > 0 || rule.jwt != nil
+}
+
+// admits checks r against the rule for urlPath and reports whether it signed
+// in, and as whom. Public rules admit anyone, but still check credentials the
+// client chose to send, so ACL "auth" entries below them can recognize
+// signed-in users.
+func (rule *compiledAuthRule) admits(r *http.Request, urlPath string) (user string, signedIn, ok bool) {
+	if rule.Public && (!rule.hasCredentials() || r.Header.Get("Authorization") == "") {
+		return "", false, true
+	}
+	user, ok = rule.allows(r, urlPath)
+	return user, ok, ok
+}
+
+// scopes reports whether the JWT r carries, if the rule accepted one, names
+// urlPath. Other credentials aren't limited to paths.
+func (rule *compiledAuthRule) scopes(r *http.Request, urlPath string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || rule.jwt == nil || rule.isStaticToken(token) {
+		return true
+	}
+	_, ok = rule.jwt.allows(token, urlPath)
+	return ok
+}
+
+// challenge answers a request the rule refused.
+func (rule *compiledAuthRule) challenge(w http.ResponseWriter) {
+	if rule.users != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="fileserver", charset="UTF-8"`)
+	}
+	if len(rule.Tokens) > 0 || rule.jwt != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="fileserver"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// allows reports whether r carries a bearer token, JWT or Basic credentials
+// accepted by the rule for urlPath, and the user they name, if any.
+func (rule *compiledAuthRule) allows(r *http.Request, urlPath string) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if rule.isStaticToken(token) {
+			return "", true
+		}
+		if rule.jwt == nil {
+			return "", false
+		}
+		return rule.jwt.allows(token, urlPath)
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		if hash, found := rule.users[user]; found {
+			return user, checkPasswordHash(hash, password)
+		}
+	}
+	return "", false
+}
+
+// isStaticToken reports whether token is one of the rule's bearer tokens.
+func (rule *compiledAuthRule) isStaticToken(token string) bool {
+	for _, want := range rule.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadHtpasswd reads an Apache htpasswd file. Only bcrypt, APR1-MD5 and {SHA}
+// hashes are supported; entries using anything else are rejected.
+func loadHtpasswd(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("htpasswd: %w", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd %s:%d: expected user:hash", name, lineNo)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("htpasswd %s:%d: unsupported hash for user %q (use bcrypt, apr1 or SHA)", name, lineNo, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("htpasswd %s: %w", name, err)
+	}
+	return users, nil
+}
+
+// checkPasswordHash verifies password against an htpasswd hash.
+func checkPasswordHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+	}
+	return false
+}
+
+// apr1 computes Apache's MD5-based crypt ("$apr1$salt$hash") of password.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := []byte(password + magic + salt)
+	for i := len(pw); i > 0; i -= 16 {
+		ctx = append(ctx, alt[:min(i, 16)]...)
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx = append(ctx, 0)
+		} else {
+			ctx = append(ctx, pw[0])
+		}
+	}
+	final := md5.Sum(ctx)
+
+	// 1000 rounds to slow down brute force, as specified by the algorithm
+	for i := 0; i < 1000; i++ {
+		var round []byte
+		if i&1 != 0 {
+			round = append(round, pw...)
+		} else {
+			round = append(round, final[:]...)
+		}
+		if i%3 != 0 {
+			round = append(round, salt...)
+		}
+		if i%7 != 0 {
+			round = append(round, pw...)
+		}
+		if i&1 != 0 {
+			round = append(round, final[:]...)
+		} else {
+			round = append(round, pw...)
+		}
+		final = md5.Sum(round)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + out.String()
+}
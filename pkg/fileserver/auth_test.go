@@ -0,0 +1,144 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newTestAuth returns an Authenticator for cfg in front of a handler that
+// answers 200 with the name the request was authenticated as.
+func newTestAuth(t *testing.T, cfg *Config) http.Handler {
+	t.Helper()
+	a, err := NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(authenticatedUser(r)))
+	}))
+}
+
+func TestAuthPrefixMatching(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AuthRules = []AuthRule{
+		{Prefix: "/private/", Tokens: []string{"s3cret"}},
+		{Prefix: "/private/public/", Public: true},
+	}
+	h := newTestAuth(t, cfg)
+
+	tests := []struct {
+		path  string
+		token string
+		want  int
+	}{
+		{"/private/a.txt", "", http.StatusUnauthorized},
+		{"/private/a.txt", "wrong", http.StatusUnauthorized},
+		{"/private/a.txt", "s3cret", http.StatusOK},
+		{"/private", "", http.StatusUnauthorized}, // the directory itself
+		{"/private/sub/../a.txt", "", http.StatusUnauthorized},
+		{"/public/../private/a.txt", "", http.StatusUnauthorized},
+		{"/privateer.txt", "", http.StatusOK}, // shares the prefix, not the directory
+		{"/private/public/a.txt", "", http.StatusOK},
+		{"/other.txt", "", http.StatusOK},
+		{"/admin/stats", "", http.StatusOK}, // has its own token check
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("GET %s with token %q = %d, want %d", tt.path, tt.token, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAuthBasicUser(t *testing.T) {
+	cfg := DefaultConfig()
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users", "alice:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n") // password "test"
+	cfg.AuthRules = []AuthRule{{Prefix: "/", Htpasswd: filepath.Join(dir, "users")}}
+	h := newTestAuth(t, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+	req.SetBasicAuth("alice", "test")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Errorf("GET as alice = %d %q, want 200 \"alice\"", w.Code, w.Body.String())
+	}
+
+	req.SetBasicAuth("alice", "nope")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("GET with a wrong password = %d, want 401 with a challenge", w.Code)
+	}
+}
+
+// WebDAV serves the same files under /dav/, so the rules for a path cover
+// both routes to it.
+func TestAuthWebDAV(t *testing.T) {
+	fh := newTestHandler(t, func(cfg *Config) {
+		cfg.WebDAV = true
+		cfg.AuthRules = []AuthRule{{Prefix: "/private/", Tokens: []string{"s3cret"}}}
+	})
+	writeTestFile(t, fh.baseDir, "private/s.txt", "secret")
+	a, err := NewAuthenticator(fh.cfg.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", fh)
+	mux.Handle("/dav/", fh.WebDAVHandler())
+	h := a.Wrap(mux)
+
+	for _, target := range []string{"/private/s.txt", "/dav/private/s.txt"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s = %d, want 401", target, w.Code)
+		}
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != "secret" {
+			t.Errorf("authenticated GET %s = %d %q, want 200 \"secret\"", target, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Every spelling of a protected path must meet its auth rule, however the
+// handler behind it decodes or folds the path.
+func TestAuthNormalizedPaths(t *testing.T) {
+	fh := newTestHandler(t, func(cfg *Config) {
+		cfg.PathDecoding = PathDecodeRepeat
+		cfg.CaseInsensitivePaths = true
+		cfg.AuthRules = []AuthRule{{Prefix: "/private/", Tokens: []string{"s3cret"}}}
+	})
+	writeTestFile(t, fh.baseDir, "private/a.txt", "secret")
+	a, err := NewAuthenticator(fh.cfg.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := fh.normalizePaths(a.Wrap(fh))
+
+	for _, target := range []string{"/private/a.txt", "/private%2Fa.txt", "/private%252Fa.txt", "/PRIVATE/a.txt", "/Private%252Fa.txt"} {
+		if w := serveTest(h, http.MethodGet, target, "", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s = %d, want 401", target, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/private%252Fa.txt", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "secret" {
+		t.Errorf("authenticated GET = %d %q, want 200 \"secret\"", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,153 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// rangeCoalesceSize is the block size for Range requests when -cacheBlockSize
+// is off: blocks aren't cached, but concurrent reads of one are still shared.
+const rangeCoalesceSize = 1024 * 1024
+
+// serveBlocks serves a Range request for a file too large to cache whole. The
+// file is read in fixed-size blocks (see blockReader), and concurrent requests
+// for the same block share one read, so players seeking to the same spot of a
+// video don't each hit the disk. With -cacheBlockSize the blocks are cached
+// too, so the hot portions of huge files, such as the start of a video or a
+// zip's central directory, are served from memory on later requests.
+func (h *FileHandler) serveBlocks(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) {
+	info, err := h.storage.Stat(h.storageName(filePath))
+	if err != nil {
+		serveReadError(w, r, urlPath, err)
+		return
+	}
+	if ctype := mimeTypeFor(cfg, filePath); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	br := &blockReader{
+		h:         h,
+		r:         r,
+		cfg:       cfg,
+		urlPath:   urlPath,
+		filePath:  filePath,
+		name:      h.storageName(filePath),
+		size:      info.Size(),
+		modTime:   info.ModTime(),
+		blockSize: cfg.CacheBlockSize,
+		cache:     cfg.CacheBlockSize > 0,
+	}
+	if !br.cache {
+		br.blockSize = rangeCoalesceSize
+	}
+	setCacheControl(w, cfg, urlPath)
+	if br.cache {
+		setCacheStatus(r, CacheHit)
+	} else {
+		setCacheStatus(r, CacheBypass)
+	}
+	http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), br)
+}
+
+// blockReader is an io.ReadSeeker over a file that fetches it block by block,
+// coalescing concurrent reads of a block. Blocks are keyed as variants of the
+// file by block size, modification time and index, so a changed file never
+// mixes with blocks of its previous version.
+type blockReader struct {
+	h         *FileHandler
+	r         *http.Request
+	cfg       *Config
+	urlPath   string
+	filePath  string
+	name      string // in the handler's storage
+	size      int64
+	modTime   time.Time
+	blockSize int64
+	cache     bool // keep blocks in the cache, not just share in-flight reads
+	off       int64
+
+	// The block last read, reused until the position moves past it
+	cur      []byte
+	curIndex int64
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	if br.off >= br.size {
+		return 0, io.EOF
+	}
+	index := br.off / br.blockSize
+	if br.cur == nil || br.curIndex != index {
+		block, err := br.block(index)
+		if err != nil {
+			return 0, err
+		}
+		br.cur, br.curIndex = block, index
+	}
+	block := br.cur
+	start := br.off - index*br.blockSize
+	if start >= int64(len(block)) {
+		// The file shrank since it was opened
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, block[start:])
+	br.off += int64(n)
+	return n, nil
+}
+
+func (br *blockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += br.off
+	case io.SeekEnd:
+		offset += br.size
+	default:
+		return 0, errors.New("blockReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("blockReader.Seek: negative position")
+	}
+	br.off = offset
+	return offset, nil
+}
+
+// block returns block index from the cache or reads (and caches) it.
+func (br *blockReader) block(index int64) ([]byte, error) {
+	key := VariantKey(br.filePath, fmt.Sprintf("block:%d:%d:%d", br.blockSize, br.modTime.UnixNano(), index))
+	if br.cache {
+		if data, ok := br.h.cache.Get(key); ok {
+			return data, nil
+		}
+		setCacheStatus(br.r, CacheMiss)
+	}
+
+	val, err, _ := br.h.sfGroup.Do(key, func() (interface{}, error) {
+		// Like load, detach from the request so a finished read is always cached
+		ctx, cancel := context.WithTimeout(br.h.ctx, br.cfg.ReadDeadline)
+		defer cancel()
+
+		if err := br.h.acquireRead(ctx, br.cfg); err != nil {
+			return nil, err
+		}
+		defer br.h.reads.release()
+
+		start := index * br.blockSize
+		data, err := br.h.storage.ReadRange(br.name, start, min(br.blockSize, br.size-start))
+		if err != nil {
+			return nil, err
+		}
+		if br.cache {
+			br.h.store(br.cfg, br.urlPath, key, data)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
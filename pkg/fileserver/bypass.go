@@ -0,0 +1,66 @@
+package fileserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// cacheDirective is how a request may use the memory cache.
+type cacheDirective int
+
+const (
+	cacheUse     cacheDirective = iota
+	cacheRefresh                // re-read the file and replace the cached copy
+	cacheBypass                 // read the file without consulting or filling the cache
+)
+
+type cacheDirectiveKey struct{}
+
+// withCacheDirective decides how r uses the cache: -noCache paths always
+// bypass it, as does Cache-Control: no-store with -honorNoCache, while
+// Cache-Control: no-cache (or Pragma: no-cache) with -honorNoCache and a
+// signed ?refresh=1 link refresh the cached copy.
+func withCacheDirective(r *http.Request, cfg *Config, urlPath string, signedRefresh bool) *http.Request {
+	directive := cacheUse
+	for _, pattern := range cfg.NoCache {
+		if matchRule(cfg, pattern, urlPath) {
+			directive = cacheBypass
+			break
+		}
+	}
+	if directive == cacheUse && cfg.HonorNoCache {
+		cc := strings.ToLower(r.Header.Get("Cache-Control"))
+		switch {
+		case hasDirective(cc, "no-store"):
+			directive = cacheBypass
+		case hasDirective(cc, "no-cache"), cc == "" && strings.EqualFold(r.Header.Get("Pragma"), "no-cache"):
+			directive = cacheRefresh
+		}
+	}
+	if directive == cacheUse && signedRefresh {
+		directive = cacheRefresh
+	}
+	if directive == cacheUse {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), cacheDirectiveKey{}, directive))
+}
+
+// cacheDirectiveOf returns the directive of r.
+func cacheDirectiveOf(r *http.Request) cacheDirective {
+	d, _ := r.Context().Value(cacheDirectiveKey{}).(cacheDirective)
+	return d
+}
+
+// hasDirective reports whether the comma-separated Cache-Control value cc
+// contains name, with or without an argument.
+func hasDirective(cc, name string) bool {
+	for _, d := range strings.Split(cc, ",") {
+		d, _, _ = strings.Cut(strings.TrimSpace(d), "=")
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
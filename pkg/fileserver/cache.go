@@ -0,0 +1,588 @@
+package fileserver
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/maphash"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheItem represents a cached file in memory.
+type CacheItem struct {
+	Key      string
+	Data     []byte
+	Stored   time.Time
+	Expires  time.Time // zero means the item never expires
+	Negative bool      // records that the file does not exist
+	RawSize  int64     // uncompressed length when Data is zstd-compressed (content length for Blob entries), zero otherwise
+	Blob     string    // key of the shared payload of a deduplicated entry, whose Data is empty
+
+	protected bool // considered frequently used by the eviction policy
+	pinned    bool // in the pinned segment, outside the size limit
+
+	// Eviction policy bookkeeping (see evictionPolicy)
+	elem  *list.Element // position in the policy's or the pinned list
+	cost  int64         // size the policy accounted for
+	freq  int64         // uses (lfu)
+	rank  int64         // eviction order, lowest first (lfu)
+	seq   uint64        // breaks rank ties (lfu)
+	index int           // position in the heap (lfu)
+}
+
+// size is the number of bytes the item is charged against the cache limit.
+// Negative entries hold no data, so their key is counted to keep them bounded.
+func (i *CacheItem) size() int64 {
+	if i.Negative || i.Blob != "" {
+		return int64(len(i.Key) + len(i.Blob))
+	}
+	return int64(len(i.Data))
+}
+
+// saved is how many bytes compression spares for the item.
+func (i *CacheItem) saved() int64 {
+	if i.RawSize == 0 || i.Blob != "" {
+		return 0
+	}
+	return i.RawSize - int64(len(i.Data))
+}
+
+// expired reports whether the item's TTL has elapsed at time now.
+func (i *CacheItem) expired(now time.Time) bool {
+	return !i.Expires.IsZero() && now.After(i.Expires)
+}
+
+// variantSep separates a base key from a variant name in variant keys.
+const variantSep = "\x00"
+
+// VariantKey returns the cache key for a derived representation (e.g. a compressed
+// encoding) of key. Variants are dropped whenever their base key is removed.
+func VariantKey(key, variant string) string {
+	return key + variantSep + variant
+}
+
+// EvictionReason tells an OnEvict hook why an entry left the cache.
+type EvictionReason string
+
+const (
+	EvictCapacity EvictionReason = "capacity" // pushed out to make room
+	EvictExpired  EvictionReason = "expired"  // TTL (and stale grace) elapsed
+	EvictRemoved  EvictionReason = "removed"  // deleted, purged, cleared or replaced
+)
+
+// CacheHooks are optional callbacks for cache events, e.g. to log evictions,
+// push metrics or spill evicted entries to a secondary store. They run
+// synchronously while the entry's shard is locked, so they must be quick and
+// must not call back into the cache. Item data is as stored (see RawSize) and
+// must not be modified. Negative entries don't trigger hooks.
+type CacheHooks struct {
+	OnSet   func(item CacheItem)
+	OnEvict func(item CacheItem, reason EvictionReason)
+}
+
+// MemoryCache is an in-memory file cache limited by total size (bytes), split
+// into independently locked shards so concurrent lookups of different files
+// don't serialize on one mutex. Each shard (see cacheShard) owns an equal share
+// of the size limit. Keys are routed by their base key,
+// so variants always live in the same shard as the entry they derive from.
+type MemoryCache struct {
+	shards  []*cacheShard
+	seed    maphash.Seed
+	offHeap *offHeapStore
+	dedup   atomic.Bool
+	fold    atomic.Bool // keys are case-insensitive
+
+	// maxBytes is the size limit set by SetMaxBytes, of which the share
+	// given to Shrink is in effect.
+	sizeMu   sync.Mutex
+	maxBytes int64
+	factor   float64
+
+	ttlMu sync.RWMutex
+	ttl   time.Duration
+
+	stopJanitor chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewMemoryCache creates a new MemoryCache with the given maximum size in bytes
+// spread over shards segments (at least one). A file larger than one shard's
+// share is not cached. ttl is the default lifetime applied by Set; zero
+// disables expiration.
+func NewMemoryCache(maxBytes int64, ttl time.Duration, shards int) *MemoryCache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &MemoryCache{
+		shards:      make([]*cacheShard, shards),
+		seed:        maphash.MakeSeed(),
+		maxBytes:    maxBytes,
+		factor:      1,
+		ttl:         ttl,
+		stopJanitor: make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = newCacheShard(maxBytes / int64(shards))
+	}
+	return c
+}
+
+// shardFor returns the shard responsible for key.
+func (c *MemoryCache) shardFor(key string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	// Variants live with their file; shared payloads spread by their digest
+	base := key
+	if !strings.HasPrefix(key, blobKeyPrefix) {
+		base, _, _ = strings.Cut(key, variantSep)
+	}
+	return c.shards[maphash.String(c.seed, base)%uint64(len(c.shards))]
+}
+
+// MaxItemBytes returns the size of the largest payload the cache can hold,
+// which is one shard's share of the size limit.
+func (c *MemoryCache) MaxItemBytes() int64 {
+	return c.shards[0].limit()
+}
+
+// Get retrieves an item from the cache, decompressing it if it was stored with
+// SetCompressed. Expired items are reported as a miss, as are negative entries.
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	key = c.normalize(key)
+	item, ok := c.shardFor(key).get(key, false)
+	if ok {
+		item, ok = c.resolve(item, true)
+	}
+	if !ok {
+		return nil, false
+	}
+	return c.unpack(item)
+}
+
+// GetStale is like Get but also returns entries that expired less than the stale
+// grace period ago (see SetStaleGrace), reporting them as stale so the caller
+// can refresh them. It also returns when the entry was stored.
+func (c *MemoryCache) GetStale(key string) (data []byte, stored time.Time, stale bool, ok bool) {
+	key = c.normalize(key)
+	item, ok := c.shardFor(key).get(key, true)
+	if ok {
+		item, ok = c.resolve(item, true)
+	}
+	if !ok {
+		return nil, time.Time{}, false, false
+	}
+	data, ok = c.unpack(item)
+	return data, item.Stored, item.expired(time.Now()), ok
+}
+
+// Peek returns the contents of key and when they were stored, without counting
+// a hit or refreshing the entry, for background checks such as the scrubber.
+func (c *MemoryCache) Peek(key string) (data []byte, stored time.Time, ok bool) {
+	key = c.normalize(key)
+	item, ok := c.shardFor(key).peek(key)
+	if ok {
+		item, ok = c.resolve(item, false)
+	}
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	data, ok = c.unpack(item)
+	return data, item.Stored, ok
+}
+
+// Expiry returns when key expires (zero if never), whether or not it already
+// has, without counting a hit or refreshing the entry.
+func (c *MemoryCache) Expiry(key string) (time.Time, bool) {
+	key = c.normalize(key)
+	item, ok := c.shardFor(key).peek(key)
+	return item.Expires, ok
+}
+
+// unpack returns the payload of item, decompressing it if needed. Corrupt
+// entries are dropped and reported as a miss.
+func (c *MemoryCache) unpack(item CacheItem) ([]byte, bool) {
+	if item.RawSize == 0 {
+		return item.Data, true
+	}
+	raw, err := zstdDecoder.DecodeAll(item.Data, make([]byte, 0, item.RawSize))
+	if err != nil {
+		c.Delete(item.Key)
+		if item.Blob != "" {
+			c.Delete(item.Blob)
+		}
+		return nil, false
+	}
+	return raw, true
+}
+
+// dedupMinSize is the smallest payload worth hashing for deduplication.
+const dedupMinSize = 4096
+
+// blobKeyPrefix starts the keys of shared payloads of deduplicated entries.
+// As variants of the empty key they are never served or removed with a file.
+const blobKeyPrefix = variantSep + "sha256:"
+
+// SetDedup turns content-addressable deduplication on or off. When on, files
+// are cached as references to a payload keyed by its SHA-256, so identical
+// files at different paths occupy memory once. A payload stays cached while
+// any path using it is requested and is evicted like any entry otherwise.
+func (c *MemoryCache) SetDedup(enabled bool) {
+	c.dedup.Store(enabled)
+}
+
+// SetCaseInsensitive makes keys that differ only in case refer to the same
+// entry, for files on case-insensitive volumes. Changing it clears the cache,
+// as existing entries may be keyed the other way.
+func (c *MemoryCache) SetCaseInsensitive(enabled bool) {
+	if c.fold.Swap(enabled) != enabled {
+		c.Clear()
+	}
+}
+
+// normalize returns the form key is stored under.
+func (c *MemoryCache) normalize(key string) string {
+	if c.fold.Load() {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// resolve fills in the Data and RawSize of a deduplicated entry from its
+// shared payload, marking the payload as used if touch is set. It reports
+// false if the payload has been evicted.
+func (c *MemoryCache) resolve(item CacheItem, touch bool) (CacheItem, bool) {
+	if item.Blob == "" {
+		return item, true
+	}
+	shard := c.shardFor(item.Blob)
+	var blob CacheItem
+	var ok bool
+	if touch {
+		blob, ok = shard.lookup(item.Blob)
+	} else {
+		blob, ok = shard.peek(item.Blob)
+	}
+	if !ok {
+		return CacheItem{}, false
+	}
+	item.Data, item.RawSize = blob.Data, blob.RawSize
+	return item, true
+}
+
+// IsNegative reports whether key was recently recorded as missing by SetNegative.
+func (c *MemoryCache) IsNegative(key string) bool {
+	key = c.normalize(key)
+	return c.shardFor(key).isNegative(key)
+}
+
+// SetNegative records that key does not exist for ttl, so repeated lookups can
+// skip the filesystem. Delete (e.g. from the file watcher) clears it early.
+// Existing positive entries are left alone.
+func (c *MemoryCache) SetNegative(key string, ttl time.Duration) {
+	key = c.normalize(key)
+	c.shardFor(key).setNegative(key, ttl)
+}
+
+// Set adds an item to the cache using the default TTL and evicts older items if necessary.
+// If the payload itself is larger than the shard's share of the cache, it's not cached.
+func (c *MemoryCache) Set(key string, data []byte) {
+	c.ttlMu.RLock()
+	ttl := c.ttl
+	c.ttlMu.RUnlock()
+
+	c.SetWithTTL(key, data, ttl)
+}
+
+// SetWithTTL is like Set but overrides the default TTL for this entry.
+// A ttl of zero stores the entry without expiration.
+func (c *MemoryCache) SetWithTTL(key string, data []byte, ttl time.Duration) {
+	c.setPacked(key, data, ttl, 0)
+}
+
+// SetCompressed is like SetWithTTL but keeps the payload zstd-compressed in
+// memory, so it is charged only its compressed size. Payloads that don't shrink
+// by at least minCompressionGain are stored as is.
+func (c *MemoryCache) SetCompressed(key string, data []byte, ttl time.Duration) {
+	compressed := zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if float64(len(compressed)) > float64(len(data))*(1-minCompressionGain) {
+		c.SetWithTTL(key, data, ttl)
+		return
+	}
+	c.setPacked(key, compressed, ttl, int64(len(data)))
+}
+
+// setPacked stores data that is already zstd-compressed from rawSize bytes
+// (or uncompressed if rawSize is zero).
+func (c *MemoryCache) setPacked(key string, data []byte, ttl time.Duration, rawSize int64) {
+	key = c.normalize(key)
+	// Variants are derived per file and rarely shared; pinned entries must not
+	// depend on a payload that can be evicted
+	if !c.dedup.Load() || len(data) < dedupMinSize || strings.Contains(key, variantSep) || c.shardFor(key).isPinned(key) {
+		c.shardFor(key).set(key, data, ttl, rawSize)
+		return
+	}
+	sum := sha256.Sum256(data)
+	blob := blobKeyPrefix + hex.EncodeToString(sum[:])
+	if shard := c.shardFor(blob); !shard.has(blob) {
+		shard.setBlob(blob, data, rawSize)
+	}
+	length := rawSize
+	if length == 0 {
+		length = int64(len(data))
+	}
+	c.shardFor(key).setRef(key, blob, length, ttl)
+}
+
+// SetMaxBytes changes the size limit, evicting entries immediately if the cache shrank.
+func (c *MemoryCache) SetMaxBytes(maxBytes int64) {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
+
+	c.maxBytes = maxBytes
+	c.resize()
+}
+
+// Shrink limits the cache to factor (0-1) of the size set with SetMaxBytes,
+// evicting entries immediately, until it is called again with 1. It lets the
+// cache give memory back under memory pressure without forgetting its size.
+func (c *MemoryCache) Shrink(factor float64) {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
+
+	c.factor = factor
+	c.resize()
+}
+
+// resize applies the size limit to the shards. Caller must hold sizeMu.
+func (c *MemoryCache) resize() {
+	maxBytes := int64(float64(c.maxBytes) * c.factor)
+	for _, shard := range c.shards {
+		shard.setMaxBytes(maxBytes / int64(len(c.shards)))
+	}
+}
+
+// SetTTL changes the default TTL used by Set. Existing entries keep their expiry.
+func (c *MemoryCache) SetTTL(ttl time.Duration) {
+	c.ttlMu.Lock()
+	defer c.ttlMu.Unlock()
+
+	c.ttl = ttl
+}
+
+// UseOffHeap stores entry data in memory mapped outside the Go heap, so a large
+// cache doesn't drive GC pacing or pause times. Reads then return a copy of the
+// entry. It must be called before the cache is first used.
+func (c *MemoryCache) UseOffHeap() error {
+	probe, err := mapMemory(1)
+	if err != nil {
+		return err
+	}
+	unmapMemory(probe)
+
+	c.offHeap = newOffHeapStore()
+	for _, shard := range c.shards {
+		shard.setStore(c.offHeap)
+	}
+	return nil
+}
+
+// SetHooks installs event callbacks, replacing any set before. A zero
+// CacheHooks removes them.
+func (c *MemoryCache) SetHooks(hooks CacheHooks) {
+	for _, shard := range c.shards {
+		shard.setHooks(hooks)
+	}
+}
+
+// SetStaleGrace sets how long expired entries are kept for GetStale. Zero drops
+// entries as soon as they expire.
+func (c *MemoryCache) SetStaleGrace(grace time.Duration) {
+	for _, shard := range c.shards {
+		shard.setStaleGrace(grace)
+	}
+}
+
+// SetTinyLFU turns the TinyLFU admission policy on or off. When on, a new entry
+// that would force evictions is only stored if it has been requested more often
+// recently than every entry it would displace, so one-off large files can't
+// flush the hot working set.
+func (c *MemoryCache) SetTinyLFU(enabled bool) {
+	for _, shard := range c.shards {
+		shard.setTinyLFU(enabled)
+	}
+}
+
+// SetProtectedRatio sets the share (0-1) of the size limit the protected segment
+// may occupy; entries beyond it are demoted back to probation.
+func (c *MemoryCache) SetProtectedRatio(ratio float64) {
+	for _, shard := range c.shards {
+		shard.setProtectedRatio(ratio)
+	}
+}
+
+// SetEvictionPolicy switches every shard to the named eviction policy (see the
+// Policy constants). Entries are kept, but what the previous policy learned
+// about how they are used is not.
+func (c *MemoryCache) SetEvictionPolicy(name string) error {
+	if _, err := newEvictionPolicy(name, 0, 0); err != nil {
+		return err
+	}
+	for _, shard := range c.shards {
+		if err := shard.setPolicy(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pin keeps key in the cache once stored, now and after it is replaced: the
+// entry is no longer charged against the size limit nor evicted to make room
+// for others. It still expires and is removed by Delete like any entry.
+func (c *MemoryCache) Pin(key string) {
+	key = c.normalize(key)
+	c.shardFor(key).pin(key)
+}
+
+// Unpin returns key to the normal eviction order, reporting whether it was pinned.
+func (c *MemoryCache) Unpin(key string) bool {
+	key = c.normalize(key)
+	return c.shardFor(key).unpin(key)
+}
+
+// Delete removes key from the cache, reporting whether it was present.
+func (c *MemoryCache) Delete(key string) bool {
+	key = c.normalize(key)
+	return c.shardFor(key).remove(key)
+}
+
+// DeletePrefix removes every key starting with prefix and returns how many were removed.
+func (c *MemoryCache) DeletePrefix(prefix string) int {
+	prefix = c.normalize(prefix)
+	removed := 0
+	for _, shard := range c.shards {
+		removed += shard.removePrefix(prefix)
+	}
+	return removed
+}
+
+// Clear removes every entry from the cache.
+func (c *MemoryCache) Clear() {
+	for _, shard := range c.shards {
+		shard.reset()
+	}
+}
+
+// Entries returns metadata for all cached entries, shard by shard. Within a
+// shard, protected entries come first and most recently used first.
+func (c *MemoryCache) Entries() []CacheEntryInfo {
+	var entries []CacheEntryInfo
+	for _, shard := range c.shards {
+		entries = append(entries, shard.entries()...)
+	}
+	return entries
+}
+
+// Items returns copies of all positive entries, including their data, shard by
+// shard and most recently used first within a shard. Data is returned as stored
+// (see RawSize) and shared with the cache, so it must not be modified.
+// Deduplicated entries carry their payload; the shared payloads themselves are
+// not listed.
+func (c *MemoryCache) Items() []CacheItem {
+	var items []CacheItem
+	for _, shard := range c.shards {
+		for _, item := range shard.items() {
+			if strings.HasPrefix(item.Key, blobKeyPrefix) {
+				continue
+			}
+			if item, ok := c.resolve(item, false); ok {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// GetStats returns the current cache counters, summed over all shards.
+func (c *MemoryCache) GetStats() CacheStats {
+	total := CacheStats{Shards: len(c.shards)}
+	for _, shard := range c.shards {
+		s := shard.stats()
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+		total.Evictions += s.Evictions
+		total.Rejections += s.Rejections
+		total.UsedBytes += s.UsedBytes
+		total.ProtectedBytes += s.ProtectedBytes
+		total.PinnedBytes += s.PinnedBytes
+		total.MaxBytes += s.MaxBytes
+		total.Entries += s.Entries
+		total.SavedBytes += s.SavedBytes
+	}
+	if c.offHeap != nil {
+		total.OffHeapBytes = c.offHeap.reservedBytes()
+	}
+	if lookups := total.Hits + total.Misses; lookups > 0 {
+		total.HitRatio = float64(total.Hits) / float64(lookups)
+	}
+	return total
+}
+
+// StartJanitor launches a goroutine that removes expired entries every interval
+// until Close is called. Without it, expired entries are only dropped lazily on Get.
+func (c *MemoryCache) StartJanitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, shard := range c.shards {
+					shard.deleteExpired()
+				}
+			case <-c.stopJanitor:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the janitor goroutine, if running.
+func (c *MemoryCache) Close() {
+	c.closeOnce.Do(func() { close(c.stopJanitor) })
+}
+
+// CacheEntryInfo describes a cached entry without exposing its data.
+type CacheEntryInfo struct {
+	Key       string
+	Size      int64
+	Stored    time.Time
+	Expires   time.Time
+	Negative  bool
+	Protected bool
+	Pinned    bool
+	RawSize   int64
+}
+
+// CacheStats is a point-in-time snapshot of cache counters.
+type CacheStats struct {
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	HitRatio       float64 `json:"hitRatio"`
+	Evictions      int64   `json:"evictions"`
+	Rejections     int64   `json:"admissionRejects"`
+	UsedBytes      int64   `json:"usedBytes"`
+	ProtectedBytes int64   `json:"protectedBytes"`
+	PinnedBytes    int64   `json:"pinnedBytes"`
+	MaxBytes       int64   `json:"maxBytes"`
+	SavedBytes     int64   `json:"compressionSavedBytes"`
+	OffHeapBytes   int64   `json:"offHeapBytes,omitempty"`
+	Entries        int     `json:"entries"`
+	Shards         int     `json:"shards"`
+}
@@ -0,0 +1,155 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// fileChecksums holds the digests of a file's contents. They are cached as a
+// variant of the file, packed into one sha256+md5 value.
+type fileChecksums struct {
+	SHA256 []byte
+	MD5    []byte
+}
+
+func checksumsOf(r io.Reader) (fileChecksums, error) {
+	sha, md := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha, md), r); err != nil {
+		return fileChecksums{}, err
+	}
+	return fileChecksums{SHA256: sha.Sum(nil), MD5: md.Sum(nil)}, nil
+}
+
+func (c fileChecksums) pack() []byte {
+	return append(append([]byte{}, c.SHA256...), c.MD5...)
+}
+
+func unpackChecksums(b []byte) (fileChecksums, bool) {
+	if len(b) != sha256.Size+md5.Size {
+		return fileChecksums{}, false
+	}
+	return fileChecksums{SHA256: b[:sha256.Size], MD5: b[sha256.Size:]}, true
+}
+
+// cachedChecksums returns the checksums stored under key, computing and
+// caching them with compute on a miss.
+func (h *FileHandler) cachedChecksums(cfg *Config, urlPath, key string, compute func() (fileChecksums, error)) (fileChecksums, error) {
+	if packed, ok := h.cache.Get(key); ok {
+		if sums, ok := unpackChecksums(packed); ok {
+			return sums, nil
+		}
+	}
+	val, err, _ := h.sfGroup.Do(key, func() (interface{}, error) {
+		sums, err := compute()
+		if err != nil {
+			return nil, err
+		}
+		h.store(cfg, urlPath, key, sums.pack())
+		return sums, nil
+	})
+	if err != nil {
+		return fileChecksums{}, err
+	}
+	return val.(fileChecksums), nil
+}
+
+// dataChecksums returns the checksums of a cached file's contents. They are
+// dropped together with the file's cache entry.
+func (h *FileHandler) dataChecksums(cfg *Config, urlPath, filePath string, data []byte) (fileChecksums, error) {
+	return h.cachedChecksums(cfg, urlPath, VariantKey(filePath, "checksum"), func() (fileChecksums, error) {
+		return checksumsOf(bytes.NewReader(data))
+	})
+}
+
+// streamChecksumKey identifies the checksums of a file too large to cache,
+// tied to its size and modification time since the file itself isn't cached.
+func streamChecksumKey(filePath string, info os.FileInfo) string {
+	return VariantKey(filePath, fmt.Sprintf("checksum:%d:%d", info.Size(), info.ModTime().UnixNano()))
+}
+
+// streamChecksums hashes a file too large to cache straight from disk.
+func (h *FileHandler) streamChecksums(cfg *Config, urlPath, filePath string, info os.FileInfo) (fileChecksums, error) {
+	return h.cachedChecksums(cfg, urlPath, streamChecksumKey(filePath, info), func() (fileChecksums, error) {
+		// Hashing a huge file can outlast -readDeadline; only shutdown aborts it
+		if err := h.acquireRead(h.ctx, cfg); err != nil {
+			return fileChecksums{}, err
+		}
+		defer h.reads.release()
+
+		file, err := h.storage.Open(h.storageName(filePath))
+		if err != nil {
+			return fileChecksums{}, err
+		}
+		defer file.Close()
+		return checksumsOf(file)
+	})
+}
+
+// setDigestHeaders advertises sums for a response carrying the whole file
+// unencoded: Digest (RFC 3230) always, Content-MD5 only when the body is the
+// complete file rather than a range.
+func setDigestHeaders(w http.ResponseWriter, r *http.Request, sums fileChecksums) {
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sums.SHA256)+",md5="+base64.StdEncoding.EncodeToString(sums.MD5))
+	if r.Header.Get("Range") == "" {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sums.MD5))
+	}
+}
+
+// checksumInfo is the ?checksum=1 response.
+type checksumInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+	MD5     string    `json:"md5"`
+}
+
+// serveChecksum answers ?checksum=1 with the file's metadata and checksums as JSON.
+func (h *FileHandler) serveChecksum(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) {
+	info, err := h.storage.Stat(h.storageName(filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			serveReadError(w, r, urlPath, err)
+		}
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Checksums are only available for files", http.StatusBadRequest)
+		return
+	}
+
+	var sums fileChecksums
+	data, err := h.load(r, cfg, urlPath, filePath)
+	switch {
+	case err == nil:
+		sums, err = h.dataChecksums(cfg, urlPath, filePath, data)
+	case errors.Is(err, errTooLargeToCache):
+		sums, err = h.streamChecksums(cfg, urlPath, filePath, info)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			serveReadError(w, r, urlPath, err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, checksumInfo{
+		Path:    urlPath,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  hex.EncodeToString(sums.SHA256),
+		MD5:     hex.EncodeToString(sums.MD5),
+	})
+}
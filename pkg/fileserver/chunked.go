@@ -0,0 +1,430 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// partialDirName holds the chunks of uploads sent as PUTs with Content-Range
+// until they are finalized. It is never served.
+const partialDirName = ".partial"
+
+// maxChunkedBytes caps chunked uploads when -maxUploadBytes is unset, so a
+// stray Content-Range offset can't grow a staging file without bound.
+const maxChunkedBytes = 64 << 30
+
+// chunkedUpload is the state persisted next to each staging file.
+type chunkedUpload struct {
+	Path   string     `json:"path"`
+	Length int64      `json:"length"` // -1 until a chunk or the finalize call states it
+	Ranges [][2]int64 `json:"ranges"` // received [start, end) byte ranges, sorted and merged
+}
+
+// chunkedStatus describes a staged upload in responses.
+type chunkedStatus struct {
+	Path     string   `json:"path"`
+	Length   *int64   `json:"length,omitempty"`
+	Received int64    `json:"received"`
+	Ranges   []string `json:"ranges"` // inclusive, as in Content-Range
+}
+
+// chunkLock guards a staged upload: chunks are written to the staging file
+// concurrently under data's read lock, while finalizing takes it exclusively
+// so no write lands after the file has been moved into place. meta guards
+// the persisted state.
+type chunkLock struct {
+	data sync.RWMutex
+	meta sync.Mutex
+}
+
+var (
+	errChunkConflict = errors.New("upload length conflicts with earlier chunks")
+	errUnknownLength = errors.New("upload length unknown; send Upload-Length")
+)
+
+// parseContentRange parses "bytes first-last/length" from a request, where
+// length may be "*". It returns the [start, end) range and the length, or -1.
+func parseContentRange(header string) (int64, int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	rng, total, ok2 := strings.Cut(spec, "/")
+	first, last, ok3 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, 0, errors.New("malformed Content-Range")
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, 0, errors.New("malformed Content-Range")
+	}
+	length := int64(-1)
+	if total != "*" {
+		var err error
+		if length, err = strconv.ParseInt(total, 10, 64); err != nil || length <= end {
+			return 0, 0, 0, errors.New("malformed Content-Range")
+		}
+	}
+	return start, end + 1, length, nil
+}
+
+// handlePutChunk stores the body of a PUT with Content-Range at its offset in
+// the staging file for urlPath. Chunks may arrive in any order, concurrently
+// and more than once; the file is only replaced once finalizeChunks is called.
+func (h *FileHandler) handlePutChunk(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string) {
+	start, end, length, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := cfg.MaxUploadBytes
+	if limit <= 0 {
+		limit = maxChunkedBytes
+	}
+	if max(end, length) > limit {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if info, err := os.Stat(filepath.Join(h.baseDir, urlPath)); err == nil && info.IsDir() {
+		h.writeError(w, r, urlPath, errIsDirectory)
+		return
+	}
+	// Turned away early rather than at finalize
+	charge, err := h.quotas.charge(cfg, urlPath, authenticatedUser(r))
+	if err == nil && !charge.allows(max(end, length)) {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+
+	id := chunkedUploadID(urlPath)
+	lock := h.chunkLock(id)
+	lock.data.RLock()
+	defer lock.data.RUnlock()
+
+	upload, err := h.updateChunked(lock, id, urlPath, true, func(upload *chunkedUpload) error {
+		return upload.setLength(length)
+	})
+	if err == nil && upload.Length >= 0 && end > upload.Length {
+		err = errChunkConflict
+	}
+	if err != nil {
+		h.chunkError(w, r, urlPath, err)
+		return
+	}
+
+	f, err := os.OpenFile(h.chunkDataPath(id), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	n, err := io.Copy(io.NewOffsetWriter(f, start), io.LimitReader(r.Body, end-start))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil && n < end-start {
+		http.Error(w, "Body shorter than Content-Range", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logf(r, "Chunk %d-%d of %s interrupted: %v", start, end-1, urlPath, err)
+		http.Error(w, "Upload interrupted", http.StatusInternalServerError)
+		return
+	}
+
+	// Only recorded once on disk, so a failed chunk is simply sent again
+	upload, err = h.updateChunked(lock, id, urlPath, true, func(upload *chunkedUpload) error {
+		upload.addRange(start, end)
+		return nil
+	})
+	if err != nil {
+		h.chunkError(w, r, urlPath, err)
+		return
+	}
+	logf(r, "Stored bytes %d-%d of %s", start, end-1, urlPath)
+	writeJSON(w, http.StatusAccepted, upload.status())
+}
+
+// finalizeChunks answers POST ?finalize: once every byte of the staged upload
+// for urlPath has arrived, it checks the length (Upload-Length, or the one the
+// chunks stated) and any Digest header (sha-256 and/or md5, base64 as in RFC
+// 3230) and moves the file into place. A checksum mismatch discards the upload.
+func (h *FileHandler) finalizeChunks(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string) {
+	want, err := parseDigest(r.Header.Get("Digest"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	length := int64(-1)
+	if header := r.Header.Get("Upload-Length"); header != "" {
+		if length, err = strconv.ParseInt(header, 10, 64); err != nil || length < 0 {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+	}
+
+	id := chunkedUploadID(urlPath)
+	lock := h.chunkLock(id)
+	lock.data.Lock()
+	defer lock.data.Unlock()
+
+	upload, err := h.updateChunked(lock, id, urlPath, false, func(upload *chunkedUpload) error {
+		return upload.setLength(length)
+	})
+	if err == nil && upload.Length < 0 {
+		err = errUnknownLength
+	}
+	if err != nil {
+		h.chunkError(w, r, urlPath, err)
+		return
+	}
+	if !upload.complete() {
+		writeJSON(w, http.StatusConflict, upload.status())
+		return
+	}
+
+	dataPath := h.chunkDataPath(id)
+	// Chunks past the length may have been written before it was known
+	if err := os.Truncate(dataPath, upload.Length); err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	f, err := os.Open(dataPath)
+	if err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	sums, err := checksumsOf(f)
+	f.Close()
+	if err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	if (want.SHA256 != nil && !bytes.Equal(want.SHA256, sums.SHA256)) || (want.MD5 != nil && !bytes.Equal(want.MD5, sums.MD5)) {
+		h.removeChunked(id)
+		logf(r, "Discarded chunked upload of %s: checksum mismatch", urlPath)
+		http.Error(w, "Digest mismatch; the upload was discarded", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// The chunks are kept if they don't fit, so the upload can be finalized
+	// once space has been freed
+	charge, err := h.quotas.charge(cfg, urlPath, authenticatedUser(r))
+	if err == nil && !charge.allows(upload.Length) {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	filePath := filepath.Join(h.baseDir, urlPath)
+	_, statErr := os.Stat(filePath)
+	if err := h.placeUpload(cfg, urlPath, authenticatedUser(r), filePath, dataPath); err != nil {
+		if errors.Is(err, errUploadRejected) {
+			h.removeChunked(id)
+		}
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	charge.commit(upload.Length)
+	h.removeChunked(id)
+	h.invalidate(filePath)
+	logf(r, "Stored %s (%d bytes in chunks)", urlPath, upload.Length)
+
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sums.SHA256))
+	if statErr == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", externalPath(cfg, urlPath))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// placeUpload moves the completed upload by user at dataPath to filePath once
+// it has passed -uploadScan, first keeping the file it replaces in the trash
+// with -trashOverwrites.
+func (h *FileHandler) placeUpload(cfg *Config, urlPath, user, filePath, dataPath string) error {
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		return errIsDirectory
+	}
+	if err := os.Chmod(dataPath, 0644); err != nil {
+		return err
+	}
+	if err := h.scanUpload(cfg, urlPath, user, dataPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	var kept string
+	if cfg.TrashOverwrites {
+		var err error
+		if kept, err = h.keepInTrash(urlPath, filePath); err != nil {
+			return err
+		}
+	}
+	err := os.Rename(dataPath, filePath)
+	if err != nil && kept != "" {
+		os.Remove(kept) // Nothing was replaced
+	}
+	return err
+}
+
+// parseDigest reads the sha-256 and md5 values of a Digest header.
+func parseDigest(header string) (fileChecksums, error) {
+	var sums fileChecksums
+	if header == "" {
+		return sums, nil
+	}
+	for _, part := range strings.Split(header, ",") {
+		alg, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		sum, err := base64.StdEncoding.DecodeString(value)
+		switch strings.ToLower(alg) {
+		case "sha-256":
+			if err != nil || len(sum) != sha256.Size {
+				return sums, errors.New("malformed sha-256 Digest")
+			}
+			sums.SHA256 = sum
+		case "md5":
+			if err != nil || len(sum) != 16 {
+				return sums, errors.New("malformed md5 Digest")
+			}
+			sums.MD5 = sum
+		}
+	}
+	if sums.SHA256 == nil && sums.MD5 == nil {
+		return sums, errors.New("Digest has neither sha-256 nor md5")
+	}
+	return sums, nil
+}
+
+// setLength records the upload's total length, if given, failing if it
+// conflicts with what was stated or received before.
+func (u *chunkedUpload) setLength(length int64) error {
+	if length < 0 {
+		return nil
+	}
+	if (u.Length >= 0 && u.Length != length) || (len(u.Ranges) > 0 && u.Ranges[len(u.Ranges)-1][1] > length) {
+		return errChunkConflict
+	}
+	u.Length = length
+	return nil
+}
+
+// addRange records that [start, end) has been received.
+func (u *chunkedUpload) addRange(start, end int64) {
+	ranges := append(u.Ranges, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, rng := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rng[0] <= last[1] {
+			last[1] = max(last[1], rng[1])
+		} else {
+			merged = append(merged, rng)
+		}
+	}
+	u.Ranges = merged
+}
+
+// complete reports whether every byte of the upload has been received.
+func (u *chunkedUpload) complete() bool {
+	return len(u.Ranges) == 1 && u.Ranges[0] == [2]int64{0, u.Length}
+}
+
+func (u *chunkedUpload) status() chunkedStatus {
+	status := chunkedStatus{Path: u.Path, Ranges: []string{}}
+	if u.Length >= 0 {
+		length := u.Length
+		status.Length = &length
+	}
+	for _, rng := range u.Ranges {
+		status.Received += rng[1] - rng[0]
+		status.Ranges = append(status.Ranges, fmt.Sprintf("%d-%d", rng[0], rng[1]-1))
+	}
+	return status
+}
+
+// updateChunked applies fn to the persisted state of the upload id to urlPath.
+// If there is none yet, it is created or, without create, an error satisfying
+// os.IsNotExist is returned.
+func (h *FileHandler) updateChunked(lock *chunkLock, id, urlPath string, create bool, fn func(*chunkedUpload) error) (*chunkedUpload, error) {
+	lock.meta.Lock()
+	defer lock.meta.Unlock()
+
+	upload := &chunkedUpload{Path: urlPath, Length: -1}
+	raw, err := os.ReadFile(h.chunkInfoPath(id))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, upload); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err) && !create:
+		return nil, err
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(filepath.Join(h.baseDir, partialDirName), 0755); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	if err := fn(upload); err != nil {
+		return upload, err
+	}
+	if raw, err = json.Marshal(upload); err != nil {
+		return nil, err
+	}
+	return upload, os.WriteFile(h.chunkInfoPath(id), raw, 0644)
+}
+
+func (h *FileHandler) removeChunked(id string) {
+	os.Remove(h.chunkDataPath(id))
+	os.Remove(h.chunkInfoPath(id))
+	h.chunkLocks.Delete(id)
+}
+
+func (h *FileHandler) chunkError(w http.ResponseWriter, r *http.Request, urlPath string, err error) {
+	switch {
+	case errors.Is(err, errChunkConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errUnknownLength):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case os.IsNotExist(err):
+		http.Error(w, "No chunked upload to finalize", http.StatusNotFound)
+	default:
+		h.writeError(w, r, urlPath, err)
+	}
+}
+
+func (h *FileHandler) chunkLock(id string) *chunkLock {
+	lock, _ := h.chunkLocks.LoadOrStore(id, &chunkLock{})
+	return lock.(*chunkLock)
+}
+
+// chunkedUploadID names the staging files of the upload to urlPath.
+func chunkedUploadID(urlPath string) string {
+	sum := sha256.Sum256([]byte(urlPath))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (h *FileHandler) chunkDataPath(id string) string {
+	return filepath.Join(h.baseDir, partialDirName, id)
+}
+
+func (h *FileHandler) chunkInfoPath(id string) string {
+	return filepath.Join(h.baseDir, partialDirName, id+".json")
+}
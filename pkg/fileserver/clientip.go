@@ -0,0 +1,42 @@
+package fileserver
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+)
+
+type clientIPKey struct{}
+
+// ClientIPResolver works out each request's client IP once, following
+// Forwarded and X-Forwarded-For only through -trustedProxies, so the access
+// log, rate limiter and traces all see the same address (see clientIP).
+type ClientIPResolver struct {
+	trusted atomic.Pointer[[]netip.Prefix]
+}
+
+func NewClientIPResolver(cfg *Config) (*ClientIPResolver, error) {
+	cr := &ClientIPResolver{}
+	if err := cr.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload applies a new -trustedProxies list.
+func (cr *ClientIPResolver) Reload(cfg *Config) error {
+	trusted, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	cr.trusted.Store(&trusted)
+	return nil
+}
+
+func (cr *ClientIPResolver) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := forwardedClientIP(r, *cr.trusted.Load())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
@@ -0,0 +1,133 @@
+package fileserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported Content-Encoding values, in default preference order.
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+)
+
+// precompressedSidecars lists the sibling file extensions checked for
+// precompressed content, in preference order.
+var precompressedSidecars = []struct {
+	encoding string
+	ext      string
+}{
+	{EncodingBrotli, ".br"},
+	{EncodingZstd, ".zst"},
+	{EncodingGzip, ".gz"},
+}
+
+// zstdEncoder and zstdDecoder are shared by all requests; EncodeAll and
+// DecodeAll are safe for concurrent use.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// minCompressionGain is the share a cached payload must shrink by before the
+// cache keeps it compressed rather than paying to decompress it on every hit.
+const minCompressionGain = 0.1
+
+// negotiateEncoding picks the first encoding from supported (in server preference
+// order) that the Accept-Encoding header allows. It returns "" for identity.
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	for _, enc := range supported {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressData encodes data with the given Content-Encoding.
+func compressData(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case EncodingZstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case EncodingBrotli:
+		var buf bytes.Buffer
+		w := brotli.NewWriterLevel(&buf, 6)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// contentTypeFor determines the Content-Type of a file from its extension
+// (see mimeTypeFor), falling back to sniffing the first bytes like
+// http.ServeContent does.
+func contentTypeFor(cfg *Config, name string, data []byte) string {
+	if ctype := mimeTypeFor(cfg, name); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(data)
+}
+
+// isCompressibleType reports whether contentType starts with one of the configured prefixes.
+func isCompressibleType(contentType string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary appends value to the Vary header unless it is already listed.
+func addVary(h http.Header, value string) {
+	for _, existing := range h.Values("Vary") {
+		for _, v := range strings.Split(existing, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
@@ -0,0 +1,1266 @@
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every server setting. YAML keys match the command line flag names,
+// so any flag can also be set in the file passed via -config.
+type Config struct {
+	Dir             string        `yaml:"dir"`
+	Port            int           `yaml:"port"`
+	Listen          []string      `yaml:"listen"`
+	ListenUnix      string        `yaml:"listenUnix"`
+	ListenUnixMode  string        `yaml:"listenUnixMode"`
+	ProxyProtocol   bool          `yaml:"proxyProtocol"`
+	URLPrefix       string        `yaml:"urlPrefix"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	GRPCPort  int    `yaml:"grpcPort"`
+	GRPCToken string `yaml:"grpcToken"`
+
+	SFTPPort           int    `yaml:"sftpPort"`
+	SFTPHostKey        string `yaml:"sftpHostKey"`
+	SFTPHtpasswd       string `yaml:"sftpHtpasswd"`
+	SFTPAuthorizedKeys string `yaml:"sftpAuthorizedKeys"`
+
+	VirtualHosts []VirtualHost `yaml:"virtualHosts"`
+	OriginURL    string        `yaml:"originURL"`
+
+	Peers       []string      `yaml:"peers"`
+	PeerDNS     string        `yaml:"peerDNS"`
+	PeerSelf    string        `yaml:"peerSelf"`
+	PeerToken   string        `yaml:"peerToken"`
+	PeerRefresh time.Duration `yaml:"peerRefresh"`
+
+	Redis             string        `yaml:"redis"`
+	RedisPrefix       string        `yaml:"redisPrefix"`
+	RedisTTL          time.Duration `yaml:"redisTTL"`
+	RedisWritePolicy  string        `yaml:"redisWritePolicy"`
+	RedisMaxItemBytes int64         `yaml:"redisMaxItemBytes"`
+	RedisTimeout      time.Duration `yaml:"redisTimeout"`
+
+	Storage        string        `yaml:"storage"`
+	S3Endpoint     string        `yaml:"s3Endpoint"`
+	S3Region       string        `yaml:"s3Region"`
+	S3AccessKey    string        `yaml:"s3AccessKey"`
+	S3SecretKey    string        `yaml:"s3SecretKey"`
+	S3SessionToken string        `yaml:"s3SessionToken"`
+	S3PathStyle    bool          `yaml:"s3PathStyle"`
+	S3HedgeAfter   time.Duration `yaml:"s3HedgeAfter"`
+
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+
+	TLSCert         string   `yaml:"tlsCert"`
+	TLSKey          string   `yaml:"tlsKey"`
+	TLSMinVersion   string   `yaml:"tlsMinVersion"`
+	TLSCipherSuites []string `yaml:"tlsCipherSuites"`
+
+	ACMEDomains  []string `yaml:"acmeDomains"`
+	ACMEEmail    string   `yaml:"acmeEmail"`
+	ACMECacheDir string   `yaml:"acmeCacheDir"`
+	ACMEHTTPPort int      `yaml:"acmeHTTPPort"`
+
+	HTTP3 bool `yaml:"http3"`
+
+	CacheSizeBytes       int64         `yaml:"cacheSizeBytes"`
+	CacheTTL             time.Duration `yaml:"cacheTTL"`
+	CacheTTLRules        []TTLRule     `yaml:"cacheTTLRules"`
+	NegativeCacheTTL     time.Duration `yaml:"negativeCacheTTL"`
+	StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate"`
+	CacheTinyLFU         bool          `yaml:"cacheTinyLFU"`
+	CacheDedup           bool          `yaml:"cacheDedup"`
+	CachePolicy          string        `yaml:"cachePolicy"`
+	MemoryHighWater      float64       `yaml:"memoryHighWater"`
+	CacheProtectedRatio  float64       `yaml:"cacheProtectedRatio"`
+	CacheShards          int           `yaml:"cacheShards"`
+	MaxCacheItemBytes    int64         `yaml:"maxCacheItemBytes"`
+	CacheCompress        bool          `yaml:"cacheCompress"`
+	CacheBlockSize       int64         `yaml:"cacheBlockSize"`
+	CacheOffHeap         bool          `yaml:"cacheOffHeap"`
+	CacheSnapshot        string        `yaml:"cacheSnapshot"`
+	SnapshotContents     bool          `yaml:"cacheSnapshotContents"`
+	SnapshotInterval     time.Duration `yaml:"cacheSnapshotInterval"`
+	WarmupManifest       string        `yaml:"warmupManifest"`
+	WarmupConcurrency    int           `yaml:"warmupConcurrency"`
+	ScrubInterval        time.Duration `yaml:"scrubInterval"`
+	ScrubHash            bool          `yaml:"scrubHash"`
+	PrefetchThreshold    int           `yaml:"prefetchThreshold"`
+	PrefetchWindow       time.Duration `yaml:"prefetchWindow"`
+	Pin                  []string      `yaml:"pin"`
+	NoCache              []string      `yaml:"noCache"`
+	HonorNoCache         bool          `yaml:"honorNoCache"`
+	JanitorInterval      time.Duration `yaml:"janitorInterval"`
+	Watch                bool          `yaml:"watch"`
+
+	CheckTime     time.Duration `yaml:"checkTime"`
+	MinSpeedMbps  float64       `yaml:"minSpeedMbps"`
+	HedgedDelay   time.Duration `yaml:"hedgedDelay"`
+	HedgeAttempts int           `yaml:"hedgeAttempts"`
+	HedgeBackoff  float64       `yaml:"hedgeBackoff"`
+	ReadDeadline  time.Duration `yaml:"readDeadline"`
+	SpeedWindow   time.Duration `yaml:"speedWindow"`
+	HedgeRules    []HedgeRule   `yaml:"hedgeRules"`
+	MirrorDirs    []string      `yaml:"mirrorDirs"`
+
+	HedgePercentile float64 `yaml:"hedgePercentile"`
+	HedgeMinSize    int64   `yaml:"hedgeMinSize"`
+
+	FadviseWillNeed bool  `yaml:"fadviseWillNeed"`
+	FadviseDontNeed bool  `yaml:"fadviseDontNeed"`
+	ReadaheadBytes  int64 `yaml:"readaheadBytes"`
+	IOUring         bool  `yaml:"ioUring"`
+	IOUringDepth    int   `yaml:"ioUringDepth"`
+
+	ParallelReads       int   `yaml:"parallelReads"`
+	ParallelReadMinSize int64 `yaml:"parallelReadMinSize"`
+
+	StreamMissMinSize int64 `yaml:"streamMissMinSize"`
+
+	MaxConcurrentReads int           `yaml:"maxConcurrentReads"`
+	ReadQueueTimeout   time.Duration `yaml:"readQueueTimeout"`
+	MaxReadMemory      int64         `yaml:"maxReadMemory"`
+	ReadMemoryWait     time.Duration `yaml:"readMemoryWait"`
+
+	Compress        []string `yaml:"compress"`
+	CompressMinSize int64    `yaml:"compressMinSize"`
+	CompressTypes   []string `yaml:"compressTypes"`
+	Precompressed   bool     `yaml:"precompressed"`
+
+	MimeTypes       map[string]string `yaml:"mimeTypes"`
+	DefaultMimeType string            `yaml:"defaultMimeType"`
+
+	CacheControl []CacheControlRule `yaml:"cacheControl"`
+	Headers      []HeaderRule       `yaml:"headers"`
+
+	DiagnosticHeaders bool `yaml:"diagnosticHeaders"`
+	Checksums         bool `yaml:"checksums"`
+	Zsync             bool `yaml:"zsync"`
+	Thumbnails        bool `yaml:"thumbnails"`
+	ThumbnailMaxSize  int  `yaml:"thumbnailMaxSize"`
+
+	ListDirs    bool   `yaml:"listDirs"`
+	IndexFile   string `yaml:"indexFile"`
+	SPAFallback string `yaml:"spaFallback"`
+
+	Archives        bool  `yaml:"archives"`
+	ArchiveMaxFiles int   `yaml:"archiveMaxFiles"`
+	ArchiveMaxBytes int64 `yaml:"archiveMaxBytes"`
+
+	ReadOnly             bool          `yaml:"readOnly"`
+	WriteToken           string        `yaml:"writeToken"`
+	MaxUploadBytes       int64         `yaml:"maxUploadBytes"`
+	Quotas               []QuotaRule   `yaml:"quotas"`
+	UploadScan           string        `yaml:"uploadScan"`
+	UploadScanTimeout    time.Duration `yaml:"uploadScanTimeout"`
+	UploadScanQuarantine bool          `yaml:"uploadScanQuarantine"`
+	SoftDelete           bool          `yaml:"softDelete"`
+	TrashOverwrites      bool          `yaml:"trashOverwrites"`
+	TrashRetention       time.Duration `yaml:"trashRetention"`
+	WebDAV               bool          `yaml:"webdav"`
+	Tus                  bool          `yaml:"tus"`
+
+	AdminToken string     `yaml:"adminToken"`
+	SignKey    string     `yaml:"signKey"`
+	AuthRules  []AuthRule `yaml:"authRules"`
+	ACL        []ACLRule  `yaml:"acl"`
+
+	RequestIDHeader string `yaml:"requestIDHeader"`
+
+	OTLPEndpoint     string  `yaml:"otlpEndpoint"`
+	OTelServiceName  string  `yaml:"otelServiceName"`
+	TraceSampleRatio float64 `yaml:"traceSampleRatio"`
+
+	Health       bool          `yaml:"health"`
+	ReadyProbe   string        `yaml:"readyProbe"`
+	ReadyTimeout time.Duration `yaml:"readyTimeout"`
+
+	SymlinkPolicy string `yaml:"symlinkPolicy"`
+
+	CaseInsensitivePaths bool   `yaml:"caseInsensitivePaths"`
+	TrailingSlash        string `yaml:"trailingSlash"`
+	PathDecoding         string `yaml:"pathDecoding"`
+
+	HideDotfiles bool     `yaml:"hideDotfiles"`
+	Hide         []string `yaml:"hide"`
+	HiddenStatus int      `yaml:"hiddenStatus"`
+
+	ErrorPages map[int]string `yaml:"errorPages"`
+
+	JWTSecret    string `yaml:"jwtSecret"`
+	JWTPublicKey string `yaml:"jwtPublicKey"`
+	JWKSURL      string `yaml:"jwksURL"`
+
+	RateLimit      float64  `yaml:"rateLimit"`
+	RateBurst      int      `yaml:"rateBurst"`
+	TrustedProxies []string `yaml:"trustedProxies"`
+	MaxMbpsPerConn float64  `yaml:"maxMbpsPerConn"`
+	MaxMbpsTotal   float64  `yaml:"maxMbpsTotal"`
+
+	CORSOrigins     []string      `yaml:"corsOrigins"`
+	CORSMethods     []string      `yaml:"corsMethods"`
+	CORSHeaders     []string      `yaml:"corsHeaders"`
+	CORSMaxAge      time.Duration `yaml:"corsMaxAge"`
+	CORSCredentials bool          `yaml:"corsCredentials"`
+
+	AccessLog           string        `yaml:"accessLog"`
+	AccessLogMaxSizeMB  int64         `yaml:"accessLogMaxSizeMB"`
+	AccessLogMaxAge     time.Duration `yaml:"accessLogMaxAge"`
+	AccessLogMaxBackups int           `yaml:"accessLogMaxBackups"`
+
+	SlowRequestLog time.Duration `yaml:"slowRequestLog"`
+}
+
+// DefaultConfig returns the settings used when neither flags nor a config file override them.
+func DefaultConfig() *Config {
+	return &Config{
+		Dir:             "./data",
+		Port:            8080,
+		ShutdownTimeout: 30 * time.Second,
+
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+
+		TLSMinVersion: "1.2",
+
+		S3Region: "us-east-1",
+
+		PeerRefresh: 30 * time.Second,
+
+		SFTPHostKey: "./sftp_host_key",
+
+		RedisPrefix:       "fileserver:",
+		RedisTTL:          1 * time.Hour,
+		RedisWritePolicy:  WriteAround,
+		RedisMaxItemBytes: 8 * 1024 * 1024,
+		RedisTimeout:      250 * time.Millisecond,
+
+		ThumbnailMaxSize: 2048,
+
+		RequestIDHeader: "X-Request-ID",
+
+		OTelServiceName:  "fileserver",
+		TraceSampleRatio: 1,
+
+		ListenUnixMode: "0660",
+
+		ReadyTimeout: 2 * time.Second,
+
+		UploadScanTimeout: time.Minute,
+
+		ArchiveMaxFiles: 10000,
+		ArchiveMaxBytes: 4 * 1024 * 1024 * 1024,
+
+		SymlinkPolicy: SymlinkWithinRoot,
+		TrailingSlash: TrailingSlashIgnore,
+		PathDecoding:  PathDecodeOnce,
+		HiddenStatus:  http.StatusNotFound,
+
+		ACMECacheDir: "./acme-cache",
+		ACMEHTTPPort: 80,
+
+		CacheSizeBytes:      1024 * 1024 * 1024,
+		CachePolicy:         PolicySLRU,
+		MemoryHighWater:     0.9,
+		CacheProtectedRatio: 0.8,
+		CacheShards:         1,
+		WarmupConcurrency:   4,
+		PrefetchWindow:      1 * time.Minute,
+		JanitorInterval:     1 * time.Minute,
+		Watch:               false,
+
+		CheckTime:     1 * time.Second,
+		MinSpeedMbps:  5.0,
+		HedgedDelay:   100 * time.Millisecond,
+		HedgeAttempts: 2,
+		HedgeBackoff:  2,
+		ReadDeadline:  30 * time.Second,
+		HedgeMinSize:  256 * 1024,
+
+		ReadQueueTimeout: 10 * time.Second,
+
+		FadviseWillNeed: true,
+		IOUringDepth:    8,
+
+		ParallelReads:       1,
+		ParallelReadMinSize: 16 * 1024 * 1024,
+
+		StreamMissMinSize: 1024 * 1024,
+
+		DiagnosticHeaders: true,
+
+		CompressMinSize: 1024,
+		CompressTypes: []string{
+			"text/", "application/javascript", "application/json", "application/xml",
+			"application/wasm", "image/svg+xml", "application/vnd.apple.mpegurl", "application/dash+xml",
+		},
+
+		ReadOnly: true,
+
+		RateBurst: 20,
+
+		CORSMethods: []string{"GET", "HEAD"},
+		CORSHeaders: []string{"Range", "If-None-Match", "If-Modified-Since", "If-Range", "Authorization"},
+		CORSMaxAge:  10 * time.Minute,
+
+		AccessLog:           "-",
+		AccessLogMaxSizeMB:  100,
+		AccessLogMaxAge:     24 * time.Hour,
+		AccessLogMaxBackups: 7,
+	}
+}
+
+// RegisterFlags binds command line flags to the fields of c, using their current values as defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Dir, "dir", c.Dir, "Directory to serve files from")
+	fs.IntVar(&c.Port, "port", c.Port, "Port to listen on")
+	fs.Var((*stringListFlag)(&c.Listen), "listen", "Comma-separated addresses to serve on instead of -port, optionally as http://addr or https://addr to mix plain and TLS (e.g. \":80,https://:443,https://[::1]:8443\")")
+	fs.StringVar(&c.URLPrefix, "urlPrefix", c.URLPrefix, "Serve everything under this path (e.g. /files) instead of the domain root")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdownTimeout", c.ShutdownTimeout, "How long to wait for in-flight requests to finish on SIGTERM/SIGINT")
+	fs.IntVar(&c.GRPCPort, "grpcPort", c.GRPCPort, "Also serve the gRPC file API (see fileserver.proto) on this port (0 = disabled)")
+	fs.StringVar(&c.GRPCToken, "grpcToken", c.GRPCToken, "Bearer token required on gRPC calls; Purge is unavailable without it (default $GRPC_TOKEN)")
+	fs.IntVar(&c.SFTPPort, "sftpPort", c.SFTPPort, "Also serve -dir over SFTP on this port (0 = disabled); writes follow -readOnly")
+	fs.StringVar(&c.SFTPHostKey, "sftpHostKey", c.SFTPHostKey, "SSH host private key for SFTP, generated on first start if missing")
+	fs.StringVar(&c.SFTPHtpasswd, "sftpHtpasswd", c.SFTPHtpasswd, "htpasswd file with the users allowed to log in over SFTP with a password")
+	fs.StringVar(&c.SFTPAuthorizedKeys, "sftpAuthorizedKeys", c.SFTPAuthorizedKeys, "authorized_keys file with the public keys allowed to log in over SFTP")
+	fs.Var((*virtualHostsFlag)(&c.VirtualHosts), "virtualHosts", "Serve other directories by Host header, as comma-separated host=dir[@cacheSizeBytes] pairs (e.g. \"media.example.com=/srv/media@536870912\"); other hosts get -dir")
+	fs.StringVar(&c.ListenUnix, "listenUnix", c.ListenUnix, "Unix domain socket to serve plain HTTP on, e.g. for a local reverse proxy (e.g. /run/greencloud.sock)")
+	fs.StringVar(&c.ListenUnixMode, "listenUnixMode", c.ListenUnixMode, "Octal permissions of the -listenUnix socket")
+	fs.BoolVar(&c.ProxyProtocol, "proxyProtocol", c.ProxyProtocol, "Require a PROXY protocol v1/v2 header on every connection (behind HAProxy or a cloud NLB) and take the client address from it")
+	fs.Var((*stringListFlag)(&c.Peers), "peers", "Comma-separated base URLs of all instances sharing one cache, this one included (e.g. http://10.0.0.1:8080,http://10.0.0.2:8080)")
+	fs.StringVar(&c.PeerDNS, "peerDNS", c.PeerDNS, "Discover peers from the addresses this name resolves to, on -port (instead of -peers)")
+	fs.StringVar(&c.PeerSelf, "peerSelf", c.PeerSelf, "This instance's URL as listed among the peers (default: detected from local addresses)")
+	fs.StringVar(&c.PeerToken, "peerToken", c.PeerToken, "Shared secret authenticating requests between peers (required with -peers or -peerDNS)")
+	fs.DurationVar(&c.PeerRefresh, "peerRefresh", c.PeerRefresh, "How often -peerDNS is re-resolved")
+	fs.StringVar(&c.Redis, "redis", c.Redis, "Share cached files with other instances through Redis: redis://[:password@]host[:port][/db] or rediss:// for TLS (default $REDIS_URL)")
+	fs.StringVar(&c.RedisPrefix, "redisPrefix", c.RedisPrefix, "Prefix of all keys this server stores in Redis")
+	fs.DurationVar(&c.RedisTTL, "redisTTL", c.RedisTTL, "How long files stay in Redis (0 = until evicted by Redis)")
+	fs.StringVar(&c.RedisWritePolicy, "redisWritePolicy", c.RedisWritePolicy, "What uploads do to Redis: write-around (drop the old entry) or write-through (store the new content)")
+	fs.Int64Var(&c.RedisMaxItemBytes, "redisMaxItemBytes", c.RedisMaxItemBytes, "Largest file stored in Redis")
+	fs.DurationVar(&c.RedisTimeout, "redisTimeout", c.RedisTimeout, "Give up on a Redis command after this long and read from storage instead")
+	fs.StringVar(&c.Storage, "storage", c.Storage, "Read files from an object store instead of -dir: s3://bucket[/prefix] or gs://bucket[/prefix] (requires -readOnly)")
+	fs.StringVar(&c.S3Endpoint, "s3Endpoint", c.S3Endpoint, "S3-compatible endpoint URL, e.g. http://minio:9000 (default: AWS for s3://, storage.googleapis.com for gs://)")
+	fs.StringVar(&c.S3Region, "s3Region", c.S3Region, "Region used to sign S3 requests")
+	fs.StringVar(&c.S3AccessKey, "s3AccessKey", c.S3AccessKey, "S3 or GCS HMAC access key (default $AWS_ACCESS_KEY_ID; empty = anonymous)")
+	fs.StringVar(&c.S3SecretKey, "s3SecretKey", c.S3SecretKey, "S3 or GCS HMAC secret (default $AWS_SECRET_ACCESS_KEY)")
+	fs.StringVar(&c.S3SessionToken, "s3SessionToken", c.S3SessionToken, "Temporary S3 session token (default $AWS_SESSION_TOKEN)")
+	fs.BoolVar(&c.S3PathStyle, "s3PathStyle", c.S3PathStyle, "Address buckets as endpoint/bucket instead of bucket.endpoint (needed by most non-AWS stores)")
+	fs.DurationVar(&c.S3HedgeAfter, "s3HedgeAfter", c.S3HedgeAfter, "Send a duplicate object-store request if the first hasn't answered within this long (0 = disabled)")
+	fs.StringVar(&c.OriginURL, "originURL", c.OriginURL, "Fetch files missing from -dir from this upstream HTTP server and keep a local copy (pull-through mirror)")
+	fs.DurationVar(&c.ReadHeaderTimeout, "readHeaderTimeout", c.ReadHeaderTimeout, "Maximum time to read request headers, against slowloris clients (0 = no limit)")
+	fs.DurationVar(&c.ReadTimeout, "readTimeout", c.ReadTimeout, "Maximum time to read a whole request including the body; bounds upload duration (0 = no limit)")
+	fs.DurationVar(&c.WriteTimeout, "writeTimeout", c.WriteTimeout, "Maximum time to write a response; bounds download duration (0 = no limit)")
+	fs.DurationVar(&c.IdleTimeout, "idleTimeout", c.IdleTimeout, "How long idle keep-alive connections stay open (0 = use readTimeout)")
+
+	fs.StringVar(&c.TLSCert, "tlsCert", c.TLSCert, "TLS certificate file (PEM); enables HTTPS together with -tlsKey")
+	fs.StringVar(&c.TLSKey, "tlsKey", c.TLSKey, "TLS private key file (PEM)")
+	fs.StringVar(&c.TLSMinVersion, "tlsMinVersion", c.TLSMinVersion, "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.Var((*stringListFlag)(&c.TLSCipherSuites), "tlsCipherSuites", "Comma-separated TLS 1.0-1.2 cipher suite names (empty = Go defaults)")
+
+	fs.Var((*stringListFlag)(&c.ACMEDomains), "acmeDomains", "Comma-separated domains to obtain Let's Encrypt certificates for (enables HTTPS)")
+	fs.StringVar(&c.ACMEEmail, "acmeEmail", c.ACMEEmail, "Contact email for the ACME account")
+	fs.StringVar(&c.ACMECacheDir, "acmeCacheDir", c.ACMECacheDir, "Directory to store ACME certificates and account keys")
+	fs.IntVar(&c.ACMEHTTPPort, "acmeHTTPPort", c.ACMEHTTPPort, "Plain HTTP port answering HTTP-01 challenges and redirecting to HTTPS (0 = disabled)")
+
+	fs.BoolVar(&c.HTTP3, "http3", c.HTTP3, "Also serve HTTP/3 (QUIC) on the same UDP port; requires TLS")
+
+	fs.Int64Var(&c.CacheSizeBytes, "cacheSizeBytes", c.CacheSizeBytes, "Maximum memory cache size in bytes (default 1GB)")
+	fs.DurationVar(&c.CacheTTL, "cacheTTL", c.CacheTTL, "Default lifetime of cached entries (0 = never expire)")
+	fs.Var((*ttlRulesFlag)(&c.CacheTTLRules), "cacheTTLRules", "Per-path TTL overrides as comma-separated glob=duration pairs (e.g. \"*.m3u8=2s,/static/**=1h\")")
+	fs.DurationVar(&c.NegativeCacheTTL, "negativeCacheTTL", c.NegativeCacheTTL, "How long to remember that a path does not exist, sparing the disk repeated 404 lookups (0 = disabled)")
+	fs.DurationVar(&c.StaleWhileRevalidate, "staleWhileRevalidate", c.StaleWhileRevalidate, "Keep serving cached files this long after their TTL expires while refreshing them in the background (0 = disabled)")
+	fs.BoolVar(&c.CacheTinyLFU, "cacheTinyLFU", c.CacheTinyLFU, "Only cache new files that are requested more often than the entries they would evict (TinyLFU admission)")
+	fs.BoolVar(&c.CacheDedup, "cacheDedup", c.CacheDedup, "Cache files by content hash so identical files at different paths are held in memory once")
+	fs.StringVar(&c.CachePolicy, "cachePolicy", c.CachePolicy, "Cache eviction policy: slru, lru, lfu (with aging), arc or 2q")
+	fs.Float64Var(&c.MemoryHighWater, "memoryHighWater", c.MemoryHighWater, "Share of the Go memory limit (GOMEMLIMIT) at which the cache is shrunk to relieve memory pressure, growing back once it eases (0 = disabled)")
+	fs.Float64Var(&c.CacheProtectedRatio, "cacheProtectedRatio", c.CacheProtectedRatio, "Share of the cache reserved for files requested more than once (SLRU protected segment, 0-1)")
+	fs.Int64Var(&c.MaxCacheItemBytes, "maxCacheItemBytes", c.MaxCacheItemBytes, "Largest file kept in the cache; bigger files are streamed from disk (0 = up to one cache shard)")
+	fs.IntVar(&c.CacheShards, "cacheShards", c.CacheShards, "Number of independently locked cache segments; each holds cacheSizeBytes/cacheShards and no file larger than that")
+	fs.BoolVar(&c.CacheCompress, "cacheCompress", c.CacheCompress, "Keep cached files of the -compressTypes types zstd-compressed in memory, trading CPU on each hit for capacity")
+	fs.BoolVar(&c.CacheOffHeap, "cacheOffHeap", c.CacheOffHeap, "Keep cached data in memory mapped outside the Go heap to reduce GC pressure (Unix only)")
+	fs.Int64Var(&c.CacheBlockSize, "cacheBlockSize", c.CacheBlockSize, "Serve Range requests for files too large to cache from cached blocks of this many bytes (e.g. 4194304; 0 = read 1 MiB blocks uncached, still sharing concurrent reads)")
+	fs.StringVar(&c.CacheSnapshot, "cacheSnapshot", c.CacheSnapshot, "File the cache index is saved to on shutdown and warmed from on startup (empty = disabled)")
+	fs.BoolVar(&c.SnapshotContents, "cacheSnapshotContents", c.SnapshotContents, "Also save cached file contents in the snapshot instead of re-reading them from disk on startup")
+	fs.DurationVar(&c.SnapshotInterval, "cacheSnapshotInterval", c.SnapshotInterval, "Additionally save the cache snapshot this often (0 = only on shutdown)")
+	fs.StringVar(&c.WarmupManifest, "warmupManifest", c.WarmupManifest, "Read these files into the cache on startup: a file listing one URL path per line, or recent:N for the N most recently modified files")
+	fs.IntVar(&c.WarmupConcurrency, "warmupConcurrency", c.WarmupConcurrency, "Files read in parallel by -warmupManifest")
+	fs.DurationVar(&c.ScrubInterval, "scrubInterval", c.ScrubInterval, "Re-check every cached file against the disk this often, evicting entries that no longer match (0 = disabled)")
+	fs.BoolVar(&c.ScrubHash, "scrubHash", c.ScrubHash, "Have the scrubber also re-read and hash each cached file to detect corruption")
+	fs.IntVar(&c.PrefetchThreshold, "prefetchThreshold", c.PrefetchThreshold, "Keep files requested at least this many times per -prefetchWindow cached and refreshed ahead of expiry (0 = disabled)")
+	fs.DurationVar(&c.PrefetchWindow, "prefetchWindow", c.PrefetchWindow, "Window over which requests are counted for -prefetchThreshold")
+	fs.Var((*stringListFlag)(&c.NoCache), "noCache", "Comma-separated globs of volatile paths that are always read from disk, never from or into the cache (e.g. \"/status/**,*.lock\")")
+	fs.BoolVar(&c.HonorNoCache, "honorNoCache", c.HonorNoCache, "Let clients re-read a file into the cache with Cache-Control: no-cache, or skip the cache with no-store (lets anyone force disk reads)")
+	fs.Var((*stringListFlag)(&c.Pin), "pin", "Comma-separated paths kept in the cache outside its size limit, never evicted to make room (e.g. \"/index.html,/setup.exe\")")
+	fs.DurationVar(&c.JanitorInterval, "janitorInterval", c.JanitorInterval, "How often expired cache entries are purged in the background")
+	fs.BoolVar(&c.Watch, "watch", c.Watch, "Invalidate cached entries when files under -dir change on disk")
+
+	fs.DurationVar(&c.CheckTime, "checkTime", c.CheckTime, "Time to check speed after")
+	fs.Float64Var(&c.MinSpeedMbps, "minSpeedMbps", c.MinSpeedMbps, "Minimum speed in Mbps before aborting")
+	fs.DurationVar(&c.HedgedDelay, "hedgedDelay", c.HedgedDelay, "Time to wait before second read attempt")
+	fs.IntVar(&c.HedgeAttempts, "hedgeAttempts", c.HedgeAttempts, "Maximum concurrent reads of one file, including the first (1 = never hedge)")
+	fs.Float64Var(&c.HedgeBackoff, "hedgeBackoff", c.HedgeBackoff, "Factor the delay before each further hedged read grows by")
+	fs.DurationVar(&c.ReadDeadline, "readDeadline", c.ReadDeadline, "Total time all attempts of one cache-miss read may take")
+	fs.Var((*hedgeRulesFlag)(&c.HedgeRules), "hedgeRules", "Per-path hedging overrides, first match wins (e.g. \"/ssd/**=off,/cloud/**=checkTime:3s;minSpeedMbps:1;hedgedDelay:500ms\")")
+	fs.DurationVar(&c.SpeedWindow, "speedWindow", c.SpeedWindow, "Read speed is measured over this trailing window, re-checked throughout the read (0 = same as -checkTime)")
+	fs.Float64Var(&c.HedgePercentile, "hedgePercentile", c.HedgePercentile, "Adaptive hedging: hedge reads slower than this percentile of recent read speeds, e.g. 10 for p10 (0 = use -minSpeedMbps)")
+	fs.Int64Var(&c.HedgeMinSize, "hedgeMinSize", c.HedgeMinSize, "Files smaller than this many bytes are never hedged or counted towards the adaptive threshold")
+	fs.Var((*stringListFlag)(&c.MirrorDirs), "mirrorDir", "Comma-separated alternate roots with the same tree as -dir (e.g. a second NFS mount); hedged reads go to them in turn")
+	fs.BoolVar(&c.FadviseWillNeed, "fadviseWillNeed", c.FadviseWillNeed, "Linux: ask the kernel to read ahead each file before reading it, so a hedged read hits the page cache")
+	fs.BoolVar(&c.FadviseDontNeed, "fadviseDontNeed", c.FadviseDontNeed, "Linux: drop files from the page cache once they are cached in memory or streamed")
+	fs.Int64Var(&c.ReadaheadBytes, "readaheadBytes", c.ReadaheadBytes, "How much of each file -fadviseWillNeed asks for up front (0 = whole file)")
+	fs.BoolVar(&c.IOUring, "ioUring", c.IOUring, "Linux: read files into the cache through io_uring, falling back to regular reads where it is unavailable")
+	fs.IntVar(&c.IOUringDepth, "ioUringDepth", c.IOUringDepth, "1MB reads kept in flight per file with -ioUring")
+	fs.IntVar(&c.ParallelReads, "parallelReads", c.ParallelReads, "Concurrent ranged reads used to fetch a large file into the cache (1 = a single sequential read)")
+	fs.Int64Var(&c.ParallelReadMinSize, "parallelReadMinSize", c.ParallelReadMinSize, "Files smaller than this many bytes are always read sequentially")
+	fs.Int64Var(&c.StreamMissMinSize, "streamMissMinSize", c.StreamMissMinSize, "Stream cache misses of files at least this many bytes to the client while they are read into the cache, instead of sending them once read (0 = disabled)")
+	fs.IntVar(&c.MaxConcurrentReads, "maxConcurrentReads", c.MaxConcurrentReads, "Maximum cache-miss reads hitting the disk at once; others queue (0 = unlimited)")
+	fs.DurationVar(&c.ReadQueueTimeout, "readQueueTimeout", c.ReadQueueTimeout, "How long a cache miss waits for a read slot before answering 503 (0 = wait indefinitely)")
+	fs.Int64Var(&c.MaxReadMemory, "maxReadMemory", c.MaxReadMemory, "Total bytes of file buffers cache-miss reads may hold at once; files that don't fit are streamed from disk uncached (0 = unlimited)")
+	fs.DurationVar(&c.ReadMemoryWait, "readMemoryWait", c.ReadMemoryWait, "How long a cache miss waits for -maxReadMemory to free up before streaming the file uncached (0 = stream right away)")
+
+	fs.Var((*stringListFlag)(&c.Compress), "compress", "Comma-separated encodings to compress responses with, in preference order (br,zstd,gzip; empty = disabled)")
+	fs.Int64Var(&c.CompressMinSize, "compressMinSize", c.CompressMinSize, "Minimum body size in bytes worth compressing")
+	fs.Var((*stringListFlag)(&c.CompressTypes), "compressTypes", "Comma-separated Content-Type prefixes eligible for compression")
+	fs.Var((*mimeTypesFlag)(&c.MimeTypes), "mimeTypes", "Comma-separated extension=Content-Type overrides, e.g. .mkv=video/x-matroska")
+	fs.Var((*cacheControlRulesFlag)(&c.CacheControl), "cacheControl", "Per-path Cache-Control headers, first match wins, directives separated by semicolons (e.g. \"/assets/**=public;max-age=31536000;immutable,/latest/**=no-cache\")")
+	fs.Var((*headerRulesFlag)(&c.Headers), "header", "Add a response header for matching paths, as pattern=Name: value (e.g. \"/app/**=X-Frame-Options: DENY\"); repeatable")
+	fs.BoolVar(&c.DiagnosticHeaders, "diagnosticHeaders", c.DiagnosticHeaders, "Send X-Cache, Age and Server-Timing headers showing how each download was served")
+	fs.BoolVar(&c.Checksums, "checksums", c.Checksums, "Send Digest/Content-MD5 headers with SHA-256 and MD5 checksums of each file and answer ?checksum=1 with them as JSON")
+	fs.BoolVar(&c.Zsync, "zsync", c.Zsync, "Answer /path?zsync with a zsync control file, so clients update large files by downloading only changed blocks")
+	fs.BoolVar(&c.Thumbnails, "thumbnails", c.Thumbnails, "Answer ?w=&h=&q= on JPEG/PNG/GIF images with a resized copy, cached like the original")
+	fs.IntVar(&c.ThumbnailMaxSize, "thumbnailMaxSize", c.ThumbnailMaxSize, "Largest width or height accepted in ?w= and ?h=")
+	fs.StringVar(&c.DefaultMimeType, "defaultMimeType", c.DefaultMimeType, "Content-Type for files of unknown type instead of sniffing their contents")
+	fs.BoolVar(&c.Precompressed, "precompressed", c.Precompressed, "Serve foo.br/.zst/.gz next to foo when the client accepts that encoding")
+
+	fs.BoolVar(&c.ListDirs, "listDirs", c.ListDirs, "Render HTML/JSON listings for directory requests instead of 403")
+	fs.StringVar(&c.IndexFile, "indexFile", c.IndexFile, "File served for directory requests when present (e.g. index.html)")
+	fs.StringVar(&c.SPAFallback, "spaFallback", c.SPAFallback, "File served for 404s on extensionless paths, for single-page apps (e.g. /index.html)")
+	fs.BoolVar(&c.Archives, "archives", c.Archives, "Answer /dir?archive=zip|tar|tar.gz with the directory packed on the fly (honours ?include= and ?exclude= globs)")
+	fs.IntVar(&c.ArchiveMaxFiles, "archiveMaxFiles", c.ArchiveMaxFiles, "Maximum number of files in a directory archive (0 = unlimited)")
+	fs.Int64Var(&c.ArchiveMaxBytes, "archiveMaxBytes", c.ArchiveMaxBytes, "Maximum total size of the files in a directory archive (0 = unlimited)")
+
+	fs.BoolVar(&c.ReadOnly, "readOnly", c.ReadOnly, "Reject all write methods (PUT/POST uploads, DELETE)")
+	fs.StringVar(&c.WriteToken, "writeToken", c.WriteToken, "Bearer token required for write methods (empty = no auth when -readOnly=false)")
+	fs.Int64Var(&c.MaxUploadBytes, "maxUploadBytes", c.MaxUploadBytes, "Maximum upload body size in bytes (0 = unlimited)")
+	fs.StringVar(&c.UploadScan, "uploadScan", c.UploadScan, "Scan uploads before they become servable: a command run with the file appended (exit 1 = reject), an http(s):// URL the file is POSTed to (403/422 = reject) or an icap:// RESPMOD service (empty disables)")
+	fs.DurationVar(&c.UploadScanTimeout, "uploadScanTimeout", c.UploadScanTimeout, "How long -uploadScan may take per file before the upload fails")
+	fs.BoolVar(&c.UploadScanQuarantine, "uploadScanQuarantine", c.UploadScanQuarantine, "Move uploads rejected by -uploadScan into "+quarantineDirName+" under -dir instead of deleting them")
+	fs.Var((*quotaRulesFlag)(&c.Quotas), "quotas", "Byte quotas on uploads as comma-separated target=bytes pairs, per top-level directory or authenticated user (e.g. \"/photos=10737418240,/*=1073741824,user:*=5368709120\")")
+	fs.BoolVar(&c.WebDAV, "webdav", c.WebDAV, "Expose -dir over WebDAV under /dav/ (writes follow -readOnly and -writeToken)")
+	fs.BoolVar(&c.Tus, "tus", c.Tus, "Accept resumable tus.io uploads under /tus/ (follows -readOnly and -writeToken)")
+	fs.BoolVar(&c.SoftDelete, "softDelete", c.SoftDelete, "Move DELETEd files into "+trashDirName+" under -dir instead of removing them")
+	fs.BoolVar(&c.TrashOverwrites, "trashOverwrites", c.TrashOverwrites, "Keep the previous version of files replaced by PUT and POST uploads in "+trashDirName+" under -dir")
+	fs.DurationVar(&c.TrashRetention, "trashRetention", c.TrashRetention, "Delete files from "+trashDirName+" once they have been there this long (0 = keep forever)")
+
+	fs.StringVar(&c.AdminToken, "adminToken", c.AdminToken, "Bearer token for the /admin/ API (empty disables it)")
+	fs.StringVar(&c.RequestIDHeader, "requestIDHeader", c.RequestIDHeader, "Header carrying request IDs: honoured from clients, generated otherwise, echoed in responses and logs (empty disables)")
+	fs.StringVar(&c.OTLPEndpoint, "otlpEndpoint", c.OTLPEndpoint, "OpenTelemetry collector to export request traces to over OTLP/HTTP (e.g. http://otel-collector:4318; empty disables tracing)")
+	fs.StringVar(&c.OTelServiceName, "otelServiceName", c.OTelServiceName, "service.name reported with exported traces")
+	fs.Float64Var(&c.TraceSampleRatio, "traceSampleRatio", c.TraceSampleRatio, "Fraction of requests without a sampled traceparent to trace (0-1)")
+	fs.BoolVar(&c.Health, "health", c.Health, "Answer /healthz (liveness) and /readyz (readiness) probes, bypassing auth and rate limits")
+	fs.StringVar(&c.ReadyProbe, "readyProbe", c.ReadyProbe, "File under -dir that /readyz reads from disk to prove the origin is serving (empty = only stat the directory)")
+	fs.DurationVar(&c.ReadyTimeout, "readyTimeout", c.ReadyTimeout, "Latency budget for /readyz checks; slower checks report the node unavailable")
+	fs.Var((*authRulesFlag)(&c.AuthRules), "authRules", "Per-path-prefix authentication as comma-separated prefix=credential pairs (e.g. \"/public/=public,/=htpasswd:users.htpasswd,/=token:s3cret\")")
+	fs.StringVar(&c.SymlinkPolicy, "symlinkPolicy", c.SymlinkPolicy, "Symlinks under -dir: deny, follow-within-root (targets must stay under -dir) or follow-all")
+	fs.BoolVar(&c.CaseInsensitivePaths, "caseInsensitivePaths", c.CaseInsensitivePaths, "Cache paths that differ only in case as one file, for -dir on a case-insensitive volume")
+	fs.StringVar(&c.TrailingSlash, "trailingSlash", c.TrailingSlash, "Requests for a file with a trailing slash: ignore (serve the file), redirect (to the path without it) or strict (404)")
+	fs.StringVar(&c.PathDecoding, "pathDecoding", c.PathDecoding, "Percent-decoding of request paths: once, repeat (until no escapes are left, so double-encoded paths match) or strict (reject encoded slashes and escapes left after decoding)")
+	fs.BoolVar(&c.HideDotfiles, "hideDotfiles", c.HideDotfiles, "Refuse paths with a component starting with a dot (.git, .env, ...) and leave them out of listings; /.well-known stays reachable")
+	fs.Var((*stringListFlag)(&c.Hide), "hide", "Comma-separated globs refused like dotfiles, checked before touching the disk (e.g. \"*.bak,*.key,node_modules,/private/**\")")
+	fs.IntVar(&c.HiddenStatus, "hiddenStatus", c.HiddenStatus, "Status answered for hidden paths: 404 or 403")
+	fs.Var((*errorPagesFlag)(&c.ErrorPages), "errorPages", "HTML templates replacing plain-text error bodies as comma-separated status=file pairs (e.g. \"404=404.html,429=busy.html\"); API clients get JSON")
+	fs.Var((*aclRulesFlag)(&c.ACL), "acl", "Ordered access rules as comma-separated glob=allow|deny|auth pairs; first match wins (e.g. \"*.key=deny,/private/**=auth\")")
+	fs.StringVar(&c.JWTSecret, "jwtSecret", c.JWTSecret, "Shared secret for HS256 JWTs accepted by jwt auth rules (env JWT_SECRET)")
+	fs.StringVar(&c.JWTPublicKey, "jwtPublicKey", c.JWTPublicKey, "PEM file with the RSA public key for RS256 JWTs")
+	fs.StringVar(&c.JWKSURL, "jwksURL", c.JWKSURL, "JWKS URL of an identity provider to fetch RS256 JWT keys from")
+	fs.StringVar(&c.SignKey, "signKey", c.SignKey, "Secret for HMAC-signed URLs; when set, reads require valid ?sig=&exp= parameters (env SIGN_KEY)")
+
+	fs.Float64Var(&c.RateLimit, "rateLimit", c.RateLimit, "Requests per second allowed per client IP (0 = unlimited)")
+	fs.IntVar(&c.RateBurst, "rateBurst", c.RateBurst, "Requests a client IP may burst above -rateLimit")
+	fs.Var((*stringListFlag)(&c.TrustedProxies), "trustedProxies", "Comma-separated proxy IPs/CIDRs whose Forwarded/X-Forwarded-For headers are trusted for the client IP in logs, rate limits and traces")
+	fs.Float64Var(&c.MaxMbpsPerConn, "maxMbpsPerConn", c.MaxMbpsPerConn, "Egress bandwidth cap per client connection in Mbps (0 = unlimited)")
+	fs.Float64Var(&c.MaxMbpsTotal, "maxMbpsTotal", c.MaxMbpsTotal, "Egress bandwidth cap shared by all clients in Mbps (0 = unlimited)")
+
+	fs.Var((*stringListFlag)(&c.CORSOrigins), "corsOrigins", "Comma-separated origins allowed to make cross-origin requests, or * for any (empty = CORS disabled)")
+	fs.Var((*stringListFlag)(&c.CORSMethods), "corsMethods", "Comma-separated methods allowed in CORS preflight responses")
+	fs.Var((*stringListFlag)(&c.CORSHeaders), "corsHeaders", "Comma-separated request headers allowed in CORS preflight responses")
+	fs.DurationVar(&c.CORSMaxAge, "corsMaxAge", c.CORSMaxAge, "How long browsers may cache a CORS preflight response")
+	fs.BoolVar(&c.CORSCredentials, "corsCredentials", c.CORSCredentials, "Allow cross-origin requests with cookies or HTTP auth")
+
+	fs.StringVar(&c.AccessLog, "accessLog", c.AccessLog, "Access log destination: a file path, \"-\" for stdout, or empty to disable")
+	fs.Int64Var(&c.AccessLogMaxSizeMB, "accessLogMaxSizeMB", c.AccessLogMaxSizeMB, "Rotate the access log file after this many megabytes (0 = never)")
+	fs.DurationVar(&c.AccessLogMaxAge, "accessLogMaxAge", c.AccessLogMaxAge, "Rotate the access log file after this long (0 = never)")
+	fs.IntVar(&c.AccessLogMaxBackups, "accessLogMaxBackups", c.AccessLogMaxBackups, "Number of rotated access log files to keep (0 = keep all)")
+	fs.DurationVar(&c.SlowRequestLog, "slowRequestLog", c.SlowRequestLog, "Log requests taking longer than this with a breakdown by phase (queue, disk, hedge, network), even without -accessLog (0 = disabled)")
+}
+
+// applyEnv applies the environment variable overrides, which take precedence over flags.
+func (c *Config) applyEnv() {
+	if envDir := os.Getenv("SERVE_DIR"); envDir != "" {
+		c.Dir = envDir
+	}
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		if p, err := strconv.Atoi(envPort); err == nil {
+			c.Port = p
+		}
+	}
+	if envCacheSize := os.Getenv("CACHE_SIZE_BYTES"); envCacheSize != "" {
+		if size, err := strconv.ParseInt(envCacheSize, 10, 64); err == nil {
+			c.CacheSizeBytes = size
+		}
+	}
+	if envAdminToken := os.Getenv("ADMIN_TOKEN"); envAdminToken != "" {
+		c.AdminToken = envAdminToken
+	}
+	if envWriteToken := os.Getenv("WRITE_TOKEN"); envWriteToken != "" {
+		c.WriteToken = envWriteToken
+	}
+	if envSignKey := os.Getenv("SIGN_KEY"); envSignKey != "" {
+		c.SignKey = envSignKey
+	}
+	if envJWTSecret := os.Getenv("JWT_SECRET"); envJWTSecret != "" {
+		c.JWTSecret = envJWTSecret
+	}
+	if envPeerToken := os.Getenv("PEER_TOKEN"); envPeerToken != "" {
+		c.PeerToken = envPeerToken
+	}
+	if envOTLP := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); envOTLP != "" {
+		c.OTLPEndpoint = envOTLP
+	}
+	if envService := os.Getenv("OTEL_SERVICE_NAME"); envService != "" {
+		c.OTelServiceName = envService
+	}
+	if envGRPCToken := os.Getenv("GRPC_TOKEN"); envGRPCToken != "" {
+		c.GRPCToken = envGRPCToken
+	}
+	if envRedis := os.Getenv("REDIS_URL"); envRedis != "" {
+		c.Redis = envRedis
+	}
+	if envKey := os.Getenv("AWS_ACCESS_KEY_ID"); envKey != "" {
+		c.S3AccessKey = envKey
+	}
+	if envSecret := os.Getenv("AWS_SECRET_ACCESS_KEY"); envSecret != "" {
+		c.S3SecretKey = envSecret
+	}
+	if envToken := os.Getenv("AWS_SESSION_TOKEN"); envToken != "" {
+		c.S3SessionToken = envToken
+	}
+	if envRegion := os.Getenv("AWS_REGION"); envRegion != "" {
+		c.S3Region = envRegion
+	}
+	if envTTL := os.Getenv("CACHE_TTL"); envTTL != "" {
+		if d, err := time.ParseDuration(envTTL); err == nil {
+			c.CacheTTL = d
+		}
+	}
+}
+
+// Validate reports every invalid setting in c.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Dir == "" {
+		errs = append(errs, errors.New("dir must not be empty"))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d out of range", c.Port))
+	}
+	if _, err := strconv.ParseUint(c.ListenUnixMode, 8, 32); err != nil {
+		errs = append(errs, fmt.Errorf("listenUnixMode %q must be octal permissions (e.g. 0660)", c.ListenUnixMode))
+	}
+	for _, s := range c.Listen {
+		spec, err := parseListenSpec(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listen %q: %w", s, err))
+		} else if spec.tls != nil && *spec.tls && c.TLSCert == "" && len(c.ACMEDomains) == 0 {
+			errs = append(errs, fmt.Errorf("listen %q: https needs tlsCert or acmeDomains", s))
+		}
+	}
+	if c.GRPCPort < 0 || c.GRPCPort > 65535 || (c.GRPCPort != 0 && c.GRPCPort == c.Port) {
+		errs = append(errs, fmt.Errorf("grpcPort %d must be in range and differ from port", c.GRPCPort))
+	}
+	if c.SFTPPort < 0 || c.SFTPPort > 65535 || (c.SFTPPort != 0 && (c.SFTPPort == c.Port || c.SFTPPort == c.GRPCPort)) {
+		errs = append(errs, fmt.Errorf("sftpPort %d must be in range and differ from port and grpcPort", c.SFTPPort))
+	}
+	if c.SFTPPort != 0 && c.SFTPHtpasswd == "" && c.SFTPAuthorizedKeys == "" {
+		errs = append(errs, errors.New("sftpPort requires sftpHtpasswd or sftpAuthorizedKeys"))
+	}
+	if c.SFTPPort != 0 && c.SFTPHostKey == "" {
+		errs = append(errs, errors.New("sftpHostKey must not be empty"))
+	}
+	if c.OriginURL != "" {
+		if u, err := url.Parse(c.OriginURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("originURL %q must be an http(s) URL", c.OriginURL))
+		}
+	}
+	if len(c.Peers) > 0 || c.PeerDNS != "" {
+		if len(c.Peers) > 0 && c.PeerDNS != "" {
+			errs = append(errs, errors.New("peers and peerDNS are mutually exclusive"))
+		}
+		if c.PeerToken == "" {
+			errs = append(errs, errors.New("peerToken is required with peers or peerDNS"))
+		}
+		if c.PeerRefresh <= 0 {
+			errs = append(errs, errors.New("peerRefresh must be positive"))
+		}
+	}
+	if c.Redis != "" {
+		if _, _, _, _, _, err := parseRedisURL(c.Redis); err != nil {
+			errs = append(errs, fmt.Errorf("redis %q: %w", c.Redis, err))
+		}
+		if c.RedisWritePolicy != WriteAround && c.RedisWritePolicy != WriteThrough {
+			errs = append(errs, fmt.Errorf("redisWritePolicy %q must be %s or %s", c.RedisWritePolicy, WriteAround, WriteThrough))
+		}
+		if c.RedisTTL < 0 || c.RedisTimeout < 0 || c.RedisMaxItemBytes < 0 {
+			errs = append(errs, errors.New("redisTTL, redisTimeout and redisMaxItemBytes must not be negative"))
+		}
+	}
+	for _, peer := range c.Peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("peers: %q must be an http(s) URL", peer))
+		}
+	}
+	if c.Storage != "" {
+		if _, _, _, err := parseStorageURL(c.Storage); err != nil {
+			errs = append(errs, fmt.Errorf("storage %q: %w", c.Storage, err))
+		}
+		if !c.ReadOnly || c.WebDAV || c.OriginURL != "" {
+			errs = append(errs, errors.New("storage: an object store is read-only; set readOnly and disable webdav and originURL"))
+		}
+		if c.S3Region == "" {
+			errs = append(errs, errors.New("s3Region must not be empty"))
+		}
+	}
+	if c.S3Endpoint != "" {
+		if u, err := url.Parse(c.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("s3Endpoint %q must be an http(s) URL", c.S3Endpoint))
+		}
+	}
+	if c.S3HedgeAfter < 0 {
+		errs = append(errs, errors.New("s3HedgeAfter must not be negative"))
+	}
+	seenHosts := make(map[string]bool)
+	for _, vh := range c.VirtualHosts {
+		host := strings.ToLower(vh.Host)
+		switch {
+		case host == "" || strings.ContainsAny(host, "/:"):
+			errs = append(errs, fmt.Errorf("virtualHosts: invalid host %q (want a bare hostname)", vh.Host))
+		case seenHosts[host]:
+			errs = append(errs, fmt.Errorf("virtualHosts: duplicate host %q", vh.Host))
+		}
+		seenHosts[host] = true
+		if vh.Dir == "" {
+			errs = append(errs, fmt.Errorf("virtualHosts: host %q has no dir", vh.Host))
+		}
+		if vh.CacheSizeBytes < 0 {
+			errs = append(errs, fmt.Errorf("virtualHosts: host %q has a negative cacheSizeBytes", vh.Host))
+		}
+	}
+	if c.URLPrefix != "" && (!strings.HasPrefix(c.URLPrefix, "/") || path.Clean(c.URLPrefix) != strings.TrimSuffix(c.URLPrefix, "/")) {
+		errs = append(errs, fmt.Errorf("urlPrefix %q must be a clean absolute path such as /files", c.URLPrefix))
+	}
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		errs = append(errs, errors.New("server timeouts must not be negative"))
+	}
+	if c.SlowRequestLog < 0 {
+		errs = append(errs, errors.New("slowRequestLog must not be negative"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tlsCert and tlsKey must be set together"))
+	}
+	if len(c.ACMEDomains) > 0 {
+		if c.TLSCert != "" {
+			errs = append(errs, errors.New("acmeDomains and tlsCert are mutually exclusive"))
+		}
+		if c.ACMECacheDir == "" {
+			errs = append(errs, errors.New("acmeCacheDir must be set when acmeDomains is used"))
+		}
+		if c.ACMEHTTPPort < 0 || c.ACMEHTTPPort > 65535 || c.ACMEHTTPPort == c.Port {
+			errs = append(errs, fmt.Errorf("acmeHTTPPort %d invalid or conflicts with port", c.ACMEHTTPPort))
+		}
+	}
+	if c.HTTP3 && c.TLSCert == "" && len(c.ACMEDomains) == 0 {
+		errs = append(errs, errors.New("http3 requires tlsCert/tlsKey or acmeDomains"))
+	}
+	if _, err := parseTLSVersion(c.TLSMinVersion); err != nil {
+		errs = append(errs, fmt.Errorf("tlsMinVersion: %w", err))
+	}
+	if _, err := parseCipherSuites(c.TLSCipherSuites); err != nil {
+		errs = append(errs, fmt.Errorf("tlsCipherSuites: %w", err))
+	}
+	if c.CacheSizeBytes < 0 {
+		errs = append(errs, errors.New("cacheSizeBytes must not be negative"))
+	}
+	if c.CacheTTL < 0 {
+		errs = append(errs, errors.New("cacheTTL must not be negative"))
+	}
+	for _, rule := range c.CacheTTLRules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("cacheTTLRules pattern %q: %w", rule.Pattern, err))
+		}
+	}
+	if c.CheckTime <= 0 {
+		errs = append(errs, errors.New("checkTime must be positive"))
+	}
+	if c.MinSpeedMbps < 0 {
+		errs = append(errs, errors.New("minSpeedMbps must not be negative"))
+	}
+	if c.HedgedDelay < 0 {
+		errs = append(errs, errors.New("hedgedDelay must not be negative"))
+	}
+	for _, rule := range c.HedgeRules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("hedgeRules pattern %q: %w", rule.Pattern, err))
+		}
+		if rule.CheckTime < 0 || rule.MinSpeedMbps < 0 || rule.HedgedDelay < 0 {
+			errs = append(errs, fmt.Errorf("hedgeRules pattern %q: values must not be negative", rule.Pattern))
+		}
+	}
+	if c.HedgeAttempts < 1 {
+		errs = append(errs, errors.New("hedgeAttempts must be at least 1"))
+	}
+	if c.HedgeBackoff < 1 {
+		errs = append(errs, errors.New("hedgeBackoff must be at least 1"))
+	}
+	if c.ReadDeadline <= 0 {
+		errs = append(errs, errors.New("readDeadline must be positive"))
+	}
+	if c.SpeedWindow < 0 {
+		errs = append(errs, errors.New("speedWindow must not be negative"))
+	}
+	if c.HedgeMinSize < 0 {
+		errs = append(errs, errors.New("hedgeMinSize must not be negative"))
+	}
+	if c.HedgePercentile < 0 || c.HedgePercentile >= 100 {
+		errs = append(errs, errors.New("hedgePercentile must be between 0 and 100"))
+	}
+	for _, dir := range c.MirrorDirs {
+		if dir == "" {
+			errs = append(errs, errors.New("mirrorDir entries must not be empty"))
+		}
+	}
+	for _, enc := range c.Compress {
+		if enc != EncodingBrotli && enc != EncodingZstd && enc != EncodingGzip {
+			errs = append(errs, fmt.Errorf("compress: unsupported encoding %q", enc))
+		}
+	}
+	if strings.ContainsAny(c.IndexFile, "/\\") {
+		errs = append(errs, errors.New("indexFile must be a plain file name"))
+	}
+	for _, rule := range c.AuthRules {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("authRules: prefix %q must start with /", rule.Prefix))
+		}
+		if !rule.Public && !rule.JWT && rule.Htpasswd == "" && len(rule.Tokens) == 0 {
+			errs = append(errs, fmt.Errorf("authRules: prefix %q needs public, jwt, htpasswd or tokens", rule.Prefix))
+		}
+		if rule.JWT && c.JWTSecret == "" && c.JWTPublicKey == "" && c.JWKSURL == "" {
+			errs = append(errs, fmt.Errorf("authRules: prefix %q accepts JWTs but no jwtSecret, jwtPublicKey or jwksURL is set", rule.Prefix))
+		}
+	}
+	for _, rule := range c.ACL {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("acl: invalid pattern %q: %w", rule.Pattern, err))
+		}
+		if rule.Action != ACLAllow && rule.Action != ACLDeny && rule.Action != ACLAuth {
+			errs = append(errs, fmt.Errorf("acl: pattern %q has unknown action %q (want allow, deny or auth)", rule.Pattern, rule.Action))
+		}
+	}
+	for _, pattern := range c.NoCache {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("noCache: invalid pattern %q: %w", pattern, err))
+		}
+	}
+	for _, pattern := range c.Hide {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("hide: invalid pattern %q: %w", pattern, err))
+		}
+	}
+	if c.HiddenStatus != http.StatusNotFound && c.HiddenStatus != http.StatusForbidden {
+		errs = append(errs, fmt.Errorf("hiddenStatus %d must be 404 or 403", c.HiddenStatus))
+	}
+	for status, file := range c.ErrorPages {
+		if status < 400 || status > 599 {
+			errs = append(errs, fmt.Errorf("errorPages: status %d is not an error status", status))
+		}
+		if file == "" {
+			errs = append(errs, fmt.Errorf("errorPages: status %d needs a template file", status))
+		}
+	}
+	switch c.SymlinkPolicy {
+	case SymlinkDeny, SymlinkWithinRoot, SymlinkFollowAll:
+	default:
+		errs = append(errs, fmt.Errorf("symlinkPolicy %q must be deny, follow-within-root or follow-all", c.SymlinkPolicy))
+	}
+	switch c.TrailingSlash {
+	case TrailingSlashIgnore, TrailingSlashRedirect, TrailingSlashStrict:
+	default:
+		errs = append(errs, fmt.Errorf("trailingSlash %q must be ignore, redirect or strict", c.TrailingSlash))
+	}
+	switch c.PathDecoding {
+	case PathDecodeOnce, PathDecodeRepeat, PathDecodeStrict:
+	default:
+		errs = append(errs, fmt.Errorf("pathDecoding %q must be once, repeat or strict", c.PathDecoding))
+	}
+	if c.MaxCacheItemBytes < 0 {
+		errs = append(errs, errors.New("maxCacheItemBytes must not be negative"))
+	}
+	if c.Thumbnails && c.ThumbnailMaxSize < 1 {
+		errs = append(errs, errors.New("thumbnailMaxSize must be positive"))
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		errs = append(errs, errors.New("traceSampleRatio must be between 0 and 1"))
+	}
+	if c.Health && c.ReadyTimeout <= 0 {
+		errs = append(errs, errors.New("readyTimeout must be positive"))
+	}
+	if c.ArchiveMaxFiles < 0 || c.ArchiveMaxBytes < 0 {
+		errs = append(errs, errors.New("archiveMaxFiles and archiveMaxBytes must not be negative"))
+	}
+	if c.CacheBlockSize < 0 {
+		errs = append(errs, errors.New("cacheBlockSize must not be negative"))
+	}
+	if c.SnapshotInterval < 0 {
+		errs = append(errs, errors.New("cacheSnapshotInterval must not be negative"))
+	}
+	if _, _, err := parseWarmupRecent(c.WarmupManifest); err != nil {
+		errs = append(errs, fmt.Errorf("warmupManifest %w", err))
+	}
+	if c.WarmupConcurrency < 1 {
+		errs = append(errs, errors.New("warmupConcurrency must be at least 1"))
+	}
+	for _, rule := range c.Quotas {
+		if err := rule.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.TrashRetention < 0 {
+		errs = append(errs, errors.New("trashRetention must not be negative"))
+	}
+	if c.ScrubInterval < 0 {
+		errs = append(errs, errors.New("scrubInterval must not be negative"))
+	}
+	if c.PrefetchThreshold < 0 {
+		errs = append(errs, errors.New("prefetchThreshold must not be negative"))
+	}
+	if c.PrefetchThreshold > 0 && c.PrefetchWindow <= 0 {
+		errs = append(errs, errors.New("prefetchWindow must be positive"))
+	}
+	if c.CacheShards < 1 {
+		errs = append(errs, errors.New("cacheShards must be at least 1"))
+	}
+	if _, err := newEvictionPolicy(c.CachePolicy, 0, 0); err != nil {
+		errs = append(errs, fmt.Errorf("cachePolicy: %w", err))
+	}
+	if c.MemoryHighWater < 0 || c.MemoryHighWater > 1 {
+		errs = append(errs, errors.New("memoryHighWater must be between 0 and 1"))
+	}
+	if c.CacheProtectedRatio < 0 || c.CacheProtectedRatio > 1 {
+		errs = append(errs, errors.New("cacheProtectedRatio must be between 0 and 1"))
+	}
+	if c.StaleWhileRevalidate < 0 {
+		errs = append(errs, errors.New("staleWhileRevalidate must not be negative"))
+	}
+	if c.NegativeCacheTTL < 0 {
+		errs = append(errs, errors.New("negativeCacheTTL must not be negative"))
+	}
+	if c.ParallelReads < 1 {
+		errs = append(errs, errors.New("parallelReads must be at least 1"))
+	}
+	if c.ParallelReadMinSize < 0 {
+		errs = append(errs, errors.New("parallelReadMinSize must not be negative"))
+	}
+	if c.StreamMissMinSize < 0 {
+		errs = append(errs, errors.New("streamMissMinSize must not be negative"))
+	}
+	if c.IOUringDepth < 1 || c.IOUringDepth > 4096 {
+		errs = append(errs, errors.New("ioUringDepth must be between 1 and 4096"))
+	}
+	if c.ReadaheadBytes < 0 {
+		errs = append(errs, errors.New("readaheadBytes must not be negative"))
+	}
+	if c.MaxConcurrentReads < 0 {
+		errs = append(errs, errors.New("maxConcurrentReads must not be negative"))
+	}
+	if c.ReadQueueTimeout < 0 {
+		errs = append(errs, errors.New("readQueueTimeout must not be negative"))
+	}
+	if c.MaxReadMemory < 0 {
+		errs = append(errs, errors.New("maxReadMemory must not be negative"))
+	}
+	if c.ReadMemoryWait < 0 {
+		errs = append(errs, errors.New("readMemoryWait must not be negative"))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, errors.New("rateLimit must not be negative"))
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		errs = append(errs, errors.New("rateBurst must be at least 1 when rateLimit is set"))
+	}
+	if c.MaxMbpsPerConn < 0 || c.MaxMbpsTotal < 0 {
+		errs = append(errs, errors.New("maxMbpsPerConn and maxMbpsTotal must not be negative"))
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trustedProxies: %w", err))
+	}
+	if c.MaxUploadBytes < 0 {
+		errs = append(errs, errors.New("maxUploadBytes must not be negative"))
+	}
+	if c.UploadScan != "" {
+		if strings.Contains(c.UploadScan, "://") {
+			if u, err := url.Parse(c.UploadScan); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "icap") {
+				errs = append(errs, fmt.Errorf("uploadScan %q must be an http(s):// or icap:// URL or a command", c.UploadScan))
+			}
+		}
+		if c.UploadScanTimeout <= 0 {
+			errs = append(errs, errors.New("uploadScanTimeout must be positive"))
+		}
+	}
+	for _, rule := range c.CacheControl {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("cacheControl pattern %q: %w", rule.Pattern, err))
+		}
+		if rule.Value == "" {
+			errs = append(errs, fmt.Errorf("cacheControl pattern %q: value must not be empty", rule.Pattern))
+		}
+	}
+	for _, rule := range c.Headers {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("headers pattern %q: %w", rule.Pattern, err))
+		}
+		if !httpguts.ValidHeaderFieldName(rule.Name) || !httpguts.ValidHeaderFieldValue(rule.Value) {
+			errs = append(errs, fmt.Errorf("headers pattern %q: invalid header %q", rule.Pattern, rule.Name))
+		}
+	}
+	for ext, ctype := range c.MimeTypes {
+		if ext != normalizeExt(ext) {
+			errs = append(errs, fmt.Errorf("mimeTypes: %q must be a lowercase extension with a leading dot", ext))
+		}
+		if _, _, err := mime.ParseMediaType(ctype); err != nil {
+			errs = append(errs, fmt.Errorf("mimeTypes: %s: %w", ext, err))
+		}
+	}
+	if c.DefaultMimeType != "" {
+		if _, _, err := mime.ParseMediaType(c.DefaultMimeType); err != nil {
+			errs = append(errs, fmt.Errorf("defaultMimeType: %w", err))
+		}
+	}
+	if c.CompressMinSize < 0 {
+		errs = append(errs, errors.New("compressMinSize must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// LoadConfig builds the effective configuration: defaults, then the YAML file at
+// configPath (if any), then flags explicitly set on fs, then environment variables.
+func LoadConfig(configPath string, fs *flag.FlagSet) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if configPath != "" {
+		raw, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing %s: %w", configPath, err)
+		}
+	}
+
+	// Re-apply flags given on the command line so they win over the file.
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	cfg.RegisterFlags(overrides)
+	var setErr error
+	fs.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) == nil {
+			return
+		}
+		if err := overrides.Set(f.Name, f.Value.String()); err != nil && setErr == nil {
+			setErr = err
+		}
+	})
+	if setErr != nil {
+		return nil, setErr
+	}
+
+	cfg.applyEnv()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ttlRulesFlag adapts a []TTLRule to flag.Value using the ParseTTLRules syntax.
+type ttlRulesFlag []TTLRule
+
+func (f *ttlRulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		parts = append(parts, rule.Pattern+"="+rule.TTL.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *ttlRulesFlag) Set(s string) error {
+	rules, err := ParseTTLRules(s)
+	if err != nil {
+		return err
+	}
+	*f = rules
+	return nil
+}
+
+// hedgeRulesFlag adapts a []HedgeRule to flag.Value using the ParseHedgeRules syntax.
+type hedgeRulesFlag []HedgeRule
+
+func (f *hedgeRulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		parts = append(parts, rule.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *hedgeRulesFlag) Set(s string) error {
+	rules, err := ParseHedgeRules(s)
+	if err != nil {
+		return err
+	}
+	*f = rules
+	return nil
+}
+
+// authRulesFlag adapts a []AuthRule to flag.Value using the ParseAuthRules syntax.
+type authRulesFlag []AuthRule
+
+func (f *authRulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, rule := range *f {
+		if rule.Public {
+			parts = append(parts, rule.Prefix+"=public")
+		}
+		if rule.JWT {
+			parts = append(parts, rule.Prefix+"=jwt")
+		}
+		if rule.Htpasswd != "" {
+			parts = append(parts, rule.Prefix+"=htpasswd:"+rule.Htpasswd)
+		}
+		for _, token := range rule.Tokens {
+			parts = append(parts, rule.Prefix+"=token:"+token)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *authRulesFlag) Set(s string) error {
+	rules, err := ParseAuthRules(s)
+	if err != nil {
+		return err
+	}
+	*f = rules
+	return nil
+}
+
+// errorPagesFlag adapts a map of status codes to template files to flag.Value,
+// parsing comma-separated status=file pairs.
+type errorPagesFlag map[int]string
+
+func (f *errorPagesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	statuses := make([]int, 0, len(*f))
+	for status := range *f {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	parts := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		parts = append(parts, strconv.Itoa(status)+"="+(*f)[status])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *errorPagesFlag) Set(s string) error {
+	pages := make(map[int]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		code, file, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("invalid error page %q: expected status=file", part)
+		}
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("invalid error page status %q", code)
+		}
+		pages[status] = file
+	}
+	*f = pages
+	return nil
+}
+
+// virtualHostsFlag adapts a []VirtualHost to flag.Value using the ParseVirtualHosts syntax.
+type virtualHostsFlag []VirtualHost
+
+func (f *virtualHostsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f))
+	for _, vh := range *f {
+		parts = append(parts, vh.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *virtualHostsFlag) Set(s string) error {
+	hosts, err := ParseVirtualHosts(s)
+	if err != nil {
+		return err
+	}
+	*f = hosts
+	return nil
+}
+
+// aclRulesFlag adapts a []ACLRule to flag.Value using the ParseACLRules syntax.
+type aclRulesFlag []ACLRule
+
+func (f *aclRulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		parts = append(parts, rule.Pattern+"="+rule.Action)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *aclRulesFlag) Set(s string) error {
+	rules, err := ParseACLRules(s)
+	if err != nil {
+		return err
+	}
+	*f = rules
+	return nil
+}
+
+// cacheControlRulesFlag adapts a []CacheControlRule to flag.Value using the ParseCacheControlRules syntax.
+type cacheControlRulesFlag []CacheControlRule
+
+func (f *cacheControlRulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		parts = append(parts, rule.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *cacheControlRulesFlag) Set(s string) error {
+	rules, err := ParseCacheControlRules(s)
+	if err != nil {
+		return err
+	}
+	*f = rules
+	return nil
+}
+
+// headerRulesFlag adapts a []HeaderRule to flag.Value. Each use of the flag adds
+// one rule; String joins them with newlines, which Set splits again.
+type headerRulesFlag []HeaderRule
+
+func (f *headerRulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		parts = append(parts, rule.String())
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (f *headerRulesFlag) Set(s string) error {
+	for _, line := range strings.Split(s, "\n") {
+		rule, err := ParseHeaderRule(line)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, rule)
+	}
+	return nil
+}
+
+// mimeTypesFlag adapts a map[string]string to flag.Value using the ParseMimeTypes syntax.
+type mimeTypesFlag map[string]string
+
+func (f *mimeTypesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return formatMimeTypes(*f)
+}
+
+func (f *mimeTypesFlag) Set(s string) error {
+	types, err := ParseMimeTypes(s)
+	if err != nil {
+		return err
+	}
+	*f = types
+	return nil
+}
+
+// stringListFlag adapts a []string to flag.Value as a comma-separated list.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(s string) error {
+	*f = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f = append(*f, item)
+		}
+	}
+	return nil
+}
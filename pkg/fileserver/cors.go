@@ -0,0 +1,89 @@
+package fileserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// corsExposedHeaders are response headers browsers hide from scripts unless
+// listed; they are needed to work with ranges and conditional requests.
+const corsExposedHeaders = "Accept-Ranges, Content-Range, Content-Length, Content-Encoding, ETag, Last-Modified"
+
+// CORS answers preflight requests and adds CORS headers for allowed origins.
+type CORS struct {
+	cfg atomic.Pointer[Config]
+}
+
+// NewCORS creates the CORS middleware state. It is a no-op while no origins are configured.
+func NewCORS(cfg *Config) *CORS {
+	c := &CORS{}
+	c.cfg.Store(cfg)
+	return c
+}
+
+// Reload swaps in new CORS settings.
+func (c *CORS) Reload(cfg *Config) {
+	c.cfg.Store(cfg)
+}
+
+// Wrap returns next with CORS handling in front of it. Preflights are answered
+// here, before authentication, since browsers send them without credentials.
+func (c *CORS) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := c.cfg.Load()
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(cfg.CORSOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		addVary(h, "Origin")
+		allowOrigin := corsAllowOrigin(cfg, origin)
+		if allowOrigin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Origin", allowOrigin)
+		if cfg.CORSCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			addVary(h, "Access-Control-Request-Method")
+			addVary(h, "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", strings.Join(cfg.CORSMethods, ", "))
+			if len(cfg.CORSHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(cfg.CORSHeaders, ", "))
+			}
+			if cfg.CORSMaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" if it isn't allowed. A wildcard is echoed back as the origin when
+// credentials are allowed, since browsers reject "*" in that case.
+func corsAllowOrigin(cfg *Config, origin string) string {
+	for _, allowed := range cfg.CORSOrigins {
+		if allowed == "*" {
+			if cfg.CORSCredentials {
+				return origin
+			}
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package fileserver
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// trashDirName is the directory under the served root that soft-deleted files are moved into.
+// It is never served.
+const trashDirName = ".trash"
+
+// handleDelete removes the file at urlPath, or moves it into the trash when soft delete is enabled.
+func (h *FileHandler) handleDelete(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string) {
+	filePath := filepath.Join(h.baseDir, urlPath)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Cannot DELETE a directory", http.StatusConflict)
+		return
+	}
+
+	if cfg.SoftDelete {
+		err = h.moveToTrash(urlPath, filePath)
+	} else {
+		err = os.Remove(filePath)
+	}
+	if err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	h.invalidate(filePath)
+	h.quotas.released(urlPath, info.Size())
+	logf(r, "Deleted %s (soft: %v)", urlPath, cfg.SoftDelete)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moveToTrash moves filePath to the same relative location under the trash
+// directory, suffixed with the deletion time so repeated deletes don't collide.
+func (h *FileHandler) moveToTrash(urlPath, filePath string) error {
+	dest, err := h.trashDest(urlPath)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filePath, dest)
+}
+
+// moveTreeToTrash is moveToTrash for a file or a whole directory. Every file
+// under a directory goes into the trash on its own, so each can be listed,
+// restored and purged, and the emptied directories are removed.
+func (h *FileHandler) moveTreeToTrash(urlPath, filePath string) error {
+	err := filepath.WalkDir(filePath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filePath, p)
+		if err != nil {
+			return err
+		}
+		return h.moveToTrash(path.Join(urlPath, filepath.ToSlash(rel)), p)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filePath)
+}
+
+// keepInTrash puts the current version of filePath into the trash before an
+// upload replaces it (-trashOverwrites), returning its location there, or ""
+// if there was no file. It is hard-linked, so the file stays in place until
+// the upload is complete.
+func (h *FileHandler) keepInTrash(urlPath, filePath string) (string, error) {
+	if info, err := os.Lstat(filePath); err != nil || !info.Mode().IsRegular() {
+		return "", nil
+	}
+	dest, err := h.trashDest(urlPath)
+	if err != nil {
+		return "", err
+	}
+	return dest, os.Link(filePath, dest)
+}
+
+// trashDest returns where in the trash the file at urlPath goes if deleted now.
+func (h *FileHandler) trashDest(urlPath string) (string, error) {
+	dest := filepath.Join(h.baseDir, trashDirName, urlPath) + "." + time.Now().Format(trashStampFormat)
+	return dest, os.MkdirAll(filepath.Dir(dest), 0755)
+}
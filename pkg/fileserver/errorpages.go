@@ -0,0 +1,161 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// maxErrorMessage caps how much of an error body is kept for the page.
+const maxErrorMessage = 1024
+
+// ErrorPages replaces the plain-text bodies of error responses with the
+// templates configured in -errorPages, or with JSON for clients that ask for
+// it. Only bodies written by http.Error are replaced, so files and proxied
+// origin responses pass through unchanged.
+type ErrorPages struct {
+	templates atomic.Pointer[map[int]*template.Template]
+}
+
+// errorPageData is what error page templates are executed with.
+type errorPageData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message"`
+	Path       string `json:"path"`
+	RequestID  string `json:"requestId,omitempty"`
+}
+
+// NewErrorPages loads the error page templates of cfg, failing if one can't
+// be read or parsed. It is a no-op while none are configured.
+func NewErrorPages(cfg *Config) (*ErrorPages, error) {
+	e := &ErrorPages{}
+	if err := e.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload re-reads the error page templates. On error the current ones stay in effect.
+func (e *ErrorPages) Reload(cfg *Config) error {
+	templates := make(map[int]*template.Template, len(cfg.ErrorPages))
+	for status, file := range cfg.ErrorPages {
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return err
+		}
+		templates[status] = tmpl
+	}
+	e.templates.Store(&templates)
+	return nil
+}
+
+// Wrap returns next with its error responses rewritten.
+func (e *ErrorPages) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		templates := *e.templates.Load()
+		if len(templates) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &errorPageWriter{ResponseWriter: w, r: r, templates: templates}
+		next.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			ew.render()
+		}
+	})
+}
+
+// errorPageWriter holds back error responses written by http.Error so they
+// can be rendered as a page instead.
+type errorPageWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	templates   map[int]*template.Template
+	wroteHeader bool
+	// status is the held-back error status, or zero if the response passes through.
+	status  int
+	message bytes.Buffer
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	h := ew.Header()
+	// http.Error marks its bodies as nosniff plain text
+	if status >= 400 && strings.HasPrefix(h.Get("Content-Type"), "text/plain") && h.Get("X-Content-Type-Options") == "nosniff" &&
+		(ew.templates[status] != nil || wantsJSON(ew.r)) {
+		ew.status = status
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorPageWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.status != 0 {
+		if room := maxErrorMessage - ew.message.Len(); room > 0 {
+			ew.message.Write(p[:min(len(p), room)])
+		}
+		return len(p), nil
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+// ReadFrom passes bodies that aren't held back straight through, keeping
+// sendfile available.
+func (ew *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.status != 0 {
+		return io.Copy(writerOnly{ew}, src)
+	}
+	return io.Copy(ew.ResponseWriter, src)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// render writes the held-back error as JSON or through its template, falling
+// back to the original message if the template fails.
+func (ew *errorPageWriter) render() {
+	data := errorPageData{
+		Status:     ew.status,
+		StatusText: http.StatusText(ew.status),
+		Message:    strings.TrimSpace(ew.message.String()),
+		Path:       ew.r.URL.Path,
+		RequestID:  requestIDOf(ew.r),
+	}
+	h := ew.Header()
+	h.Del("Content-Length")
+
+	if wantsJSON(ew.r) {
+		h.Set("Content-Type", "application/json")
+		ew.ResponseWriter.WriteHeader(ew.status)
+		json.NewEncoder(ew.ResponseWriter).Encode(data)
+		return
+	}
+
+	var body bytes.Buffer
+	if err := ew.templates[ew.status].Execute(&body, data); err != nil {
+		log.Printf("Error rendering %d page for %s: %v", ew.status, data.Path, err)
+		ew.ResponseWriter.WriteHeader(ew.status)
+		ew.ResponseWriter.Write(ew.message.Bytes())
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(body.Bytes())
+}
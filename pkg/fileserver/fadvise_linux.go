@@ -0,0 +1,30 @@
+package fileserver
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseWillNeed asks the kernel to start reading the first length bytes of f
+// (0 = all of it) into the page cache, so a hedged second read finds them there.
+func adviseWillNeed(f *os.File, length int64) {
+	fadvise(f, length, unix.FADV_WILLNEED)
+}
+
+// adviseDontNeed drops f from the page cache once its contents are held in
+// memory or it was streamed as a one-off, so it doesn't evict hotter pages.
+func adviseDontNeed(f *os.File) {
+	fadvise(f, 0, unix.FADV_DONTNEED)
+}
+
+func fadvise(f *os.File, length int64, advice int) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	// Advice is only a hint; failures (e.g. on pipes) are ignored
+	conn.Control(func(fd uintptr) {
+		unix.Fadvise(int(fd), 0, length, advice)
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package fileserver
+
+import "os"
+
+// adviseWillNeed is a no-op where posix_fadvise isn't available.
+func adviseWillNeed(f *os.File, length int64) {}
+
+// adviseDontNeed is a no-op where posix_fadvise isn't available.
+func adviseDontNeed(f *os.File) {}
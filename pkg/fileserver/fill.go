@@ -0,0 +1,215 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// canStreamFill reports whether a cache miss of filePath may be streamed to
+// r while it is read: -streamMissMinSize is on and the response needs nothing
+// computed over the whole file, i.e. neither checksums nor compression.
+func (h *FileHandler) canStreamFill(r *http.Request, cfg *Config, filePath string) bool {
+	if cfg.StreamMissMinSize <= 0 || cfg.Checksums {
+		return false
+	}
+	// Byte ranges are only served from the identity representation
+	if len(cfg.Compress) == 0 || r.Header.Get("Range") != "" {
+		return true
+	}
+	if ctype := mimeTypeFor(cfg, filePath); ctype != "" && !isCompressibleType(ctype, cfg.CompressTypes) {
+		return true
+	}
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Compress) == ""
+}
+
+// serveFill serves a file as it is read into the cache. Range requests wait
+// only for the bytes they ask for.
+func (h *FileHandler) serveFill(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string, filling *fillBuffer) {
+	name := filepath.Base(filePath)
+	// Without a known extension, ServeContent sniffs the type from the first bytes
+	ctype := mimeTypeFor(cfg, name)
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if len(cfg.Compress) > 0 && (ctype == "" || isCompressibleType(ctype, cfg.CompressTypes)) {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	setCacheControl(w, cfg, urlPath)
+	setDiagnosticHeaders(w, r, cfg)
+
+	span := startSpan(r.Context(), "serve")
+	span.SetAttr("serve.bytes", filling.size)
+	span.SetAttr("serve.streamed", true)
+	http.ServeContent(w, r, name, time.Time{}, filling.reader())
+	span.End()
+}
+
+// fetchShared runs fetch for filePath through singleflight, as every cache
+// fill of it does, streaming the disk read into a fillBuffer that all callers
+// get, so clients joining a read in progress can follow it too rather than
+// wait for it to complete. The buffer is nil with -streamMissMinSize off.
+//
+// The buffer is registered before the caller knows whether its fetch will
+// run or join another, so a buffer whose read never started may outlive its
+// call; the next fill of filePath picks it up.
+func (h *FileHandler) fetchShared(cfg *Config, urlPath, filePath string, span *Span) (<-chan singleflight.Result, *fillBuffer) {
+	h.fillMu.Lock()
+	filling, ok := h.fills[filePath]
+	if !ok && cfg.StreamMissMinSize > 0 {
+		filling = newFillBuffer()
+		h.fills[filePath] = filling
+	}
+	h.fillMu.Unlock()
+
+	results := h.sfGroup.DoChan(filePath, func() (interface{}, error) {
+		result, err := h.fetch(cfg, urlPath, filePath, span, filling)
+		if filling != nil {
+			// Unregistered before singleflight forgets the call, so later
+			// callers never attach to a finished fill
+			h.fillMu.Lock()
+			if h.fills[filePath] == filling {
+				delete(h.fills, filePath)
+			}
+			h.fillMu.Unlock()
+			filling.finish(err)
+		}
+		return result, err
+	})
+	return results, filling
+}
+
+// readyOf returns a channel closed once filling can be streamed, or nil,
+// which blocks forever, if there is nothing to stream.
+func readyOf(filling *fillBuffer) <-chan struct{} {
+	if filling == nil {
+		return nil
+	}
+	return filling.ready
+}
+
+// fillBuffer is a cache fill in progress: the file's contents as far as they
+// have been read, which a client can stream (see reader) while the read goes
+// on. Hedged attempts all write to the same buffer, each only adding the bytes
+// past what the leading attempt already has, so a client keeps streaming from
+// whichever attempt is ahead.
+type fillBuffer struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	size  int64 // from Stat when the read started
+	data  []byte
+	done  bool
+	err   error
+	ready chan struct{} // closed by start
+}
+
+func newFillBuffer() *fillBuffer {
+	f := &fillBuffer{ready: make(chan struct{})}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// start makes the fill available to stream once the file turned out to be
+// size bytes. Only the first call has an effect.
+func (f *fillBuffer) start(size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.ready:
+		return
+	default:
+	}
+	f.size = size
+	f.data = make([]byte, 0, size)
+	close(f.ready)
+}
+
+// started reports whether start was called.
+func (f *fillBuffer) started() bool {
+	select {
+	case <-f.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// write records that the file holds p at offset, keeping whatever part of it
+// lies past the data read so far.
+func (f *fillBuffer) write(offset int64, p []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	if end := offset + int64(len(p)); end > int64(len(f.data)) && offset <= int64(len(f.data)) {
+		f.data = append(f.data, p[int64(len(f.data))-offset:]...)
+		f.cond.Broadcast()
+	}
+}
+
+// finish ends the fill with its outcome, waking clients waiting for data.
+func (f *fillBuffer) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	f.done, f.err = true, err
+	f.cond.Broadcast()
+}
+
+// bytes returns the data read so far; the whole file once finished successfully.
+func (f *fillBuffer) bytes() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data
+}
+
+// reader returns a reader over the file that blocks until the bytes it is
+// asked for have been read. It seeks within the size given to start.
+func (f *fillBuffer) reader() io.ReadSeeker {
+	return &fillReader{f: f}
+}
+
+type fillReader struct {
+	f   *fillBuffer
+	off int64
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r.off >= int64(len(f.data)) && !f.done {
+		f.cond.Wait()
+	}
+	if r.off < int64(len(f.data)) {
+		n := copy(p, f.data[r.off:])
+		r.off += int64(n)
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 0, io.EOF
+}
+
+func (r *fillReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("fillReader: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
@@ -0,0 +1,443 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes returned by the file service.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcOutOfRange         = 11
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+const (
+	grpcServicePrefix = "/fileserver.v1.FileService/"
+	// grpcMaxMessage bounds request messages, like gRPC's own default.
+	grpcMaxMessage   = 4 << 20
+	grpcDefaultChunk = 64 << 10
+	grpcMaxChunk     = 1 << 20
+)
+
+// grpcError is a failure with an explicit gRPC status.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// GRPCService serves the FileService of fileserver.proto over HTTP/2. Files
+// go through the same cache, peers and hedged reads as HTTP downloads. The
+// protobuf messages are small enough to encode by hand, which keeps the gRPC
+// and protobuf runtimes out of the binary.
+type GRPCService struct {
+	h     *FileHandler
+	token string
+}
+
+func NewGRPCService(h *FileHandler, token string) *GRPCService {
+	return &GRPCService{h: h, token: token}
+}
+
+func (s *GRPCService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "This port only serves gRPC", http.StatusUnsupportedMediaType)
+		return
+	}
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	code, msg := grpcOK, ""
+	if err := s.call(w, r); err != nil {
+		code, msg = grpcStatusOf(r, err)
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(msg))
+	}
+}
+
+// call decodes the request message and dispatches it to the method.
+func (s *GRPCService) call(w http.ResponseWriter, r *http.Request) error {
+	method, ok := strings.CutPrefix(r.URL.Path, grpcServicePrefix)
+	if !ok {
+		return grpcErrorf(grpcUnimplemented, "unknown service %s", r.URL.Path)
+	}
+	if s.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			return grpcErrorf(grpcUnauthenticated, "missing or invalid bearer token")
+		}
+	}
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	varints, strs, err := pbDecode(req)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "malformed request: %v", err)
+	}
+
+	cfg := s.h.cfg.Load()
+	urlPath, filePath, err := s.resolve(cfg, string(strs[1]))
+	if err != nil {
+		return err
+	}
+	switch method {
+	case "GetFile":
+		return s.getFile(w, r, cfg, urlPath, filePath, int64(varints[2]), int64(varints[3]), int64(int32(varints[4])))
+	case "Stat":
+		info, err := s.h.storage.Stat(s.h.storageName(filePath))
+		if err != nil {
+			return err
+		}
+		return writeGRPCMessage(w, fileInfoMessage(cfg, path.Base(urlPath), info.Size(), info.ModTime(), info.IsDir()))
+	case "List":
+		return s.list(w, cfg, urlPath, filePath)
+	case "Purge":
+		if s.token == "" {
+			return grpcErrorf(grpcPermissionDenied, "Purge requires -grpcToken")
+		}
+		purged := s.h.cache.Delete(filePath)
+		if varints[2] != 0 {
+			s.h.invalidateTree(filePath)
+		} else {
+			s.h.invalidate(filePath)
+		}
+		log.Printf("gRPC: purged %s from cache", urlPath)
+		return writeGRPCMessage(w, pbAppendBool(nil, 1, purged))
+	default:
+		return grpcErrorf(grpcUnimplemented, "unknown method %s", method)
+	}
+}
+
+// resolve applies the same path checks as HTTP requests, except ACLs, which
+// are tied to HTTP authentication.
+func (s *GRPCService) resolve(cfg *Config, p string) (urlPath, filePath string, err error) {
+	urlPath = path.Clean("/" + p)
+	if isInternalPath(urlPath) || isHiddenPath(cfg, urlPath) {
+		return "", "", grpcErrorf(grpcNotFound, "%s not found", urlPath)
+	}
+	filePath = filepath.Join(s.h.baseDir, filepath.FromSlash(urlPath))
+	if !s.h.symlinkAllowed(cfg, filePath) {
+		return "", "", grpcErrorf(grpcPermissionDenied, "%s is outside the served directory", urlPath)
+	}
+	return urlPath, filePath, nil
+}
+
+// getFile streams length bytes (0 = all) from offset in chunks of chunkSize.
+func (s *GRPCService) getFile(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string, offset, length, chunkSize int64) error {
+	if offset < 0 || length < 0 || chunkSize < 0 {
+		return grpcErrorf(grpcInvalidArgument, "offset, length and chunk_size must not be negative")
+	}
+	if chunkSize == 0 {
+		chunkSize = grpcDefaultChunk
+	}
+	chunkSize = min(chunkSize, grpcMaxChunk)
+	if urlPath == "/" {
+		return errIsDirectory
+	}
+
+	data, err := s.h.load(withRequestInfo(r), cfg, urlPath, filePath)
+	var src io.ReaderAt
+	var size int64
+	switch {
+	case err == nil:
+		src, size = readerAtBytes(data), int64(len(data))
+	case errors.Is(err, errTooLargeToCache):
+		// Stream it straight from storage, as HTTP does
+		file, err := s.h.storage.Open(s.h.storageName(filePath))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		src, size = file, info.Size()
+	default:
+		return err
+	}
+
+	if offset > size {
+		return grpcErrorf(grpcOutOfRange, "offset %d is beyond the end of the file (%d bytes)", offset, size)
+	}
+	end := size
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+	buf := make([]byte, chunkSize)
+	for pos := offset; pos < end; {
+		n, err := src.ReadAt(buf[:min(chunkSize, end-pos)], pos)
+		if n > 0 {
+			msg := pbAppendInt(nil, 1, pos)
+			msg = pbAppendBytes(msg, 2, buf[:n])
+			if err := writeGRPCMessage(w, msg); err != nil {
+				return err
+			}
+			pos += int64(n)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF && pos < end {
+			return grpcErrorf(grpcInternal, "%s shrank while being read", urlPath)
+		}
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GRPCService) list(w http.ResponseWriter, cfg *Config, urlPath, dirPath string) error {
+	info, err := s.h.storage.Stat(s.h.storageName(dirPath))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return grpcErrorf(grpcFailedPrecondition, "%s is not a directory", urlPath)
+	}
+	entries, err := s.h.readDirEntries(cfg, urlPath, dirPath)
+	if err != nil {
+		return err
+	}
+	sortDirEntries(entries, "name", false)
+	var msg []byte
+	for _, e := range entries {
+		msg = pbAppendMessage(msg, 1, fileInfoMessage(cfg, e.Name, e.Size, e.ModTime, e.Type == "dir"))
+	}
+	return writeGRPCMessage(w, msg)
+}
+
+// fileInfoMessage encodes a FileInfo.
+func fileInfoMessage(cfg *Config, name string, size int64, modTime time.Time, isDir bool) []byte {
+	msg := pbAppendString(nil, 1, name)
+	if !isDir {
+		msg = pbAppendInt(msg, 2, size)
+	}
+	msg = pbAppendInt(msg, 3, modTime.UnixNano())
+	msg = pbAppendBool(msg, 4, isDir)
+	if !isDir {
+		msg = pbAppendString(msg, 5, mimeTypeFor(cfg, name))
+	}
+	return msg
+}
+
+// grpcStatusOf maps an error from a method to a gRPC status code and message.
+func grpcStatusOf(r *http.Request, err error) (int, string) {
+	var ge *grpcError
+	switch {
+	case errors.As(err, &ge):
+		return ge.code, ge.msg
+	case os.IsNotExist(err):
+		return grpcNotFound, "not found"
+	case errors.Is(err, errIsDirectory):
+		return grpcFailedPrecondition, "is a directory"
+	case os.IsPermission(err):
+		return grpcPermissionDenied, "permission denied"
+	case errors.Is(err, errReadQueueFull):
+		return grpcUnavailable, "too many concurrent reads"
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded, "deadline exceeded"
+	case errors.Is(err, context.Canceled):
+		return grpcCanceled, "canceled"
+	default:
+		log.Printf("gRPC %s failed: %v", r.URL.Path, err)
+		return grpcInternal, "internal error"
+	}
+}
+
+// grpcEncodeMessage percent-encodes a status message as the gRPC spec requires.
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses a grpc-timeout header such as "250m" or "5S".
+func parseGRPCTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// readGRPCMessage reads the single length-prefixed message of a unary or
+// server-streaming call.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading request: %v", err)
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "request of %d bytes exceeds %d", n, grpcMaxMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading request: %v", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage sends one uncompressed message and flushes it to the client.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+type readerAtBytes []byte
+
+func (b readerAtBytes) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Protobuf wire format, limited to what fileserver.proto needs. Fields with
+// their zero value are omitted, as in proto3.
+
+func pbAppendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func pbAppendInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(pbAppendTag(b, field, 0), uint64(v))
+}
+
+func pbAppendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return pbAppendInt(b, field, 1)
+}
+
+func pbAppendBytes(b []byte, field int, data []byte) []byte {
+	if len(data) == 0 {
+		return b
+	}
+	return pbAppendMessage(b, field, data)
+}
+
+func pbAppendString(b []byte, field int, s string) []byte {
+	return pbAppendBytes(b, field, []byte(s))
+}
+
+// pbAppendMessage appends a length-delimited field even if it is empty, as
+// repeated message elements must be.
+func pbAppendMessage(b []byte, field int, msg []byte) []byte {
+	b = binary.AppendUvarint(pbAppendTag(b, field, 2), uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// pbDecode splits a flat message into its varint and length-delimited fields
+// by number. Later occurrences win; fixed-size fields are skipped.
+func pbDecode(b []byte) (varints map[int]uint64, strs map[int][]byte, err error) {
+	varints = make(map[int]uint64)
+	strs = make(map[int][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errors.New("bad tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, nil, errors.New("bad varint")
+			}
+			varints[field] = v
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return nil, nil, errors.New("bad length")
+			}
+			strs[field] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			b = b[4:]
+		default:
+			return nil, nil, fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return varints, strs, nil
+}
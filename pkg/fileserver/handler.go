@@ -0,0 +1,1081 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type FileHandler struct {
+	baseDir string
+	// realBase is baseDir with symlinks resolved, or empty if that failed at startup.
+	realBase string
+	// storage is what files are read from; writes always go to baseDir.
+	storage Storage
+	cache   *MemoryCache
+	sfGroup singleflight.Group
+	reads   *readSlots
+	readMem *readMemory
+	// fills holds the buffers of the cache fills in progress (see fetchShared).
+	fills  map[string]*fillBuffer
+	fillMu sync.Mutex
+
+	// peers, if set, owns the cache fills of files assigned to other instances.
+	peers *PeerPool
+	// tier, if set, is a cache shared with other instances behind this one's memory.
+	tier CacheTier
+
+	// mirrorNext rotates hedged reads over the configured mirror directories.
+	mirrorNext atomic.Uint64
+	// speeds feeds the adaptive hedging threshold.
+	speeds *speedHistory
+	// hot tracks popular files for the prefetcher.
+	hot *hotFiles
+	// pins maps the file paths pinned in the cache to their URL paths.
+	pins  map[string]string
+	pinMu sync.Mutex
+	// prefetchWake triggers a prefetch pass ahead of schedule.
+	prefetchWake chan struct{}
+	// chunkLocks maps staged chunked uploads to their *chunkLock.
+	chunkLocks sync.Map
+	// quotas tracks usage against -quotas.
+	quotas *Quotas
+
+	// hooks is the chain registered with Use.
+	hooks  atomic.Pointer[[]Hooks]
+	hookMu sync.Mutex
+
+	// cfg holds the hot-reloadable settings (thresholds, path rules).
+	cfg atomic.Pointer[Config]
+
+	// ctx parents all detached disk reads so Close can abort them on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewFileHandler returns an http.Handler serving the files in storage through
+// cache with hedged reads. Close it to abort reads still in flight.
+func NewFileHandler(cfg *Config, cache *MemoryCache, storage Storage) *FileHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &FileHandler{
+		baseDir: cfg.Dir,
+		storage: storage,
+		cache:   cache,
+		reads:   newReadSlots(cfg.MaxConcurrentReads),
+		readMem: newReadMemory(cfg.MaxReadMemory),
+		speeds:  newSpeedHistory(),
+		hot:     newHotFiles(),
+		pins:    make(map[string]string),
+		fills:   make(map[string]*fillBuffer),
+		quotas:  NewQuotas(cfg.Dir),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	h.prefetchWake = make(chan struct{}, 1)
+	h.realBase, _ = realPath(cfg.Dir)
+	h.cfg.Store(cfg)
+	h.applyPins(nil, cfg)
+	return h
+}
+
+// Reload swaps in new settings for subsequent requests. The serving
+// directory is fixed at construction and is not affected.
+func (h *FileHandler) Reload(cfg *Config) {
+	h.applyPins(h.cfg.Load(), cfg)
+	h.cfg.Store(cfg)
+	h.reads.setLimit(cfg.MaxConcurrentReads)
+	h.readMem.setLimit(cfg.MaxReadMemory)
+}
+
+// Close cancels all outstanding disk reads. Requests waiting on them fail.
+func (h *FileHandler) Close() {
+	h.cancel()
+}
+
+func (h *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := h.cfg.Load()
+	r = withRequestInfo(r)
+
+	// Clean path and prevent directory traversal
+	cleanPath, err := requestPath(cfg, r)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if chain := h.hookChain(); chain != nil {
+		h.serveWithHooks(w, r, cfg, cleanPath, chain)
+		return
+	}
+	h.serve(w, r, cfg, cleanPath, nil)
+}
+
+// serve answers a request for cleanPath, running the Pre hooks of chain.
+func (h *FileHandler) serve(w http.ResponseWriter, r *http.Request, cfg *Config, cleanPath string, chain []Hooks) {
+	// Trash and in-progress uploads are never reachable over HTTP
+	if isInternalPath(cleanPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, hooks := range chain {
+		if hooks.PreAuth != nil && !hooks.PreAuth(w, r, cleanPath) {
+			return
+		}
+	}
+
+	if isHiddenPath(cfg, cleanPath) {
+		http.Error(w, http.StatusText(cfg.HiddenStatus), cfg.HiddenStatus)
+		return
+	}
+
+	if !h.checkACL(w, r, cfg, cleanPath) {
+		return
+	}
+	// Signed-URL mode: reject before touching the disk or cache
+	signedRefresh := false
+	if cfg.SignKey != "" && r.Method == http.MethodGet {
+		query, now := r.URL.Query(), time.Now()
+		if query.Get("refresh") == "1" && verifySignedURL(cfg.SignKey, refreshSignedPath(cleanPath), query, now) == nil {
+			signedRefresh = true
+		} else if err := verifySignedURL(cfg.SignKey, cleanPath, query, now); err != nil {
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if !h.symlinkAllowed(cfg, filepath.Join(h.baseDir, cleanPath)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if cleanPath == "/" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else if h.authorizeWrite(w, r, cfg) {
+			h.handlePut(w, r, cfg, cleanPath)
+		}
+		return
+	case http.MethodPost:
+		if h.authorizeWrite(w, r, cfg) {
+			h.handlePost(w, r, cfg, cleanPath)
+		}
+		return
+	case http.MethodDelete:
+		if cleanPath == "/" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else if h.authorizeWrite(w, r, cfg) {
+			h.handleDelete(w, r, cfg, cleanPath)
+		}
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, rule := range cfg.Headers {
+		if matchPath(rule.Pattern, cleanPath) {
+			w.Header().Set(rule.Name, rule.Value)
+		}
+	}
+
+	r = withCacheDirective(r, cfg, cleanPath, signedRefresh)
+
+	for _, hooks := range chain {
+		if hooks.PreRead != nil && !hooks.PreRead(w, r, cleanPath) {
+			return
+		}
+	}
+
+	filePath := filepath.Join(h.baseDir, cleanPath)
+
+	if cleanPath != "/" && !h.checkTrailingSlash(w, r, cfg, filePath) {
+		return
+	}
+	if len(cfg.Quotas) > 0 && r.URL.Query().Has("quota") {
+		h.serveQuota(w, r, cfg, cleanPath, filePath)
+		return
+	}
+	if cleanPath == "/" {
+		h.serveDirectory(w, r, cfg, cleanPath, filePath)
+		return
+	}
+
+	if cfg.Checksums && r.URL.Query().Get("checksum") == "1" {
+		h.serveChecksum(w, r, cfg, cleanPath, filePath)
+		return
+	}
+	if cfg.Zsync && r.URL.Query().Has("zsync") {
+		h.serveZsync(w, r, cfg, cleanPath, filePath)
+		return
+	}
+	if cfg.Thumbnails && wantsThumbnail(r, cfg, cleanPath) {
+		h.serveThumbnail(w, r, cfg, cleanPath, filePath)
+		return
+	}
+
+	// Prefer a precompressed sibling (foo.js.br) when the client accepts it
+	if cfg.Precompressed && r.Header.Get("Range") == "" {
+		addVary(w.Header(), "Accept-Encoding")
+		if h.servePrecompressed(w, r, cfg, cleanPath, filePath) {
+			return
+		}
+	}
+
+	data, filling, err := h.loadStreaming(r, cfg, cleanPath, filePath, h.canStreamFill(r, cfg, filePath))
+	if err != nil {
+		if os.IsNotExist(err) && cfg.OriginURL != "" {
+			h.serveFromOrigin(w, r, cfg, cleanPath, filePath)
+		} else if os.IsNotExist(err) {
+			h.notFound(w, r, cfg, cleanPath)
+		} else if errors.Is(err, errTooLargeToCache) && r.Header.Get("Range") != "" {
+			h.serveBlocks(w, r, cfg, cleanPath, filePath)
+		} else if errors.Is(err, errTooLargeToCache) {
+			h.serveStream(w, r, cfg, cleanPath, filePath)
+		} else if errors.Is(err, errIsDirectory) {
+			h.serveDirectory(w, r, cfg, cleanPath, filePath)
+		} else {
+			serveReadError(w, r, cleanPath, err)
+		}
+		return
+	}
+	if filling != nil {
+		h.serveFill(w, r, cfg, cleanPath, filePath, filling)
+		return
+	}
+
+	// Serve the buffer
+	h.serveBytes(w, r, cfg, cleanPath, filePath, data)
+}
+
+// checkACL applies the first matching ACL rule to urlPath, answering 403 for
+// denied paths and 401 for auth-only paths requested without credentials.
+func (h *FileHandler) checkACL(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string) bool {
+	switch aclError(r, cfg, urlPath) {
+	case errForbidden:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	case errUnauthorized:
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+var (
+	errForbidden    = errors.New("forbidden by ACL")
+	errUnauthorized = errors.New("authentication required by ACL")
+)
+
+// aclError is checkACL for code that reports failures through writeError.
+func aclError(r *http.Request, cfg *Config, urlPath string) error {
+	switch aclAction(cfg, urlPath) {
+	case ACLDeny:
+		return errForbidden
+	case ACLAuth:
+		if !isAuthenticated(r) {
+			return errUnauthorized
+		}
+	}
+	return nil
+}
+
+// notFound answers a request for a missing path. For single-page applications,
+// extensionless paths (client-side routes) get the configured fallback file instead.
+func (h *FileHandler) notFound(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string) {
+	if cfg.SPAFallback != "" && path.Ext(urlPath) == "" {
+		fallbackURL := path.Clean("/" + cfg.SPAFallback)
+		fallbackPath := filepath.Join(h.baseDir, fallbackURL)
+		data, err := h.load(r, cfg, fallbackURL, fallbackPath)
+		if err == nil {
+			h.serveBytes(w, r, cfg, fallbackURL, fallbackPath, data)
+			return
+		}
+		logf(r, "Error reading SPA fallback %s: %v", fallbackURL, err)
+	}
+	http.NotFound(w, r)
+}
+
+// errTooLargeToCache is returned by load for files that exceed the cacheable
+// item size; they are streamed from disk instead.
+var errTooLargeToCache = errors.New("file too large to cache")
+
+// maxItemBytes is the largest file load will read into memory: the configured
+// -maxCacheItemBytes, capped at what the cache could hold anyway.
+func (h *FileHandler) maxItemBytes(cfg *Config) int64 {
+	limit := h.cache.MaxItemBytes()
+	if cfg.MaxCacheItemBytes > 0 && cfg.MaxCacheItemBytes < limit {
+		return cfg.MaxCacheItemBytes
+	}
+	return limit
+}
+
+// serveStream serves a file straight from disk without buffering or caching it,
+// for files too large for the cache.
+func (h *FileHandler) serveStream(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) {
+	setCacheStatus(r, CacheBypass)
+	file, err := h.storage.Open(h.storageName(filePath))
+	if err != nil {
+		serveReadError(w, r, urlPath, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		serveReadError(w, r, urlPath, err)
+		return
+	}
+	// Without a known extension, ServeContent sniffs the type from the first bytes
+	if ctype := mimeTypeFor(cfg, filePath); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	setCacheControl(w, cfg, urlPath)
+	setDiagnosticHeaders(w, r, cfg)
+	// Hashing a huge file would hold up the response; only use checksums
+	// already computed by a ?checksum=1 request
+	if cfg.Checksums {
+		if packed, ok := h.cache.Get(streamChecksumKey(filePath, info)); ok {
+			if sums, ok := unpackChecksums(packed); ok {
+				setDigestHeaders(w, r, sums)
+			}
+		}
+	}
+	http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), file)
+	if osFile, ok := file.(*os.File); ok && cfg.FadviseDontNeed {
+		adviseDontNeed(osFile)
+	}
+}
+
+// serveReadError answers a failed read: 503 when the disk read queue is
+// saturated so clients back off, 500 for anything else.
+func serveReadError(w http.ResponseWriter, r *http.Request, urlPath string, err error) {
+	if errors.Is(err, errReadQueueFull) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	logf(r, "Error reading file %s: %v", urlPath, err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// load returns the contents of filePath from the cache or, on a miss, from disk
+// through a singleflight-coalesced hedged read whose result is then cached.
+func (h *FileHandler) load(r *http.Request, cfg *Config, urlPath, filePath string) ([]byte, error) {
+	data, _, err := h.loadStreaming(r, cfg, urlPath, filePath, false)
+	return data, err
+}
+
+// loadStreaming is load, except that with stream set a cache miss this request
+// reads from disk may return the read in progress instead of the contents,
+// once the file turns out to be at least -streamMissMinSize bytes. The read
+// still completes and is cached if the client goes away.
+func (h *FileHandler) loadStreaming(r *http.Request, cfg *Config, urlPath, filePath string, stream bool) ([]byte, *fillBuffer, error) {
+	if cfg.PrefetchThreshold > 0 && h.peerOwner(r, urlPath) == "" {
+		h.hot.record(cfg, urlPath, filePath)
+	}
+	if directive := cacheDirectiveOf(r); directive != cacheUse {
+		data, err := h.loadFresh(r, cfg, urlPath, filePath, directive)
+		return data, nil, err
+	}
+
+	// Check cache first. Recently expired entries are still served while a
+	// background read refreshes them.
+	timing := timingOf(r)
+	start := time.Now()
+	span := startSpan(r.Context(), "cache.lookup")
+	data, stored, stale, ok := h.cache.GetStale(filePath)
+	span.SetAttr("cache.hit", ok)
+	span.End()
+	timing.Cache = time.Since(start)
+	if ok {
+		timing.Age = time.Since(stored)
+		if stale {
+			setCacheStatus(r, CacheStale)
+			h.revalidate(cfg, urlPath, filePath)
+		} else {
+			setCacheStatus(r, CacheHit)
+		}
+		return data, nil, nil
+	}
+	if cfg.NegativeCacheTTL > 0 && h.cache.IsNegative(filePath) {
+		setCacheStatus(r, CacheHit)
+		return nil, nil, &os.PathError{Op: "open", Path: filePath, Err: os.ErrNotExist}
+	}
+
+	// Files owned by another instance are fetched from its cache, not stored here
+	if peer := h.peerOwner(r, urlPath); peer != "" {
+		start = time.Now()
+		data, err := h.loadFromPeer(cfg, peer, urlPath, filePath)
+		timing.Read = time.Since(start)
+		if !errors.Is(err, errPeerUnavailable) {
+			if err == nil {
+				setCacheStatus(r, CachePeer)
+			} else if cfg.NegativeCacheTTL > 0 && os.IsNotExist(err) {
+				h.cache.SetNegative(filePath, cfg.NegativeCacheTTL)
+			}
+			return data, nil, err
+		}
+	}
+
+	// Use singleflight to prevent cache stampedes
+	start = time.Now()
+	span = startSpan(r.Context(), "singleflight.wait")
+	results, filling := h.fetchShared(cfg, urlPath, filePath, span)
+	if !stream {
+		filling = nil
+	}
+	var res singleflight.Result
+	select {
+	case res = <-results:
+	case <-readyOf(filling):
+		// The read is on its way, whether this request started it or joined
+		// it; the response follows it while the fill is finished and cached
+		// in the background
+		timing.Read = time.Since(start)
+		setCacheStatus(r, CacheMiss)
+		go func() {
+			res := <-results
+			span.SetAttr("singleflight.shared", res.Shared)
+			span.SetError(res.Err)
+			span.End()
+			recordSingleflight(res.Shared, timing.Read)
+			if res.Err == nil {
+				h.store(cfg, urlPath, filePath, res.Val.(*readResult).data)
+			}
+		}()
+		return nil, filling, nil
+	}
+	val, err, shared := res.Val, res.Err, res.Shared
+	span.SetAttr("singleflight.shared", shared)
+	span.SetError(err)
+	span.End()
+	timing.Read = time.Since(start)
+	recordSingleflight(shared, timing.Read)
+	if err != nil {
+		if cfg.NegativeCacheTTL > 0 && os.IsNotExist(err) {
+			h.cache.SetNegative(filePath, cfg.NegativeCacheTTL)
+		}
+		return nil, nil, err
+	}
+
+	result := val.(*readResult)
+	timing.Hedge = result.hedgeDelay
+	timing.Queue = result.queueWait
+	switch {
+	case result.shared:
+		setCacheStatus(r, CacheShared)
+	case result.hedged:
+		setCacheStatus(r, CacheHedged)
+	default:
+		setCacheStatus(r, CacheMiss)
+	}
+
+	// Cache the result
+	h.store(cfg, urlPath, filePath, result.data)
+	return result.data, nil, nil
+}
+
+// fetch reads filePath from the cache tier or from disk for the cache, using
+// the hedging settings for urlPath. It runs inside singleflight, detached from the original request to
+// ensure the read is completed and cached even if the first caller disconnects.
+// It still derives from the handler's context so shutdown can abort it. The
+// reads are traced under span, the leading caller's wait, if it is sampled.
+// A disk read is streamed into filling, if set (see doRead).
+func (h *FileHandler) fetch(cfg *Config, urlPath, filePath string, span *Span, filling *fillBuffer) (*readResult, error) {
+	name := h.storageName(filePath)
+	if data, ok := h.tierGet(name); ok {
+		return &readResult{data: data, shared: true}, nil
+	}
+	result, err := h.read(cfg, urlPath, filePath, span, filling)
+	if err == nil {
+		h.tierFill(cfg, name, result.data)
+	}
+	return result, err
+}
+
+// read is fetch without the cache tier: a hedged disk read in a read slot.
+func (h *FileHandler) read(cfg *Config, urlPath, filePath string, span *Span, filling *fillBuffer) (*readResult, error) {
+	cfg = hedgeConfigFor(cfg, urlPath)
+	bgCtx, cancel := context.WithTimeout(h.ctx, cfg.ReadDeadline)
+	defer cancel()
+	if span != nil {
+		bgCtx = contextWithSpan(bgCtx, span)
+	}
+
+	queued := span.Child("read.queue")
+	start := time.Now()
+	err := h.acquireRead(bgCtx, cfg)
+	queued.SetError(err)
+	queued.End()
+	if err != nil {
+		return nil, err
+	}
+	defer h.reads.release()
+	queueWait := time.Since(start)
+
+	result, err := h.readHedged(bgCtx, cfg, filePath, h.maxItemBytes(cfg), filling)
+	if err != nil {
+		return nil, err
+	}
+	result.queueWait = queueWait
+	return result, nil
+}
+
+// loadFresh reads filePath from disk past the memory cache and the cache tier,
+// for requests that refresh or bypass the cache (see withCacheDirective). A
+// refresh replaces the cached copies with what it read; a bypass leaves them
+// alone, as does a refresh of a file owned by a peer.
+func (h *FileHandler) loadFresh(r *http.Request, cfg *Config, urlPath, filePath string, directive cacheDirective) ([]byte, error) {
+	if directive == cacheRefresh && h.peerOwner(r, urlPath) != "" {
+		directive = cacheBypass
+	}
+	timing := timingOf(r)
+	start := time.Now()
+	span := startSpan(r.Context(), "singleflight.wait")
+	// Kept apart from cache fills, which may be answered by the cache tier
+	val, err, shared := h.sfGroup.Do(VariantKey(filePath, "fresh"), func() (interface{}, error) {
+		return h.read(cfg, urlPath, filePath, span, nil)
+	})
+	span.SetAttr("singleflight.shared", shared)
+	span.SetError(err)
+	span.End()
+	timing.Read = time.Since(start)
+	recordSingleflight(shared, timing.Read)
+	if err == nil {
+		timing.Hedge = val.(*readResult).hedgeDelay
+		timing.Queue = val.(*readResult).queueWait
+	}
+
+	if directive == cacheBypass {
+		setCacheStatus(r, CacheBypass)
+		if err != nil {
+			return nil, err
+		}
+		return val.(*readResult).data, nil
+	}
+	setCacheStatus(r, CacheRefresh)
+	switch {
+	case err == nil:
+		data := val.(*readResult).data
+		h.store(cfg, urlPath, filePath, data)
+		h.tierFill(cfg, h.storageName(filePath), data)
+		return data, nil
+	case errors.Is(err, errNoReadMemory):
+		// Says nothing about the file
+	case os.IsNotExist(err), errors.Is(err, errTooLargeToCache), errors.Is(err, errIsDirectory):
+		// The cached copy no longer reflects the file
+		h.cache.Delete(filePath)
+	}
+	return nil, err
+}
+
+// revalidate refreshes a stale cache entry in the background. Concurrent
+// refreshes and cold loads of the same file share one read.
+func (h *FileHandler) revalidate(cfg *Config, urlPath, filePath string) {
+	go func() {
+		results, _ := h.fetchShared(cfg, urlPath, filePath, nil)
+		res := <-results
+		switch err := res.Err; {
+		case err == nil:
+			h.store(cfg, urlPath, filePath, res.Val.(*readResult).data)
+		case errors.Is(err, errNoReadMemory):
+			// Try again on a later request
+		case os.IsNotExist(err), errors.Is(err, errTooLargeToCache), errors.Is(err, errIsDirectory):
+			// The stale copy no longer reflects the file; stop serving it
+			h.cache.Delete(filePath)
+		default:
+			log.Printf("Error revalidating %s: %v", urlPath, err)
+		}
+	}()
+}
+
+// acquireRead waits up to ReadQueueTimeout for a disk read slot.
+func (h *FileHandler) acquireRead(ctx context.Context, cfg *Config) error {
+	if cfg.ReadQueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ReadQueueTimeout)
+		defer cancel()
+	}
+	if err := h.reads.acquire(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errReadQueueFull
+		}
+		return err
+	}
+	return nil
+}
+
+// servePrecompressed serves the first sidecar file (e.g. foo.js.br next to foo.js)
+// whose encoding the client accepts. It reports false if none was usable.
+func (h *FileHandler) servePrecompressed(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) bool {
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	for _, sidecar := range precompressedSidecars {
+		if negotiateEncoding(acceptEncoding, []string{sidecar.encoding}) == "" {
+			continue
+		}
+		data, err := h.load(r, cfg, urlPath+sidecar.ext, filePath+sidecar.ext)
+		if err != nil {
+			if !os.IsNotExist(err) && !errors.Is(err, errTooLargeToCache) {
+				logf(r, "Error reading %s%s: %v", urlPath, sidecar.ext, err)
+			}
+			continue
+		}
+
+		name := filepath.Base(filePath)
+		w.Header().Set("Content-Type", contentTypeFor(cfg, name, nil))
+		w.Header().Set("Content-Encoding", sidecar.encoding)
+		setCacheControl(w, cfg, urlPath)
+		setDiagnosticHeaders(w, r, cfg)
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+		return true
+	}
+	return false
+}
+
+// store caches data under key, honoring any per-path TTL override for urlPath.
+func (h *FileHandler) store(cfg *Config, urlPath, key string, data []byte) {
+	ttl, ok := ttlFor(cfg.CacheTTLRules, urlPath)
+	switch {
+	case shouldCacheCompressed(cfg, key, data):
+		if !ok {
+			ttl = cfg.CacheTTL
+		}
+		h.cache.SetCompressed(key, data, ttl)
+	case ok:
+		h.cache.SetWithTTL(key, data, ttl)
+	default:
+		h.cache.Set(key, data)
+	}
+}
+
+// shouldCacheCompressed reports whether data is worth keeping compressed in the
+// cache: -cacheCompress is on and the file is of a compressible type. Variants
+// are already encoded and stored as is.
+func shouldCacheCompressed(cfg *Config, key string, data []byte) bool {
+	if !cfg.CacheCompress || int64(len(data)) < cfg.CompressMinSize || strings.Contains(key, variantSep) {
+		return false
+	}
+	return isCompressibleType(contentTypeFor(cfg, filepath.Base(key), data), cfg.CompressTypes)
+}
+
+// hedgeConfigFor applies the first hedge rule matching urlPath to a copy of cfg.
+// A disabled rule zeroes the speed threshold so reads are never hedged.
+func hedgeConfigFor(cfg *Config, urlPath string) *Config {
+	for _, rule := range cfg.HedgeRules {
+		if !matchPath(rule.Pattern, urlPath) {
+			continue
+		}
+		c := *cfg
+		switch {
+		case rule.Disabled:
+			c.MinSpeedMbps, c.HedgePercentile = 0, 0
+		case rule.MinSpeedMbps > 0:
+			c.MinSpeedMbps, c.HedgePercentile = rule.MinSpeedMbps, 0
+		}
+		if rule.CheckTime > 0 {
+			c.CheckTime = rule.CheckTime
+		}
+		if rule.HedgedDelay > 0 {
+			c.HedgedDelay = rule.HedgedDelay
+		}
+		return &c
+	}
+	return cfg
+}
+
+// ttlFor returns the TTL of the first rule matching urlPath.
+func ttlFor(rules []TTLRule, urlPath string) (time.Duration, bool) {
+	for _, rule := range rules {
+		if matchPath(rule.Pattern, urlPath) {
+			return rule.TTL, true
+		}
+	}
+	return 0, false
+}
+
+// setCacheControl sets Cache-Control from the first -cacheControl rule matching
+// urlPath, plus Expires for HTTP/1.0 caches when the rule has a max-age.
+func setCacheControl(w http.ResponseWriter, cfg *Config, urlPath string) {
+	value := cacheControlFor(cfg.CacheControl, urlPath)
+	if value == "" {
+		return
+	}
+	w.Header().Set("Cache-Control", value)
+	if age, ok := maxAge(value); ok {
+		w.Header().Set("Expires", time.Now().Add(age).UTC().Format(http.TimeFormat))
+	}
+}
+
+func (h *FileHandler) serveBytes(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string, data []byte) {
+	name := filepath.Base(filePath)
+	// Set explicitly so ServeContent doesn't sniff a compressed body
+	contentType := contentTypeFor(cfg, name, data)
+	w.Header().Set("Content-Type", contentType)
+	setCacheControl(w, cfg, urlPath)
+	setDiagnosticHeaders(w, r, cfg)
+
+	// Derived variants of a bypassed read mustn't come from or go to the cache
+	bypass := cacheDirectiveOf(r) == cacheBypass
+	body := data
+	if len(cfg.Compress) > 0 && int64(len(data)) >= cfg.CompressMinSize && isCompressibleType(contentType, cfg.CompressTypes) {
+		addVary(w.Header(), "Accept-Encoding")
+		// Byte ranges are only served from the identity representation
+		if r.Header.Get("Range") == "" {
+			if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Compress); encoding != "" {
+				var compressed []byte
+				var err error
+				if bypass {
+					compressed, err = compressData(data, encoding)
+				} else {
+					compressed, err = h.compressedVariant(cfg, urlPath, filePath, data, encoding)
+				}
+				if err != nil {
+					logf(r, "Failed to %s-compress %s: %v", encoding, urlPath, err)
+				} else if len(compressed) < len(data) {
+					w.Header().Set("Content-Encoding", encoding)
+					body = compressed
+				}
+			}
+		}
+	}
+	if cfg.Checksums && w.Header().Get("Content-Encoding") == "" {
+		var sums fileChecksums
+		var err error
+		if bypass {
+			sums, err = checksumsOf(bytes.NewReader(data))
+		} else {
+			sums, err = h.dataChecksums(cfg, urlPath, filePath, data)
+		}
+		if err == nil {
+			setDigestHeaders(w, r, sums)
+		}
+	}
+
+	// We could use http.ServeContent to support Range requests properly
+	// By wrapping our byte slice in a bytes.Reader
+	seeker := bytes.NewReader(body)
+
+	// We don't have the original file modtime easily without an extra stat,
+	// but ServeContent will handle the range logic at least.
+	span := startSpan(r.Context(), "serve")
+	span.SetAttr("serve.bytes", len(body))
+	http.ServeContent(w, r, name, time.Time{}, seeker)
+	span.End()
+}
+
+// compressedVariant returns data encoded with encoding, compressing it at most
+// once per cached file and keeping the result as a cache variant.
+func (h *FileHandler) compressedVariant(cfg *Config, urlPath, filePath string, data []byte, encoding string) ([]byte, error) {
+	key := VariantKey(filePath, encoding)
+	if compressed, ok := h.cache.Get(key); ok {
+		return compressed, nil
+	}
+
+	val, err, _ := h.sfGroup.Do(key, func() (interface{}, error) {
+		compressed, err := compressData(data, encoding)
+		if err != nil {
+			return nil, err
+		}
+		h.store(cfg, urlPath, key, compressed)
+		return compressed, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
+
+// readResult is the value shared by all singleflight callers of readHedged.
+type readResult struct {
+	data       []byte
+	hedged     bool          // the first read was slow and a second, concurrent read won the race
+	hedgeDelay time.Duration // from the start of the read until the first hedged attempt, if any
+	queueWait  time.Duration // waiting for a read slot (-maxConcurrentReads)
+	shared     bool          // found in the cache tier; nothing was read from disk
+}
+
+// readAttempt is the outcome of one of the racing reads in readHedged.
+type readAttempt struct {
+	data   []byte
+	err    error
+	hedged bool
+}
+
+// readHedged implements the hedging read logic: every read but the last
+// allowed attempt is monitored, and once one falls below minSpeed within
+// checkTime another read (from the next mirror directory, if any) is started
+// after a delay while the slow ones keep going. The delay starts at hedgedDelay
+// and grows by hedgeBackoff for each further attempt, up to hedgeAttempts reads
+// in total. Whichever read finishes first wins and the others are cancelled.
+// All attempts stream into filling, if set.
+func (h *FileHandler) readHedged(ctx context.Context, cfg *Config, filePath string, maxBytes int64, filling *fillBuffer) (*readResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// Returning cancels the losing reads
+	defer cancel()
+
+	// Buffered so the losers can finish without a reader
+	results := make(chan readAttempt, cfg.HedgeAttempts)
+	slow := make(chan struct{}, cfg.HedgeAttempts)
+	launched, pending := 0, 0
+	start := time.Now()
+	var hedgeDelay time.Duration
+	name := h.storageName(filePath)
+	launch := func() {
+		attempt := launched
+		launched++
+		pending++
+		store := h.storage
+		if attempt == 1 {
+			hedgeDelay = time.Since(start)
+			readMetrics.hedged.Add(1)
+		}
+		if attempt > 0 {
+			store = h.hedgeStorage(cfg)
+			log.Printf("Read of %s is slow, hedging with attempt %d of %d from %v...",
+				name, attempt+1, cfg.HedgeAttempts, store)
+		}
+		var onSlow func()
+		if launched < cfg.HedgeAttempts {
+			onSlow = func() { slow <- struct{}{} }
+		}
+		span := startSpan(ctx, "storage.read")
+		if attempt > 0 {
+			span = startSpan(ctx, "storage.read.hedged")
+		}
+		span.SetAttr("read.attempt", attempt+1)
+		span.SetAttr("read.storage", fmt.Sprint(store))
+		go func() {
+			data, err := h.doRead(ctx, cfg, store, name, maxBytes, onSlow, filling)
+			span.SetAttr("read.bytes", len(data))
+			span.SetError(err)
+			span.End()
+			results <- readAttempt{data: data, err: err, hedged: attempt > 0}
+		}()
+	}
+	launch()
+
+	// wanted counts slow reads not yet answered by a new attempt
+	delay, wanted := cfg.HedgedDelay, 0
+	var wait <-chan time.Time
+	var waitSpan *Span
+	defer func() { waitSpan.End() }()
+	var err error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.hedged {
+					readMetrics.hedgeWins.Add(1)
+				}
+				return &readResult{data: res.data, hedged: res.hedged, hedgeDelay: hedgeDelay}, nil
+			}
+			err = res.err
+			continue
+		case <-slow:
+			wanted++
+		case <-wait:
+			wait = nil
+			waitSpan.End()
+			wanted--
+			launch()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// Pause before each new attempt to let the kernel pull data into Page Cache
+		if wait == nil && wanted > 0 && launched < cfg.HedgeAttempts {
+			wait = time.After(delay)
+			waitSpan = startSpan(ctx, "hedge.wait")
+			waitSpan.SetAttr("hedge.delay_ms", delay)
+			delay = time.Duration(float64(delay) * cfg.HedgeBackoff)
+		}
+	}
+	return nil, err
+}
+
+// hedgeStorage returns where a hedged read should go: the next mirror
+// directory, or the handler's own storage without mirrors.
+func (h *FileHandler) hedgeStorage(cfg *Config) Storage {
+	if len(cfg.MirrorDirs) == 0 {
+		return h.storage
+	}
+	return NewLocalStorage(cfg.MirrorDirs[h.mirrorNext.Add(1)%uint64(len(cfg.MirrorDirs))])
+}
+
+// uringFallback logs the first failure to set up io_uring.
+var uringFallback sync.Once
+
+// readChunkSize is how much doRead asks for per Read call.
+const readChunkSize = 1024 * 1024
+
+// readChunks recycles doRead's chunk buffers across reads.
+var readChunks = sync.Pool{New: func() any {
+	chunk := make([]byte, readChunkSize)
+	return &chunk
+}}
+
+// doRead reads the whole file into memory. Files larger than maxBytes are
+// rejected with errTooLargeToCache before any data is read. If onSlow is set,
+// it is called once the read falls below the hedging speed threshold; files
+// smaller than -hedgeMinSize are never considered slow. Files of at least
+// -streamMissMinSize are read into filling, if set, starting it, instead of
+// a buffer of their own. The buffer is reserved from -maxReadMemory for the
+// duration of the read, failing with errNoReadMemory if that takes too long.
+func (h *FileHandler) doRead(ctx context.Context, cfg *Config, store Storage, name string, maxBytes int64, onSlow func(), filling *fillBuffer) ([]byte, error) {
+	opened := time.Now()
+	file, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// Page cache hints and io_uring only apply to local files
+	osFile, _ := file.(*os.File)
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return nil, errIsDirectory
+	} else if info.Size() > maxBytes {
+		return nil, errTooLargeToCache
+	}
+	// Speed over the check window means nothing for files read in a few packets
+	measured := info.Size() >= cfg.HedgeMinSize
+	if filling != nil && info.Size() < cfg.StreamMissMinSize {
+		filling = nil
+	}
+	// A shared buffer is reserved by the attempt that starts it
+	if filling == nil || !filling.started() {
+		if err := h.reserveReadMemory(ctx, cfg, info.Size()); err != nil {
+			return nil, err
+		}
+		defer h.readMem.release(info.Size())
+	}
+	if filling != nil {
+		filling.start(info.Size())
+	}
+	if osFile != nil && cfg.FadviseWillNeed {
+		adviseWillNeed(osFile, cfg.ReadaheadBytes)
+	}
+
+	var reader io.Reader = file
+	if cfg.ParallelReads > 1 && info.Size() >= cfg.ParallelReadMinSize {
+		pr := newParallelReader(file, info.Size(), cfg.ParallelReads)
+		defer pr.Close()
+		reader = pr
+	} else if osFile != nil && cfg.IOUring {
+		if ur, err := newURingReader(osFile, info.Size(), cfg.IOUringDepth); err == nil {
+			defer ur.Close()
+			reader = ur
+		} else {
+			uringFallback.Do(func() { log.Printf("io_uring unavailable, using regular reads: %v", err) })
+		}
+	}
+	if threshold := h.hedgeThreshold(cfg); onSlow != nil && measured && threshold > 0 {
+		window := cfg.SpeedWindow
+		if window <= 0 {
+			window = cfg.CheckTime
+		}
+		hr := NewHedgingReader(ctx, reader, cfg.CheckTime, window, threshold, onSlow)
+		defer hr.Stop()
+		reader = hr
+	}
+	start := time.Now()
+
+	// Sized up front so the file is copied once; it only grows if the file does
+	var buf *bytes.Buffer
+	if filling == nil {
+		buf = bytes.NewBuffer(make([]byte, 0, info.Size()))
+	}
+	var offset int64
+	chunkp := readChunks.Get().(*[]byte)
+	defer readChunks.Put(chunkp)
+	chunk := *chunkp
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n, readErr := reader.Read(chunk)
+		if n > 0 {
+			if offset == 0 {
+				readMetrics.firstByte.observe(milliseconds(time.Since(opened)))
+			}
+			if filling != nil {
+				filling.write(offset, chunk[:n])
+			} else {
+				buf.Write(chunk[:n])
+			}
+			offset += int64(n)
+		}
+
+		if readErr != nil {
+			if readErr == io.EOF {
+				break
+			}
+			return nil, readErr
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > 0 && measured {
+		mbps := float64(offset) * 8 / (1024 * 1024 * elapsed.Seconds())
+		h.speeds.record(mbps)
+		readMetrics.speed.observe(mbps)
+	}
+	// The contents now live in the memory cache
+	if osFile != nil && cfg.FadviseDontNeed {
+		adviseDontNeed(osFile)
+	}
+	if filling != nil {
+		return filling.bytes(), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// reserveReadMemory takes n bytes of -maxReadMemory for a read buffer,
+// waiting up to -readMemoryWait for them to become free.
+func (h *FileHandler) reserveReadMemory(ctx context.Context, cfg *Config, n int64) error {
+	if h.readMem.tryAcquire(n) {
+		return nil
+	}
+	if cfg.ReadMemoryWait > 0 {
+		ctx, cancel := context.WithTimeout(ctx, cfg.ReadMemoryWait)
+		defer cancel()
+		err := h.readMem.acquire(ctx, n)
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, errNoReadMemory) {
+			return err
+		}
+	}
+	readMetrics.memoryFull.Add(1)
+	return errNoReadMemory
+}
+
+// hedgeThreshold is the speed (Mbps) below which a read is hedged: the
+// -hedgePercentile of recent reads in adaptive mode, otherwise -minSpeedMbps.
+// -minSpeedMbps also applies while too few reads have been seen.
+func (h *FileHandler) hedgeThreshold(cfg *Config) float64 {
+	if cfg.HedgePercentile > 0 {
+		if mbps, ok := h.speeds.percentile(cfg.HedgePercentile); ok {
+			return mbps
+		}
+	}
+	return cfg.MinSpeedMbps
+}
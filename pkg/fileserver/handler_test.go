@@ -0,0 +1,73 @@
+package fileserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestHandler returns a writable FileHandler serving a fresh temporary
+// directory, with the defaults adjusted by configure, if given.
+func newTestHandler(t *testing.T, configure func(cfg *Config)) *FileHandler {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Dir = t.TempDir()
+	cfg.ReadOnly = false
+	cfg.Watch = false
+	if configure != nil {
+		configure(cfg)
+	}
+	h := NewFileHandler(cfg, NewMemoryCache(cfg.CacheSizeBytes, cfg.CacheTTL, 1), NewLocalStorage(cfg.Dir))
+	t.Cleanup(h.Close)
+	return h
+}
+
+// writeTestFile creates the file name under dir, and its parents.
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTest sends a request through h and returns the recorded response.
+// A non-empty user marks the request as authenticated, as the auth
+// middleware would.
+func serveTest(h http.Handler, method, target, user, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if user != "" {
+		req = req.WithContext(context.WithValue(req.Context(), authenticatedKey{}, user))
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeFile(t *testing.T) {
+	h := newTestHandler(t, nil)
+	writeTestFile(t, h.baseDir, "docs/a.txt", "hello")
+
+	w := serveTest(h, http.MethodGet, "/docs/a.txt", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("GET = %d %q, want 200 \"hello\"", w.Code, w.Body.String())
+	}
+	if w := serveTest(h, http.MethodGet, "/docs/missing.txt", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing file = %d, want 404", w.Code)
+	}
+	if w := serveTest(h, http.MethodGet, "/.trash/a.txt", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of the trash = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// HealthChecks answers liveness and readiness probes ahead of auth, rate
+// limiting and the URL prefix, so orchestrators can always reach them.
+// /healthz only says the process is serving; /readyz checks that the origin
+// is reachable and the cache is up, and optionally reads a probe file.
+type HealthChecks struct {
+	h       *FileHandler
+	probe   string // URL path of the probe file, or ""
+	timeout time.Duration
+}
+
+func NewHealthChecks(cfg *Config, h *FileHandler) *HealthChecks {
+	hc := &HealthChecks{h: h, timeout: cfg.ReadyTimeout}
+	if cfg.ReadyProbe != "" {
+		hc.probe = path.Clean("/" + cfg.ReadyProbe)
+	}
+	return hc
+}
+
+// Wrap serves /healthz and /readyz, passing everything else to next.
+func (hc *HealthChecks) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		case "/readyz":
+			hc.serveReady(w)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+type readyCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	MS    int64  `json:"ms"`
+}
+
+func (hc *HealthChecks) serveReady(w http.ResponseWriter) {
+	// A hung mount blocks forever rather than failing; give up after the budget
+	done := make(chan []readyCheck, 1)
+	go func() { done <- hc.check() }()
+	var checks []readyCheck
+	select {
+	case checks = <-done:
+	case <-time.After(hc.timeout):
+		checks = []readyCheck{{Name: "timeout", Error: fmt.Sprintf("checks took longer than %v", hc.timeout), MS: hc.timeout.Milliseconds()}}
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+func (hc *HealthChecks) check() []readyCheck {
+	run := func(name string, fn func() error) readyCheck {
+		start := time.Now()
+		err := fn()
+		c := readyCheck{Name: name, OK: err == nil, MS: time.Since(start).Milliseconds()}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		return c
+	}
+
+	checks := []readyCheck{
+		run("origin", func() error {
+			info, err := hc.h.storage.Stat(hc.h.storageName(hc.h.baseDir))
+			if err == nil && !info.IsDir() {
+				err = fmt.Errorf("%v is not a directory", hc.h.storage)
+			}
+			return err
+		}),
+		run("cache", func() error {
+			if hc.h.cache == nil || hc.h.ctx.Err() != nil {
+				return fmt.Errorf("cache is not available")
+			}
+			return nil
+		}),
+	}
+	if hc.probe != "" {
+		checks = append(checks, run("probe", func() error {
+			// Read past the cache, so the probe tests the disk itself
+			_, err := hc.h.storage.ReadRange(hc.h.storageName(filepath.Join(hc.h.baseDir, filepath.FromSlash(hc.probe))), 0, 4096)
+			return err
+		}))
+	}
+	return checks
+}
@@ -0,0 +1,77 @@
+package fileserver
+
+import (
+	"net/http"
+	"time"
+)
+
+// Hooks are optional callbacks a deployment registers on a FileHandler (see
+// Use) to add its own authentication, quota or logging logic. Any of them may
+// be nil. A Pre hook that returns false stops the request; it must have
+// written the response itself.
+type Hooks struct {
+	// PreAuth runs before the handler's own checks (hidden paths, ACL rules,
+	// write tokens and signed URLs), e.g. to reject or authenticate requests.
+	PreAuth func(w http.ResponseWriter, r *http.Request, urlPath string) bool
+	// PreRead runs for GET requests that passed those checks, before the
+	// file is looked up in the cache or read, e.g. to enforce quotas.
+	PreRead func(w http.ResponseWriter, r *http.Request, urlPath string) bool
+	// PostServe runs once the response has been written, including for
+	// requests a Pre hook stopped.
+	PostServe func(r *http.Request, result ServeResult)
+}
+
+// ServeResult describes how the handler answered a request.
+type ServeResult struct {
+	Path        string        // cleaned URL path
+	Status      int           // response status code
+	Bytes       int64         // response body bytes written
+	CacheStatus string        // CacheHit, CacheMiss, ...; empty if no file was loaded
+	Duration    time.Duration // time spent in the handler
+	CacheTime   time.Duration // cache lookup
+	ReadTime    time.Duration // waiting for the disk read on a miss
+	HedgeDelay  time.Duration // delay before the first hedged attempt, if any
+}
+
+// Use registers hooks to run on every request, after those registered before.
+func (h *FileHandler) Use(hooks Hooks) {
+	h.hookMu.Lock()
+	defer h.hookMu.Unlock()
+	var chain []Hooks
+	if old := h.hooks.Load(); old != nil {
+		chain = append(chain, *old...)
+	}
+	chain = append(chain, hooks)
+	h.hooks.Store(&chain)
+}
+
+// hookChain returns the registered hooks, or nil if there are none.
+func (h *FileHandler) hookChain() []Hooks {
+	if chain := h.hooks.Load(); chain != nil {
+		return *chain
+	}
+	return nil
+}
+
+// serveWithHooks serves r and then runs the PostServe hooks of chain with the outcome.
+func (h *FileHandler) serveWithHooks(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string, chain []Hooks) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	h.serve(rec, r, cfg, urlPath, chain)
+
+	result := ServeResult{Path: urlPath, Status: rec.status, Bytes: rec.bytes, Duration: time.Since(start)}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		result.CacheStatus = info.CacheStatus
+		result.CacheTime = info.Timing.Cache
+		result.ReadTime = info.Timing.Read
+		result.HedgeDelay = info.Timing.Hedge
+	}
+	for _, hooks := range chain {
+		if hooks.PostServe != nil {
+			hooks.PostServe(r, result)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package fileserver
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server returns a QUIC listener sharing the TCP server's handler and certificates.
+// It binds the UDP port with the same number as the TCP listener.
+func newHTTP3Server(addr string, handler http.Handler, tlsCfg *tls.Config) *http3.Server {
+	return &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsCfg),
+	}
+}
+
+// advertiseHTTP3 adds an Alt-Svc header to every TCP response so clients
+// upgrade to the HTTP/3 listener on subsequent requests.
+func advertiseHTTP3(next http.Handler, h3 *http3.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQuicHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
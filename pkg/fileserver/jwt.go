@@ -0,0 +1,189 @@
+package fileserver
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksRefreshInterval bounds how stale fetched JWKS keys may get, and how often
+// an unknown key ID may trigger a refetch.
+const jwksRefreshInterval = time.Hour
+
+// pathClaims are the JWT claims understood by the server. Paths lists the URL
+// prefixes the token may access and is required.
+type pathClaims struct {
+	Paths []string `json:"paths"`
+	jwt.RegisteredClaims
+}
+
+// jwtVerifier validates HS256 tokens against a shared secret and RS256 tokens
+// against a PEM public key or keys fetched from a JWKS URL.
+type jwtVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	jwks      *jwksCache
+	fold      bool // paths claims are matched ignoring case
+}
+
+// newJWTVerifier builds a verifier from cfg, or returns nil if no JWT key is configured.
+func newJWTVerifier(cfg *Config) (*jwtVerifier, error) {
+	if cfg.JWTSecret == "" && cfg.JWTPublicKey == "" && cfg.JWKSURL == "" {
+		return nil, nil
+	}
+	v := &jwtVerifier{secret: []byte(cfg.JWTSecret), fold: cfg.CaseInsensitivePaths}
+	if cfg.JWTPublicKey != "" {
+		pemData, err := os.ReadFile(cfg.JWTPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("jwtPublicKey: %w", err)
+		}
+		if v.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(pemData); err != nil {
+			return nil, fmt.Errorf("jwtPublicKey: %w", err)
+		}
+	}
+	if cfg.JWKSURL != "" {
+		v.jwks = &jwksCache{url: cfg.JWKSURL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return v, nil
+}
+
+// allows reports whether tokenString is a valid JWT whose paths claim covers
+// urlPath, and its subject.
+func (v *jwtVerifier) allows(tokenString, urlPath string) (string, bool) {
+	var claims pathClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, v.key, jwt.WithValidMethods([]string{"HS256", "RS256"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", false
+	}
+	for _, prefix := range claims.Paths {
+		if v.fold {
+			prefix = strings.ToLower(prefix)
+		}
+		if (AuthRule{Prefix: prefix}).matches(urlPath) {
+			return claims.Subject, true
+		}
+	}
+	return "", false
+}
+
+// key selects the verification key for token based on its algorithm and key ID.
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		return v.secret, nil
+	case "RS256":
+		if v.jwks != nil {
+			kid, _ := token.Header["kid"].(string)
+			if key := v.jwks.get(kid); key != nil {
+				return key, nil
+			}
+		}
+		if v.publicKey != nil {
+			return v.publicKey, nil
+		}
+		return nil, errors.New("no RS256 key available")
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+// jwksCache holds RSA keys fetched from a JWKS endpoint, refreshed lazily.
+type jwksCache struct {
+	url    string
+	client *http.Client
+	group  singleflight.Group // one fetch at a time, shared by all callers
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// get returns the key for kid, refetching the key set when it is stale or the
+// key is unknown (at most once per interval, so bogus kids can't hammer the IdP).
+// A known key is returned right away while a stale set is refreshed in the
+// background; only requests for an unknown key wait for the fetch.
+func (c *jwksCache) get(kid string) *rsa.PublicKey {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	refresh := (!ok || time.Since(c.fetched) > jwksRefreshInterval) && time.Since(c.fetched) > time.Minute
+	c.mu.Unlock()
+
+	switch {
+	case !refresh:
+		return key
+	case ok:
+		go c.refresh()
+		return key
+	}
+	return c.refresh()[kid]
+}
+
+// refresh fetches the key set without holding the lock, so a slow identity
+// provider only delays the requests that need the new keys, and swaps it in.
+func (c *jwksCache) refresh() map[string]*rsa.PublicKey {
+	keys, _, _ := c.group.Do("", func() (interface{}, error) {
+		keys, err := c.fetch()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil {
+			log.Printf("JWKS fetch from %s failed: %v", c.url, err)
+		} else {
+			c.keys = keys
+		}
+		c.fetched = time.Now()
+		return c.keys, nil
+	})
+	return keys.(map[string]*rsa.PublicKey)
+}
+
+// fetch downloads and decodes the RSA keys of the JWKS document.
+func (c *jwksCache) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var doc struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if !strings.EqualFold(k.Kty, "RSA") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
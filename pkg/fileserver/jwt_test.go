@@ -0,0 +1,72 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWTRequiresExpiry(t *testing.T) {
+	v := &jwtVerifier{secret: []byte("k")}
+	sign := func(claims pathClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expiring := sign(pathClaims{Paths: []string{"/"}, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}})
+	if _, ok := v.allows(expiring, "/a.txt"); !ok {
+		t.Error("token with exp refused")
+	}
+	if _, ok := v.allows(sign(pathClaims{Paths: []string{"/"}}), "/a.txt"); ok {
+		t.Error("token without exp accepted")
+	}
+}
+
+// A slow JWKS endpoint mustn't hold up requests signed with a key already known.
+func TestJWKSRefreshDoesNotBlock(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	fetches := 0
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches++; fetches > 1 {
+			<-release
+		}
+		fmt.Fprintf(w, `{"keys":[{"kid":"a","kty":"RSA","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	}))
+	defer idp.Close()
+	defer close(release)
+
+	c := &jwksCache{url: idp.URL, client: idp.Client()}
+	if c.get("a") == nil {
+		t.Fatal("key not fetched")
+	}
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-2 * jwksRefreshInterval)
+	c.mu.Unlock()
+
+	done := make(chan *rsa.PublicKey)
+	go func() { done <- c.get("a") }()
+	select {
+	case got := <-done:
+		if got == nil {
+			t.Error("known key lost during a refresh")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("get waited for the JWKS refresh")
+	}
+}
@@ -0,0 +1,165 @@
+package fileserver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenSpec is an address from -listen: "host:port", or with an explicit
+// "http://" or "https://" scheme to mix plain and TLS listeners. Addresses
+// without a scheme use TLS whenever it is configured, like -port.
+type listenSpec struct {
+	addr string
+	tls  *bool // nil = follow the TLS configuration
+}
+
+func parseListenSpec(s string) (listenSpec, error) {
+	spec := listenSpec{addr: s}
+	if scheme, rest, ok := strings.Cut(s, "://"); ok {
+		useTLS := false
+		switch scheme {
+		case "https":
+			useTLS = true
+		case "http":
+		default:
+			return spec, fmt.Errorf("unknown scheme %q (want http or https)", scheme)
+		}
+		spec.addr, spec.tls = rest, &useTLS
+	}
+	if _, _, err := net.SplitHostPort(spec.addr); err != nil {
+		return spec, err
+	}
+	return spec, nil
+}
+
+// serverListener is a listener the main server accepts connections on.
+type serverListener struct {
+	net.Listener
+	tls       bool
+	activated bool // passed in by systemd
+}
+
+// openListeners returns the listeners for the main server: the sockets passed
+// by systemd socket activation, those given with -listen and the -listenUnix
+// socket. Without any of them, it listens on -port. With -proxyProtocol, all
+// of them expect PROXY protocol headers.
+func openListeners(cfg *Config, tlsEnabled bool) ([]serverListener, error) {
+	listeners, err := systemdListeners(tlsEnabled)
+	if err != nil {
+		return nil, err
+	}
+	specs := cfg.Listen
+	if len(specs) == 0 && len(listeners) == 0 && cfg.ListenUnix == "" {
+		specs = []string{":" + strconv.Itoa(cfg.Port)}
+	}
+	for _, s := range specs {
+		spec, err := parseListenSpec(s)
+		if err != nil {
+			return nil, fmt.Errorf("listen %q: %w", s, err)
+		}
+		useTLS := tlsEnabled
+		if spec.tls != nil {
+			useTLS = *spec.tls
+		}
+		if useTLS && !tlsEnabled {
+			return nil, fmt.Errorf("listen %q: https needs -tlsCert or -acmeDomains", s)
+		}
+		l, err := net.Listen("tcp", spec.addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, serverListener{Listener: l, tls: useTLS})
+	}
+	if cfg.ListenUnix != "" {
+		l, err := listenUnix(cfg.ListenUnix, cfg.ListenUnixMode)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, serverListener{Listener: l})
+	}
+	if cfg.ProxyProtocol {
+		timeout := cfg.ReadHeaderTimeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		for i := range listeners {
+			listeners[i].Listener = &proxyListener{Listener: listeners[i].Listener, timeout: timeout}
+		}
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix domain socket with the given octal mode,
+// replacing a socket left behind by a previous run. The socket file is
+// removed again when the listener closes.
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("listenUnixMode %q: %w", mode, err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners adopts the sockets of systemd socket activation
+// (LISTEN_PID, LISTEN_FDS and optionally LISTEN_FDNAMES). Sockets named
+// "http" or "https" get that protocol; others follow the TLS configuration.
+func systemdListeners(tlsEnabled bool) ([]serverListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Not for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const firstFD = 3
+	var listeners []serverListener
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d (%s): %w", firstFD+i, name, err)
+		}
+		useTLS := tlsEnabled
+		switch name {
+		case "http":
+			useTLS = false
+		case "https":
+			if !tlsEnabled {
+				return nil, fmt.Errorf("socket activation fd %d (%s): https needs -tlsCert or -acmeDomains", firstFD+i, name)
+			}
+			useTLS = true
+		}
+		listeners = append(listeners, serverListener{Listener: l, tls: useTLS, activated: true})
+	}
+	return listeners, nil
+}
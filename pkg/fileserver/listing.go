@@ -0,0 +1,210 @@
+package fileserver
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dirEntry is one row of a directory listing.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Type    string    `json:"type"` // "file" or "dir"
+}
+
+// serveDirectory serves the directory's index file if configured and present,
+// otherwise renders a listing when listings are enabled, and refuses with 403 otherwise.
+func (h *FileHandler) serveDirectory(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, dirPath string) {
+	if cfg.Archives && r.URL.Query().Has("archive") {
+		h.serveArchive(w, r, cfg, urlPath, dirPath)
+		return
+	}
+	if cfg.IndexFile == "" && !cfg.ListDirs {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Relative links in the index or listing only resolve correctly with a trailing slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := externalPath(cfg, r.URL.Path) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	if cfg.IndexFile != "" {
+		indexURL := path.Join(urlPath, cfg.IndexFile)
+		indexPath := filepath.Join(dirPath, cfg.IndexFile)
+		data, err := h.load(r, cfg, indexURL, indexPath)
+		if err == nil {
+			h.serveBytes(w, r, cfg, indexURL, indexPath, data)
+			return
+		}
+		if !os.IsNotExist(err) {
+			serveReadError(w, r, indexURL, err)
+			return
+		}
+	}
+
+	if !cfg.ListDirs {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	entries, err := h.readDirEntries(cfg, urlPath, dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		logf(r, "Error listing %s: %v", urlPath, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	sortKey, desc := r.URL.Query().Get("sort"), r.URL.Query().Get("order") == "desc"
+	sortDirEntries(entries, sortKey, desc)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = listingTemplate.Execute(w, map[string]interface{}{
+		"Path":    externalPath(cfg, urlPath),
+		"Parent":  urlPath != "/",
+		"Entries": entries,
+		"Sort":    sortKey,
+		"Desc":    desc,
+	})
+	if err != nil {
+		logf(r, "Error rendering listing for %s: %v", urlPath, err)
+	}
+}
+
+// readDirEntries lists dirPath, hiding the server's internal directories at the
+// root and anything hidden by -hideDotfiles or -hide.
+func (h *FileHandler) readDirEntries(cfg *Config, urlPath, dirPath string) ([]dirEntry, error) {
+	des, err := h.storage.List(h.storageName(dirPath))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dirEntry, 0, len(des))
+	for _, de := range des {
+		if p := path.Join(urlPath, de.Name()); isInternalPath(p) || isHiddenPath(cfg, p) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue // Removed since ReadDir
+		}
+		entry := dirEntry{Name: de.Name(), Size: info.Size(), ModTime: info.ModTime(), Type: "file"}
+		if info.IsDir() {
+			entry.Type = "dir"
+			entry.Size = 0
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// sortDirEntries orders directories first, then by key ("name", "size" or "mtime").
+func sortDirEntries(entries []dirEntry, key string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Type != b.Type {
+			return a.Type == "dir"
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch key {
+		case "size":
+			return a.Size < b.Size
+		case "mtime":
+			return a.ModTime.Before(b.ModTime)
+		default:
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+	})
+}
+
+// wantsJSON reports whether the client asked for a machine-readable response.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"href": func(e dirEntry) string {
+		u := url.URL{Path: e.Name}
+		if e.Type == "dir" {
+			return u.String() + "/"
+		}
+		return u.String()
+	},
+	"sortLink": func(key, current string, desc bool) string {
+		order := "asc"
+		if key == current && !desc {
+			order = "desc"
+		}
+		return "?sort=" + key + "&order=" + order
+	},
+	"humanSize": humanSize,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1.5em 0.2em 0; text-align: left; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>
+<th><a href="{{sortLink "name" .Sort .Desc}}">Name</a></th>
+<th><a href="{{sortLink "size" .Sort .Desc}}">Size</a></th>
+<th><a href="{{sortLink "mtime" .Sort .Desc}}">Modified</a></th>
+</tr>
+{{if .Parent}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Entries}}<tr>
+<td><a href="{{href .}}">{{.Name}}{{if eq .Type "dir"}}/{{end}}</a></td>
+<td class="size">{{if eq .Type "file"}}{{humanSize .Size}}{{end}}</td>
+<td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// humanSize formats a byte count with a binary unit suffix.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
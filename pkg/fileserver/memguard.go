@@ -0,0 +1,120 @@
+package fileserver
+
+import (
+	"log"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// memoryCheckInterval is how often MemoryGuard samples memory use.
+	memoryCheckInterval = time.Second
+	// minCacheFactor is the smallest share of its size a cache is shrunk to.
+	minCacheFactor = 0.1
+	// cacheGrowStep is how much of its size a shrunk cache regains per check
+	// once memory use is back below the low-water mark.
+	cacheGrowStep = 0.1
+)
+
+// MemoryGuard shrinks the caches when the process nears its Go memory limit
+// (GOMEMLIMIT): once the live heap plus off-heap cache memory passes
+// -memoryHighWater of the limit, the caches give up the excess, and they grow
+// back step by step after use has fallen a tenth below the mark. Without a
+// memory limit it does nothing.
+type MemoryGuard struct {
+	cfg    atomic.Pointer[Config]
+	caches []*MemoryCache
+
+	// Owned by the checking goroutine
+	factor float64 // share of their size the caches are limited to
+	cycles uint64  // GC cycles to wait for after the last shrink
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryGuard starts watching memory use on behalf of caches.
+func NewMemoryGuard(cfg *Config, caches ...*MemoryCache) *MemoryGuard {
+	g := &MemoryGuard{caches: caches, factor: 1, done: make(chan struct{})}
+	g.cfg.Store(cfg)
+	go func() {
+		ticker := time.NewTicker(memoryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.check()
+			case <-g.done:
+				return
+			}
+		}
+	}()
+	return g
+}
+
+// Reload swaps in a new high-water mark.
+func (g *MemoryGuard) Reload(cfg *Config) {
+	g.cfg.Store(cfg)
+}
+
+// Close stops watching. The caches keep their current size.
+func (g *MemoryGuard) Close() {
+	g.closeOnce.Do(func() { close(g.done) })
+}
+
+// check samples memory use and shrinks or grows the caches accordingly.
+func (g *MemoryGuard) check() {
+	highWater := g.cfg.Load().MemoryHighWater
+	limit := debug.SetMemoryLimit(-1)
+	if highWater <= 0 || limit == math.MaxInt64 {
+		g.setFactor(1)
+		return
+	}
+
+	// The live heap is only measured by a GC, so the same excess must not be
+	// cut twice before a cycle started after the last shrink has completed
+	samples := []metrics.Sample{{Name: "/gc/heap/live:bytes"}, {Name: "/gc/cycles/total:gc-cycles"}}
+	metrics.Read(samples)
+	used := int64(samples[0].Value.Uint64())
+	cycles := samples[1].Value.Uint64()
+	var cached, maxCached int64
+	for _, cache := range g.caches {
+		stats := cache.GetStats()
+		used += stats.OffHeapBytes
+		cached += stats.UsedBytes
+		maxCached += stats.MaxBytes
+	}
+
+	high := int64(highWater * float64(limit))
+	switch {
+	case used > high && cycles > g.cycles && cached > 0:
+		g.cycles = cycles + 1
+		// Limit the caches to what they hold minus the excess
+		fullSize := float64(maxCached) / g.factor
+		factor := max(min(float64(cached-(used-high))/fullSize, g.factor), minCacheFactor)
+		if factor < g.factor {
+			log.Printf("Memory pressure: %d of %d bytes in use, shrinking the cache to %.0f%% of its size", used, limit, factor*100)
+			g.setFactor(factor)
+		}
+	case used < high-high/10 && g.factor < 1:
+		g.setFactor(min(g.factor+cacheGrowStep, 1))
+		if g.factor == 1 {
+			log.Printf("Memory pressure eased, cache back to its full size")
+		}
+	}
+}
+
+// setFactor limits every cache to factor of its size.
+func (g *MemoryGuard) setFactor(factor float64) {
+	if factor == g.factor {
+		return
+	}
+	g.factor = factor
+	for _, cache := range g.caches {
+		cache.Shrink(factor)
+	}
+}
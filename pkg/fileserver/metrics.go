@@ -0,0 +1,126 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket upper bounds for the read histograms.
+var (
+	speedBuckets   = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+	latencyBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+)
+
+// readMetrics collects the data needed to tune -minSpeedMbps, -checkTime and
+// -hedgedDelay, published under "reads" in /admin/vars.
+var readMetrics = struct {
+	// speedAtCheck is the throughput of monitored reads when first checked at
+	// -checkTime; reads that finish sooner don't appear.
+	speedAtCheck *histogram
+	// speed is the throughput of completed disk reads of at least -hedgeMinSize.
+	speed *histogram
+	// firstByte is the time from opening a file to its first bytes.
+	firstByte *histogram
+	// hedged counts reads that started a hedged attempt; hedgeWins those an
+	// attempt other than the first answered, i.e. where hedging paid off.
+	hedged, hedgeWins atomic.Int64
+	// leaders count cache fills that read the file; joins the requests that
+	// waited for another's read instead, for as long as joinWait.
+	leaders, joins atomic.Int64
+	joinWait       *histogram
+	// memoryFull counts reads that found no room in -maxReadMemory in time
+	// and were streamed from disk uncached instead.
+	memoryFull atomic.Int64
+}{
+	speedAtCheck: newHistogram(speedBuckets),
+	speed:        newHistogram(speedBuckets),
+	firstByte:    newHistogram(latencyBuckets),
+	joinWait:     newHistogram(latencyBuckets),
+}
+
+func init() {
+	expvar.Publish("reads", expvar.Func(func() any {
+		hedged, wins := readMetrics.hedged.Load(), readMetrics.hedgeWins.Load()
+		winRate := 0.0
+		if hedged > 0 {
+			winRate = float64(wins) / float64(hedged)
+		}
+		return map[string]any{
+			"speedAtCheckMbps":   readMetrics.speedAtCheck,
+			"speedMbps":          readMetrics.speed,
+			"firstByteMs":        readMetrics.firstByte,
+			"hedged":             hedged,
+			"hedgeWins":          wins,
+			"hedgeWinRate":       winRate,
+			"singleflightLeads":  readMetrics.leaders.Load(),
+			"singleflightJoins":  readMetrics.joins.Load(),
+			"singleflightWaitMs": readMetrics.joinWait,
+			"memoryFull":         readMetrics.memoryFull.Load(),
+		}
+	}))
+}
+
+// recordSingleflight counts a cache fill through singleflight, and how long
+// the request waited if it joined another's read.
+func recordSingleflight(shared bool, wait time.Duration) {
+	if !shared {
+		readMetrics.leaders.Add(1)
+		return
+	}
+	readMetrics.joins.Add(1)
+	readMetrics.joinWait.observe(milliseconds(wait))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// histogram counts observations into buckets with fixed upper bounds. It
+// marshals to cumulative counts per bound ("le", as in Prometheus), plus the
+// count and sum of all observations.
+type histogram struct {
+	bounds []float64
+	counts []atomic.Int64 // per bucket; the last one is above every bound
+	sum    atomic.Uint64  // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+// observe records v in the first bucket whose bound is at least v.
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) MarshalJSON() ([]byte, error) {
+	le := make(map[string]int64, len(h.counts))
+	var total int64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		bound := "+Inf"
+		if i < len(h.bounds) {
+			bound = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		le[bound] = total
+	}
+	return json.Marshal(map[string]any{
+		"le":    le,
+		"count": total,
+		"sum":   math.Float64frombits(h.sum.Load()),
+	})
+}
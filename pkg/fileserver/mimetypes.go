@@ -0,0 +1,80 @@
+package fileserver
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// builtinMimeTypes covers extensions that system MIME tables commonly lack or
+// get wrong, and for which sniffing yields a generic type.
+var builtinMimeTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".wasm": "application/wasm",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
+
+// ParseMimeTypes parses a comma-separated list of extension=type pairs,
+// e.g. ".mkv=video/x-matroska,.heic=image/heic". Extensions are matched
+// case-insensitively; the leading dot is optional.
+func ParseMimeTypes(s string) (map[string]string, error) {
+	types := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		ext, ctype, ok := strings.Cut(part, "=")
+		ext, ctype = strings.TrimSpace(ext), strings.TrimSpace(ctype)
+		if !ok || ext == "" || ctype == "" {
+			return nil, fmt.Errorf("invalid MIME type mapping %q: expected .ext=type", part)
+		}
+		if _, _, err := mime.ParseMediaType(ctype); err != nil {
+			return nil, fmt.Errorf("invalid MIME type %q for %s: %w", ctype, ext, err)
+		}
+		types[normalizeExt(ext)] = ctype
+	}
+	return types, nil
+}
+
+// formatMimeTypes is the inverse of ParseMimeTypes, sorted by extension.
+func formatMimeTypes(types map[string]string) string {
+	parts := make([]string, 0, len(types))
+	for ext, ctype := range types {
+		parts = append(parts, ext+"="+ctype)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// mimeTypeFor returns the Content-Type for name from -mimeTypes,
+// builtinMimeTypes, the system tables and finally -defaultMimeType, in that
+// order. It returns "" when none apply and the type should be sniffed.
+func mimeTypeFor(cfg *Config, name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext != "" {
+		if ctype, ok := cfg.MimeTypes[ext]; ok {
+			return ctype
+		}
+		if ctype, ok := builtinMimeTypes[ext]; ok {
+			return ctype
+		}
+		if ctype := mime.TypeByExtension(ext); ctype != "" {
+			return ctype
+		}
+	}
+	return cfg.DefaultMimeType
+}
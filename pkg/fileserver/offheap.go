@@ -0,0 +1,98 @@
+package fileserver
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// slabPageSize is the unit in which off-heap memory is mapped for small items.
+// Larger items get a mapping of their own.
+const slabPageSize = 1 << 20
+
+// errOffHeapUnsupported is returned by UseOffHeap on platforms without mmap.
+var errOffHeapUnsupported = errors.New("off-heap cache storage is not supported on this platform")
+
+// offHeapStore hands out byte slices backed by anonymous memory mappings rather
+// than the Go heap, so a large cache neither inflates the GC's heap target nor
+// has to be walked by it. Small items are packed into memcached-style slab
+// classes; slab pages are reused but never returned to the OS.
+type offHeapStore struct {
+	mu       sync.Mutex
+	classes  []*slabClass
+	reserved int64 // bytes currently mapped
+}
+
+// slabClass holds the free slots of one size.
+type slabClass struct {
+	size int
+	free [][]byte
+}
+
+func newOffHeapStore() *offHeapStore {
+	s := &offHeapStore{}
+	for size := 64; ; size = (size*5/4 + 7) &^ 7 {
+		size = min(size, slabPageSize)
+		s.classes = append(s.classes, &slabClass{size: size})
+		if size == slabPageSize {
+			break
+		}
+	}
+	return s
+}
+
+// alloc returns an off-heap slice of length n. Its capacity identifies the
+// slot or mapping, so it must be passed to free unchanged.
+func (s *offHeapStore) alloc(n int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > slabPageSize {
+		buf, err := mapMemory(n)
+		if err != nil {
+			return nil, err
+		}
+		s.reserved += int64(cap(buf))
+		return buf[:n], nil
+	}
+
+	class := s.classes[sort.Search(len(s.classes), func(i int) bool { return s.classes[i].size >= n })]
+	if len(class.free) == 0 {
+		page, err := mapMemory(slabPageSize)
+		if err != nil {
+			return nil, err
+		}
+		s.reserved += int64(cap(page))
+		for off := 0; off+class.size <= len(page); off += class.size {
+			class.free = append(class.free, page[off:off+class.size:off+class.size])
+		}
+	}
+	slot := class.free[len(class.free)-1]
+	class.free = class.free[:len(class.free)-1]
+	return slot[:n], nil
+}
+
+// free returns a slice obtained from alloc. The caller must not use it afterwards.
+func (s *offHeapStore) free(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cap(buf) > slabPageSize {
+		s.reserved -= int64(cap(buf))
+		unmapMemory(buf[:cap(buf)])
+		return
+	}
+	i := sort.Search(len(s.classes), func(i int) bool { return s.classes[i].size >= cap(buf) })
+	s.classes[i].free = append(s.classes[i].free, buf[:cap(buf)])
+}
+
+// reservedBytes reports how much memory is currently mapped.
+func (s *offHeapStore) reservedBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reserved
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package fileserver
+
+func mapMemory(n int) ([]byte, error) {
+	return nil, errOffHeapUnsupported
+}
+
+func unmapMemory(buf []byte) {}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package fileserver
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapMemory maps n bytes (rounded up to whole pages) of anonymous memory.
+func mapMemory(n int) ([]byte, error) {
+	pageSize := os.Getpagesize()
+	size := (n + pageSize - 1) / pageSize * pageSize
+	return syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
+
+// unmapMemory releases a mapping created by mapMemory.
+func unmapMemory(buf []byte) {
+	syscall.Munmap(buf)
+}
@@ -0,0 +1,128 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// originClient fetches misses from -originURL. Only the wait for response
+// headers is bounded; bodies may take as long as the file needs.
+var originClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	},
+}
+
+// originFills tracks paths currently being copied from the origin, so only
+// one request per path writes the local copy.
+var originFills sync.Map // filePath -> struct{}
+
+// originURL returns the upstream URL for urlPath.
+func originURL(cfg *Config, urlPath string) string {
+	return strings.TrimSuffix(cfg.OriginURL, "/") + (&url.URL{Path: urlPath}).EscapedPath()
+}
+
+// serveFromOrigin answers a local miss from -originURL. A full GET is streamed
+// to the client while being written to filePath, so later requests are served
+// locally; the copy is finished even if the client goes away. Range requests
+// and requests arriving while another is filling the same path are proxied
+// without being stored.
+func (h *FileHandler) serveFromOrigin(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) {
+	_, filling := originFills.LoadOrStore(filePath, struct{}{})
+	fill := !filling && r.Header.Get("Range") == ""
+	if !filling && !fill {
+		originFills.Delete(filePath)
+	}
+	if fill {
+		defer originFills.Delete(filePath)
+	}
+
+	// A fill outlives its request; only shutdown aborts it
+	ctx := r.Context()
+	if fill {
+		ctx = h.ctx
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, originURL(cfg, urlPath), nil)
+	if err != nil {
+		serveReadError(w, r, urlPath, err)
+		return
+	}
+	setRequestIDHeader(req, r)
+	for _, name := range []string{"Range", "If-Range"} {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	setCacheStatus(r, CacheOrigin)
+	resp, err := originClient.Do(req)
+	if err != nil {
+		logf(r, "Origin fetch %s failed: %v", urlPath, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		h.notFound(w, r, cfg, urlPath)
+		return
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent &&
+		resp.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+		logf(r, "Origin fetch %s failed: %s", urlPath, resp.Status)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Range", "Last-Modified", "ETag", "Accept-Ranges"} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	setCacheControl(w, cfg, urlPath)
+	setDiagnosticHeaders(w, r, cfg)
+	w.WriteHeader(resp.StatusCode)
+
+	if !fill || resp.StatusCode != http.StatusOK {
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	client := &detachableWriter{w: w}
+	if _, err := writeFileAtomic(filePath, io.TeeReader(resp.Body, client)); err != nil {
+		if !errors.Is(err, errIsDirectory) {
+			logf(r, "Origin fill %s failed: %v", urlPath, err)
+		}
+		return
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(filePath, modTime, modTime)
+	}
+	h.invalidate(filePath)
+	logf(r, "Filled %s from origin", urlPath)
+}
+
+// detachableWriter forwards writes to w until the first error, then silently
+// discards the rest, so a departed client doesn't abort a fill.
+type detachableWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (d *detachableWriter) Write(p []byte) (int, error) {
+	if !d.failed {
+		if _, err := d.w.Write(p); err != nil {
+			d.failed = true
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,111 @@
+package fileserver
+
+import (
+	"io"
+	"sync"
+)
+
+const parallelChunkSize = 1024 * 1024
+
+// parallelReader reads a file with several concurrent positional reads, each
+// fetching the next unclaimed 1MB chunk, and returns the chunks in order. On
+// network filesystems, where a single stream is bound by round-trip latency,
+// this multiplies throughput. Workers stay at most a few chunks ahead of the
+// consumer, so memory use is bounded regardless of file size.
+type parallelReader struct {
+	file    io.ReaderAt
+	size    int64
+	window  int
+	chunks  []parallelChunk
+	mu      sync.Mutex
+	cond    *sync.Cond
+	next    int   // next chunk to hand to a worker
+	pos     int64 // read position
+	stopped bool
+}
+
+type parallelChunk struct {
+	data []byte
+	err  error
+	done bool
+}
+
+func newParallelReader(file io.ReaderAt, size int64, workers int) *parallelReader {
+	r := &parallelReader{
+		file:   file,
+		size:   size,
+		window: 2 * workers,
+		chunks: make([]parallelChunk, (size+parallelChunkSize-1)/parallelChunkSize),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+func (r *parallelReader) work() {
+	for {
+		r.mu.Lock()
+		for !r.stopped && r.next < len(r.chunks) && r.next >= int(r.pos/parallelChunkSize)+r.window {
+			r.cond.Wait()
+		}
+		if r.stopped || r.next >= len(r.chunks) {
+			r.mu.Unlock()
+			return
+		}
+		i := r.next
+		r.next++
+		r.mu.Unlock()
+
+		off := int64(i) * parallelChunkSize
+		buf := make([]byte, min(parallelChunkSize, r.size-off))
+		n, err := r.file.ReadAt(buf, off)
+		if err == io.EOF {
+			// The file shrank since it was opened
+			err = io.ErrUnexpectedEOF
+		}
+
+		r.mu.Lock()
+		r.chunks[i] = parallelChunk{data: buf[:n], err: err, done: true}
+		r.cond.Broadcast()
+		r.mu.Unlock()
+	}
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := int(r.pos / parallelChunkSize)
+	for !r.chunks[i].done {
+		r.cond.Wait()
+	}
+	c := &r.chunks[i]
+	start := r.pos - int64(i)*parallelChunkSize
+	if c.err != nil && start >= int64(len(c.data)) {
+		return 0, c.err
+	}
+	n := copy(p, c.data[start:])
+	r.pos += int64(n)
+	if r.pos == int64(i+1)*parallelChunkSize {
+		// Chunk consumed; let the workers move on
+		c.data = nil
+		r.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// Close stops the workers after their current read. It does not wait for
+// them, so a stalled read can't hold up the caller.
+func (r *parallelReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopped = true
+	r.cond.Broadcast()
+	return nil
+}
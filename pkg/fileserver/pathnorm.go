@@ -0,0 +1,99 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Trailing slash handling for files (-trailingSlash). Directories always get one.
+const (
+	TrailingSlashIgnore   = "ignore"   // /file.txt/ serves /file.txt
+	TrailingSlashRedirect = "redirect" // /file.txt/ redirects to /file.txt
+	TrailingSlashStrict   = "strict"   // /file.txt/ is not found
+)
+
+// Percent-decoding rules for request paths (-pathDecoding).
+const (
+	PathDecodeOnce   = "once"   // decoded once; %2F is a path separator
+	PathDecodeRepeat = "repeat" // decoded until no escapes are left, so double-encoded paths name the same file
+	PathDecodeStrict = "strict" // paths with encoded slashes or escapes left after decoding are rejected
+)
+
+// maxPathDecodes bounds how often PathDecodeRepeat decodes a path.
+const maxPathDecodes = 4
+
+var errBadPath = errors.New("malformed request path")
+
+type normalizedPathKey struct{}
+
+// normalizePaths decodes request paths under -pathDecoding once, before auth
+// and anything else looks at them, and rewrites r.URL.Path to the result.
+// Auth rules, ACLs, -hide and the cache thus all judge the path the file is
+// served from. Rejected paths are answered 400.
+func (h *FileHandler) normalizePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := requestPath(h.cfg.Load(), r)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		u := *r.URL
+		u.Path, u.RawPath = p, ""
+		if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+			u.Path += "/" // Kept for directory redirects and -trailingSlash
+		}
+		r = r.WithContext(context.WithValue(r.Context(), normalizedPathKey{}, p))
+		r.URL = &u
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestPath returns the clean path r names under -pathDecoding, failing
+// with errBadPath if it is rejected. Paths normalizePaths has seen are not
+// decoded again.
+func requestPath(cfg *Config, r *http.Request) (string, error) {
+	if p, ok := r.Context().Value(normalizedPathKey{}).(string); ok {
+		return p, nil
+	}
+	p := r.URL.Path
+	switch cfg.PathDecoding {
+	case PathDecodeRepeat:
+		for i := 0; i < maxPathDecodes && strings.Contains(p, "%"); i++ {
+			decoded, err := url.PathUnescape(p)
+			if err != nil || decoded == p {
+				break
+			}
+			p = decoded
+		}
+	case PathDecodeStrict:
+		if strings.Contains(strings.ToUpper(r.URL.EscapedPath()), "%2F") || strings.Contains(p, "%") {
+			return "", errBadPath
+		}
+	}
+	return filepath.Clean(p), nil
+}
+
+// checkTrailingSlash applies -trailingSlash to a request for the file at
+// filePath, reporting false if it answered the request instead.
+func (h *FileHandler) checkTrailingSlash(w http.ResponseWriter, r *http.Request, cfg *Config, filePath string) bool {
+	if cfg.TrailingSlash == TrailingSlashIgnore || !strings.HasSuffix(r.URL.Path, "/") {
+		return true
+	}
+	if info, err := h.storage.Stat(h.storageName(filePath)); err != nil || info.IsDir() {
+		return true
+	}
+	if cfg.TrailingSlash == TrailingSlashStrict {
+		http.NotFound(w, r)
+		return false
+	}
+	target := externalPath(cfg, strings.TrimRight(r.URL.Path, "/"))
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return false
+}
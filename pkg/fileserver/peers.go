@@ -0,0 +1,367 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// peerPathPrefix is where instances fetch files from each other.
+const peerPathPrefix = "/_peer"
+
+// peerReplicas is the number of points each peer gets on the hash ring.
+const peerReplicas = 128
+
+// peerInvalidateTimeout bounds the delivery of one invalidation to one peer.
+const peerInvalidateTimeout = 5 * time.Second
+
+// errPeerUnavailable means the owning peer couldn't answer; the file is then
+// read locally instead.
+var errPeerUnavailable = errors.New("peer unavailable")
+
+// hashRing assigns keys to peers by consistent hashing, so adding or removing
+// an instance only moves the keys it owns.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+	peers  []string
+}
+
+func newHashRing(peers []string) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string), peers: peers}
+	for _, peer := range peers {
+		for i := 0; i < peerReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = peer
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// owner returns the peer responsible for key, or "" for an empty ring.
+func (ring *hashRing) owner(key string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+// PeerPool makes a group of instances act as one cache: every file has an
+// owner on the hash ring, and the other instances fetch it from the owner's
+// memory instead of reading it themselves. Members come from -peers or the
+// addresses -peerDNS resolves to.
+type PeerPool struct {
+	h      *FileHandler
+	self   string
+	token  string
+	ring   atomic.Pointer[hashRing]
+	client *http.Client
+	cancel context.CancelFunc
+}
+
+// NewPeerPool builds the pool described by cfg and attaches it to h. With
+// -peerDNS it keeps re-resolving the name every -peerRefresh until Close.
+func NewPeerPool(cfg *Config, h *FileHandler) *PeerPool {
+	p := &PeerPool{
+		h:      h,
+		self:   strings.TrimSuffix(cfg.PeerSelf, "/"),
+		token:  cfg.PeerToken,
+		client: &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64, IdleConnTimeout: 90 * time.Second}},
+	}
+	p.ring.Store(newHashRing(nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+
+	if cfg.PeerDNS != "" {
+		p.resolve(cfg)
+		go func() {
+			ticker := time.NewTicker(cfg.PeerRefresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.resolve(cfg)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	} else {
+		peers := make([]string, 0, len(cfg.Peers))
+		for _, peer := range cfg.Peers {
+			peers = append(peers, strings.TrimSuffix(peer, "/"))
+		}
+		if p.self == "" {
+			p.self = findSelf(peers, cfg.Port)
+		}
+		p.setPeers(peers)
+	}
+	if p.self == "" {
+		log.Printf("Warning: This instance is not among the peers; it will own no files (set -peerSelf)")
+	}
+	h.peers = p
+	return p
+}
+
+// resolve replaces the members with the addresses -peerDNS resolves to.
+func (p *PeerPool) resolve(cfg *Config) {
+	addrs, err := net.LookupHost(cfg.PeerDNS)
+	if err != nil {
+		log.Printf("Peer discovery via %s failed, keeping %d peers: %v", cfg.PeerDNS, len(p.ring.Load().peers), err)
+		return
+	}
+	scheme := "http"
+	if cfg.TLSCert != "" || len(cfg.ACMEDomains) > 0 {
+		scheme = "https"
+	}
+	prefix := strings.TrimSuffix(cfg.URLPrefix, "/")
+	peers := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, scheme+"://"+net.JoinHostPort(addr, strconv.Itoa(cfg.Port))+prefix)
+	}
+	if p.self == "" {
+		p.self = findSelf(peers, cfg.Port)
+	}
+	p.setPeers(peers)
+}
+
+// setPeers installs a new ring if the membership changed.
+func (p *PeerPool) setPeers(peers []string) {
+	sort.Strings(peers)
+	if strings.Join(peers, ",") == strings.Join(p.ring.Load().peers, ",") {
+		return
+	}
+	p.ring.Store(newHashRing(peers))
+	log.Printf("Peer ring: %d members (%s), self %s", len(peers), strings.Join(peers, ", "), p.self)
+}
+
+// findSelf returns the peer URL pointing at one of this host's addresses
+// on port, or "" if none does.
+func findSelf(peers []string, port int) string {
+	local := make(map[string]bool)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				local[ipNet.IP.String()] = true
+			}
+		}
+	}
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil || u.Port() != strconv.Itoa(port) {
+			continue
+		}
+		ips, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if local[ip] {
+				return peer
+			}
+		}
+	}
+	return ""
+}
+
+// ownerOf returns the peer that owns urlPath, or "" if it is this instance.
+func (p *PeerPool) ownerOf(urlPath string) string {
+	owner := p.ring.Load().owner(urlPath)
+	if owner == p.self {
+		return ""
+	}
+	return owner
+}
+
+// fetch loads urlPath from peer's cache. Errors mirror a local read so callers
+// handle both alike; errPeerUnavailable means the peer couldn't be asked.
+func (p *PeerPool) fetch(ctx context.Context, peer, urlPath string, maxBytes int64) ([]byte, error) {
+	target := peer + peerPathPrefix + (&url.URL{Path: urlPath}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("Peer fetch of %s from %s failed, reading locally: %v", urlPath, peer, err)
+		return nil, errPeerUnavailable
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, &os.PathError{Op: "open", Path: urlPath, Err: os.ErrNotExist}
+	case http.StatusConflict:
+		return nil, errIsDirectory
+	case http.StatusRequestEntityTooLarge:
+		return nil, errTooLargeToCache
+	default:
+		log.Printf("Peer fetch of %s from %s failed, reading locally: %s", urlPath, peer, resp.Status)
+		return nil, errPeerUnavailable
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, errTooLargeToCache
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errTooLargeToCache
+	}
+	return data, nil
+}
+
+// Wrap routes the peer API to the pool ahead of next. Peer requests carry
+// -peerToken and skip the client-facing auth, rate limits and throttling.
+func (p *PeerPool) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, peerPathPrefix+"/") {
+			p.serve(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve answers a peer's fetch from this instance's cache or disk. It never
+// forwards the request again, even if the rings disagree.
+func (p *PeerPool) serve(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h := p.h
+	cfg := h.cfg.Load()
+	urlPath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, peerPathPrefix))
+	filePath := filepath.Join(h.baseDir, urlPath)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// Another instance changed or purged urlPath; don't pass it on
+		if r.URL.Query().Get("tree") == "1" {
+			h.dropTree(filePath)
+		} else {
+			h.cache.Delete(filePath)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isInternalPath(urlPath) || isHiddenPath(cfg, urlPath) || !h.symlinkAllowed(cfg, filePath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	r = withRequestInfo(r.WithContext(context.WithValue(r.Context(), fromPeerKey{}, true)))
+	data, err := h.load(r, cfg, urlPath, filePath)
+	switch {
+	case err == nil:
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case os.IsNotExist(err):
+		http.NotFound(w, r)
+	case errors.Is(err, errIsDirectory):
+		http.Error(w, "Is a directory", http.StatusConflict)
+	case errors.Is(err, errTooLargeToCache):
+		http.Error(w, "Too large to cache", http.StatusRequestEntityTooLarge)
+	default:
+		serveReadError(w, r, urlPath, err)
+	}
+}
+
+// Invalidate tells every other peer to drop urlPath, and with tree everything
+// below it, from its cache. Delivery is asynchronous and best effort: a peer
+// that misses it serves its copy until the entry expires or is evicted.
+func (p *PeerPool) Invalidate(urlPath string, tree bool) {
+	query := ""
+	if tree {
+		query = "?tree=1"
+	}
+	for _, peer := range p.ring.Load().peers {
+		if peer == p.self {
+			continue
+		}
+		peer := peer
+		target := peer + peerPathPrefix + (&url.URL{Path: urlPath}).EscapedPath() + query
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), peerInvalidateTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+p.token)
+			resp, err := p.client.Do(req)
+			if err != nil {
+				log.Printf("Invalidating %s on %s failed: %v", urlPath, peer, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				log.Printf("Invalidating %s on %s failed: %s", urlPath, peer, resp.Status)
+			}
+		}()
+	}
+}
+
+// Close stops peer discovery.
+func (p *PeerPool) Close() {
+	p.cancel()
+}
+
+type fromPeerKey struct{}
+
+// peerOwner returns the peer to fetch urlPath from for r, or "" to read it
+// locally: without a pool, when this instance owns it, or when r came from a peer.
+func (h *FileHandler) peerOwner(r *http.Request, urlPath string) string {
+	if h.peers == nil {
+		return ""
+	}
+	if fromPeer, _ := r.Context().Value(fromPeerKey{}).(bool); fromPeer {
+		return ""
+	}
+	return h.peers.ownerOf(urlPath)
+}
+
+// loadFromPeer fetches urlPath from its owner, coalescing concurrent requests.
+// It is keyed apart from local reads so a loop between peers with diverging
+// rings can't wait on itself.
+func (h *FileHandler) loadFromPeer(cfg *Config, peer, urlPath, filePath string) ([]byte, error) {
+	val, err, _ := h.sfGroup.Do(VariantKey(filePath, "peer"), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(h.ctx, cfg.ReadDeadline)
+		defer cancel()
+		return h.peers.fetch(ctx, peer, urlPath, h.maxItemBytes(cfg))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
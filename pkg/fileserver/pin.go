@@ -0,0 +1,80 @@
+package fileserver
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// pinnedFile is a path pinned in the cache, as listed by the admin API.
+type pinnedFile struct {
+	Path   string `json:"path"`
+	Cached bool   `json:"cached"`
+}
+
+// Pin keeps urlPath in the cache regardless of memory pressure (see
+// MemoryCache.Pin). The prefetcher reads it in and keeps it loaded across
+// invalidations and expiry. Pins added at runtime last until restart.
+func (h *FileHandler) Pin(urlPath string) {
+	urlPath = path.Clean("/" + urlPath)
+	filePath := filepath.Join(h.baseDir, filepath.FromSlash(urlPath))
+	h.pinMu.Lock()
+	h.pins[filePath] = urlPath
+	h.pinMu.Unlock()
+	h.cache.Pin(filePath)
+	h.wakePrefetcher()
+}
+
+// Unpin releases urlPath to normal eviction, reporting whether it was pinned.
+func (h *FileHandler) Unpin(urlPath string) bool {
+	urlPath = path.Clean("/" + urlPath)
+	filePath := filepath.Join(h.baseDir, filepath.FromSlash(urlPath))
+	h.pinMu.Lock()
+	_, ok := h.pins[filePath]
+	delete(h.pins, filePath)
+	h.pinMu.Unlock()
+	if ok {
+		h.cache.Unpin(filePath)
+	}
+	return ok
+}
+
+// Pins lists the pinned paths and whether each is currently cached.
+func (h *FileHandler) Pins() []pinnedFile {
+	out := []pinnedFile{}
+	for filePath, urlPath := range h.pinnedFiles() {
+		_, cached := h.cache.Expiry(filePath)
+		out = append(out, pinnedFile{Path: urlPath, Cached: cached})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// pinnedFiles returns the pinned files, keyed by file path.
+func (h *FileHandler) pinnedFiles() map[string]string {
+	h.pinMu.Lock()
+	defer h.pinMu.Unlock()
+	out := make(map[string]string, len(h.pins))
+	for filePath, urlPath := range h.pins {
+		out[filePath] = urlPath
+	}
+	return out
+}
+
+// applyPins pins the -pin paths of cfg and unpins those dropped from it since old.
+func (h *FileHandler) applyPins(old, cfg *Config) {
+	keep := make(map[string]bool, len(cfg.Pin))
+	for _, p := range cfg.Pin {
+		keep[path.Clean("/"+p)] = true
+	}
+	if old != nil {
+		for _, p := range old.Pin {
+			if !keep[path.Clean("/"+p)] {
+				h.Unpin(p)
+			}
+		}
+	}
+	for p := range keep {
+		h.Pin(p)
+	}
+}
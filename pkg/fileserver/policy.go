@@ -0,0 +1,626 @@
+package fileserver
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// Eviction policies selectable with -cachePolicy.
+const (
+	PolicySLRU = "slru" // segmented LRU: probation and protected segments
+	PolicyLRU  = "lru"  // least recently used
+	PolicyLFU  = "lfu"  // least frequently used with dynamic aging (LFU-DA)
+	PolicyARC  = "arc"  // adaptive replacement cache
+	Policy2Q   = "2q"   // FIFO admission queue in front of an LRU
+)
+
+// evictionPolicy decides which of a shard's unpinned entries is evicted next.
+// The shard keeps the index and the byte counters; policies only order the
+// entries, keeping their own bookkeeping in each CacheItem. Entries a policy
+// considers frequently used are marked protected. All methods are called
+// with the shard's write lock held.
+type evictionPolicy interface {
+	name() string
+	// add starts tracking a newly stored item.
+	add(item *CacheItem)
+	// hit records a use of item.
+	hit(item *CacheItem)
+	// update records that item was stored again, possibly with a new size.
+	update(item *CacheItem)
+	// remove stops tracking item; evicted is set if it went to make room.
+	remove(item *CacheItem, evicted bool)
+	// victim returns the entry to evict next, or nil if there is none.
+	victim() *CacheItem
+	// walk calls fn on the entries in eviction order until fn returns false.
+	walk(fn func(*CacheItem) bool)
+	// resize adapts to a new size limit.
+	resize(maxBytes int64)
+	// protectedBytes is the size of the entries marked protected.
+	protectedBytes() int64
+	// reset forgets every entry.
+	reset()
+}
+
+// newEvictionPolicy returns the named policy for a shard of maxBytes.
+// protectedRatio only applies to SLRU.
+func newEvictionPolicy(name string, maxBytes int64, protectedRatio float64) (evictionPolicy, error) {
+	switch name {
+	case PolicySLRU:
+		return &slruPolicy{probation: list.New(), protected: list.New(), maxBytes: maxBytes, ratio: protectedRatio}, nil
+	case PolicyLRU:
+		return &lruPolicy{entries: list.New()}, nil
+	case PolicyLFU:
+		return &lfuPolicy{}, nil
+	case PolicyARC:
+		return &arcPolicy{t1: list.New(), t2: list.New(), b1: list.New(), b2: list.New(), ghosts: make(map[string]*list.Element), maxBytes: maxBytes}, nil
+	case Policy2Q:
+		return &twoQPolicy{in: list.New(), main: list.New(), out: list.New(), ghosts: make(map[string]*list.Element), maxBytes: maxBytes}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q (want slru, lru, lfu, arc or 2q)", name)
+}
+
+// walkList calls fn on the items of l from the back until fn returns false,
+// reporting whether it got through all of them.
+func walkList(l *list.List, fn func(*CacheItem) bool) bool {
+	for elem := l.Back(); elem != nil; elem = elem.Prev() {
+		if !fn(elem.Value.(*CacheItem)) {
+			return false
+		}
+	}
+	return true
+}
+
+// back returns the item at the back of l, or nil if l is empty.
+func back(l *list.List) *CacheItem {
+	if elem := l.Back(); elem != nil {
+		return elem.Value.(*CacheItem)
+	}
+	return nil
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+	entries *list.List
+}
+
+func (p *lruPolicy) name() string { return PolicyLRU }
+
+func (p *lruPolicy) add(item *CacheItem) {
+	item.protected, item.cost = false, item.size()
+	item.elem = p.entries.PushFront(item)
+}
+
+func (p *lruPolicy) hit(item *CacheItem) {
+	p.entries.MoveToFront(item.elem)
+}
+
+func (p *lruPolicy) update(item *CacheItem) {
+	item.cost = item.size()
+	p.entries.MoveToFront(item.elem)
+}
+
+func (p *lruPolicy) remove(item *CacheItem, evicted bool) {
+	p.entries.Remove(item.elem)
+}
+
+func (p *lruPolicy) victim() *CacheItem            { return back(p.entries) }
+func (p *lruPolicy) walk(fn func(*CacheItem) bool) { walkList(p.entries, fn) }
+func (p *lruPolicy) resize(maxBytes int64)         {}
+func (p *lruPolicy) protectedBytes() int64         { return 0 }
+func (p *lruPolicy) reset()                        { p.entries.Init() }
+
+// slruPolicy is a segmented LRU. New entries land in a probation segment and
+// graduate to a protected segment on their second hit, so a scan of one-off
+// files only churns probation while repeatedly used files stay resident.
+// Probation is drained before the protected segment is touched.
+type slruPolicy struct {
+	probation, protected *list.List
+	protectedSize        int64
+	maxBytes             int64
+	ratio                float64 // share of maxBytes the protected segment may use
+}
+
+func (p *slruPolicy) name() string { return PolicySLRU }
+
+func (p *slruPolicy) add(item *CacheItem) {
+	item.protected, item.cost = false, item.size()
+	item.elem = p.probation.PushFront(item)
+}
+
+func (p *slruPolicy) hit(item *CacheItem) {
+	if item.protected {
+		p.protected.MoveToFront(item.elem)
+		return
+	}
+	p.probation.Remove(item.elem)
+	item.protected = true
+	item.elem = p.protected.PushFront(item)
+	p.protectedSize += item.cost
+	p.rebalance()
+}
+
+func (p *slruPolicy) update(item *CacheItem) {
+	size := item.size()
+	if item.protected {
+		p.protectedSize += size - item.cost
+		p.protected.MoveToFront(item.elem)
+	} else {
+		p.probation.MoveToFront(item.elem)
+	}
+	item.cost = size
+	p.rebalance()
+}
+
+func (p *slruPolicy) remove(item *CacheItem, evicted bool) {
+	if item.protected {
+		p.protected.Remove(item.elem)
+		p.protectedSize -= item.cost
+		return
+	}
+	p.probation.Remove(item.elem)
+}
+
+func (p *slruPolicy) victim() *CacheItem {
+	if item := back(p.probation); item != nil {
+		return item
+	}
+	return back(p.protected)
+}
+
+func (p *slruPolicy) walk(fn func(*CacheItem) bool) {
+	if walkList(p.probation, fn) {
+		walkList(p.protected, fn)
+	}
+}
+
+func (p *slruPolicy) resize(maxBytes int64) {
+	p.maxBytes = maxBytes
+	p.rebalance()
+}
+
+// setRatio sets the share (0-1) of the size limit the protected segment may occupy.
+func (p *slruPolicy) setRatio(ratio float64) {
+	p.ratio = ratio
+	p.rebalance()
+}
+
+// rebalance demotes the least recently used protected entries back to
+// probation until the protected segment fits its share of the size limit.
+func (p *slruPolicy) rebalance() {
+	limit := int64(float64(p.maxBytes) * p.ratio)
+	for p.protectedSize > limit {
+		item := back(p.protected)
+		if item == nil {
+			return
+		}
+		p.protected.Remove(item.elem)
+		item.protected = false
+		p.protectedSize -= item.cost
+		item.elem = p.probation.PushFront(item)
+	}
+}
+
+func (p *slruPolicy) protectedBytes() int64 { return p.protectedSize }
+
+func (p *slruPolicy) reset() {
+	p.probation.Init()
+	p.protected.Init()
+	p.protectedSize = 0
+}
+
+// lfuPolicy evicts the least frequently used entry, with dynamic aging
+// (LFU-DA): an entry's rank is its use count plus the rank of the last evicted
+// entry when it was last used, so formerly popular files that went cold are
+// eventually evicted too. Entries used more than once are protected.
+type lfuPolicy struct {
+	entries lfuHeap
+	age     int64  // rank of the last evicted entry
+	seq     uint64 // breaks rank ties, oldest use first
+	hot     int64
+}
+
+func (p *lfuPolicy) name() string { return PolicyLFU }
+
+func (p *lfuPolicy) add(item *CacheItem) {
+	item.protected, item.cost = false, item.size()
+	item.freq = 1
+	p.rank(item)
+	heap.Push(&p.entries, item)
+}
+
+func (p *lfuPolicy) hit(item *CacheItem) {
+	item.freq++
+	if !item.protected {
+		item.protected = true
+		p.hot += item.cost
+	}
+	p.rank(item)
+	heap.Fix(&p.entries, item.index)
+}
+
+func (p *lfuPolicy) update(item *CacheItem) {
+	size := item.size()
+	if item.protected {
+		p.hot += size - item.cost
+	}
+	item.cost = size
+	p.rank(item)
+	heap.Fix(&p.entries, item.index)
+}
+
+// rank sets item's eviction rank for a use now.
+func (p *lfuPolicy) rank(item *CacheItem) {
+	p.seq++
+	item.rank, item.seq = p.age+item.freq, p.seq
+}
+
+func (p *lfuPolicy) remove(item *CacheItem, evicted bool) {
+	heap.Remove(&p.entries, item.index)
+	if item.protected {
+		p.hot -= item.cost
+	}
+	if evicted {
+		p.age = item.rank
+	}
+}
+
+func (p *lfuPolicy) victim() *CacheItem {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	return p.entries[0]
+}
+
+// walk visits the heap in rank order without disturbing it, using a second
+// heap of the indexes whose parents have been visited.
+func (p *lfuPolicy) walk(fn func(*CacheItem) bool) {
+	if len(p.entries) == 0 {
+		return
+	}
+	next := &lfuFrontier{entries: p.entries, indexes: []int{0}}
+	for next.Len() > 0 {
+		i := heap.Pop(next).(int)
+		if !fn(p.entries[i]) {
+			return
+		}
+		for _, child := range [2]int{2*i + 1, 2*i + 2} {
+			if child < len(p.entries) {
+				heap.Push(next, child)
+			}
+		}
+	}
+}
+
+func (p *lfuPolicy) resize(maxBytes int64) {}
+func (p *lfuPolicy) protectedBytes() int64 { return p.hot }
+
+func (p *lfuPolicy) reset() {
+	p.entries, p.age, p.hot = nil, 0, 0
+}
+
+// lfuHeap is a min-heap of items by rank, then by last use.
+type lfuHeap []*CacheItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *lfuHeap) Push(x any) {
+	item := x.(*CacheItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// lfuFrontier is a min-heap of indexes into an lfuHeap.
+type lfuFrontier struct {
+	entries lfuHeap
+	indexes []int
+}
+
+func (f *lfuFrontier) Len() int           { return len(f.indexes) }
+func (f *lfuFrontier) Less(i, j int) bool { return f.entries.Less(f.indexes[i], f.indexes[j]) }
+func (f *lfuFrontier) Swap(i, j int)      { f.indexes[i], f.indexes[j] = f.indexes[j], f.indexes[i] }
+func (f *lfuFrontier) Push(x any)         { f.indexes = append(f.indexes, x.(int)) }
+
+func (f *lfuFrontier) Pop() any {
+	i := f.indexes[len(f.indexes)-1]
+	f.indexes = f.indexes[:len(f.indexes)-1]
+	return i
+}
+
+// ghost remembers an evicted entry's key and size, so ARC and 2Q can
+// recognize it when it is stored again.
+type ghost struct {
+	key      string
+	size     int64
+	frequent bool // evicted from ARC's t2 rather than t1
+}
+
+// arcPolicy is an adaptive replacement cache sized in bytes. t1 holds entries
+// used once recently and t2 (protected) those used at least twice; ghosts of
+// entries evicted from each (b1, b2) shift the byte target for t1 towards
+// whichever list would have kept them, adapting between recency and frequency.
+type arcPolicy struct {
+	t1, t2, b1, b2                     *list.List
+	ghosts                             map[string]*list.Element
+	t1Bytes, t2Bytes, b1Bytes, b2Bytes int64
+	target                             int64 // bytes t1 may use before t2 gives way
+	maxBytes                           int64
+}
+
+func (p *arcPolicy) name() string { return PolicyARC }
+
+func (p *arcPolicy) add(item *CacheItem) {
+	item.cost = item.size()
+	elem, ok := p.ghosts[item.Key]
+	if !ok {
+		item.protected = false
+		item.elem = p.t1.PushFront(item)
+		p.t1Bytes += item.cost
+		return
+	}
+	// Evicted too early: grow the list it was evicted from
+	if elem.Value.(*ghost).frequent {
+		ratio := max(float64(p.b1Bytes)/float64(max(p.b2Bytes, 1)), 1)
+		p.target = max(p.target-int64(ratio*float64(item.cost)), 0)
+	} else {
+		ratio := max(float64(p.b2Bytes)/float64(max(p.b1Bytes, 1)), 1)
+		p.target = min(p.target+int64(ratio*float64(item.cost)), p.maxBytes)
+	}
+	p.dropGhost(elem)
+	item.protected = true
+	item.elem = p.t2.PushFront(item)
+	p.t2Bytes += item.cost
+}
+
+func (p *arcPolicy) hit(item *CacheItem) {
+	if item.protected {
+		p.t2.MoveToFront(item.elem)
+		return
+	}
+	p.t1.Remove(item.elem)
+	p.t1Bytes -= item.cost
+	item.protected = true
+	item.elem = p.t2.PushFront(item)
+	p.t2Bytes += item.cost
+}
+
+func (p *arcPolicy) update(item *CacheItem) {
+	size := item.size()
+	if item.protected {
+		p.t2Bytes += size - item.cost
+		p.t2.MoveToFront(item.elem)
+	} else {
+		p.t1Bytes += size - item.cost
+		p.t1.MoveToFront(item.elem)
+	}
+	item.cost = size
+}
+
+func (p *arcPolicy) remove(item *CacheItem, evicted bool) {
+	ghosts := p.b1
+	if item.protected {
+		p.t2.Remove(item.elem)
+		p.t2Bytes -= item.cost
+		ghosts = p.b2
+	} else {
+		p.t1.Remove(item.elem)
+		p.t1Bytes -= item.cost
+	}
+	if !evicted {
+		return
+	}
+	p.ghosts[item.Key] = ghosts.PushFront(&ghost{key: item.Key, size: item.cost, frequent: item.protected})
+	if item.protected {
+		p.b2Bytes += item.cost
+	} else {
+		p.b1Bytes += item.cost
+	}
+	p.trim()
+}
+
+// trim bounds the ghost lists: t1 and b1 together to the size limit, all
+// four lists to twice that.
+func (p *arcPolicy) trim() {
+	for p.t1Bytes+p.b1Bytes > p.maxBytes && p.b1.Len() > 0 {
+		p.dropGhost(p.b1.Back())
+	}
+	for p.t1Bytes+p.t2Bytes+p.b1Bytes+p.b2Bytes > 2*p.maxBytes && p.b1.Len()+p.b2.Len() > 0 {
+		if p.b2.Len() > 0 {
+			p.dropGhost(p.b2.Back())
+		} else {
+			p.dropGhost(p.b1.Back())
+		}
+	}
+}
+
+func (p *arcPolicy) dropGhost(elem *list.Element) {
+	g := elem.Value.(*ghost)
+	if g.frequent {
+		p.b2.Remove(elem)
+		p.b2Bytes -= g.size
+	} else {
+		p.b1.Remove(elem)
+		p.b1Bytes -= g.size
+	}
+	delete(p.ghosts, g.key)
+}
+
+func (p *arcPolicy) victim() *CacheItem {
+	if p.t1.Len() > 0 && (p.t1Bytes > p.target || p.t2.Len() == 0) {
+		return back(p.t1)
+	}
+	return back(p.t2)
+}
+
+func (p *arcPolicy) walk(fn func(*CacheItem) bool) {
+	t1Bytes := p.t1Bytes
+	e1, e2 := p.t1.Back(), p.t2.Back()
+	for e1 != nil || e2 != nil {
+		var item *CacheItem
+		if e1 != nil && (t1Bytes > p.target || e2 == nil) {
+			item, e1 = e1.Value.(*CacheItem), e1.Prev()
+			t1Bytes -= item.cost
+		} else {
+			item, e2 = e2.Value.(*CacheItem), e2.Prev()
+		}
+		if !fn(item) {
+			return
+		}
+	}
+}
+
+func (p *arcPolicy) resize(maxBytes int64) {
+	p.maxBytes = maxBytes
+	p.target = min(p.target, maxBytes)
+	p.trim()
+}
+
+func (p *arcPolicy) protectedBytes() int64 { return p.t2Bytes }
+
+func (p *arcPolicy) reset() {
+	p.t1.Init()
+	p.t2.Init()
+	p.b1.Init()
+	p.b2.Init()
+	p.ghosts = make(map[string]*list.Element)
+	p.t1Bytes, p.t2Bytes, p.b1Bytes, p.b2Bytes, p.target = 0, 0, 0, 0, 0
+}
+
+// twoQPolicy is 2Q sized in bytes. New entries wait in a FIFO queue (in)
+// holding a quarter of the cache; only entries stored again after leaving it,
+// while their ghost is remembered (out), enter the main LRU and are protected.
+// Scans pass through the FIFO without disturbing the main LRU.
+type twoQPolicy struct {
+	in, main, out               *list.List
+	ghosts                      map[string]*list.Element
+	inBytes, mainBytes, outSize int64
+	maxBytes                    int64
+}
+
+func (p *twoQPolicy) name() string { return Policy2Q }
+
+func (p *twoQPolicy) add(item *CacheItem) {
+	item.cost = item.size()
+	if elem, ok := p.ghosts[item.Key]; ok {
+		p.dropGhost(elem)
+		item.protected = true
+		item.elem = p.main.PushFront(item)
+		p.mainBytes += item.cost
+		return
+	}
+	item.protected = false
+	item.elem = p.in.PushFront(item)
+	p.inBytes += item.cost
+}
+
+func (p *twoQPolicy) hit(item *CacheItem) {
+	// The FIFO ignores hits; they only count once an entry made it to main
+	if item.protected {
+		p.main.MoveToFront(item.elem)
+	}
+}
+
+func (p *twoQPolicy) update(item *CacheItem) {
+	size := item.size()
+	if item.protected {
+		p.mainBytes += size - item.cost
+		p.main.MoveToFront(item.elem)
+	} else {
+		p.inBytes += size - item.cost
+	}
+	item.cost = size
+}
+
+func (p *twoQPolicy) remove(item *CacheItem, evicted bool) {
+	if item.protected {
+		p.main.Remove(item.elem)
+		p.mainBytes -= item.cost
+		return
+	}
+	p.in.Remove(item.elem)
+	p.inBytes -= item.cost
+	if !evicted {
+		return
+	}
+	p.ghosts[item.Key] = p.out.PushFront(&ghost{key: item.Key, size: item.cost})
+	p.outSize += item.cost
+	p.trim()
+}
+
+// trim bounds the remembered ghosts to half the size limit.
+func (p *twoQPolicy) trim() {
+	for p.outSize > p.maxBytes/2 && p.out.Len() > 0 {
+		p.dropGhost(p.out.Back())
+	}
+}
+
+func (p *twoQPolicy) dropGhost(elem *list.Element) {
+	g := elem.Value.(*ghost)
+	p.out.Remove(elem)
+	p.outSize -= g.size
+	delete(p.ghosts, g.key)
+}
+
+// inLimit is the share of the size limit the FIFO may hold while main has entries.
+func (p *twoQPolicy) inLimit() int64 {
+	return p.maxBytes / 4
+}
+
+func (p *twoQPolicy) victim() *CacheItem {
+	if p.in.Len() > 0 && (p.inBytes > p.inLimit() || p.main.Len() == 0) {
+		return back(p.in)
+	}
+	return back(p.main)
+}
+
+func (p *twoQPolicy) walk(fn func(*CacheItem) bool) {
+	inBytes := p.inBytes
+	e1, e2 := p.in.Back(), p.main.Back()
+	for e1 != nil || e2 != nil {
+		var item *CacheItem
+		if e1 != nil && (inBytes > p.inLimit() || e2 == nil) {
+			item, e1 = e1.Value.(*CacheItem), e1.Prev()
+			inBytes -= item.cost
+		} else {
+			item, e2 = e2.Value.(*CacheItem), e2.Prev()
+		}
+		if !fn(item) {
+			return
+		}
+	}
+}
+
+func (p *twoQPolicy) resize(maxBytes int64) {
+	p.maxBytes = maxBytes
+	p.trim()
+}
+
+func (p *twoQPolicy) protectedBytes() int64 { return p.mainBytes }
+
+func (p *twoQPolicy) reset() {
+	p.in.Init()
+	p.main.Init()
+	p.out.Init()
+	p.ghosts = make(map[string]*list.Element)
+	p.inBytes, p.mainBytes, p.outSize = 0, 0, 0
+}
@@ -0,0 +1,72 @@
+package fileserver
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	for _, policy := range []string{PolicyLRU, PolicyLFU, PolicyARC, Policy2Q, PolicySLRU} {
+		t.Run(policy, func(t *testing.T) {
+			c := NewMemoryCache(64*1024, 0, 1)
+			if err := c.SetEvictionPolicy(policy); err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, 1024)
+			for i := 0; i < 1000; i++ {
+				c.Set("/f"+strconv.Itoa(i), data)
+			}
+			if used := c.GetStats().UsedBytes; used > 64*1024 {
+				t.Errorf("cache holds %d bytes, over its 65536 byte limit", used)
+			}
+			c.Set("/last", data)
+			if _, ok := c.Get("/last"); !ok {
+				t.Error("the newest entry was evicted")
+			}
+		})
+	}
+	if err := NewMemoryCache(1024, 0, 1).SetEvictionPolicy("mru"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+// benchmarkPolicy replays a Zipf-distributed stream of requests for 10,000
+// files of 1 KiB against a cache holding a tenth of them under policy,
+// filling it on every miss, and reports the hit ratio.
+func benchmarkPolicy(b *testing.B, policy string) {
+	const files, fileSize = 10000, 1024
+	c := NewMemoryCache(files/10*fileSize, 0, 1)
+	if err := c.SetEvictionPolicy(policy); err != nil {
+		b.Fatal(err)
+	}
+	keys := make([]string, files)
+	for i := range keys {
+		keys[i] = "/files/" + strconv.Itoa(i)
+	}
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, files-1)
+	stream := make([]string, 1<<16)
+	for i := range stream {
+		stream[i] = keys[zipf.Uint64()]
+	}
+	data := make([]byte, fileSize)
+
+	var hits int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := stream[i%len(stream)]
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Set(key, data)
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+}
+
+func BenchmarkPolicyLRU(b *testing.B)  { benchmarkPolicy(b, PolicyLRU) }
+func BenchmarkPolicyLFU(b *testing.B)  { benchmarkPolicy(b, PolicyLFU) }
+func BenchmarkPolicyARC(b *testing.B)  { benchmarkPolicy(b, PolicyARC) }
+func BenchmarkPolicy2Q(b *testing.B)   { benchmarkPolicy(b, Policy2Q) }
+func BenchmarkPolicySLRU(b *testing.B) { benchmarkPolicy(b, PolicySLRU) }
@@ -0,0 +1,149 @@
+package fileserver
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// prefetchCheckInterval is how often hot files are checked; entries
+	// expiring within twice this are refreshed ahead of time.
+	prefetchCheckInterval = 5 * time.Second
+	// maxTrackedPaths bounds the request counters of one window.
+	maxTrackedPaths = 100000
+	// maxHotFiles bounds how many files are kept prefetched at once.
+	maxHotFiles = 1000
+)
+
+// hotFiles counts requests per file over fixed windows. A file requested at
+// least -prefetchThreshold times in a window becomes hot, and stays hot for
+// as long as every following window reaches the threshold too.
+type hotFiles struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+	hot         map[string]string // file path -> URL path
+}
+
+func newHotFiles() *hotFiles {
+	return &hotFiles{
+		windowStart: time.Now(),
+		counts:      make(map[string]int),
+		hot:         make(map[string]string),
+	}
+}
+
+// record counts a request for filePath.
+func (hf *hotFiles) record(cfg *Config, urlPath, filePath string) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	hf.rotate(cfg, time.Now())
+	n, ok := hf.counts[filePath]
+	if !ok && len(hf.counts) >= maxTrackedPaths {
+		return
+	}
+	n++
+	hf.counts[filePath] = n
+	if _, hot := hf.hot[filePath]; !hot && n >= cfg.PrefetchThreshold && len(hf.hot) < maxHotFiles {
+		hf.hot[filePath] = urlPath
+	}
+}
+
+// rotate starts a new window once the current one is over, cooling down the
+// hot files that fell below the threshold in it.
+func (hf *hotFiles) rotate(cfg *Config, now time.Time) {
+	if now.Sub(hf.windowStart) < cfg.PrefetchWindow {
+		return
+	}
+	for filePath := range hf.hot {
+		if hf.counts[filePath] < cfg.PrefetchThreshold {
+			delete(hf.hot, filePath)
+		}
+	}
+	hf.counts = make(map[string]int)
+	hf.windowStart = now
+}
+
+// snapshot returns the current hot files.
+func (hf *hotFiles) snapshot(cfg *Config) map[string]string {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	hf.rotate(cfg, time.Now())
+	out := make(map[string]string, len(hf.hot))
+	for filePath, urlPath := range hf.hot {
+		out[filePath] = urlPath
+	}
+	return out
+}
+
+// forget stops prefetching filePath until it becomes hot again.
+func (hf *hotFiles) forget(filePath string) {
+	hf.mu.Lock()
+	delete(hf.hot, filePath)
+	hf.mu.Unlock()
+}
+
+// StartPrefetcher keeps hot and pinned files in the cache: those evicted or
+// invalidated are read back in, and those about to expire are refreshed, so
+// the next request for a popular file never waits on a cold read. It follows
+// config reloads and stops with Close.
+func (h *FileHandler) StartPrefetcher() {
+	go func() {
+		ticker := time.NewTicker(prefetchCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-h.prefetchWake:
+			case <-h.ctx.Done():
+				return
+			}
+			h.prefetch(h.cfg.Load())
+		}
+	}()
+}
+
+// wakePrefetcher runs a prefetch pass now rather than at the next tick.
+func (h *FileHandler) wakePrefetcher() {
+	select {
+	case h.prefetchWake <- struct{}{}:
+	default:
+	}
+}
+
+// prefetch runs one pass over the hot and pinned files.
+func (h *FileHandler) prefetch(cfg *Config) {
+	files := h.pinnedFiles()
+	if cfg.PrefetchThreshold > 0 {
+		for filePath, urlPath := range h.hot.snapshot(cfg) {
+			files[filePath] = urlPath
+		}
+	}
+	refreshBefore := time.Now().Add(2 * prefetchCheckInterval)
+	for filePath, urlPath := range files {
+		if h.ctx.Err() != nil {
+			return
+		}
+		if !h.symlinkAllowed(cfg, filePath) {
+			continue
+		}
+		if expires, ok := h.cache.Expiry(filePath); ok && (expires.IsZero() || expires.After(refreshBefore)) {
+			continue
+		}
+		results, _ := h.fetchShared(cfg, urlPath, filePath, nil)
+		res := <-results
+		switch err := res.Err; {
+		case err == nil:
+			h.store(cfg, urlPath, filePath, res.Val.(*readResult).data)
+		case errors.Is(err, errNoReadMemory):
+			// Memory is tight; a later pass will try again
+		case os.IsNotExist(err), errors.Is(err, errTooLargeToCache), errors.Is(err, errIsDirectory):
+			h.hot.forget(filePath)
+		default:
+			log.Printf("Error prefetching %s: %v", urlPath, err)
+		}
+	}
+}
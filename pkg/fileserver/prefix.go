@@ -0,0 +1,39 @@
+package fileserver
+
+import (
+	"net/http"
+	"strings"
+)
+
+// mountAt serves h under prefix (e.g. "/files"), stripping it before the
+// request reaches any handler so paths, auth rules and ACLs stay relative to
+// the served root. Requests outside the prefix get 404, and the bare prefix
+// redirects to its trailing-slash form.
+func mountAt(prefix string, h http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return h
+	}
+	strip := http.StripPrefix(prefix, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
+
+// externalPath returns the path clients use to reach urlPath, i.e. with
+// -urlPrefix in front, for redirects, Location headers and listings.
+func externalPath(cfg *Config, urlPath string) string {
+	return strings.TrimSuffix(cfg.URLPrefix, "/") + urlPath
+}
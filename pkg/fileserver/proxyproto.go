@@ -0,0 +1,158 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyListener accepts connections that start with a PROXY protocol header
+// (v1 text or v2 binary), as sent by HAProxy or a cloud load balancer, and
+// reports the client address from the header as the connection's remote
+// address. Connections without a valid header are refused.
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, timeout: pl.timeout}, nil
+}
+
+// proxyConn reads the header on first use, in the connection's own goroutine
+// rather than in Accept, so a slow client can't hold up other connections.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func (pc *proxyConn) init() {
+	pc.once.Do(func() {
+		pc.reader = bufio.NewReader(pc.Conn)
+		if pc.timeout > 0 {
+			pc.Conn.SetReadDeadline(time.Now().Add(pc.timeout))
+			defer pc.Conn.SetReadDeadline(time.Time{})
+		}
+		pc.remote, pc.err = readProxyHeader(pc.reader)
+		if pc.err != nil {
+			log.Printf("Rejecting connection from %v: bad PROXY protocol header: %v", pc.Conn.RemoteAddr(), pc.err)
+			pc.Conn.Close()
+		}
+	})
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	pc.init()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.reader.Read(p)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.init()
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a PROXY protocol header from r. It returns the
+// source address, or nil for health checks by the proxy itself (v1 UNKNOWN,
+// v2 LOCAL) and address families other than TCP over IPv4/IPv6.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if prefix, err := r.Peek(6); err != nil || string(prefix) != "PROXY " {
+		return nil, errors.New("missing header")
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes, CRLF included
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("v1 header too long or not CRLF-terminated")
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", header)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", header[12]&0x0f)
+	}
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,489 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quotaDirName holds the ledger of who uploaded which file, for per-user
+// quotas, under the served root. It is never served.
+const quotaDirName = ".quota"
+
+// quotaRescanInterval is how long usage is tracked from the server's own
+// writes before it is measured on disk again, picking up changes made by
+// other means (SFTP, the filesystem itself).
+const quotaRescanInterval = 5 * time.Minute
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// QuotaRule limits the bytes stored under a top-level directory (Dir, e.g.
+// "/photos", or "/*" for every one without a rule of its own) or owned by an
+// authenticated user (User, or "*" for every user without a rule of their
+// own). A user owns the files they uploaded.
+type QuotaRule struct {
+	Dir   string `yaml:"dir"`
+	User  string `yaml:"user"`
+	Bytes int64  `yaml:"bytes"`
+}
+
+// ParseQuotaRules parses a comma-separated list of target=bytes pairs, where
+// target is a top-level directory ("/photos" or "/*") or "user:NAME" ("user:*").
+func ParseQuotaRules(s string) ([]QuotaRule, error) {
+	var rules []QuotaRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		target, value, ok := strings.Cut(part, "=")
+		bytes, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid quota %q: expected /dir=bytes or user:NAME=bytes", part)
+		}
+		if user, ok := strings.CutPrefix(target, "user:"); ok {
+			rules = append(rules, QuotaRule{User: user, Bytes: bytes})
+		} else {
+			rules = append(rules, QuotaRule{Dir: target, Bytes: bytes})
+		}
+	}
+	return rules, nil
+}
+
+// validate reports what is wrong with the rule, if anything.
+func (rule QuotaRule) validate() error {
+	switch {
+	case (rule.Dir == "") == (rule.User == ""):
+		return errors.New("quota must name either a directory or a user")
+	case rule.Dir != "" && rule.Dir != "/*" && quotaDir(rule.Dir+"/") != rule.Dir:
+		return fmt.Errorf("quota directory %q must be a top-level directory like /photos", rule.Dir)
+	case rule.Bytes <= 0:
+		return fmt.Errorf("quota for %s must be positive", rule.target())
+	}
+	return nil
+}
+
+func (rule QuotaRule) target() string {
+	if rule.User != "" {
+		return "user:" + rule.User
+	}
+	return rule.Dir
+}
+
+// quotaRulesFlag adapts a []QuotaRule to flag.Value using the ParseQuotaRules syntax.
+type quotaRulesFlag []QuotaRule
+
+func (f *quotaRulesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		parts = append(parts, rule.target()+"="+strconv.FormatInt(rule.Bytes, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *quotaRulesFlag) Set(s string) error {
+	rules, err := ParseQuotaRules(s)
+	if err != nil {
+		return err
+	}
+	*f = rules
+	return nil
+}
+
+// quotaDir returns the top-level directory the file at urlPath lies in, or ""
+// for files directly in the root and in internal directories.
+func quotaDir(urlPath string) string {
+	top, _, ok := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	if !ok || top == "" || isInternalPath("/"+top) {
+		return ""
+	}
+	return "/" + top
+}
+
+// quotaLimits returns the limits on the directory dir and on user, 0 meaning
+// none. Rules naming the directory or user win over "*".
+func quotaLimits(rules []QuotaRule, dir, user string) (dirLimit, userLimit int64) {
+	var anyDir, anyUser int64
+	for _, rule := range rules {
+		switch {
+		case dir != "" && rule.Dir == dir:
+			dirLimit = rule.Bytes
+		case dir != "" && rule.Dir == "/*":
+			anyDir = rule.Bytes
+		case user != "" && rule.User == user:
+			userLimit = rule.Bytes
+		case user != "" && rule.User == "*":
+			anyUser = rule.Bytes
+		}
+	}
+	if dirLimit == 0 {
+		dirLimit = anyDir
+	}
+	if userLimit == 0 {
+		userLimit = anyUser
+	}
+	return dirLimit, userLimit
+}
+
+// Quotas tracks the usage of a served directory against -quotas. Usage is
+// measured on disk when first needed and then kept up to date from the
+// server's own writes until quotaRescanInterval has passed.
+//
+// Uploads are checked against the usage when they start, so concurrent
+// uploads to the same directory or by the same user may together overshoot
+// a quota by up to their size.
+type Quotas struct {
+	baseDir string
+
+	mu     sync.Mutex
+	dirs   map[string]*quotaUsage // by top-level directory
+	users  map[string]*quotaUsage
+	owners map[string]string // URL path -> user who uploaded it; nil until loaded
+}
+
+type quotaUsage struct {
+	bytes    int64
+	measured time.Time
+}
+
+// QuotaStatus is a quota and its usage, as reported by ?quota.
+type QuotaStatus struct {
+	Dir   string `json:"dir,omitempty"`
+	User  string `json:"user,omitempty"`
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used"`
+}
+
+func NewQuotas(baseDir string) *Quotas {
+	return &Quotas{
+		baseDir: baseDir,
+		dirs:    make(map[string]*quotaUsage),
+		users:   make(map[string]*quotaUsage),
+	}
+}
+
+// Status returns the quotas that apply to uploads into the top-level
+// directory dir (or the root, if empty) by user.
+func (q *Quotas) Status(cfg *Config, dir, user string) ([]QuotaStatus, error) {
+	dirLimit, userLimit := quotaLimits(cfg.Quotas, dir, user)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := []QuotaStatus{}
+	if dirLimit > 0 {
+		used, err := q.dirUsage(dir)
+		if err != nil {
+			return nil, err
+		}
+		status = append(status, QuotaStatus{Dir: dir, Limit: dirLimit, Used: used})
+	}
+	if userLimit > 0 {
+		used, err := q.userUsage(user)
+		if err != nil {
+			return nil, err
+		}
+		status = append(status, QuotaStatus{User: user, Limit: userLimit, Used: used})
+	}
+	return status, nil
+}
+
+// quotaCharge is an upload being checked against the quotas on its target.
+// A nil charge, for servers without quotas, allows everything.
+type quotaCharge struct {
+	q       *Quotas
+	urlPath string
+	dir     string
+	user    string
+	// Replaced file, whose bytes are freed by the upload
+	oldSize  int64
+	oldOwner string
+	// remaining is how large the upload may be.
+	remaining int64
+}
+
+// charge starts an upload to urlPath by user, failing with errQuotaExceeded
+// if a quota on it is already used up.
+func (q *Quotas) charge(cfg *Config, urlPath, user string) (*quotaCharge, error) {
+	if len(cfg.Quotas) == 0 {
+		return nil, nil
+	}
+	c := &quotaCharge{q: q, urlPath: urlPath, dir: quotaDir(urlPath), user: user, remaining: math.MaxInt64}
+	dirLimit, userLimit := quotaLimits(cfg.Quotas, c.dir, user)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.loadOwners(); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filepath.Join(q.baseDir, urlPath)); err == nil && info.Mode().IsRegular() {
+		c.oldSize, c.oldOwner = info.Size(), q.owners[urlPath]
+	}
+	if dirLimit > 0 {
+		used, err := q.dirUsage(c.dir)
+		if err != nil {
+			return nil, err
+		}
+		c.remaining = min(c.remaining, dirLimit-used+c.oldSize)
+	}
+	if userLimit > 0 {
+		used, err := q.userUsage(user)
+		if err != nil {
+			return nil, err
+		}
+		freed := int64(0)
+		if c.oldOwner == user {
+			freed = c.oldSize
+		}
+		c.remaining = min(c.remaining, userLimit-used+freed)
+	}
+	if c.remaining <= 0 {
+		return nil, errQuotaExceeded
+	}
+	return c, nil
+}
+
+// allows reports whether an upload of size bytes fits.
+func (c *quotaCharge) allows(size int64) bool {
+	return c == nil || size <= c.remaining
+}
+
+// limit returns r failing with errQuotaExceeded once it yields more than fits.
+func (c *quotaCharge) limit(r io.Reader) io.Reader {
+	if c == nil || c.remaining == math.MaxInt64 {
+		return r
+	}
+	return &quotaReader{r: r, remaining: c.remaining}
+}
+
+// commit accounts for the upload having stored size bytes.
+func (c *quotaCharge) commit(size int64) {
+	if c == nil {
+		return
+	}
+	q := c.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.adjust(q.dirs, c.dir, size-c.oldSize)
+	q.adjust(q.users, c.oldOwner, -c.oldSize)
+	q.adjust(q.users, c.user, size)
+	if c.user != c.oldOwner {
+		if c.user == "" {
+			delete(q.owners, c.urlPath)
+		} else {
+			q.owners[c.urlPath] = c.user
+		}
+		q.saveOwners()
+	}
+}
+
+// released accounts for the file at urlPath, of size bytes, having been
+// deleted or moved into the trash.
+func (q *Quotas) released(urlPath string, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.adjust(q.dirs, quotaDir(urlPath), -size)
+	if owner, ok := q.owners[urlPath]; ok {
+		q.adjust(q.users, owner, -size)
+		delete(q.owners, urlPath)
+		q.saveOwners()
+	}
+}
+
+// chargeMove fails with errQuotaExceeded if moving the file or directory at
+// filePath from oldPath to newPath would overfill the quota on the top-level
+// directory it moves into. Ownership doesn't change, so user quotas can't be.
+func (q *Quotas) chargeMove(cfg *Config, oldPath, newPath, filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil || len(cfg.Quotas) == 0 {
+		return nil // The move itself reports a missing file
+	}
+	size := info.Size()
+	if info.IsDir() {
+		// Judged by where the files inside end up
+		oldPath, newPath = oldPath+"/", newPath+"/"
+		size = 0
+		filepath.WalkDir(filePath, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				if info, err := d.Info(); err == nil {
+					size += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+	if quotaDir(oldPath) == quotaDir(newPath) {
+		return nil
+	}
+	charge, err := q.charge(cfg, newPath, "")
+	if err == nil && !charge.allows(size) {
+		err = errQuotaExceeded
+	}
+	return err
+}
+
+// moved accounts for the file or directory at oldPath having been renamed to
+// newPath, or deleted if newPath is "". Ledger entries under it follow, and
+// usage is measured on disk again when next needed.
+func (q *Quotas) moved(oldPath, newPath string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	clear(q.dirs)
+	clear(q.users)
+	var changed bool
+	moved := make(map[string]string)
+	for urlPath, owner := range q.owners {
+		if urlPath == oldPath || strings.HasPrefix(urlPath, oldPath+"/") {
+			delete(q.owners, urlPath)
+			if newPath != "" {
+				moved[newPath+urlPath[len(oldPath):]] = owner
+			}
+			changed = true
+		}
+	}
+	for urlPath, owner := range moved {
+		q.owners[urlPath] = owner
+	}
+	if changed {
+		q.saveOwners()
+	}
+}
+
+// adjust applies a change of delta bytes to the measured usage of key.
+func (q *Quotas) adjust(usage map[string]*quotaUsage, key string, delta int64) {
+	if u, ok := usage[key]; ok && key != "" {
+		u.bytes = max(u.bytes+delta, 0)
+	}
+}
+
+// dirUsage returns the bytes stored under the top-level directory dir,
+// measuring them if they are unknown or due for a rescan.
+func (q *Quotas) dirUsage(dir string) (int64, error) {
+	if u, ok := q.dirs[dir]; ok && time.Since(u.measured) < quotaRescanInterval {
+		return u.bytes, nil
+	}
+	var used int64
+	err := filepath.WalkDir(filepath.Join(q.baseDir, dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if info, err := d.Info(); err == nil {
+			used += info.Size()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	q.dirs[dir] = &quotaUsage{bytes: used, measured: time.Now()}
+	return used, nil
+}
+
+// userUsage returns the bytes in the files user uploaded, measuring them if
+// they are unknown or due for a rescan. Files since removed by other means
+// are dropped from the ledger.
+func (q *Quotas) userUsage(user string) (int64, error) {
+	if u, ok := q.users[user]; ok && time.Since(u.measured) < quotaRescanInterval {
+		return u.bytes, nil
+	}
+	if err := q.loadOwners(); err != nil {
+		return 0, err
+	}
+	var used int64
+	var gone bool
+	for urlPath, owner := range q.owners {
+		if owner != user {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(q.baseDir, urlPath))
+		if err != nil {
+			delete(q.owners, urlPath)
+			gone = true
+			continue
+		}
+		used += info.Size()
+	}
+	if gone {
+		q.saveOwners()
+	}
+	q.users[user] = &quotaUsage{bytes: used, measured: time.Now()}
+	return used, nil
+}
+
+func (q *Quotas) ownersPath() string {
+	return filepath.Join(q.baseDir, quotaDirName, "owners.json")
+}
+
+// loadOwners reads the ownership ledger, once.
+func (q *Quotas) loadOwners() error {
+	if q.owners != nil {
+		return nil
+	}
+	owners := make(map[string]string)
+	raw, err := os.ReadFile(q.ownersPath())
+	if err == nil {
+		err = json.Unmarshal(raw, &owners)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("quota ledger: %w", err)
+	}
+	q.owners = owners
+	return nil
+}
+
+// saveOwners writes the ownership ledger back. A failure is only logged: the
+// usage in memory stays right, and the ledger is rewritten on the next change.
+func (q *Quotas) saveOwners() {
+	raw, err := json.Marshal(q.owners)
+	if err == nil {
+		_, err = writeFileAtomic(q.ownersPath(), bytes.NewReader(raw))
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to save the quota ledger: %v", err)
+	}
+}
+
+// serveQuota answers ?quota with the quotas on uploads to urlPath by the
+// requesting user and their usage, as JSON.
+func (h *FileHandler) serveQuota(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) {
+	target := urlPath
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		target += "/"
+	}
+	status, err := h.quotas.Status(cfg, quotaDir(target), authenticatedUser(r))
+	if err != nil {
+		logf(r, "Error measuring quota usage for %s: %v", urlPath, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, status)
+}
+
+// quotaReader fails with errQuotaExceeded once more than remaining bytes are read.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	qr.remaining -= int64(n)
+	if qr.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
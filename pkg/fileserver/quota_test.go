@@ -0,0 +1,144 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseQuotaRules(t *testing.T) {
+	rules, err := ParseQuotaRules("/photos=100, /*=10,user:alice=50,user:*=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []QuotaRule{{Dir: "/photos", Bytes: 100}, {Dir: "/*", Bytes: 10}, {User: "alice", Bytes: 50}, {User: "*", Bytes: 5}}
+	if len(rules) != len(want) {
+		t.Fatalf("ParseQuotaRules = %v, want %v", rules, want)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, rules[i], want[i])
+		}
+	}
+	for _, bad := range []string{"/photos", "/photos=lots", "user:bob"} {
+		if _, err := ParseQuotaRules(bad); err == nil {
+			t.Errorf("ParseQuotaRules(%q) succeeded", bad)
+		}
+	}
+	if err := (QuotaRule{Dir: "/a/b", Bytes: 1}).validate(); err == nil {
+		t.Error("a nested quota directory validated")
+	}
+}
+
+func TestDirectoryQuota(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.Quotas = []QuotaRule{{Dir: "/a", Bytes: 10}}
+	})
+	writeTestFile(t, h.baseDir, "a/old.txt", "1234")
+
+	put := func(path, body string, want int) {
+		t.Helper()
+		if w := serveTest(h, http.MethodPut, path, "", body); w.Code != want {
+			t.Errorf("PUT %s (%d bytes) = %d, want %d", path, len(body), w.Code, want)
+		}
+	}
+	put("/a/x.txt", "123456", http.StatusCreated) // 10 of 10 bytes used
+	put("/a/y.txt", "1", http.StatusInsufficientStorage)
+	put("/a/x.txt", "1234567", http.StatusInsufficientStorage)
+	put("/a/x.txt", "12", http.StatusNoContent) // a replacement frees the old bytes
+	put("/b/big.txt", strings.Repeat("x", 100), http.StatusCreated)
+	if _, err := os.Stat(filepath.Join(h.baseDir, "a", "y.txt")); !os.IsNotExist(err) {
+		t.Error("upload over quota was stored")
+	}
+
+	if w := serveTest(h, http.MethodDelete, "/a/old.txt", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want 204", w.Code)
+	}
+	put("/a/y.txt", "12345678", http.StatusCreated) // 2 + 8 after the delete
+
+	w := serveTest(h, http.MethodGet, "/a/?quota", "", "")
+	var status []QuotaStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("?quota answered %q: %v", w.Body.String(), err)
+	}
+	if len(status) != 1 || status[0] != (QuotaStatus{Dir: "/a", Limit: 10, Used: 10}) {
+		t.Errorf("?quota = %+v, want /a with 10 of 10 bytes used", status)
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.Quotas = []QuotaRule{{User: "alice", Bytes: 10}, {User: "*", Bytes: 5}}
+	})
+	put := func(user, path, body string, want int) {
+		t.Helper()
+		if w := serveTest(h, http.MethodPut, path, user, body); w.Code != want {
+			t.Errorf("PUT %s (%d bytes) as %q = %d, want %d", path, len(body), user, w.Code, want)
+		}
+	}
+	put("alice", "/one/a.txt", "12345678", http.StatusCreated)
+	put("alice", "/two/b.txt", "123", http.StatusInsufficientStorage) // counted across directories
+	put("bob", "/two/b.txt", "12345", http.StatusCreated)
+	put("bob", "/two/c.txt", "1", http.StatusInsufficientStorage)
+	put("", "/two/d.txt", strings.Repeat("x", 100), http.StatusCreated) // anonymous uploads own nothing
+
+	// Ownership survives a restart
+	h2 := NewFileHandler(h.cfg.Load(), NewMemoryCache(1<<20, 0, 1), NewLocalStorage(h.baseDir))
+	defer h2.Close()
+	if w := serveTest(h2, http.MethodPut, "/two/e.txt", "alice", "123"); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("PUT after a restart = %d, want 507", w.Code)
+	}
+}
+
+func TestQuotaChargeLimitsBody(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.Quotas = []QuotaRule{{Dir: "/*", Bytes: 4}}
+	})
+	// Without a Content-Length the body is cut off as it overflows
+	r := httptest.NewRequest(http.MethodPut, "/a/x.txt", strings.NewReader("123456789"))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("PUT of unknown length over quota = %d, want 507", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(h.baseDir, "a", "x.txt")); !os.IsNotExist(err) {
+		t.Error("upload over quota was stored")
+	}
+}
+
+// Users signed in through an auth rule write without the write token, and
+// their uploads are charged to them.
+func TestUserQuotaWithWriteToken(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users", "alice:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n") // password "test"
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.WriteToken = "w"
+		cfg.AuthRules = []AuthRule{{Prefix: "/", Public: true, Htpasswd: filepath.Join(dir, "users")}}
+		cfg.Quotas = []QuotaRule{{User: "alice", Bytes: 10}}
+	})
+	a, err := NewAuthenticator(h.cfg.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := a.Wrap(h)
+	put := func(path, body string, signIn bool, want int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		if signIn {
+			req.SetBasicAuth("alice", "test")
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("PUT %s (%d bytes, signed in: %v) = %d, want %d", path, len(body), signIn, w.Code, want)
+		}
+	}
+	put("/a.txt", "12345678", true, http.StatusCreated)
+	put("/b.txt", "123", true, http.StatusInsufficientStorage)
+	put("/c.txt", "1", false, http.StatusUnauthorized) // anonymous writes still need the token
+}
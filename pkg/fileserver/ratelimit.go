@@ -0,0 +1,123 @@
+package fileserver
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdle is how long a client's bucket is kept after its last request.
+const rateLimiterIdle = 10 * time.Minute
+
+// RateLimiter enforces a per-client-IP token bucket in front of the server.
+type RateLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	clients  map[string]*clientLimiter
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a limiter from cfg and starts dropping idle clients in
+// the background until Close is called. A zero -rateLimit disables limiting.
+func NewRateLimiter(cfg *Config) (*RateLimiter, error) {
+	rl := &RateLimiter{
+		clients: make(map[string]*clientLimiter),
+		stop:    make(chan struct{}),
+	}
+	if err := rl.Reload(cfg); err != nil {
+		return nil, err
+	}
+	go rl.cleanup()
+	return rl, nil
+}
+
+// Reload applies new limits. Existing buckets are reset when the limits change.
+func (rl *RateLimiter) Reload(cfg *Config) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	limit := rate.Limit(cfg.RateLimit)
+	if limit != rl.limit || cfg.RateBurst != rl.burst {
+		rl.clients = make(map[string]*clientLimiter)
+	}
+	rl.limit = limit
+	rl.burst = cfg.RateBurst
+	return nil
+}
+
+// Close stops the cleanup goroutine.
+func (rl *RateLimiter) Close() {
+	rl.stopOnce.Do(func() { close(rl.stop) })
+}
+
+// Wrap returns next guarded by the limiter. Clients over their budget get 429
+// with a Retry-After telling them when the next request would be accepted.
+func (rl *RateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delay, ok := rl.reserve(r); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reserve takes a token for the client of r. If none is available it reports
+// false and how long until one will be.
+func (rl *RateLimiter) reserve(r *http.Request) (time.Duration, bool) {
+	rl.mu.Lock()
+	if rl.limit <= 0 {
+		rl.mu.Unlock()
+		return 0, true
+	}
+	ip := clientIP(r)
+	client, ok := rl.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[ip] = client
+	}
+	now := time.Now()
+	client.lastSeen = now
+	rl.mu.Unlock()
+
+	res := client.limiter.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Second, false
+	}
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// cleanup periodically forgets clients that have been idle for rateLimiterIdle.
+func (rl *RateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rl.mu.Lock()
+			for ip, client := range rl.clients {
+				if time.Since(client.lastSeen) > rateLimiterIdle {
+					delete(rl.clients, ip)
+				}
+			}
+			rl.mu.Unlock()
+		case <-rl.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package fileserver
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// HedgingReader wraps a file to monitor its read speed. Once the read has run
+// for checkTime, it calls onSlow (once) whenever the throughput over the last
+// window drops below minSpeed, but keeps reading so the caller can race a
+// second read against it. A timer repeats the check throughout the transfer,
+// so a read that starts fast and then stalls outright is caught too.
+type HedgingReader struct {
+	file      io.Reader
+	ctx       context.Context
+	startTime time.Time
+	checkTime time.Duration
+	window    time.Duration
+	minSpeed  float64 // Mbps
+	onSlow    func()
+	slowOnce  sync.Once
+
+	mu        sync.Mutex
+	bytesRead int64
+	samples   []speedSample // progress points, oldest first
+	timer     *time.Timer
+	stopped   bool
+	checked   bool // speed at checkTime recorded
+}
+
+// speedSample records how many bytes had been read at a point in time.
+type speedSample struct {
+	at    time.Time
+	total int64
+}
+
+func NewHedgingReader(ctx context.Context, file io.Reader, checkTime, window time.Duration, minSpeed float64, onSlow func()) *HedgingReader {
+	now := time.Now()
+	r := &HedgingReader{
+		file:      file,
+		ctx:       ctx,
+		startTime: now,
+		checkTime: checkTime,
+		window:    window,
+		minSpeed:  minSpeed,
+		onSlow:    onSlow,
+		samples:   []speedSample{{at: now}},
+	}
+	r.timer = time.AfterFunc(checkTime, r.tick)
+	return r
+}
+
+// Stop ends monitoring once the read is done.
+func (r *HedgingReader) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopped = true
+	r.timer.Stop()
+}
+
+func (r *HedgingReader) Read(p []byte) (n int, err error) {
+	// Respect context cancellation
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err = r.file.Read(p)
+	r.mu.Lock()
+	r.bytesRead += int64(n)
+	r.samples = append(r.samples, speedSample{at: time.Now(), total: r.bytesRead})
+	r.mu.Unlock()
+	r.checkSpeed()
+
+	return n, err
+}
+
+// tick runs the periodic check and re-arms the timer until the read is slow or done.
+func (r *HedgingReader) tick() {
+	if r.checkSpeed() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.stopped {
+		r.timer.Reset(max(r.window/4, 10*time.Millisecond))
+	}
+}
+
+// checkSpeed calls onSlow if we are past the checkTime interval and the
+// throughput over the last window is below minSpeed. It reports whether the
+// read was found slow.
+func (r *HedgingReader) checkSpeed() bool {
+	now := time.Now()
+	if now.Sub(r.startTime) < r.checkTime {
+		return false
+	}
+
+	r.mu.Lock()
+	// Measure from the newest sample at or before the window start (or the
+	// start of the read), dropping the ones before it.
+	cutoff := now.Add(-r.window)
+	i := 0
+	for i+1 < len(r.samples) && !r.samples[i+1].at.After(cutoff) {
+		i++
+	}
+	r.samples = r.samples[i:]
+	from := r.samples[0]
+	bytes := r.bytesRead - from.total
+	first := !r.checked
+	r.checked = true
+	r.mu.Unlock()
+
+	// Speed in Mbps: (bytes * 8) / (1024 * 1024) / seconds
+	speedMbps := (float64(bytes) * 8) / (1024 * 1024 * now.Sub(from.at).Seconds())
+	if first {
+		readMetrics.speedAtCheck.observe(speedMbps)
+	}
+	if speedMbps >= r.minSpeed {
+		return false
+	}
+	r.slowOnce.Do(r.onSlow)
+	return true
+}
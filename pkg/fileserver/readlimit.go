@@ -0,0 +1,143 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errReadQueueFull is returned when a cold read waited too long for a disk read slot.
+var errReadQueueFull = errors.New("too many concurrent disk reads")
+
+// readSlots is a resizable semaphore bounding concurrent disk reads, so a burst
+// of cache misses can't pile onto a slow mount all at once.
+type readSlots struct {
+	mu     sync.Mutex
+	limit  int // <= 0 means unlimited
+	active int
+	wake   chan struct{} // closed and replaced whenever a slot may have become free
+}
+
+func newReadSlots(limit int) *readSlots {
+	return &readSlots{limit: limit, wake: make(chan struct{})}
+}
+
+// acquire blocks until a slot is free or ctx ends.
+func (s *readSlots) acquire(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.limit <= 0 || s.active < s.limit {
+			s.active++
+			s.mu.Unlock()
+			return nil
+		}
+		wake := s.wake
+		s.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees a slot taken by acquire.
+func (s *readSlots) release() {
+	s.mu.Lock()
+	s.active--
+	s.broadcast()
+	s.mu.Unlock()
+}
+
+// setLimit resizes the semaphore. Reads already running are not interrupted.
+func (s *readSlots) setLimit(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.broadcast()
+	s.mu.Unlock()
+}
+
+// broadcast wakes all waiters. Caller must hold mu.
+func (s *readSlots) broadcast() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// errNoReadMemory is returned when a cold read's buffer doesn't fit
+// -maxReadMemory in time. It counts as errTooLargeToCache, so the file is
+// streamed from disk instead.
+var errNoReadMemory = fmt.Errorf("%w: read buffer memory exhausted", errTooLargeToCache)
+
+// readMemory is a resizable budget, in bytes, for the buffers cache-miss reads
+// fill, so many concurrent cold reads of large files can't exhaust memory
+// before any of them reaches the size-limited cache.
+type readMemory struct {
+	mu    sync.Mutex
+	limit int64 // <= 0 means unlimited
+	used  int64
+	wake  chan struct{} // closed and replaced whenever memory may have been freed
+}
+
+func newReadMemory(limit int64) *readMemory {
+	return &readMemory{limit: limit, wake: make(chan struct{})}
+}
+
+// tryAcquire takes n bytes if they are free right away.
+func (m *readMemory) tryAcquire(n int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limit <= 0 || m.used+n <= m.limit {
+		m.used += n
+		return true
+	}
+	return false
+}
+
+// acquire blocks until n bytes are free or ctx ends. It fails right away with
+// errNoReadMemory if n exceeds the whole budget.
+func (m *readMemory) acquire(ctx context.Context, n int64) error {
+	for {
+		m.mu.Lock()
+		if m.limit <= 0 || m.used+n <= m.limit {
+			m.used += n
+			m.mu.Unlock()
+			return nil
+		}
+		if n > m.limit {
+			m.mu.Unlock()
+			return errNoReadMemory
+		}
+		wake := m.wake
+		m.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes taken by acquire or tryAcquire.
+func (m *readMemory) release(n int64) {
+	m.mu.Lock()
+	m.used -= n
+	m.broadcast()
+	m.mu.Unlock()
+}
+
+// setLimit resizes the budget. Reads already holding memory keep it.
+func (m *readMemory) setLimit(limit int64) {
+	m.mu.Lock()
+	m.limit = limit
+	m.broadcast()
+	m.mu.Unlock()
+}
+
+// broadcast wakes all waiters. Caller must hold mu.
+func (m *readMemory) broadcast() {
+	close(m.wake)
+	m.wake = make(chan struct{})
+}
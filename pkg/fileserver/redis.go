@@ -0,0 +1,308 @@
+package fileserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisMaxIdle bounds the connections kept open between commands.
+const redisMaxIdle = 16
+
+// redisTier is a CacheTier on a Redis server (or anything speaking RESP, like
+// Valkey or KeyDB). Keys are prefix+name and expire after ttl.
+type redisTier struct {
+	addr      string
+	username  string
+	password  string
+	db        int
+	tlsConfig *tls.Config // nil for plain TCP
+	prefix    string
+	ttl       time.Duration
+	// timeout bounds each command including connecting, so a slow or
+	// unreachable Redis degrades to storage reads instead of stalling them.
+	timeout time.Duration
+	idle    chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply from the server. The connection stays usable.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// parseRedisURL splits redis://[[user]:password@]host[:port][/db]; rediss:// uses TLS.
+func parseRedisURL(s string) (addr, username, password string, db int, useTLS bool, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", "", 0, false, err
+	}
+	if (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return "", "", "", 0, false, errors.New("want redis://[:password@]host[:port][/db] or rediss://...")
+	}
+	addr = u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		if db, err = strconv.Atoi(p); err != nil || db < 0 {
+			return "", "", "", 0, false, fmt.Errorf("invalid database %q", p)
+		}
+	}
+	return addr, username, password, db, u.Scheme == "rediss", nil
+}
+
+func newRedisTier(cfg *Config) (*redisTier, error) {
+	addr, username, password, db, useTLS, err := parseRedisURL(cfg.Redis)
+	if err != nil {
+		return nil, err
+	}
+	t := &redisTier{
+		addr:     addr,
+		username: username,
+		password: password,
+		db:       db,
+		prefix:   cfg.RedisPrefix,
+		ttl:      cfg.RedisTTL,
+		timeout:  cfg.RedisTimeout,
+		idle:     make(chan *redisConn, redisMaxIdle),
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		t.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	return t, nil
+}
+
+func (t *redisTier) String() string {
+	return fmt.Sprintf("redis %s/%d", t.addr, t.db)
+}
+
+func (t *redisTier) Get(key string) ([]byte, bool, error) {
+	reply, err := t.do("GET", t.prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	data, ok := reply.([]byte)
+	if !ok || data == nil {
+		return nil, false, nil
+	}
+	return data, true, nil
+}
+
+func (t *redisTier) Set(key string, data []byte) error {
+	args := []any{"SET", t.prefix + key, data}
+	if t.ttl > 0 {
+		args = append(args, "PX", t.ttl.Milliseconds())
+	}
+	_, err := t.do(args...)
+	return err
+}
+
+func (t *redisTier) Delete(key string) error {
+	_, err := t.do("UNLINK", t.prefix+key)
+	return err
+}
+
+func (t *redisTier) DeletePrefix(prefix string) error {
+	pattern := redisGlobEscape(t.prefix+prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := t.do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000)
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]any)
+		if len(keys) > 0 {
+			if _, err := t.do(append([]any{"UNLINK"}, keys...)...); err != nil {
+				return err
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// redisGlobEscape quotes the characters SCAN MATCH treats as wildcards.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\^`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// do sends one command and reads its reply. Arguments are strings, byte
+// slices or integers.
+func (t *redisTier) do(args ...any) (any, error) {
+	conn, err := t.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.roundTrip(t.timeout, args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection or dials, authenticates and selects the
+// database on a new one.
+func (t *redisTier) conn() (*redisConn, error) {
+	select {
+	case conn := <-t.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: t.timeout}
+	var nc net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", t.addr, t.tlsConfig)
+	} else {
+		nc, err = dialer.Dial("tcp", t.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if t.password != "" {
+		args := []any{"AUTH", t.password}
+		if t.username != "" {
+			args = []any{"AUTH", t.username, t.password}
+		}
+		if _, err := conn.roundTrip(t.timeout, args); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	if t.db != 0 {
+		if _, err := conn.roundTrip(t.timeout, []any{"SELECT", t.db}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("SELECT: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) roundTrip(timeout time.Duration, args []any) (any, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	var buf []byte
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		default:
+			return nil, fmt.Errorf("unsupported redis argument %T", arg)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(b)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, b...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply parses one RESP2 reply: a status string, an error, an integer,
+// a bulk string ([]byte, nil if null) or an array ([]any).
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []any(nil), nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = c.readReply()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				// Keep reading so the connection stays in sync
+				items[i] = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
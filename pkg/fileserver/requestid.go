@@ -0,0 +1,127 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// RequestIDs tags every request with an ID for end-to-end correlation: the
+// one the client or proxy sent in the header, if well-formed, or a fresh one.
+// The ID is echoed in the response, added to plain-text error bodies, passed
+// on to the origin and written to the access log and request-scoped log lines.
+type RequestIDs struct {
+	header string
+}
+
+// NewRequestIDs returns nil when -requestIDHeader is empty.
+func NewRequestIDs(cfg *Config) *RequestIDs {
+	if cfg.RequestIDHeader == "" {
+		return nil
+	}
+	return &RequestIDs{header: http.CanonicalHeaderKey(cfg.RequestIDHeader)}
+}
+
+func (ri *RequestIDs) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(ri.header)
+		if !validRequestID(id) {
+			var b [16]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+			r.Header.Set(ri.header, id)
+		}
+		w.Header().Set(ri.header, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID{ri.header, id}))
+		next.ServeHTTP(&requestIDWriter{ResponseWriter: w, id: id}, r)
+	})
+}
+
+type requestID struct {
+	header, id string
+}
+
+// validRequestID accepts IDs of up to 128 characters that are safe to log
+// and echo: letters, digits and a few separators.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDOf returns the ID of r, or "" if request IDs are disabled.
+func requestIDOf(r *http.Request) string {
+	v, _ := r.Context().Value(requestIDKey{}).(requestID)
+	return v.id
+}
+
+// setRequestIDHeader passes r's ID on to an outgoing request made on its behalf.
+func setRequestIDHeader(out, r *http.Request) {
+	if v, ok := r.Context().Value(requestIDKey{}).(requestID); ok {
+		out.Header.Set(v.header, v.id)
+	}
+}
+
+// logf is log.Printf for lines about a request, prefixed with its ID.
+func logf(r *http.Request, format string, args ...interface{}) {
+	if id := requestIDOf(r); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// requestIDWriter appends the request ID to error bodies written by
+// http.Error, so users can quote it when reporting a failure.
+type requestIDWriter struct {
+	http.ResponseWriter
+	id        string
+	errorBody bool
+}
+
+func (rw *requestIDWriter) WriteHeader(status int) {
+	h := rw.Header()
+	// http.Error's signature: plain text with nosniff and no length
+	rw.errorBody = status >= 400 && h.Get("Content-Type") == "text/plain; charset=utf-8" &&
+		h.Get("X-Content-Type-Options") == "nosniff" && h.Get("Content-Length") == ""
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *requestIDWriter) Write(p []byte) (int, error) {
+	if !rw.errorBody {
+		return rw.ResponseWriter.Write(p)
+	}
+	rw.errorBody = false
+	if _, err := rw.ResponseWriter.Write(append(p[:len(p):len(p)], fmt.Sprintf("Request ID: %s\n", rw.id)...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom passes bodies other than error messages straight through, keeping
+// sendfile available.
+func (rw *requestIDWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rw.errorBody {
+		return io.Copy(writerOnly{rw}, src)
+	}
+	return io.Copy(rw.ResponseWriter, src)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *requestIDWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,132 @@
+package fileserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an io.Writer that appends to a file and rotates it once it
+// exceeds maxBytes or has been open longer than maxAge. Rotated files are
+// renamed with a timestamp suffix and only the newest maxBackups are kept.
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// NewRotatingFile opens (or creates) path for appending.
+// A zero maxBytes or maxAge disables that rotation trigger; zero maxBackups keeps all.
+func NewRotatingFile(path string, maxBytes int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.shouldRotate(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
+
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) shouldRotate(incoming int64) bool {
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+incoming > rf.maxBytes {
+		return true
+	}
+	return rf.maxAge > 0 && time.Since(rf.openedAt) >= rf.maxAge
+}
+
+// rotate renames the current file aside and opens a fresh one.
+// Caller must hold mu.
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.%s", rf.path, time.Now().Format("20060102-150405.000"))
+	if err := os.Rename(rf.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.pruneBackups()
+	return nil
+}
+
+// pruneBackups removes the oldest rotated files beyond maxBackups.
+func (rf *RotatingFile) pruneBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		// The timestamp suffix sorts lexically; ignore unrelated files like "access.log.gz".
+		suffix := strings.TrimPrefix(m, rf.path+".")
+		if len(suffix) == len("20060102-150405.000") {
+			backups = append(backups, m)
+		}
+	}
+	if len(backups) <= rf.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-rf.maxBackups] {
+		os.Remove(old)
+	}
+}
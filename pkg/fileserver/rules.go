@@ -0,0 +1,372 @@
+package fileserver
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matchPath reports whether the request path urlPath matches pattern.
+// Patterns use path.Match syntax against the full path ("/live/*.m3u8").
+// A pattern without a slash matches the base name anywhere ("*.m3u8"),
+// and a trailing "/**" matches everything below a directory ("/assets/**").
+func matchPath(pattern, urlPath string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+	}
+	if !strings.Contains(pattern, "/") {
+		urlPath = path.Base(urlPath)
+	}
+	matched, _ := path.Match(pattern, urlPath)
+	return matched
+}
+
+// foldPath returns urlPath as rules see it: lower-cased with
+// -caseInsensitivePaths, where every spelling of a path names the same file.
+func foldPath(cfg *Config, urlPath string) string {
+	if cfg.CaseInsensitivePaths {
+		return strings.ToLower(urlPath)
+	}
+	return urlPath
+}
+
+// matchRule is matchPath ignoring case with -caseInsensitivePaths.
+func matchRule(cfg *Config, pattern, urlPath string) bool {
+	return matchPath(foldPath(cfg, pattern), foldPath(cfg, urlPath))
+}
+
+// internalDirs are top-level directories under the served root that hold server
+// state (soft-deleted and quarantined files, in-progress uploads, quota ledger) and must never be served.
+var internalDirs = []string{trashDirName, tusDirName, partialDirName, quotaDirName, quarantineDirName}
+
+// stagingPrefix starts the names of uploads being written or scanned next to
+// their destination.
+const stagingPrefix = ".upload-"
+
+// isInternalPath reports whether urlPath points into one of internalDirs, in
+// any case, as a case-insensitive volume would serve it, or at an upload
+// still being staged, which mustn't be served before it passes -uploadScan
+// even when dotfiles are.
+func isInternalPath(urlPath string) bool {
+	urlPath = strings.ToLower(urlPath)
+	for _, dir := range internalDirs {
+		if urlPath == "/"+dir || strings.HasPrefix(urlPath, "/"+dir+"/") {
+			return true
+		}
+	}
+	return strings.HasPrefix(path.Base(urlPath), stagingPrefix)
+}
+
+// isHiddenPath reports whether urlPath is hidden by -hideDotfiles or -hide.
+// Patterns without a slash are tried against every path component, so hiding
+// a directory name also hides everything below it.
+func isHiddenPath(cfg *Config, urlPath string) bool {
+	urlPath = foldPath(cfg, urlPath)
+	for _, name := range strings.Split(strings.TrimPrefix(urlPath, "/"), "/") {
+		// ACME challenges and other well-known URIs live under /.well-known
+		if cfg.HideDotfiles && strings.HasPrefix(name, ".") && name != ".well-known" {
+			return true
+		}
+		for _, pattern := range cfg.Hide {
+			if !strings.Contains(pattern, "/") {
+				if matched, _ := path.Match(foldPath(cfg, pattern), name); matched {
+					return true
+				}
+			}
+		}
+	}
+	for _, pattern := range cfg.Hide {
+		if strings.Contains(pattern, "/") && matchRule(cfg, pattern, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// TTLRule overrides the cache TTL for request paths matching Pattern.
+type TTLRule struct {
+	Pattern string        `yaml:"pattern"`
+	TTL     time.Duration `yaml:"ttl"`
+}
+
+// ParseTTLRules parses a comma-separated list of pattern=duration pairs,
+// e.g. "*.m3u8=2s,/static/**=1h".
+func ParseTTLRules(s string) ([]TTLRule, error) {
+	var rules []TTLRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid TTL rule %q: expected pattern=duration", part)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid TTL rule pattern %q: %w", pattern, err)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL rule duration %q: %w", value, err)
+		}
+		rules = append(rules, TTLRule{Pattern: pattern, TTL: ttl})
+	}
+	return rules, nil
+}
+
+// AuthRule protects every request path under Prefix. Public rules allow anonymous
+// access; otherwise a Basic auth user from the Htpasswd file, one of Tokens
+// (as a bearer token) or, with JWT, a signed token scoped to the path is required.
+type AuthRule struct {
+	Prefix   string   `yaml:"prefix"`
+	Public   bool     `yaml:"public"`
+	Htpasswd string   `yaml:"htpasswd"`
+	Tokens   []string `yaml:"tokens"`
+	JWT      bool     `yaml:"jwt"`
+}
+
+// matches reports whether urlPath falls under the rule's prefix. "/public/" also
+// covers "/public" itself so the trailing-slash redirect isn't blocked.
+func (rule AuthRule) matches(urlPath string) bool {
+	return strings.HasPrefix(urlPath, rule.Prefix) || urlPath == strings.TrimSuffix(rule.Prefix, "/")
+}
+
+// ParseAuthRules parses a comma-separated list of prefix=credential pairs, where
+// credential is "public", "jwt", "htpasswd:FILE" or "token:TOKEN". Pairs sharing a prefix
+// are merged, e.g. "/public/=public,/=htpasswd:users.htpasswd,/=token:s3cret".
+func ParseAuthRules(s string) ([]AuthRule, error) {
+	var rules []AuthRule
+	index := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, value, ok := strings.Cut(part, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid auth rule %q: expected /prefix=credential", part)
+		}
+		i, seen := index[prefix]
+		if !seen {
+			i = len(rules)
+			index[prefix] = i
+			rules = append(rules, AuthRule{Prefix: prefix})
+		}
+		switch kind, arg, _ := strings.Cut(value, ":"); {
+		case value == "public":
+			rules[i].Public = true
+		case value == "jwt":
+			rules[i].JWT = true
+		case kind == "htpasswd" && arg != "":
+			rules[i].Htpasswd = arg
+		case kind == "token" && arg != "":
+			rules[i].Tokens = append(rules[i].Tokens, arg)
+		default:
+			return nil, fmt.Errorf("invalid auth rule credential %q: expected public, jwt, htpasswd:FILE or token:TOKEN", value)
+		}
+	}
+	return rules, nil
+}
+
+// ACL actions.
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+	ACLAuth  = "auth" // only requests authenticated by an auth rule
+)
+
+// ACLRule decides access for request paths matching Pattern (matchPath syntax).
+type ACLRule struct {
+	Pattern string `yaml:"pattern"`
+	Action  string `yaml:"action"`
+}
+
+// aclAction returns the action of the first -acl rule matching urlPath, or
+// allow if none does.
+func aclAction(cfg *Config, urlPath string) string {
+	for _, rule := range cfg.ACL {
+		if matchRule(cfg, rule.Pattern, urlPath) {
+			return rule.Action
+		}
+	}
+	return ACLAllow
+}
+
+// ParseACLRules parses a comma-separated, ordered list of pattern=action pairs,
+// e.g. "*.key=deny,/private/**=auth".
+func ParseACLRules(s string) ([]ACLRule, error) {
+	var rules []ACLRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, action, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid ACL rule %q: expected pattern=action", part)
+		}
+		rules = append(rules, ACLRule{Pattern: pattern, Action: action})
+	}
+	return rules, nil
+}
+
+// HedgeRule overrides the hedging settings for request paths matching Pattern,
+// e.g. to relax thresholds for a slow cloud mount or turn hedging off for a
+// local SSD under the same -dir. Zero fields keep the global setting.
+type HedgeRule struct {
+	Pattern      string        `yaml:"pattern"`
+	Disabled     bool          `yaml:"disabled"`
+	CheckTime    time.Duration `yaml:"checkTime"`
+	MinSpeedMbps float64       `yaml:"minSpeedMbps"`
+	HedgedDelay  time.Duration `yaml:"hedgedDelay"`
+}
+
+// ParseHedgeRules parses a comma-separated list of pattern=settings pairs, where
+// settings is "off" or semicolon-separated key:value overrides of checkTime,
+// minSpeedMbps and hedgedDelay, e.g.
+// "/ssd/**=off,/cloud/**=checkTime:3s;minSpeedMbps:1;hedgedDelay:500ms".
+func ParseHedgeRules(s string) ([]HedgeRule, error) {
+	var rules []HedgeRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, settings, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid hedge rule %q: expected pattern=settings", part)
+		}
+		rule := HedgeRule{Pattern: pattern}
+		if settings == "off" {
+			rule.Disabled = true
+			rules = append(rules, rule)
+			continue
+		}
+		for _, setting := range strings.Split(settings, ";") {
+			key, value, _ := strings.Cut(setting, ":")
+			var err error
+			switch key {
+			case "checkTime":
+				rule.CheckTime, err = time.ParseDuration(value)
+			case "minSpeedMbps":
+				rule.MinSpeedMbps, err = strconv.ParseFloat(value, 64)
+			case "hedgedDelay":
+				rule.HedgedDelay, err = time.ParseDuration(value)
+			default:
+				return nil, fmt.Errorf("invalid hedge rule %q: unknown setting %q", part, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid hedge rule %q: %w", part, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// String formats the rule in ParseHedgeRules syntax.
+func (rule HedgeRule) String() string {
+	if rule.Disabled {
+		return rule.Pattern + "=off"
+	}
+	var settings []string
+	if rule.CheckTime > 0 {
+		settings = append(settings, "checkTime:"+rule.CheckTime.String())
+	}
+	if rule.MinSpeedMbps > 0 {
+		settings = append(settings, "minSpeedMbps:"+strconv.FormatFloat(rule.MinSpeedMbps, 'g', -1, 64))
+	}
+	if rule.HedgedDelay > 0 {
+		settings = append(settings, "hedgedDelay:"+rule.HedgedDelay.String())
+	}
+	return rule.Pattern + "=" + strings.Join(settings, ";")
+}
+
+// CacheControlRule sets the Cache-Control header of responses for request
+// paths matching Pattern (matchPath syntax).
+type CacheControlRule struct {
+	Pattern string `yaml:"pattern"`
+	Value   string `yaml:"value"`
+}
+
+// ParseCacheControlRules parses a comma-separated list of pattern=directives
+// pairs. Directives are separated by semicolons since Cache-Control itself uses
+// commas, e.g. "/assets/**=public;max-age=31536000;immutable,/latest/**=no-cache".
+func ParseCacheControlRules(s string) ([]CacheControlRule, error) {
+	var rules []CacheControlRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid Cache-Control rule %q: expected pattern=directives", part)
+		}
+		directives := strings.Split(value, ";")
+		for i := range directives {
+			directives[i] = strings.TrimSpace(directives[i])
+		}
+		rules = append(rules, CacheControlRule{Pattern: pattern, Value: strings.Join(directives, ", ")})
+	}
+	return rules, nil
+}
+
+// String formats the rule in ParseCacheControlRules syntax.
+func (rule CacheControlRule) String() string {
+	return rule.Pattern + "=" + strings.ReplaceAll(rule.Value, ", ", ";")
+}
+
+// cacheControlFor returns the Cache-Control value of the first rule matching
+// urlPath, or "" if none does.
+func cacheControlFor(rules []CacheControlRule, urlPath string) string {
+	for _, rule := range rules {
+		if matchPath(rule.Pattern, urlPath) {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+// maxAge returns the max-age directive of a Cache-Control value.
+func maxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if secs, err := strconv.ParseInt(value, 10, 64); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// HeaderRule adds a static response header to requests for paths matching
+// Pattern (matchPath syntax). Every matching rule applies, later ones winning.
+type HeaderRule struct {
+	Pattern string `yaml:"pattern"`
+	Name    string `yaml:"name"`
+	Value   string `yaml:"value"`
+}
+
+// ParseHeaderRule parses a single pattern=Name: value rule, e.g.
+// "/app/**=Content-Security-Policy: default-src 'self'".
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	pattern, header, ok := strings.Cut(s, "=")
+	name, value, ok2 := strings.Cut(header, ":")
+	if !ok || !ok2 {
+		return HeaderRule{}, fmt.Errorf("invalid header rule %q: expected pattern=Name: value", s)
+	}
+	return HeaderRule{
+		Pattern: strings.TrimSpace(pattern),
+		Name:    strings.TrimSpace(name),
+		Value:   strings.TrimSpace(value),
+	}, nil
+}
+
+// String formats the rule in ParseHeaderRule syntax.
+func (rule HeaderRule) String() string {
+	return rule.Pattern + "=" + rule.Name + ": " + rule.Value
+}
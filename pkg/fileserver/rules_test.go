@@ -0,0 +1,111 @@
+package fileserver
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"*.key", "/a/b/server.key", true},
+		{"*.key", "/a/server.key.txt", false},
+		{"/live/*.m3u8", "/live/a.m3u8", true},
+		{"/live/*.m3u8", "/live/sub/a.m3u8", false},
+		{"/assets/**", "/assets", true},
+		{"/assets/**", "/assets/js/app.js", true},
+		{"/assets/**", "/assetsx/app.js", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.ACL = []ACLRule{
+			{Pattern: "/private/open.txt", Action: ACLAllow},
+			{Pattern: "*.key", Action: ACLDeny},
+			{Pattern: "/private/**", Action: ACLAuth},
+		}
+	})
+	for _, name := range []string{"a.txt", "certs/server.key", "private/a.txt", "private/open.txt"} {
+		writeTestFile(t, h.baseDir, name, "x")
+	}
+
+	tests := []struct {
+		method, path, user string
+		want               int
+	}{
+		{http.MethodGet, "/a.txt", "", http.StatusOK},
+		{http.MethodGet, "/certs/server.key", "", http.StatusForbidden},
+		{http.MethodGet, "/certs/server.key", "alice", http.StatusForbidden},
+		{http.MethodGet, "/private/a.txt", "", http.StatusUnauthorized},
+		{http.MethodGet, "/private/a.txt", "alice", http.StatusOK},
+		{http.MethodGet, "/private/open.txt", "", http.StatusOK}, // first match wins
+		{http.MethodPut, "/private/new.txt", "", http.StatusUnauthorized},
+		{http.MethodPut, "/new.key", "alice", http.StatusForbidden},
+		{http.MethodDelete, "/certs/server.key", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := serveTest(h, tt.method, tt.path, tt.user, "x"); w.Code != tt.want {
+			t.Errorf("%s %s as %q = %d, want %d", tt.method, tt.path, tt.user, w.Code, tt.want)
+		}
+	}
+}
+
+func TestHiddenPaths(t *testing.T) {
+	cfg := DefaultConfig()
+	if isHiddenPath(cfg, "/.env") {
+		t.Error("dotfiles hidden without -hideDotfiles")
+	}
+	cfg.HideDotfiles = true
+	cfg.Hide = []string{"node_modules", "/drafts/**"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/.env", true},
+		{"/a/.git/config", true},
+		{"/.well-known/acme-challenge/x", false},
+		{"/web/node_modules/x.js", true},
+		{"/drafts/a.md", true},
+		{"/posts/drafts/a.md", false},
+		{"/posts/a.md", false},
+	}
+	for _, tt := range tests {
+		if got := isHiddenPath(cfg, tt.path); got != tt.want {
+			t.Errorf("isHiddenPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if !isInternalPath("/a/.upload-123") {
+		t.Error("a staged upload is reachable")
+	}
+}
+
+func TestRulesIgnoreCase(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CaseInsensitivePaths = true
+	cfg.ACL = []ACLRule{{Pattern: "/Private/**", Action: ACLDeny}}
+	cfg.Hide = []string{"*.BAK"}
+	for _, p := range []string{"/private/a", "/PRIVATE/a", "/Private/a"} {
+		if got := aclAction(cfg, p); got != ACLDeny {
+			t.Errorf("aclAction(%q) = %q, want deny", p, got)
+		}
+	}
+	if !isHiddenPath(cfg, "/db.bak") || !isHiddenPath(cfg, "/old/DB.Bak") {
+		t.Error("-hide pattern differing in case didn't hide")
+	}
+	if !isInternalPath("/.TRASH/a.txt") {
+		t.Error("the trash is reachable in upper case")
+	}
+
+	cfg.CaseInsensitivePaths = false
+	if aclAction(cfg, "/private/a") != ACLAllow || isHiddenPath(cfg, "/db.bak") {
+		t.Error("rules ignore case without -caseInsensitivePaths")
+	}
+}
@@ -0,0 +1,574 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the payload hash of a request without a body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Storage reads objects from an S3-compatible bucket: AWS S3, GCS through
+// its XML API (with HMAC keys), MinIO and the like. The object for name is
+// prefix+name, and "directories" are key prefixes ending in a slash.
+type s3Storage struct {
+	client       *http.Client
+	endpoint     *url.URL
+	bucket       string
+	prefix       string // empty or ending in "/"
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	// hedgeAfter duplicates a request whose response headers haven't arrived
+	// in time; the first answer wins. Zero disables it.
+	hedgeAfter time.Duration
+}
+
+// parseStorageURL splits an s3://bucket/prefix or gs://bucket/prefix URL.
+func parseStorageURL(s string) (scheme, bucket, prefix string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", "", err
+	}
+	if (u.Scheme != "s3" && u.Scheme != "gs") || u.Host == "" {
+		return "", "", "", fmt.Errorf("want s3://bucket[/prefix] or gs://bucket[/prefix]")
+	}
+	prefix = strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return u.Scheme, u.Host, prefix, nil
+}
+
+func newS3Storage(cfg *Config) (*s3Storage, error) {
+	scheme, bucket, prefix, err := parseStorageURL(cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Storage{
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   64,
+		}},
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       cfg.S3Region,
+		accessKey:    cfg.S3AccessKey,
+		secretKey:    cfg.S3SecretKey,
+		sessionToken: cfg.S3SessionToken,
+		pathStyle:    cfg.S3PathStyle,
+		hedgeAfter:   cfg.S3HedgeAfter,
+	}
+	endpoint := cfg.S3Endpoint
+	switch {
+	case endpoint != "":
+	case scheme == "gs":
+		endpoint = "https://storage.googleapis.com"
+		s.region = "auto"
+	default:
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	if scheme == "gs" {
+		s.pathStyle = true
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid s3Endpoint: %w", err)
+	}
+	return s, nil
+}
+
+func (s *s3Storage) String() string { return "s3://" + s.bucket + "/" + s.prefix }
+
+// key returns the object key for name.
+func (s *s3Storage) key(name string) string {
+	if name == "." || name == "" {
+		return s.prefix
+	}
+	return s.prefix + name
+}
+
+func (s *s3Storage) Open(name string) (StorageFile, error) {
+	resp, err := s.request(http.MethodGet, s.key(name), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &s3File{s: s, name: name, info: objectInfoFrom(name, resp), body: resp.Body}, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		info, err := s.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return &s3File{s: s, name: name, info: info}, nil
+	default:
+		return nil, s3Error("open", name, resp)
+	}
+}
+
+func (s *s3Storage) Stat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return &objectInfo{name: ".", dir: true}, nil
+	}
+	resp, err := s.request(http.MethodHead, s.key(name), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return objectInfoFrom(name, resp), nil
+	case http.StatusNotFound:
+		// Not an object; it is a directory if any key lives below it
+		list, err := s.list(s.key(name)+"/", "", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Contents) == 0 && len(list.CommonPrefixes) == 0 {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+		return &objectInfo{name: path.Base(name), dir: true}, nil
+	default:
+		return nil, s3Error("stat", name, resp)
+	}
+}
+
+func (s *s3Storage) ReadRange(name string, off, length int64) ([]byte, error) {
+	if length <= 0 {
+		return nil, nil
+	}
+	resp, err := s.request(http.MethodGet, s.key(name), nil, fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The range was ignored; skip to it
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	case http.StatusNotFound:
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	default:
+		return nil, s3Error("read", name, resp)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, length))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *s3Storage) List(name string) ([]fs.DirEntry, error) {
+	prefix := s.key(name)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		list, err := s.list(prefix, token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range list.CommonPrefixes {
+			dirName := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(&objectInfo{name: dirName, dir: true}))
+		}
+		for _, obj := range list.Contents {
+			if obj.Key == prefix {
+				continue // Directory marker
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&objectInfo{
+				name:    strings.TrimPrefix(obj.Key, prefix),
+				size:    obj.Size,
+				modTime: obj.LastModified,
+			}))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	if len(entries) == 0 && name != "." {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// listResult is the part of a ListObjectsV2 response used here.
+type listResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// list returns one page of the keys directly below prefix.
+func (s *s3Storage) list(prefix, token string, maxKeys int) (*listResult, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"delimiter": {"/"},
+		"prefix":    {prefix},
+		"max-keys":  {strconv.Itoa(maxKeys)},
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	resp, err := s.request(http.MethodGet, "", query, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("list", prefix, resp)
+	}
+	var list listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("s3: list %s: %w", prefix, err)
+	}
+	return &list, nil
+}
+
+// request sends a signed request for key (the bucket itself if empty),
+// hedging it after hedgeAfter.
+func (s *s3Storage) request(method, key string, query url.Values, byteRange string) (*http.Response, error) {
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query), nil)
+		if err != nil {
+			return nil, err
+		}
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		s.sign(req, time.Now().UTC())
+		return req, nil
+	}
+	if s.hedgeAfter <= 0 {
+		req, err := newRequest(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return s.client.Do(req)
+	}
+
+	type attempt struct {
+		resp   *http.Response
+		err    error
+		cancel context.CancelFunc
+	}
+	// Buffered so a loser can finish without a reader
+	results := make(chan attempt, 2)
+	launch := func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := newRequest(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		go func() {
+			resp, err := s.client.Do(req)
+			results <- attempt{resp: resp, err: err, cancel: cancel}
+		}()
+		return nil
+	}
+	if err := launch(); err != nil {
+		return nil, err
+	}
+	pending := 1
+	timer := time.NewTimer(s.hedgeAfter)
+	defer timer.Stop()
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if launch() == nil {
+				pending++
+			}
+			continue
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				res.cancel()
+				err = res.err
+				continue
+			}
+			if pending > 0 {
+				// Discard the slower response whenever it arrives
+				go func() {
+					if loser := <-results; loser.err == nil {
+						loser.resp.Body.Close()
+						loser.cancel()
+					}
+				}()
+			}
+			res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: res.cancel}
+			return res.resp, nil
+		}
+	}
+	return nil, err
+}
+
+// cancelOnClose releases a hedged request's context with its body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// objectURL returns the URL of key in the bucket, path-style or virtual-hosted.
+func (s *s3Storage) objectURL(key string, query url.Values) string {
+	u := *s.endpoint
+	p := "/" + key
+	if s.pathStyle {
+		p = "/" + s.bucket + p
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + p
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return u.String()
+}
+
+// sign adds AWS Signature Version 4 headers to req. Without credentials the
+// request stays anonymous, which suits public buckets.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if s.accessKey == "" {
+		return
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes s the way SigV4 expects: everything but
+// unreserved characters, and slashes unless encodeSlash is set.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by key, as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error describes an unexpected response, including the S3 error code.
+func s3Error(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	var body struct {
+		Code string `xml:"Code"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+	if body.Code != "" {
+		return fmt.Errorf("s3: %s %s: %s (%s)", op, name, resp.Status, body.Code)
+	}
+	return fmt.Errorf("s3: %s %s: %s", op, name, resp.Status)
+}
+
+// s3File is an open object. It reads the body of the GET that opened it
+// and, after a seek, continues with a ranged GET from the new position.
+type s3File struct {
+	s    *s3Storage
+	name string
+	info fs.FileInfo
+	body io.ReadCloser
+	pos  int64
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDirectory}
+	}
+	if f.pos >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		resp, err := f.s.request(http.MethodGet, f.s.key(f.name), nil, fmt.Sprintf("bytes=%d-", f.pos))
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			return 0, s3Error("read", f.name, resp)
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	if err == io.EOF && f.pos < f.info.Size() {
+		// The object shrank since it was opened
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, errors.New("s3File.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3File.Seek: negative position")
+	}
+	if offset != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	data, err := f.s.ReadRange(f.name, off, int64(len(p)))
+	n := copy(p, data)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// objectInfo describes an object or key prefix as an fs.FileInfo.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func objectInfoFrom(name string, resp *http.Response) *objectInfo {
+	info := &objectInfo{name: path.Base(name), size: resp.ContentLength}
+	info.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info
+}
+
+func (fi *objectInfo) Name() string       { return fi.name }
+func (fi *objectInfo) Size() int64        { return fi.size }
+func (fi *objectInfo) ModTime() time.Time { return fi.modTime }
+func (fi *objectInfo) IsDir() bool        { return fi.dir }
+func (fi *objectInfo) Sys() any           { return nil }
+
+func (fi *objectInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,211 @@
+package fileserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineDirName holds uploads rejected by -uploadScan, with
+// -uploadScanQuarantine, under the served root. It is never served.
+const quarantineDirName = ".quarantine"
+
+// maxScanReason bounds how much of a scanner's explanation is passed on.
+const maxScanReason = 200
+
+var (
+	errUploadRejected = errors.New("upload rejected by scanner")
+	errScanFailed     = errors.New("upload scanner unavailable")
+)
+
+// scanUpload runs -uploadScan on the upload to urlPath by user, staged at
+// stagedPath, before it is moved into place. A rejected file is removed, or
+// moved into quarantine with -uploadScanQuarantine, and errUploadRejected
+// returned with the scanner's reason. If the scanner can't give a verdict,
+// the upload fails with errScanFailed rather than go unscanned.
+func (h *FileHandler) scanUpload(cfg *Config, urlPath, user, stagedPath string) error {
+	if cfg.UploadScan == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(h.ctx, cfg.UploadScanTimeout)
+	defer cancel()
+
+	var clean bool
+	var reason string
+	var err error
+	switch {
+	case strings.HasPrefix(cfg.UploadScan, "http://"), strings.HasPrefix(cfg.UploadScan, "https://"):
+		clean, reason, err = scanHTTP(ctx, cfg.UploadScan, urlPath, user, stagedPath)
+	case strings.HasPrefix(cfg.UploadScan, "icap://"):
+		clean, reason, err = scanICAP(ctx, cfg.UploadScan, stagedPath)
+	default:
+		clean, reason, err = scanExec(ctx, cfg.UploadScan, urlPath, user, stagedPath)
+	}
+	if err != nil {
+		log.Printf("Upload scan of %s failed: %v", urlPath, err)
+		return errScanFailed
+	}
+	if clean {
+		return nil
+	}
+
+	if len(reason) > maxScanReason {
+		reason = reason[:maxScanReason]
+	}
+	if cfg.UploadScanQuarantine {
+		dest := filepath.Join(h.baseDir, quarantineDirName, urlPath) + "." + time.Now().Format(trashStampFormat)
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err == nil {
+			err = os.Rename(stagedPath, dest)
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to quarantine the upload of %s: %v", urlPath, err)
+		}
+		log.Printf("Upload of %s rejected by scanner (%s), quarantined", urlPath, reason)
+	} else {
+		log.Printf("Upload of %s rejected by scanner (%s)", urlPath, reason)
+	}
+	os.Remove(stagedPath)
+	return fmt.Errorf("%w: %s", errUploadRejected, reason)
+}
+
+// scanExec runs command with the file's path appended. Exit status 0 means
+// clean and 1 rejected, as with clamscan; the first line of output is the reason.
+func scanExec(ctx context.Context, command, urlPath, user, stagedPath string) (bool, string, error) {
+	args := strings.Fields(command)
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], stagedPath)...)
+	cmd.Env = append(os.Environ(), "UPLOAD_PATH="+urlPath, "UPLOAD_USER="+user)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		reason, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		return false, reason, nil
+	default:
+		return false, "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+}
+
+// scanHTTP POSTs the file to endpoint. A 2xx response means clean and 403 or
+// 422 rejected, with the body as the reason.
+func scanHTTP(ctx context.Context, endpoint, urlPath, user, stagedPath string) (bool, string, error) {
+	f, err := os.Open(stagedPath)
+	if err != nil {
+		return false, "", err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, f)
+	if err != nil {
+		return false, "", err
+	}
+	if info, err := f.Stat(); err == nil {
+		req.ContentLength = info.Size()
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Path", urlPath)
+	if user != "" {
+		req.Header.Set("X-Upload-User", user)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxScanReason))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, "", nil
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusUnprocessableEntity:
+		return false, strings.TrimSpace(string(body)), nil
+	default:
+		return false, "", fmt.Errorf("scanner answered %s", resp.Status)
+	}
+}
+
+// scanICAP sends the file to an ICAP (RFC 3507) RESPMOD service, e.g. c-icap
+// with ClamAV, as the body of a response. "204 No Content" means clean; a
+// modified response means the service blocked it, with the reason taken from
+// the usual X-Infection-Found or X-Violations-Found headers.
+func scanICAP(ctx context.Context, service, stagedPath string) (bool, string, error) {
+	u, err := url.Parse(service)
+	if err != nil {
+		return false, "", err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	f, err := os.Open(stagedPath)
+	if err != nil {
+		return false, "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, "", err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	resHdr := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", info.Size())
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n%s", service, u.Host, len(resHdr), resHdr)
+	if info.Size() > 0 {
+		fmt.Fprintf(w, "%x\r\n", info.Size())
+		if _, err := io.Copy(w, f); err != nil {
+			return false, "", err
+		}
+		w.WriteString("\r\n")
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return false, "", err
+	}
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	status, err := r.ReadLine()
+	if err != nil {
+		return false, "", err
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, "", err
+	}
+	_, code, _ := strings.Cut(status, " ")
+	switch {
+	case strings.HasPrefix(code, "204"):
+		return true, "", nil
+	case strings.HasPrefix(code, "200"):
+		reason := header.Get("X-Infection-Found")
+		if reason == "" {
+			reason = header.Get("X-Violations-Found")
+		}
+		if reason == "" {
+			reason = "blocked by ICAP service"
+		}
+		return false, reason, nil
+	default:
+		return false, "", fmt.Errorf("ICAP service answered %q", status)
+	}
+}
@@ -0,0 +1,112 @@
+package fileserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testScanner writes a scanner command that rejects files containing EVIL.
+func testScanner(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the test scanner is a shell script")
+	}
+	script := filepath.Join(t.TempDir(), "scan.sh")
+	content := "#!/bin/sh\nif grep -q EVIL \"$1\"; then echo \"EVIL found\"; exit 1; fi\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestUploadScanExec(t *testing.T) {
+	scanner := testScanner(t)
+	h := newTestHandler(t, func(cfg *Config) { cfg.UploadScan = scanner })
+	writeTestFile(t, h.baseDir, "kept.txt", "original")
+
+	if w := serveTest(h, http.MethodPut, "/clean.txt", "", "harmless"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT of a clean file = %d, want 201", w.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(h.baseDir, "clean.txt")); string(data) != "harmless" {
+		t.Errorf("clean upload stored as %q", data)
+	}
+
+	w := serveTest(h, http.MethodPut, "/bad.txt", "", "an EVIL payload")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "EVIL found") {
+		t.Errorf("PUT of a rejected file = %d %q, want 422 with the reason", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(h.baseDir, "bad.txt")); !os.IsNotExist(err) {
+		t.Error("rejected upload became servable")
+	}
+
+	if w := serveTest(h, http.MethodPut, "/kept.txt", "", "EVIL"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("PUT replacing a file with a rejected one = %d, want 422", w.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(h.baseDir, "kept.txt")); string(data) != "original" {
+		t.Errorf("rejected upload replaced the file with %q", data)
+	}
+	if entries, _ := os.ReadDir(h.baseDir); len(entries) != 2 {
+		t.Errorf("staging files left behind: %v", entries)
+	}
+}
+
+func TestUploadScanQuarantine(t *testing.T) {
+	scanner := testScanner(t)
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.UploadScan = scanner
+		cfg.UploadScanQuarantine = true
+	})
+	if w := serveTest(h, http.MethodPut, "/dir/bad.txt", "", "EVIL"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("PUT of a rejected file = %d, want 422", w.Code)
+	}
+	matches, _ := filepath.Glob(filepath.Join(h.baseDir, quarantineDirName, "dir", "bad.txt.*"))
+	if len(matches) != 1 {
+		t.Fatalf("quarantine holds %v, want the rejected file", matches)
+	}
+	if w := serveTest(h, http.MethodGet, "/"+quarantineDirName+"/dir/"+filepath.Base(matches[0]), "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a quarantined file = %d, want 404", w.Code)
+	}
+}
+
+func TestUploadScanUnavailable(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.UploadScan = filepath.Join(t.TempDir(), "no-such-scanner")
+	})
+	if w := serveTest(h, http.MethodPut, "/a.txt", "", "data"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("PUT with a broken scanner = %d, want 503", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(h.baseDir, "a.txt")); !os.IsNotExist(err) {
+		t.Error("unscanned upload became servable")
+	}
+}
+
+func TestUploadScanHTTP(t *testing.T) {
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Upload-Path") != "/up.txt" || r.Header.Get("X-Upload-User") != "alice" {
+			http.Error(w, "missing upload headers", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(string(body), "EVIL") {
+			http.Error(w, "EVIL found", http.StatusForbidden)
+		}
+	}))
+	defer scanner.Close()
+	h := newTestHandler(t, func(cfg *Config) { cfg.UploadScan = scanner.URL })
+
+	if w := serveTest(h, http.MethodPut, "/up.txt", "alice", "fine"); w.Code != http.StatusCreated {
+		t.Errorf("PUT of a clean file = %d %q, want 201", w.Code, w.Body.String())
+	}
+	if w := serveTest(h, http.MethodPut, "/up.txt", "alice", "EVIL"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("PUT of a rejected file = %d, want 422", w.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(h.baseDir, "up.txt")); string(data) != "fine" {
+		t.Errorf("file holds %q after a rejected replacement", data)
+	}
+}
@@ -0,0 +1,136 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// scrubPause is the break between two checked entries, keeping the scrubber
+// a low-priority trickle next to request traffic.
+const scrubPause = 10 * time.Millisecond
+
+// StartScrubber periodically re-checks every cached file against its source on
+// disk and evicts entries that no longer match, catching modifications the
+// watcher missed (e.g. on network filesystems) and, with -scrubHash, bit rot.
+// The interval and hashing follow config reloads; it stops with Close.
+func (h *FileHandler) StartScrubber() {
+	go func() {
+		for {
+			interval := h.cfg.Load().ScrubInterval
+			if interval <= 0 {
+				// Disabled by a reload; look again later
+				interval = time.Minute
+			}
+			select {
+			case <-time.After(interval):
+			case <-h.ctx.Done():
+				return
+			}
+			if cfg := h.cfg.Load(); cfg.ScrubInterval > 0 {
+				h.scrub(cfg)
+			}
+		}
+	}()
+}
+
+// scrub runs one pass over the cache.
+func (h *FileHandler) scrub(cfg *Config) {
+	var checked, evicted int
+	for _, entry := range h.cache.Entries() {
+		// Variants are derived from their file and dropped with it
+		if strings.Contains(entry.Key, variantSep) {
+			continue
+		}
+		select {
+		case <-time.After(scrubPause):
+		case <-h.ctx.Done():
+			return
+		}
+		checked++
+		if reason := h.scrubEntry(cfg, entry); reason != "" {
+			h.cache.Delete(entry.Key)
+			log.Printf("Scrubber: evicted %s: %s", entry.Key, reason)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		log.Printf("Scrubber: checked %d cached files, evicted %d", checked, evicted)
+	}
+}
+
+// scrubEntry checks one cache entry against the disk, returning why it should
+// be evicted or "" if it is still valid.
+func (h *FileHandler) scrubEntry(cfg *Config, entry CacheEntryInfo) string {
+	name := h.storageName(entry.Key)
+	info, err := h.storage.Stat(name)
+	if entry.Negative {
+		if err == nil {
+			return "file now exists"
+		}
+		return ""
+	}
+	switch {
+	case os.IsNotExist(err):
+		return "file no longer exists"
+	case err != nil:
+		// Possibly transient; check again next pass
+		return ""
+	case info.IsDir():
+		return "path is now a directory"
+	case info.ModTime().After(entry.Stored):
+		return "file modified on disk"
+	}
+	size := entry.RawSize
+	if size == 0 {
+		size = entry.Size
+	}
+	if size != info.Size() {
+		return fmt.Sprintf("size differs from disk (cached %d, on disk %d)", size, info.Size())
+	}
+	if !cfg.ScrubHash {
+		return ""
+	}
+
+	data, stored, ok := h.cache.Peek(entry.Key)
+	if !ok || !stored.Equal(entry.Stored) {
+		// Evicted or replaced since the listing
+		return ""
+	}
+	onDisk, err := h.hashFile(cfg, entry.Key)
+	if err != nil {
+		return ""
+	}
+	if cached := sha256.Sum256(data); !bytes.Equal(cached[:], onDisk) {
+		if info, err := h.storage.Stat(name); err == nil && info.ModTime().After(stored) {
+			return "file modified on disk"
+		}
+		return "contents differ from disk with an unchanged modification time (possible corruption)"
+	}
+	return ""
+}
+
+// hashFile returns the SHA-256 of filePath, sharing the disk read slots with
+// cache misses.
+func (h *FileHandler) hashFile(cfg *Config, filePath string) ([]byte, error) {
+	if err := h.acquireRead(h.ctx, cfg); err != nil {
+		return nil, err
+	}
+	defer h.reads.release()
+
+	file, err := h.storage.Open(h.storageName(filePath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	sha := sha256.New()
+	if _, err := io.Copy(sha, file); err != nil {
+		return nil, err
+	}
+	return sha.Sum(nil), nil
+}
@@ -0,0 +1,558 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Server is the complete file server described by a Config: the file handler
+// and its cache, virtual hosts, the optional APIs, the middleware chain and
+// the listeners. The command-line binary is a thin wrapper around it. To embed
+// only the hedged-cache handler in another service, use NewFileHandler instead.
+type Server struct {
+	// cfg is the running configuration, replaced by each successful Reload.
+	cfg           atomic.Pointer[Config]
+	cache         *MemoryCache
+	handler       *FileHandler
+	vhostHandlers map[string]*FileHandler
+
+	auth      *Authenticator
+	limiter   *RateLimiter
+	clientIPs *ClientIPResolver
+	cors      *CORS
+	errors    *ErrorPages
+	throttle  *Throttle
+	slow      *SlowRequests
+	memory    *MemoryGuard
+
+	tlsCfg     *tls.Config
+	listeners  []serverListener
+	addr       string
+	server     *http.Server
+	servers    []*http.Server
+	acmeServer *http.Server
+	grpcServer *http.Server
+	h3Server   *http3.Server
+
+	// closers release resources in reverse order on Close.
+	closers []func()
+}
+
+// evictions counts cache evictions by reason for /admin/vars.
+var evictions = expvar.NewMap("cacheEvictions")
+
+// NewServer builds the server described by cfg and opens its listeners. It
+// must be started with Serve, or released with Close if it never is.
+func NewServer(cfg *Config) (s *Server, err error) {
+	s = &Server{vhostHandlers: make(map[string]*FileHandler)}
+	s.cfg.Store(cfg)
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	ensureDir(cfg.Dir)
+
+	// Initialize the memory cache
+	log.Printf("Initializing memory cache (Max Size: %d bytes, TTL: %v, Shards: %d)", cfg.CacheSizeBytes, cfg.CacheTTL, cfg.CacheShards)
+	cache, err := newCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.cache = cache
+	s.onClose(cache.Close)
+	expvar.Publish("cache", expvar.Func(func() any { return cache.GetStats() }))
+	cache.SetHooks(CacheHooks{
+		OnEvict: func(item CacheItem, reason EvictionReason) { evictions.Add(string(reason), 1) },
+	})
+
+	if cfg.Watch {
+		invalidator, err := NewCacheInvalidator(cfg.Dir, cache)
+		if err != nil {
+			log.Printf("Warning: File watching disabled: %v", err)
+		} else {
+			s.onClose(func() { invalidator.Close() })
+		}
+	}
+
+	// Initialize the file handler
+	log.Printf("Initializing file handler (Hedged threshold: %.2f Mbps after %v)", cfg.MinSpeedMbps, cfg.CheckTime)
+	storage, err := newStorage(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage configuration: %w", err)
+	}
+	if cfg.Storage != "" {
+		log.Printf("Reading files from %v", storage)
+	}
+	handler := NewFileHandler(cfg, cache, storage)
+	s.handler = handler
+	s.onClose(handler.Close)
+	tier, err := newCacheTier(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis configuration: %w", err)
+	}
+	if tier != nil {
+		log.Printf("Sharing cached files through %v (%s)", tier, cfg.RedisWritePolicy)
+		handler.tier = tier
+	}
+	if !cfg.ReadOnly && cfg.WriteToken == "" {
+		log.Printf("Warning: Uploads are enabled without -writeToken; anyone can write to %s", cfg.Dir)
+	}
+
+	handler.StartScrubber()
+	handler.StartPrefetcher()
+	handler.StartTrashPurger()
+
+	// Warm the cache from the previous run so a restart doesn't start cold
+	if cfg.CacheSnapshot != "" {
+		if err := handler.WarmFromSnapshot(cfg.CacheSnapshot); err != nil {
+			log.Printf("Warning: Ignoring cache snapshot %s: %v", cfg.CacheSnapshot, err)
+		}
+		if cfg.SnapshotInterval > 0 {
+			done := make(chan struct{})
+			s.onClose(func() { close(done) })
+			go func() {
+				ticker := time.NewTicker(cfg.SnapshotInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						saveSnapshot(cache, cfg)
+					case <-done:
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	if cfg.WarmupManifest != "" {
+		if err := handler.Warmup(cfg); err != nil {
+			log.Printf("Warning: Skipping cache warm-up from %s: %v", cfg.WarmupManifest, err)
+		}
+	}
+
+	// Each virtual host gets its own handler, cache and watcher
+	caches := []*MemoryCache{cache}
+	router := &hostRouter{hosts: make(map[string]http.Handler), fallback: handler}
+	for _, vh := range cfg.VirtualHosts {
+		hostCfg := hostConfig(cfg, vh)
+		ensureDir(hostCfg.Dir)
+		log.Printf("Virtual host %s serving %s (Cache: %d bytes)", vh.Host, hostCfg.Dir, hostCfg.CacheSizeBytes)
+		hostCache, err := newCache(hostCfg)
+		if err != nil {
+			return nil, err
+		}
+		s.onClose(hostCache.Close)
+		caches = append(caches, hostCache)
+		hostCache.SetHooks(CacheHooks{
+			OnEvict: func(item CacheItem, reason EvictionReason) { evictions.Add(string(reason), 1) },
+		})
+		if hostCfg.Watch {
+			invalidator, err := NewCacheInvalidator(hostCfg.Dir, hostCache)
+			if err != nil {
+				log.Printf("Warning: File watching disabled for %s: %v", vh.Host, err)
+			} else {
+				s.onClose(func() { invalidator.Close() })
+			}
+		}
+		hostHandler := NewFileHandler(hostCfg, hostCache, NewLocalStorage(hostCfg.Dir))
+		if tier != nil {
+			hostHandler.tier, _ = newCacheTier(hostCfg)
+		}
+		s.onClose(hostHandler.Close)
+		hostHandler.StartScrubber()
+		hostHandler.StartPrefetcher()
+		hostHandler.StartTrashPurger()
+		router.hosts[strings.ToLower(vh.Host)] = hostHandler
+		s.vhostHandlers[strings.ToLower(vh.Host)] = hostHandler
+	}
+
+	s.memory = NewMemoryGuard(cfg, caches...)
+	s.onClose(s.memory.Close)
+
+	var peers *PeerPool
+	if len(cfg.Peers) > 0 || cfg.PeerDNS != "" {
+		peers = NewPeerPool(cfg, handler)
+		s.onClose(peers.Close)
+	}
+
+	// Setup HTTP server
+	mux := http.NewServeMux()
+	mux.Handle("/", router)
+	if cfg.WebDAV {
+		log.Printf("WebDAV enabled under /dav/")
+		mux.Handle("/dav/", handler.WebDAVHandler())
+	}
+	if cfg.Tus {
+		log.Printf("Resumable (tus) uploads enabled under /tus/")
+		tus := NewTusHandler(handler)
+		mux.Handle("/tus/", tus)
+		mux.Handle("/tus", tus)
+	}
+	if cfg.AdminToken != "" {
+		log.Printf("Admin API enabled under /admin/")
+		mux.Handle("/admin/", NewAdminHandler(cfg.Dir, cache, cfg.AdminToken, peers, tier, handler, s.vhostHandlers))
+	}
+
+	if s.auth, err = NewAuthenticator(cfg); err != nil {
+		return nil, fmt.Errorf("failed to load auth rules: %w", err)
+	}
+	if s.limiter, err = NewRateLimiter(cfg); err != nil {
+		return nil, fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+	s.onClose(s.limiter.Close)
+	s.cors = NewCORS(cfg)
+	s.throttle = NewThrottle(cfg)
+	app := handler.normalizePaths(s.limiter.Wrap(s.cors.Wrap(s.auth.Wrap(s.throttle.Wrap(mux)))))
+	if peers != nil {
+		app = peers.Wrap(app)
+	}
+	if cfg.URLPrefix != "" {
+		log.Printf("Serving under %s/", strings.TrimSuffix(cfg.URLPrefix, "/"))
+		app = mountAt(cfg.URLPrefix, app)
+	}
+	if s.errors, err = NewErrorPages(cfg); err != nil {
+		return nil, fmt.Errorf("failed to load error pages: %w", err)
+	}
+	app = s.errors.Wrap(app)
+
+	if tracer := NewTracer(cfg); tracer != nil {
+		log.Printf("Exporting traces to %v", tracer)
+		s.onClose(tracer.Close)
+		app = tracer.Wrap(app)
+	}
+	if cfg.Health {
+		log.Printf("Health checks enabled at /healthz and /readyz")
+		app = NewHealthChecks(cfg, handler).Wrap(app)
+	}
+	s.slow = NewSlowRequests(cfg)
+	app = s.slow.Wrap(app)
+
+	rootHandler := app
+	switch cfg.AccessLog {
+	case "":
+		log.Printf("Access logging disabled")
+	case "-":
+		rootHandler = AccessLog(app, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	default:
+		logFile, err := NewRotatingFile(cfg.AccessLog, cfg.AccessLogMaxSizeMB*1024*1024, cfg.AccessLogMaxAge, cfg.AccessLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %w", err)
+		}
+		s.onClose(func() { logFile.Close() })
+		log.Printf("Writing access log to %s", cfg.AccessLog)
+		rootHandler = AccessLog(app, slog.New(slog.NewJSONHandler(logFile, nil)))
+	}
+
+	if s.clientIPs, err = NewClientIPResolver(cfg); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy configuration: %w", err)
+	}
+	rootHandler = s.clientIPs.Wrap(rootHandler)
+	if requestIDs := NewRequestIDs(cfg); requestIDs != nil {
+		rootHandler = requestIDs.Wrap(rootHandler)
+	}
+
+	acmeManager := newACMEManager(cfg)
+	if s.tlsCfg, err = buildTLSConfig(cfg, acmeManager); err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	if s.listeners, err = openListeners(cfg, s.tlsCfg != nil); err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	s.onClose(func() {
+		for _, l := range s.listeners {
+			l.Close()
+		}
+	})
+
+	// HTTP/3 shares the port number of the first TLS listener
+	s.addr = ":" + strconv.Itoa(cfg.Port)
+	for _, l := range s.listeners {
+		if l.tls {
+			s.addr = l.Addr().String()
+			break
+		}
+	}
+
+	if cfg.HTTP3 {
+		s.h3Server = newHTTP3Server(s.addr, rootHandler, s.tlsCfg)
+		rootHandler = advertiseHTTP3(rootHandler, s.h3Server)
+	}
+
+	s.server = &http.Server{
+		Addr:              s.addr,
+		Handler:           rootHandler,
+		TLSConfig:         s.tlsCfg,
+		ConnContext:       s.throttle.ConnContext,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	s.servers = []*http.Server{s.server}
+
+	// With ACME, a plain HTTP listener answers HTTP-01 challenges and redirects everything else to HTTPS
+	if acmeManager != nil && cfg.ACMEHTTPPort > 0 {
+		s.acmeServer = &http.Server{
+			Addr:              ":" + strconv.Itoa(cfg.ACMEHTTPPort),
+			Handler:           acmeManager.HTTPHandler(nil),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		}
+		s.servers = append(s.servers, s.acmeServer)
+	}
+
+	// gRPC needs HTTP/2, which without TLS means h2c
+	if cfg.GRPCPort > 0 {
+		if cfg.GRPCToken == "" {
+			log.Printf("Warning: gRPC API enabled without -grpcToken; anyone reaching port %d can read files", cfg.GRPCPort)
+		}
+		var grpcHandler http.Handler = NewGRPCService(handler, cfg.GRPCToken)
+		if s.tlsCfg == nil {
+			grpcHandler = h2c.NewHandler(grpcHandler, &http2.Server{})
+		}
+		s.grpcServer = &http.Server{
+			Addr:              ":" + strconv.Itoa(cfg.GRPCPort),
+			Handler:           grpcHandler,
+			TLSConfig:         s.tlsCfg,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		}
+		s.servers = append(s.servers, s.grpcServer)
+	}
+	return s, nil
+}
+
+// onClose registers f to run on Close.
+func (s *Server) onClose(f func()) {
+	s.closers = append(s.closers, f)
+}
+
+// Close releases everything NewServer set up, in reverse order.
+func (s *Server) Close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+	s.closers = nil
+}
+
+// Handler returns the file handler serving -dir, e.g. to mount it elsewhere.
+func (s *Server) Handler() *FileHandler {
+	return s.handler
+}
+
+// Use registers hooks on the file handlers of -dir and all virtual hosts.
+func (s *Server) Use(hooks Hooks) {
+	s.handler.Use(hooks)
+	for _, hostHandler := range s.vhostHandlers {
+		hostHandler.Use(hooks)
+	}
+}
+
+// Serve accepts connections until ctx is done or a listener fails, then
+// drains in-flight requests for up to -shutdownTimeout, saves the cache
+// snapshot and releases the server.
+func (s *Server) Serve(ctx context.Context) error {
+	defer s.Close()
+	cfg := s.cfg.Load()
+
+	serverErr := make(chan error, len(s.servers)+len(s.listeners)+2)
+	for _, l := range s.listeners {
+		l := l
+		go func() {
+			how := ""
+			if l.activated {
+				how = ", socket activation"
+			}
+			if l.tls {
+				log.Printf("Server listening on %s (HTTPS%s)", l.Addr(), how)
+				// Empty file names make the server use TLSConfig.GetCertificate (ACME).
+				serverErr <- s.server.ServeTLS(l, cfg.TLSCert, cfg.TLSKey)
+				return
+			}
+			log.Printf("Server listening on %s (HTTP%s)", l.Addr(), how)
+			serverErr <- s.server.Serve(l)
+		}()
+	}
+	if s.h3Server != nil {
+		go func() {
+			log.Printf("HTTP/3 listening on %s (UDP)", s.addr)
+			serverErr <- s.h3Server.ListenAndServe()
+		}()
+	}
+	if cfg.SFTPPort > 0 {
+		sftpServer, err := NewSFTPServer(cfg, s.handler)
+		if err != nil {
+			return fmt.Errorf("invalid SFTP configuration: %w", err)
+		}
+		defer sftpServer.Close()
+		go func() {
+			sftpAddr := ":" + strconv.Itoa(cfg.SFTPPort)
+			log.Printf("SFTP listening on %s", sftpAddr)
+			serverErr <- sftpServer.ListenAndServe(sftpAddr)
+		}()
+	}
+	if s.acmeServer != nil {
+		go func() {
+			log.Printf("ACME challenge listener on %s", s.acmeServer.Addr)
+			serverErr <- s.acmeServer.ListenAndServe()
+		}()
+	}
+	if s.grpcServer != nil {
+		go func() {
+			log.Printf("gRPC listening on %s", s.grpcServer.Addr)
+			if s.tlsCfg != nil {
+				serverErr <- s.grpcServer.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+				return
+			}
+			serverErr <- s.grpcServer.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serverErr:
+		if err != nil && err != http.ErrServerClosed {
+			return err
+		}
+	case <-ctx.Done():
+		// The drain timeout may have been changed by a reload since startup
+		timeout := s.cfg.Load().ShutdownTimeout
+		log.Printf("Shutting down, draining connections (timeout %v)", timeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		for _, srv := range s.servers {
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Printf("Drain incomplete on %s (%v), closing remaining connections", srv.Addr, err)
+				srv.Close()
+			}
+		}
+		if s.h3Server != nil {
+			s.h3Server.Close()
+		}
+	}
+
+	// Abort any hedged reads still running for requests that are gone
+	s.handler.Close()
+	if cfg.CacheSnapshot != "" {
+		saveSnapshot(s.cache, cfg)
+	}
+	log.Printf("Server stopped")
+	return nil
+}
+
+// Reload applies the hot-reloadable settings of newCfg, keeping the current
+// ones if any of them is invalid. Settings that need a restart are logged.
+func (s *Server) Reload(newCfg *Config) error {
+	if err := s.auth.Reload(newCfg); err != nil {
+		return err
+	}
+	if err := s.limiter.Reload(newCfg); err != nil {
+		return err
+	}
+	if err := s.clientIPs.Reload(newCfg); err != nil {
+		return err
+	}
+	if err := s.errors.Reload(newCfg); err != nil {
+		return err
+	}
+	warnStaticChanges(s.cfg.Load(), newCfg)
+	s.cors.Reload(newCfg)
+	s.throttle.Reload(newCfg)
+	s.slow.Reload(newCfg)
+	s.memory.Reload(newCfg)
+	reloadCache(s.cache, newCfg)
+	s.handler.Reload(newCfg)
+	for _, vh := range newCfg.VirtualHosts {
+		if hostHandler, ok := s.vhostHandlers[strings.ToLower(vh.Host)]; ok && hostHandler.baseDir == vh.Dir {
+			hostCfg := hostConfig(newCfg, vh)
+			reloadCache(hostHandler.cache, hostCfg)
+			hostHandler.Reload(hostCfg)
+		}
+	}
+	s.cfg.Store(newCfg)
+	log.Printf("Configuration reloaded (Hedged threshold: %.2f Mbps after %v, Cache: %d bytes)",
+		newCfg.MinSpeedMbps, newCfg.CheckTime, newCfg.CacheSizeBytes)
+	return nil
+}
+
+// ensureDir creates a missing serving directory.
+func ensureDir(dir string) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		log.Printf("Warning: Serving directory %s does not exist, creating it.", dir)
+		os.MkdirAll(dir, 0755)
+	}
+}
+
+// newCache builds the memory cache described by cfg and starts its janitor.
+func newCache(cfg *Config) (*MemoryCache, error) {
+	cache := NewMemoryCache(cfg.CacheSizeBytes, cfg.CacheTTL, cfg.CacheShards)
+	if cfg.CacheOffHeap {
+		if err := cache.UseOffHeap(); err != nil {
+			return nil, fmt.Errorf("error enabling off-heap cache: %w", err)
+		}
+	}
+	reloadCache(cache, cfg)
+	// The janitor always runs so TTLs introduced by a later reload are honored.
+	cache.StartJanitor(cfg.JanitorInterval)
+	return cache, nil
+}
+
+// reloadCache applies the hot-reloadable cache settings in cfg.
+func reloadCache(cache *MemoryCache, cfg *Config) {
+	cache.SetMaxBytes(cfg.CacheSizeBytes)
+	cache.SetTTL(cfg.CacheTTL)
+	cache.SetStaleGrace(cfg.StaleWhileRevalidate)
+	cache.SetTinyLFU(cfg.CacheTinyLFU)
+	cache.SetDedup(cfg.CacheDedup)
+	cache.SetProtectedRatio(cfg.CacheProtectedRatio)
+	cache.SetCaseInsensitive(cfg.CaseInsensitivePaths)
+	if err := cache.SetEvictionPolicy(cfg.CachePolicy); err != nil {
+		log.Printf("Error setting cache policy: %v", err)
+	}
+}
+
+// saveSnapshot writes the cache snapshot configured in cfg, logging the outcome.
+func saveSnapshot(cache *MemoryCache, cfg *Config) {
+	start := time.Now()
+	n, err := SaveSnapshot(cache, cfg.CacheSnapshot, cfg.SnapshotContents)
+	if err != nil {
+		log.Printf("Error saving cache snapshot %s: %v", cfg.CacheSnapshot, err)
+		return
+	}
+	log.Printf("Saved cache snapshot %s (%d entries in %v)", cfg.CacheSnapshot, n, time.Since(start).Round(time.Millisecond))
+}
+
+// warnStaticChanges logs settings that changed in the file but only take effect on restart.
+func warnStaticChanges(oldCfg, newCfg *Config) {
+	if oldCfg.Dir != newCfg.Dir || oldCfg.Port != newCfg.Port || strings.Join(oldCfg.Listen, ",") != strings.Join(newCfg.Listen, ",") ||
+		oldCfg.ListenUnix != newCfg.ListenUnix || oldCfg.ListenUnixMode != newCfg.ListenUnixMode || oldCfg.ProxyProtocol != newCfg.ProxyProtocol || oldCfg.URLPrefix != newCfg.URLPrefix || oldCfg.Storage != newCfg.Storage ||
+		strings.Join(oldCfg.Peers, ",") != strings.Join(newCfg.Peers, ",") || oldCfg.PeerDNS != newCfg.PeerDNS || oldCfg.PeerToken != newCfg.PeerToken ||
+		virtualHostsKey(oldCfg.VirtualHosts) != virtualHostsKey(newCfg.VirtualHosts) || oldCfg.Watch != newCfg.Watch || oldCfg.WebDAV != newCfg.WebDAV || oldCfg.Tus != newCfg.Tus ||
+		oldCfg.AdminToken != newCfg.AdminToken || oldCfg.AccessLog != newCfg.AccessLog ||
+		oldCfg.RequestIDHeader != newCfg.RequestIDHeader || oldCfg.OTLPEndpoint != newCfg.OTLPEndpoint || oldCfg.OTelServiceName != newCfg.OTelServiceName || oldCfg.TraceSampleRatio != newCfg.TraceSampleRatio ||
+		oldCfg.Health != newCfg.Health || oldCfg.ReadyProbe != newCfg.ReadyProbe || oldCfg.ReadyTimeout != newCfg.ReadyTimeout ||
+		oldCfg.TLSCert != newCfg.TLSCert || oldCfg.TLSKey != newCfg.TLSKey ||
+		strings.Join(oldCfg.ACMEDomains, ",") != strings.Join(newCfg.ACMEDomains, ",") || oldCfg.HTTP3 != newCfg.HTTP3 ||
+		oldCfg.ReadHeaderTimeout != newCfg.ReadHeaderTimeout || oldCfg.ReadTimeout != newCfg.ReadTimeout ||
+		oldCfg.WriteTimeout != newCfg.WriteTimeout || oldCfg.IdleTimeout != newCfg.IdleTimeout || oldCfg.CacheShards != newCfg.CacheShards || oldCfg.CacheOffHeap != newCfg.CacheOffHeap ||
+		oldCfg.CacheSnapshot != newCfg.CacheSnapshot || oldCfg.SnapshotContents != newCfg.SnapshotContents || oldCfg.SnapshotInterval != newCfg.SnapshotInterval {
+		log.Printf("Warning: dir, port, listen, proxyProtocol, urlPrefix, storage, peer, redis, gRPC, SFTP, virtual host names and dirs, watch, webdav, tus, adminToken, health check, requestIDHeader, tracing, accessLog, TLS, http3, server timeout, cacheShards, cacheOffHeap and cache snapshot changes require a restart")
+	}
+}
@@ -0,0 +1,921 @@
+package fileserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP v3 packet types (draft-ietf-secsh-filexfer-02).
+const (
+	sftpFxpInit     = 1
+	sftpFxpVersion  = 2
+	sftpFxpOpen     = 3
+	sftpFxpClose    = 4
+	sftpFxpRead     = 5
+	sftpFxpWrite    = 6
+	sftpFxpLstat    = 7
+	sftpFxpFstat    = 8
+	sftpFxpSetstat  = 9
+	sftpFxpFsetstat = 10
+	sftpFxpOpendir  = 11
+	sftpFxpReaddir  = 12
+	sftpFxpRemove   = 13
+	sftpFxpMkdir    = 14
+	sftpFxpRmdir    = 15
+	sftpFxpRealpath = 16
+	sftpFxpStat     = 17
+	sftpFxpRename   = 18
+	sftpFxpStatus   = 101
+	sftpFxpHandle   = 102
+	sftpFxpData     = 103
+	sftpFxpName     = 104
+	sftpFxpAttrs    = 105
+)
+
+// SFTP status codes.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// SFTP open flags and attribute flags.
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	// sftpMaxPacket bounds incoming packets; clients write in 32-256 KiB pieces.
+	sftpMaxPacket = 1 << 20
+	// sftpMaxRead caps the data returned by one READ.
+	sftpMaxRead = 256 << 10
+	// sftpMaxHandles caps the files and directories a session may hold open.
+	sftpMaxHandles = 256
+	// sftpDirBatch is the number of entries returned per READDIR.
+	sftpDirBatch = 100
+)
+
+// SFTPServer serves the same tree as HTTP over SFTP, for tooling that speaks
+// nothing else. Downloads go through the cache. Uploads follow -readOnly and
+// -maxUploadBytes and invalidate the cache like PUT does.
+type SFTPServer struct {
+	h        *FileHandler
+	config   *ssh.ServerConfig
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+func NewSFTPServer(cfg *Config, h *FileHandler) (*SFTPServer, error) {
+	hostKey, err := loadHostKey(cfg.SFTPHostKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{}
+	config.AddHostKey(hostKey)
+
+	if cfg.SFTPHtpasswd != "" {
+		users, err := loadHtpasswd(cfg.SFTPHtpasswd)
+		if err != nil {
+			return nil, err
+		}
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if hash, ok := users[conn.User()]; ok && checkPasswordHash(hash, string(password)) {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		}
+	}
+	if cfg.SFTPAuthorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(cfg.SFTPAuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if keys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		}
+	}
+	return &SFTPServer{h: h, config: config}, nil
+}
+
+// loadHostKey reads the server's private key, generating an ed25519 key on
+// first start so clients see the same fingerprint across restarts.
+func loadHostKey(name string) (ssh.Signer, error) {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "fileserver")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(name, data, 0600); err != nil {
+			return nil, fmt.Errorf("sftp host key: %w", err)
+		}
+		log.Printf("Generated SFTP host key %s", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("sftp host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("sftp host key %s: %w", name, err)
+	}
+	return signer, nil
+}
+
+// loadAuthorizedKeys reads an OpenSSH authorized_keys file. Any listed key
+// may log in under any user name.
+func loadAuthorizedKeys(name string) (map[string]bool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("authorized keys: %w", err)
+	}
+	keys := make(map[string]bool)
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break // Only comments and blank lines remain
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("authorized keys %s: no keys found", name)
+	}
+	return keys, nil
+}
+
+// ListenAndServe accepts SSH connections on addr until Close is called.
+func (s *SFTPServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections. Sessions in progress are not interrupted.
+func (s *SFTPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *SFTPServer) serveConn(nc net.Conn) {
+	defer nc.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		log.Printf("SFTP: handshake with %s failed: %v", nc.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("SFTP: %s logged in from %s", conn.User(), conn.RemoteAddr())
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			started := false
+			for req := range requests {
+				// A session may only start the sftp subsystem, once; there is no shell
+				ok := !started && req.Type == "subsystem" && len(req.Payload) >= 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					started = true
+					go func() {
+						session := &sftpSession{h: s.h, user: conn.User(), ch: ch, handles: make(map[string]*sftpFile)}
+						session.serve()
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// sftpSession runs the SFTP protocol on one channel. Requests are handled in
+// order, one at a time.
+type sftpSession struct {
+	h          *FileHandler
+	user       string
+	ch         io.ReadWriter
+	handles    map[string]*sftpFile
+	nextHandle uint64
+}
+
+// sftpFile is an open file or directory.
+type sftpFile struct {
+	urlPath  string
+	filePath string
+
+	// Reads: the cached contents, or the storage file for large files.
+	data []byte
+	file StorageFile
+	size int64
+
+	// Writes go to tmp, which replaces filePath on close.
+	tmp     *os.File
+	append  bool
+	modTime time.Time
+
+	// Directories
+	dir     bool
+	entries []dirEntry
+}
+
+func (ss *sftpSession) serve() {
+	defer func() {
+		for _, handle := range ss.handles {
+			handle.abort()
+		}
+	}()
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(ss.ch, lenBuf[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if n == 0 || n > sftpMaxPacket {
+			log.Printf("SFTP: %s sent a packet of %d bytes, closing", ss.user, n)
+			return
+		}
+		packet := make([]byte, n)
+		if _, err := io.ReadFull(ss.ch, packet); err != nil {
+			return
+		}
+		if err := ss.handle(packet); err != nil {
+			return
+		}
+	}
+}
+
+// handle dispatches one request and writes its response.
+func (ss *sftpSession) handle(packet []byte) error {
+	r := &sftpReader{b: packet[1:]}
+	if packet[0] == sftpFxpInit {
+		return ss.send(sftpFxpVersion, binary.BigEndian.AppendUint32(nil, 3))
+	}
+	id := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+	cfg := ss.h.cfg.Load()
+	switch packet[0] {
+	case sftpFxpRealpath:
+		urlPath := path.Clean("/" + r.string())
+		return ss.sendName(id, []sftpEntry{{name: urlPath, longname: urlPath}})
+	case sftpFxpStat, sftpFxpLstat:
+		_, filePath, err := ss.resolve(cfg, r.string())
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		info, err := ss.h.storage.Stat(ss.h.storageName(filePath))
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		return ss.send(sftpFxpAttrs, appendSFTPAttrs(binary.BigEndian.AppendUint32(nil, id), info.Size(), info.Mode(), info.ModTime()))
+	case sftpFxpFstat:
+		handle, err := ss.lookup(r.string())
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		return ss.sendHandleAttrs(id, handle)
+	case sftpFxpOpen:
+		p, flags := r.string(), r.uint32()
+		r.attrs()
+		return ss.open(id, cfg, p, flags)
+	case sftpFxpOpendir:
+		return ss.opendir(id, cfg, r.string())
+	case sftpFxpRead:
+		name, offset, length := r.string(), r.uint64(), r.uint32()
+		handle, err := ss.lookup(name)
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		return ss.read(id, handle, int64(offset), int64(min(length, sftpMaxRead)))
+	case sftpFxpWrite:
+		name, offset, data := r.string(), r.uint64(), r.bytes()
+		if r.err != nil {
+			return ss.sendStatus(id, sftpBadMessage, r.err.Error())
+		}
+		handle, err := ss.lookup(name)
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		return ss.sendError(id, ss.write(cfg, handle, int64(offset), data))
+	case sftpFxpReaddir:
+		handle, err := ss.lookup(r.string())
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		return ss.readdir(id, cfg, handle)
+	case sftpFxpClose:
+		name := r.string()
+		handle, err := ss.lookup(name)
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		delete(ss.handles, name)
+		return ss.sendError(id, ss.close(handle))
+	case sftpFxpSetstat:
+		p := r.string()
+		attrs := r.attrs()
+		return ss.sendError(id, ss.setstat(cfg, p, attrs))
+	case sftpFxpFsetstat:
+		handle, err := ss.lookup(r.string())
+		attrs := r.attrs()
+		if err == nil {
+			err = ss.fsetstat(cfg, handle, attrs)
+		}
+		return ss.sendError(id, err)
+	case sftpFxpRemove:
+		return ss.sendError(id, ss.remove(cfg, r.string()))
+	case sftpFxpMkdir:
+		p := r.string()
+		r.attrs()
+		return ss.sendError(id, ss.mkdir(cfg, p))
+	case sftpFxpRmdir:
+		return ss.sendError(id, ss.rmdir(cfg, r.string()))
+	case sftpFxpRename:
+		oldPath, newPath := r.string(), r.string()
+		return ss.sendError(id, ss.rename(cfg, oldPath, newPath))
+	default:
+		// Symlinks and extensions
+		return ss.sendStatus(id, sftpOpUnsupported, "operation not supported")
+	}
+}
+
+// resolve applies the same checks as HTTP requests to a client path.
+func (ss *sftpSession) resolve(cfg *Config, p string) (urlPath, filePath string, err error) {
+	urlPath = path.Clean("/" + p)
+	if isInternalPath(urlPath) || isHiddenPath(cfg, urlPath) {
+		return "", "", os.ErrNotExist
+	}
+	filePath = filepath.Join(ss.h.baseDir, filepath.FromSlash(urlPath))
+	if !ss.h.symlinkAllowed(cfg, filePath) {
+		return "", "", os.ErrPermission
+	}
+	return urlPath, filePath, nil
+}
+
+// resolveWrite is resolve for requests that modify the tree.
+func (ss *sftpSession) resolveWrite(cfg *Config, p string) (urlPath, filePath string, err error) {
+	if cfg.ReadOnly {
+		return "", "", os.ErrPermission
+	}
+	urlPath, filePath, err = ss.resolve(cfg, p)
+	if err == nil && urlPath == "/" {
+		err = os.ErrPermission
+	}
+	return urlPath, filePath, err
+}
+
+func (ss *sftpSession) lookup(name string) (*sftpFile, error) {
+	handle, ok := ss.handles[name]
+	if !ok {
+		return nil, errors.New("invalid handle")
+	}
+	return handle, nil
+}
+
+// addHandle registers an open file or directory and sends its handle.
+func (ss *sftpSession) addHandle(id uint32, handle *sftpFile) error {
+	if len(ss.handles) >= sftpMaxHandles {
+		handle.abort()
+		return ss.sendStatus(id, sftpFailure, "too many open handles")
+	}
+	ss.nextHandle++
+	name := strconv.FormatUint(ss.nextHandle, 10)
+	ss.handles[name] = handle
+	return ss.send(sftpFxpHandle, appendSFTPString(binary.BigEndian.AppendUint32(nil, id), name))
+}
+
+func (ss *sftpSession) open(id uint32, cfg *Config, p string, flags uint32) error {
+	if flags&(sftpFlagWrite|sftpFlagAppend|sftpFlagCreat|sftpFlagTrunc) == 0 {
+		return ss.openRead(id, cfg, p)
+	}
+	urlPath, filePath, err := ss.resolveWrite(cfg, p)
+	if err != nil {
+		return ss.sendError(id, err)
+	}
+	info, statErr := os.Stat(filePath)
+	switch {
+	case statErr == nil && info.IsDir():
+		return ss.sendStatus(id, sftpFailure, "is a directory")
+	case statErr == nil && flags&sftpFlagCreat != 0 && flags&sftpFlagExcl != 0:
+		return ss.sendStatus(id, sftpFailure, "file exists")
+	case os.IsNotExist(statErr) && flags&sftpFlagCreat == 0:
+		return ss.sendError(id, statErr)
+	}
+
+	// Write to a temporary file next to the target, like PUT, so readers
+	// never see a partial upload
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), stagingPrefix+"*")
+	if err != nil {
+		return ss.sendError(id, err)
+	}
+	handle := &sftpFile{urlPath: urlPath, filePath: filePath, tmp: tmp, append: flags&sftpFlagAppend != 0}
+	if statErr == nil && flags&sftpFlagTrunc == 0 {
+		// Partial writes modify the existing contents
+		if err := copyFileInto(tmp, filePath); err != nil {
+			handle.abort()
+			return ss.sendError(id, err)
+		}
+	}
+	return ss.addHandle(id, handle)
+}
+
+func copyFileInto(dst *os.File, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// openRead opens a file for download through the cache. Files too large to
+// cache are read from storage directly.
+func (ss *sftpSession) openRead(id uint32, cfg *Config, p string) error {
+	urlPath, filePath, err := ss.resolve(cfg, p)
+	if err != nil {
+		return ss.sendError(id, err)
+	}
+	if urlPath == "/" {
+		return ss.sendStatus(id, sftpFailure, "is a directory")
+	}
+	// load only uses the request for per-request bookkeeping
+	r, _ := http.NewRequestWithContext(ss.h.ctx, http.MethodGet, urlPath, nil)
+	data, err := ss.h.load(withRequestInfo(r), cfg, urlPath, filePath)
+	switch {
+	case err == nil:
+		return ss.addHandle(id, &sftpFile{urlPath: urlPath, filePath: filePath, data: data, size: int64(len(data))})
+	case errors.Is(err, errTooLargeToCache):
+		file, err := ss.h.storage.Open(ss.h.storageName(filePath))
+		if err != nil {
+			return ss.sendError(id, err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return ss.sendError(id, err)
+		}
+		return ss.addHandle(id, &sftpFile{urlPath: urlPath, filePath: filePath, file: file, size: info.Size()})
+	case errors.Is(err, errIsDirectory):
+		return ss.sendStatus(id, sftpFailure, "is a directory")
+	default:
+		return ss.sendError(id, err)
+	}
+}
+
+func (ss *sftpSession) opendir(id uint32, cfg *Config, p string) error {
+	urlPath, filePath, err := ss.resolve(cfg, p)
+	if err != nil {
+		return ss.sendError(id, err)
+	}
+	info, err := ss.h.storage.Stat(ss.h.storageName(filePath))
+	if err != nil {
+		return ss.sendError(id, err)
+	}
+	if !info.IsDir() {
+		return ss.sendStatus(id, sftpFailure, "not a directory")
+	}
+	entries, err := ss.h.readDirEntries(cfg, urlPath, filePath)
+	if err != nil {
+		return ss.sendError(id, err)
+	}
+	return ss.addHandle(id, &sftpFile{urlPath: urlPath, filePath: filePath, dir: true, entries: entries})
+}
+
+func (ss *sftpSession) read(id uint32, handle *sftpFile, offset, length int64) error {
+	if handle.dir || handle.tmp != nil {
+		return ss.sendStatus(id, sftpFailure, "handle not open for reading")
+	}
+	if offset >= handle.size {
+		return ss.sendStatus(id, sftpEOF, "EOF")
+	}
+	length = min(length, handle.size-offset)
+	var chunk []byte
+	if handle.data != nil {
+		chunk = handle.data[offset : offset+length]
+	} else {
+		chunk = make([]byte, length)
+		n, err := handle.file.ReadAt(chunk, offset)
+		if n == 0 && err != nil {
+			return ss.sendError(id, err)
+		}
+		chunk = chunk[:n]
+	}
+	return ss.send(sftpFxpData, appendSFTPString(binary.BigEndian.AppendUint32(nil, id), string(chunk)))
+}
+
+func (ss *sftpSession) write(cfg *Config, handle *sftpFile, offset int64, data []byte) error {
+	if handle.tmp == nil {
+		return os.ErrPermission
+	}
+	if handle.append {
+		info, err := handle.tmp.Stat()
+		if err != nil {
+			return err
+		}
+		offset = info.Size()
+	}
+	if cfg.MaxUploadBytes > 0 && offset+int64(len(data)) > cfg.MaxUploadBytes {
+		return errors.New("file exceeds the upload size limit")
+	}
+	_, err := handle.tmp.WriteAt(data, offset)
+	return err
+}
+
+func (ss *sftpSession) readdir(id uint32, cfg *Config, handle *sftpFile) error {
+	if !handle.dir {
+		return ss.sendStatus(id, sftpFailure, "not a directory")
+	}
+	if len(handle.entries) == 0 {
+		return ss.sendStatus(id, sftpEOF, "EOF")
+	}
+	batch := handle.entries[:min(len(handle.entries), sftpDirBatch)]
+	handle.entries = handle.entries[len(batch):]
+	entries := make([]sftpEntry, 0, len(batch))
+	for _, e := range batch {
+		mode := fs.FileMode(0644)
+		if e.Type == "dir" {
+			mode = fs.ModeDir | 0755
+		}
+		entries = append(entries, sftpEntry{name: e.Name, size: e.Size, mode: mode, modTime: e.ModTime, attrs: true})
+	}
+	return ss.sendName(id, entries)
+}
+
+// close finishes a handle; for uploads the new contents replace the target.
+func (ss *sftpSession) close(handle *sftpFile) error {
+	switch {
+	case handle.file != nil:
+		return handle.file.Close()
+	case handle.tmp == nil:
+		return nil
+	}
+	defer os.Remove(handle.tmp.Name()) // No-op after a successful rename
+	if err := handle.tmp.Sync(); err != nil {
+		handle.tmp.Close()
+		return err
+	}
+	if err := handle.tmp.Close(); err != nil {
+		return err
+	}
+	if !handle.modTime.IsZero() {
+		os.Chtimes(handle.tmp.Name(), handle.modTime, handle.modTime)
+	}
+	if err := ss.h.placeUpload(ss.h.cfg.Load(), handle.urlPath, ss.user, handle.filePath, handle.tmp.Name()); err != nil {
+		return err
+	}
+	ss.h.invalidate(handle.filePath)
+	log.Printf("Stored %s via SFTP (%s)", handle.urlPath, ss.user)
+	return nil
+}
+
+// abort releases a handle without committing an upload.
+func (handle *sftpFile) abort() {
+	if handle.file != nil {
+		handle.file.Close()
+	}
+	if handle.tmp != nil {
+		handle.tmp.Close()
+		os.Remove(handle.tmp.Name())
+	}
+}
+
+// setstat truncates and sets modification times; ownership and permission
+// changes are accepted and ignored, as files are always served 0644.
+func (ss *sftpSession) setstat(cfg *Config, p string, attrs sftpSetAttrs) error {
+	_, filePath, err := ss.resolveWrite(cfg, p)
+	if err != nil {
+		return err
+	}
+	if attrs.flags&sftpAttrSize != 0 {
+		if err := os.Truncate(filePath, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		if err := os.Chtimes(filePath, attrs.modTime, attrs.modTime); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&(sftpAttrSize|sftpAttrACModTime) != 0 {
+		ss.h.invalidate(filePath)
+	}
+	return nil
+}
+
+func (ss *sftpSession) fsetstat(cfg *Config, handle *sftpFile, attrs sftpSetAttrs) error {
+	if handle.tmp == nil {
+		if cfg.ReadOnly {
+			return os.ErrPermission
+		}
+		return ss.setstat(cfg, handle.urlPath, attrs)
+	}
+	if attrs.flags&sftpAttrSize != 0 {
+		if err := handle.tmp.Truncate(int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		handle.modTime = attrs.modTime // Applied once the upload is in place
+	}
+	return nil
+}
+
+func (ss *sftpSession) remove(cfg *Config, p string) error {
+	urlPath, filePath, err := ss.resolveWrite(cfg, p)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("is a directory")
+	}
+	if cfg.SoftDelete {
+		err = ss.h.moveToTrash(urlPath, filePath)
+	} else {
+		err = os.Remove(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	ss.h.invalidate(filePath)
+	ss.h.quotas.released(urlPath, info.Size())
+	log.Printf("Deleted %s via SFTP (%s, soft: %v)", urlPath, ss.user, cfg.SoftDelete)
+	return nil
+}
+
+func (ss *sftpSession) mkdir(cfg *Config, p string) error {
+	_, filePath, err := ss.resolveWrite(cfg, p)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(filePath, 0755)
+}
+
+func (ss *sftpSession) rmdir(cfg *Config, p string) error {
+	_, filePath, err := ss.resolveWrite(cfg, p)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+	ss.h.invalidateTree(filePath)
+	return nil
+}
+
+func (ss *sftpSession) rename(cfg *Config, oldPath, newPath string) error {
+	oldURLPath, oldFilePath, err := ss.resolveWrite(cfg, oldPath)
+	if err != nil {
+		return err
+	}
+	newURLPath, newFilePath, err := ss.resolveWrite(cfg, newPath)
+	if err != nil {
+		return err
+	}
+	// SFTP v3 renames never overwrite
+	if _, err := os.Lstat(newFilePath); err == nil {
+		return errors.New("target exists")
+	}
+	if err := os.Rename(oldFilePath, newFilePath); err != nil {
+		return err
+	}
+	ss.h.invalidateTree(oldFilePath)
+	ss.h.invalidateTree(newFilePath)
+	log.Printf("Renamed %s to %s via SFTP (%s)", oldURLPath, newURLPath, ss.user)
+	return nil
+}
+
+func (ss *sftpSession) sendHandleAttrs(id uint32, handle *sftpFile) error {
+	var info fs.FileInfo
+	var err error
+	switch {
+	case handle.tmp != nil:
+		info, err = handle.tmp.Stat()
+	case handle.file != nil:
+		info, err = handle.file.Stat()
+	default:
+		info, err = ss.h.storage.Stat(ss.h.storageName(handle.filePath))
+	}
+	if err != nil {
+		return ss.sendError(id, err)
+	}
+	size := info.Size()
+	if handle.data != nil {
+		size = handle.size // What this handle serves, even if the file changed since
+	}
+	return ss.send(sftpFxpAttrs, appendSFTPAttrs(binary.BigEndian.AppendUint32(nil, id), size, info.Mode(), info.ModTime()))
+}
+
+// sftpEntry is one name in an SSH_FXP_NAME response.
+type sftpEntry struct {
+	name     string
+	longname string
+	size     int64
+	mode     fs.FileMode
+	modTime  time.Time
+	attrs    bool
+}
+
+func (ss *sftpSession) sendName(id uint32, entries []sftpEntry) error {
+	b := binary.BigEndian.AppendUint32(nil, id)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(entries)))
+	for _, e := range entries {
+		b = appendSFTPString(b, e.name)
+		if !e.attrs {
+			b = appendSFTPString(b, e.longname)
+			b = binary.BigEndian.AppendUint32(b, 0)
+			continue
+		}
+		// Clients such as the OpenSSH sftp "ls -l" show this verbatim
+		longname := fmt.Sprintf("%s    1 %-8s %-8s %8d %s %s", e.mode, ss.user, ss.user, e.size, e.modTime.Format("Jan _2 15:04"), e.name)
+		b = appendSFTPString(b, longname)
+		b = appendSFTPAttrs(b, e.size, e.mode, e.modTime)
+	}
+	return ss.send(sftpFxpName, b)
+}
+
+// sendError answers with OK for a nil error and the closest status otherwise.
+func (ss *sftpSession) sendError(id uint32, err error) error {
+	switch {
+	case err == nil:
+		return ss.sendStatus(id, sftpOK, "OK")
+	case os.IsNotExist(err):
+		return ss.sendStatus(id, sftpNoSuchFile, "no such file")
+	case os.IsPermission(err):
+		return ss.sendStatus(id, sftpPermissionDenied, "permission denied")
+	case errors.Is(err, errReadQueueFull):
+		return ss.sendStatus(id, sftpFailure, "server busy, try again")
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err // Don't reveal server paths
+	}
+	return ss.sendStatus(id, sftpFailure, err.Error())
+}
+
+func (ss *sftpSession) sendStatus(id uint32, code uint32, msg string) error {
+	b := binary.BigEndian.AppendUint32(nil, id)
+	b = binary.BigEndian.AppendUint32(b, code)
+	b = appendSFTPString(b, msg)
+	b = appendSFTPString(b, "en")
+	return ss.send(sftpFxpStatus, b)
+}
+
+func (ss *sftpSession) send(packetType byte, payload []byte) error {
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 5+len(payload)), uint32(1+len(payload)))
+	b = append(b, packetType)
+	_, err := ss.ch.Write(append(b, payload...))
+	return err
+}
+
+func appendSFTPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// appendSFTPAttrs encodes size, POSIX mode and times.
+func appendSFTPAttrs(b []byte, size int64, mode fs.FileMode, modTime time.Time) []byte {
+	perm := uint32(mode.Perm())
+	if mode.IsDir() {
+		perm |= 0o040000
+	} else {
+		perm |= 0o100000
+	}
+	b = binary.BigEndian.AppendUint32(b, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+	b = binary.BigEndian.AppendUint64(b, uint64(size))
+	b = binary.BigEndian.AppendUint32(b, perm)
+	b = binary.BigEndian.AppendUint32(b, uint32(modTime.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(modTime.Unix()))
+}
+
+// sftpSetAttrs is the part of a client's ATTRS this server acts on.
+type sftpSetAttrs struct {
+	flags   uint32
+	size    uint64
+	modTime time.Time
+}
+
+// sftpReader decodes request fields, remembering the first error.
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sftpReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *sftpReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *sftpReader) uint64() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+
+func (r *sftpReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || uint64(n) > uint64(len(r.b)) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *sftpReader) string() string { return string(r.bytes()) }
+
+func (r *sftpReader) attrs() sftpSetAttrs {
+	a := sftpSetAttrs{flags: r.uint32()}
+	if a.flags&sftpAttrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		r.uint32()
+	}
+	if a.flags&sftpAttrACModTime != 0 {
+		r.uint32() // atime
+		a.modTime = time.Unix(int64(r.uint32()), 0)
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.bytes()
+			r.bytes()
+		}
+	}
+	return a
+}
@@ -0,0 +1,714 @@
+package fileserver
+
+import (
+	"bytes"
+	"container/list"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheShard is one independently locked segment of a MemoryCache, limited by
+// total memory size (bytes). Which entry is evicted to make room is up to its
+// eviction policy, a segmented LRU (SLRU) unless set otherwise. Entries may
+// additionally carry a TTL after which they are treated as missing. Pinned
+// entries (see pin) live in a segment of their own outside the size limit and
+// the policy, and are never evicted to make room.
+type cacheShard struct {
+	maxBytes       int64
+	usedBytes      int64
+	pinnedBytes    int64
+	savedBytes     int64         // bytes spared by keeping entries compressed
+	protectedRatio float64       // share of maxBytes the SLRU protected segment may use
+	staleGrace     time.Duration // how long expired entries are kept for stale serving
+	policy         evictionPolicy
+	pinned         *list.List
+	pins           map[string]struct{} // keys whose entries are pinned
+	cache          map[string]*CacheItem
+	variants       map[string]map[string]struct{} // base key -> variant keys
+	admission      *cmSketch                      // TinyLFU frequency sketch; nil admits everything
+	hooks          CacheHooks
+	store          *offHeapStore // holds entry data off the Go heap; nil keeps it on the heap
+	mu             sync.RWMutex
+
+	hits       int64
+	misses     int64
+	evictions  int64
+	rejections int64
+}
+
+// defaultProtectedRatio is the protected segment's default share of the cache.
+const defaultProtectedRatio = 0.8
+
+// newCacheShard creates an SLRU shard with the given maximum size in bytes.
+func newCacheShard(maxBytes int64) *cacheShard {
+	policy, _ := newEvictionPolicy(PolicySLRU, maxBytes, defaultProtectedRatio)
+	return &cacheShard{
+		maxBytes:       maxBytes,
+		usedBytes:      0,
+		policy:         policy,
+		pinned:         list.New(),
+		pins:           make(map[string]struct{}),
+		protectedRatio: defaultProtectedRatio,
+		cache:          make(map[string]*CacheItem),
+		variants:       make(map[string]map[string]struct{}),
+	}
+}
+
+// get returns a copy of the item stored under key. Negative entries are reported
+// as a miss, as are expired ones unless allowStale is set and they are still
+// within the stale grace period. Entries past that are removed.
+func (c *cacheShard) get(key string, allowStale bool) (CacheItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.admission != nil {
+		c.admission.increment(key)
+	}
+
+	if item, ok := c.cache[key]; ok {
+		if item.Negative {
+			return CacheItem{}, false
+		}
+		if now := time.Now(); item.expired(now) {
+			if item.expired(now.Add(-c.staleGrace)) {
+				c.removeItem(item, EvictExpired)
+				c.misses++
+				return CacheItem{}, false
+			}
+			if !allowStale {
+				// Kept for stale serving until a refresh replaces it
+				c.misses++
+				return CacheItem{}, false
+			}
+		}
+		c.touch(item)
+		c.hits++
+		copied := *item
+		if c.store != nil {
+			// Off-heap memory is reused once the entry is evicted
+			copied.Data = bytes.Clone(item.Data)
+		}
+		return copied, true
+	}
+	c.misses++
+	return CacheItem{}, false
+}
+
+// peek returns a copy of the positive item stored under key, expired or not,
+// without counting a hit or moving it in the LRU.
+func (c *cacheShard) peek(key string) (CacheItem, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, ok := c.cache[key]
+	if !ok || item.Negative {
+		return CacheItem{}, false
+	}
+	copied := *item
+	if c.store != nil {
+		copied.Data = bytes.Clone(copied.Data)
+	}
+	return copied, true
+}
+
+// lookup returns a copy of the item stored under key and marks it as used,
+// without counting a hit. It resolves the payloads of deduplicated entries,
+// whose own lookup was already counted.
+func (c *cacheShard) lookup(key string) (CacheItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.cache[key]
+	if !ok {
+		return CacheItem{}, false
+	}
+	c.touch(item)
+	copied := *item
+	if c.store != nil {
+		copied.Data = bytes.Clone(copied.Data)
+	}
+	return copied, true
+}
+
+// has reports whether key is stored, expired or not.
+func (c *cacheShard) has(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.cache[key]
+	return ok
+}
+
+// isNegative reports whether key was recently recorded as missing by setNegative.
+func (c *cacheShard) isNegative(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.cache[key]
+	if !ok || !item.Negative {
+		return false
+	}
+	if item.expired(time.Now()) {
+		c.removeItem(item, EvictExpired)
+		return false
+	}
+	c.touch(item)
+	c.hits++
+	return true
+}
+
+// setNegative records that key does not exist for ttl.
+// Existing positive entries are left alone.
+func (c *cacheShard) setNegative(key string, ttl time.Duration) {
+	now := time.Now()
+	item := &CacheItem{Key: key, Stored: now, Expires: now.Add(ttl), Negative: true}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.cache[key]; ok {
+		return
+	}
+	c.cache[key] = item
+	c.policy.add(item)
+	c.usedBytes += item.size()
+	c.evict()
+}
+
+// set stores data under key, evicting older items if necessary. A ttl of zero
+// stores the entry without expiration. rawSize is the uncompressed length if
+// data is zstd-compressed. Payloads larger than the shard are not cached.
+func (c *cacheShard) set(key string, data []byte, ttl time.Duration, rawSize int64) {
+	c.put(&CacheItem{Key: key, Data: data, RawSize: rawSize}, ttl, true)
+}
+
+// setRef stores a deduplicated entry for key whose content, length bytes
+// long, is the shared payload stored under blob.
+func (c *cacheShard) setRef(key, blob string, length int64, ttl time.Duration) {
+	c.put(&CacheItem{Key: key, Blob: blob, RawSize: length}, ttl, true)
+}
+
+// setBlob stores a shared payload for deduplicated entries. It never expires
+// and skips admission, which the referencing entry already passed.
+func (c *cacheShard) setBlob(key string, data []byte, rawSize int64) {
+	c.put(&CacheItem{Key: key, Data: data, RawSize: rawSize}, 0, false)
+}
+
+// put stores the key, data, blob and rawSize of item for ttl.
+func (c *cacheShard) put(item *CacheItem, ttl time.Duration, admit bool) {
+	key, data, rawSize := item.Key, item.Data, item.RawSize
+	dataSize := item.size()
+	now := time.Now()
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, pinned := c.pins[key]
+	if dataSize > c.maxBytes && !pinned {
+		return // Too large to cache
+	}
+
+	// If key already exists, update data and move to front
+	if oldItem, ok := c.cache[key]; ok {
+		data, ok := c.place(data)
+		if !ok {
+			return
+		}
+		c.release(oldItem.Data)
+		c.charge(oldItem, -1)
+		oldItem.Data = data
+		oldItem.Blob = item.Blob
+		oldItem.RawSize = rawSize
+		oldItem.Stored = now
+		oldItem.Expires = expires
+		oldItem.Negative = false
+		c.charge(oldItem, 1)
+		if oldItem.pinned {
+			c.pinned.MoveToFront(oldItem.elem)
+		} else {
+			c.policy.update(oldItem)
+		}
+		c.setPinned(oldItem, pinned)
+		c.dropVariants(key, EvictRemoved)
+		if c.hooks.OnSet != nil {
+			c.hooks.OnSet(*oldItem)
+		}
+		c.evict()
+		return
+	}
+
+	if admit && !pinned && !c.admit(key, dataSize) {
+		c.rejections++
+		return
+	}
+	data, ok := c.place(data)
+	if !ok {
+		return
+	}
+
+	// Add new item
+	item.Data, item.Stored, item.Expires, item.pinned = data, now, expires, pinned
+	c.cache[key] = item
+	if pinned {
+		item.elem = c.pinned.PushFront(item)
+	} else {
+		c.policy.add(item)
+	}
+	c.charge(item, 1)
+	if c.hooks.OnSet != nil {
+		c.hooks.OnSet(*item)
+	}
+
+	if base, _, ok := strings.Cut(key, variantSep); ok {
+		if c.variants[base] == nil {
+			c.variants[base] = make(map[string]struct{})
+		}
+		c.variants[base][key] = struct{}{}
+	}
+
+	c.evict()
+}
+
+// place copies data into off-heap memory if the shard uses it. It reports false
+// if that memory couldn't be allocated.
+// Caller must hold the write lock.
+func (c *cacheShard) place(data []byte) ([]byte, bool) {
+	if c.store == nil || len(data) == 0 {
+		return data, true
+	}
+	buf, err := c.store.alloc(len(data))
+	if err != nil {
+		log.Printf("Error allocating %d bytes of off-heap cache memory: %v", len(data), err)
+		return nil, false
+	}
+	copy(buf, data)
+	return buf, true
+}
+
+// release frees entry data allocated by place.
+// Caller must hold the write lock.
+func (c *cacheShard) release(data []byte) {
+	if c.store != nil {
+		c.store.free(data)
+	}
+}
+
+// limit returns the shard's size limit.
+func (c *cacheShard) limit() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.maxBytes
+}
+
+// setMaxBytes changes the size limit, evicting entries immediately if the shard shrank.
+func (c *cacheShard) setMaxBytes(maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxBytes = maxBytes
+	c.policy.resize(maxBytes)
+	c.evict()
+}
+
+// setStore moves entry data off the Go heap into store. It must be called
+// while the shard is still empty.
+func (c *cacheShard) setStore(store *offHeapStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.store = store
+}
+
+// setHooks installs the event callbacks.
+func (c *cacheShard) setHooks(hooks CacheHooks) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hooks = hooks
+}
+
+// setStaleGrace sets how long past their expiry entries remain available to
+// stale reads.
+func (c *cacheShard) setStaleGrace(grace time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.staleGrace = grace
+}
+
+// admissionSketchWidth is the number of counters per row of the TinyLFU sketch.
+const admissionSketchWidth = 1 << 16
+
+// setTinyLFU turns the TinyLFU admission policy on or off. When on, a new entry
+// that would force evictions is only stored if it has been requested more often
+// recently than every entry it would displace, so one-off large files can't
+// flush the hot working set.
+func (c *cacheShard) setTinyLFU(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !enabled {
+		c.admission = nil
+	} else if c.admission == nil {
+		c.admission = newCMSketch(admissionSketchWidth)
+	}
+}
+
+// admit reports whether a new entry of size bytes may be inserted under key.
+// Caller must hold the write lock.
+func (c *cacheShard) admit(key string, size int64) bool {
+	if c.admission == nil {
+		return true
+	}
+	need := c.usedBytes + size - c.maxBytes
+	if need <= 0 {
+		return true
+	}
+	// Walk the entries evict would remove, in the same order
+	freq := c.admission.estimate(key)
+	admitted := true
+	c.policy.walk(func(victim *CacheItem) bool {
+		if c.admission.estimate(victim.Key) >= freq {
+			admitted = false
+			return false
+		}
+		need -= victim.size()
+		return need > 0
+	})
+	return admitted
+}
+
+// setProtectedRatio sets the share (0-1) of the size limit the SLRU protected
+// segment may occupy; entries beyond it are demoted back to probation.
+func (c *cacheShard) setProtectedRatio(ratio float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.protectedRatio = ratio
+	if slru, ok := c.policy.(*slruPolicy); ok {
+		slru.setRatio(ratio)
+	}
+}
+
+// setPolicy switches to the named eviction policy, handing it the current
+// entries in eviction order. What the old policy learned about them (recency
+// segments, frequencies, ghosts) is lost.
+func (c *cacheShard) setPolicy(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.policy.name() == name {
+		return nil
+	}
+	policy, err := newEvictionPolicy(name, c.maxBytes, c.protectedRatio)
+	if err != nil {
+		return err
+	}
+	var items []*CacheItem
+	c.policy.walk(func(item *CacheItem) bool {
+		items = append(items, item)
+		return true
+	})
+	c.policy = policy
+	for _, item := range items {
+		policy.add(item)
+	}
+	return nil
+}
+
+// pin keeps the entry for key, now and whenever it is stored again, in the
+// pinned segment, where it is neither charged against the size limit nor
+// evicted to make room. It still expires and is removed like any entry.
+func (c *cacheShard) pin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pins[key] = struct{}{}
+	if item, ok := c.cache[key]; ok && !item.Negative {
+		c.setPinned(item, true)
+	}
+}
+
+// unpin returns key's entry to the eviction policy, reporting whether key was pinned.
+func (c *cacheShard) unpin(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pins[key]; !ok {
+		return false
+	}
+	delete(c.pins, key)
+	if item, ok := c.cache[key]; ok {
+		c.setPinned(item, false)
+		c.evict()
+	}
+	return true
+}
+
+// isPinned reports whether key is pinned.
+func (c *cacheShard) isPinned(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.pins[key]
+	return ok
+}
+
+// setPinned moves item into or out of the pinned segment. Entries leaving it
+// are handed to the eviction policy as if newly stored.
+// Caller must hold the write lock.
+func (c *cacheShard) setPinned(item *CacheItem, pinned bool) {
+	if item.pinned == pinned {
+		return
+	}
+	c.charge(item, -1)
+	if item.pinned {
+		c.pinned.Remove(item.elem)
+	} else {
+		c.policy.remove(item, false)
+	}
+	item.pinned, item.protected = pinned, false
+	if pinned {
+		item.elem = c.pinned.PushFront(item)
+	} else {
+		c.policy.add(item)
+	}
+	c.charge(item, 1)
+}
+
+// remove deletes key from the shard, reporting whether it was present. Variants
+// cached without their base entry (e.g. blocks of a large file) go with it.
+func (c *cacheShard) remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.cache[key]; ok {
+		c.removeItem(item, EvictRemoved)
+		return true
+	}
+	if _, ok := c.variants[key]; ok {
+		c.dropVariants(key, EvictRemoved)
+		return true
+	}
+	return false
+}
+
+// removePrefix deletes every key starting with prefix and returns how many were removed.
+func (c *cacheShard) removePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, item := range c.cache {
+		if strings.HasPrefix(key, prefix) && c.cache[key] == item {
+			c.removeItem(item, EvictRemoved)
+			removed++
+		}
+	}
+	return removed
+}
+
+// reset removes every entry from the shard.
+func (c *cacheShard) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, item := range c.cache {
+		if c.hooks.OnEvict != nil && !item.Negative {
+			c.hooks.OnEvict(*item, EvictRemoved)
+		}
+		c.release(item.Data)
+	}
+	c.policy.reset()
+	c.pinned.Init()
+	c.pinnedBytes = 0
+	c.savedBytes = 0
+	c.cache = make(map[string]*CacheItem)
+	c.variants = make(map[string]map[string]struct{})
+	c.usedBytes = 0
+}
+
+// entries returns metadata for all entries in the shard, pinned ones first,
+// then the rest in reverse eviction order (most valuable first).
+func (c *cacheShard) entries() []CacheEntryInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := make([]CacheEntryInfo, 0, len(c.cache))
+	for _, item := range c.ordered() {
+		entries = append(entries, CacheEntryInfo{
+			Key:       item.Key,
+			Size:      item.size(),
+			Stored:    item.Stored,
+			Expires:   item.Expires,
+			Negative:  item.Negative,
+			Protected: item.protected,
+			Pinned:    item.pinned,
+			RawSize:   item.RawSize,
+		})
+	}
+	return entries
+}
+
+// items returns copies of the shard's positive entries in the order of entries.
+func (c *cacheShard) items() []CacheItem {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	items := make([]CacheItem, 0, len(c.cache))
+	for _, item := range c.ordered() {
+		if !item.Negative {
+			copied := *item
+			if c.store != nil {
+				copied.Data = bytes.Clone(item.Data)
+			}
+			items = append(items, copied)
+		}
+	}
+	return items
+}
+
+// ordered lists the pinned entries, most recently used first, followed by
+// the others in reverse eviction order.
+// Caller must hold the lock.
+func (c *cacheShard) ordered() []*CacheItem {
+	items := make([]*CacheItem, 0, len(c.cache))
+	for elem := c.pinned.Front(); elem != nil; elem = elem.Next() {
+		items = append(items, elem.Value.(*CacheItem))
+	}
+	pinned := len(items)
+	c.policy.walk(func(item *CacheItem) bool {
+		items = append(items, item)
+		return true
+	})
+	slices.Reverse(items[pinned:])
+	return items
+}
+
+// stats returns the shard's counters.
+func (c *cacheShard) stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return CacheStats{
+		Hits:           c.hits,
+		Misses:         c.misses,
+		Evictions:      c.evictions,
+		Rejections:     c.rejections,
+		UsedBytes:      c.usedBytes,
+		ProtectedBytes: c.policy.protectedBytes(),
+		PinnedBytes:    c.pinnedBytes,
+		SavedBytes:     c.savedBytes,
+		MaxBytes:       c.maxBytes,
+		Entries:        len(c.cache),
+	}
+}
+
+// deleteExpired removes every entry whose TTL (plus the stale grace period, for
+// positive entries) has elapsed.
+func (c *cacheShard) deleteExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, item := range c.cache {
+		// Removing a base entry may already have taken its variants with it.
+		if c.cache[key] != item {
+			continue
+		}
+		if (item.Negative && item.expired(now)) || item.expired(now.Add(-c.staleGrace)) {
+			c.removeItem(item, EvictExpired)
+		}
+	}
+}
+
+// evict removes the items chosen by the eviction policy until usedBytes <= maxBytes.
+// Caller must hold the write lock.
+func (c *cacheShard) evict() {
+	for c.usedBytes > c.maxBytes {
+		item := c.policy.victim()
+		if item == nil {
+			return
+		}
+		c.removeItem(item, EvictCapacity)
+		c.evictions++
+	}
+}
+
+// touch records a hit on item with the eviction policy, or moves it to the
+// front of the pinned segment.
+// Caller must hold the write lock.
+func (c *cacheShard) touch(item *CacheItem) {
+	if item.pinned {
+		c.pinned.MoveToFront(item.elem)
+		return
+	}
+	c.policy.hit(item)
+}
+
+// removeItem unlinks item from the policy and index, along with any variants of it.
+// Caller must hold the write lock.
+func (c *cacheShard) removeItem(item *CacheItem, reason EvictionReason) {
+	c.unlink(item, reason)
+
+	if base, _, ok := strings.Cut(item.Key, variantSep); ok {
+		if set := c.variants[base]; set != nil {
+			delete(set, item.Key)
+			if len(set) == 0 {
+				delete(c.variants, base)
+			}
+		}
+		return
+	}
+
+	// Variants are derived from the base entry and must not outlive it.
+	c.dropVariants(item.Key, reason)
+}
+
+// dropVariants removes all variants of base key.
+// Caller must hold the write lock.
+func (c *cacheShard) dropVariants(key string, reason EvictionReason) {
+	for variantKey := range c.variants[key] {
+		if variant, ok := c.cache[variantKey]; ok {
+			c.unlink(variant, reason)
+		}
+	}
+	delete(c.variants, key)
+}
+
+// unlink removes a single item from the policy and index.
+// Caller must hold the write lock.
+func (c *cacheShard) unlink(item *CacheItem, reason EvictionReason) {
+	if item.pinned {
+		c.pinned.Remove(item.elem)
+	} else {
+		c.policy.remove(item, reason == EvictCapacity)
+	}
+	delete(c.cache, item.Key)
+	c.charge(item, -1)
+	if c.hooks.OnEvict != nil && !item.Negative {
+		c.hooks.OnEvict(*item, reason)
+	}
+	c.release(item.Data)
+}
+
+// charge adds item to (sign 1) or takes it off (sign -1) the byte counters:
+// the size limit, or the pinned bytes outside it.
+// Caller must hold the write lock.
+func (c *cacheShard) charge(item *CacheItem, sign int64) {
+	size := sign * item.size()
+	if item.pinned {
+		c.pinnedBytes += size
+	} else {
+		c.usedBytes += size
+	}
+	c.savedBytes += sign * item.saved()
+}
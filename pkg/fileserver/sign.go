@@ -0,0 +1,72 @@
+package fileserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+var (
+	errSignatureMissing = errors.New("missing sig or exp parameter")
+	errSignatureExpired = errors.New("signed URL has expired")
+	errSignatureInvalid = errors.New("invalid signature")
+)
+
+// signature computes the URL-safe HMAC-SHA256 of urlPath and its expiry time.
+func signature(key, urlPath string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(urlPath + "\n" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignPath returns the query string (sig=...&exp=...) that grants read access to
+// urlPath until expires.
+func SignPath(key, urlPath string, expires time.Time) string {
+	exp := expires.Unix()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", signature(key, path.Clean("/"+urlPath), exp))
+	return q.Encode()
+}
+
+// refreshSignedPath is what links allowed to ?refresh=1 the cache sign in
+// place of the bare path, so a download link can't be turned into one.
+func refreshSignedPath(urlPath string) string {
+	return urlPath + "?refresh=1"
+}
+
+// SignRefreshPath is like SignPath, but the link also makes the server re-read
+// urlPath and replace its cached copy.
+func SignRefreshPath(key, urlPath string, expires time.Time) string {
+	exp := expires.Unix()
+	q := url.Values{}
+	q.Set("refresh", "1")
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", signature(key, refreshSignedPath(path.Clean("/"+urlPath)), exp))
+	return q.Encode()
+}
+
+// verifySignedURL checks the sig and exp query parameters of a request for urlPath.
+func verifySignedURL(key, urlPath string, query url.Values, now time.Time) error {
+	sig, expStr := query.Get("sig"), query.Get("exp")
+	if sig == "" || expStr == "" {
+		return errSignatureMissing
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(key, urlPath, exp))) {
+		return errSignatureInvalid
+	}
+	// Only genuine links are told they expired
+	if now.Unix() > exp {
+		return errSignatureExpired
+	}
+	return nil
+}
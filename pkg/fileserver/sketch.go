@@ -0,0 +1,75 @@
+package fileserver
+
+import "hash/maphash"
+
+// sketchDepth is the number of hash rows in the count-min sketch.
+const sketchDepth = 4
+
+// cmSketch is a count-min sketch of recent access frequencies with 4-bit
+// saturating counters. All counters are halved periodically so the estimate
+// follows the current workload instead of all-time popularity (TinyLFU aging).
+type cmSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	seed      maphash.Seed
+	additions int
+	resetAt   int
+}
+
+// newCMSketch creates a sketch with width counters per row, rounded up to a power of two.
+func newCMSketch(width int) *cmSketch {
+	size := 16
+	for size < width {
+		size <<= 1
+	}
+	s := &cmSketch{mask: uint64(size - 1), seed: maphash.MakeSeed(), resetAt: 10 * size}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// indexes derives one counter position per row from a single hash.
+func (s *cmSketch) indexes(key string) [sketchDepth]uint64 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := h, h>>32|h<<32
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+// increment records one access to key.
+func (s *cmSketch) increment(key string) {
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+// estimate returns the approximate recent access count of key.
+func (s *cmSketch) estimate(key string) uint8 {
+	lowest := uint8(15)
+	for i, idx := range s.indexes(key) {
+		if v := s.rows[i][idx]; v < lowest {
+			lowest = v
+		}
+	}
+	return lowest
+}
+
+// reset halves every counter.
+func (s *cmSketch) reset() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] >>= 1
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,83 @@
+package fileserver
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// SlowRequests logs requests that take longer than -slowRequestLog, with the
+// time spent in each phase, whether or not the access log is enabled.
+type SlowRequests struct {
+	cfg atomic.Pointer[Config]
+}
+
+// NewSlowRequests creates the slow request logger. It is a no-op while
+// -slowRequestLog is zero.
+func NewSlowRequests(cfg *Config) *SlowRequests {
+	s := &SlowRequests{}
+	s.cfg.Store(cfg)
+	return s
+}
+
+// Reload swaps in a new threshold.
+func (s *SlowRequests) Reload(cfg *Config) {
+	s.cfg.Store(cfg)
+}
+
+// Wrap returns next with slow requests logged after they complete.
+func (s *SlowRequests) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		threshold := s.cfg.Load().SlowRequestLog
+		if threshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		r = withRequestInfo(r)
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if elapsed := time.Since(start); elapsed >= threshold {
+			logSlowRequest(r, rec, elapsed)
+		}
+	})
+}
+
+// logSlowRequest logs r with its time split into waiting for a read slot
+// (queue), reading before the first hedged attempt started (hedge), the rest
+// of the disk read (disk) and everything else, mostly sending the response
+// (network), naming the phase that dominated.
+func logSlowRequest(r *http.Request, rec *statusRecorder, elapsed time.Duration) {
+	info := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	t := info.Timing
+	phases := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"queue", t.Queue},
+		{"hedge", t.Hedge},
+		{"disk", max(t.Read-t.Queue-t.Hedge, 0)},
+		{"network", max(elapsed-t.Cache-t.Read, 0)},
+	}
+	dominant := phases[0]
+	for _, phase := range phases[1:] {
+		if phase.d > dominant.d {
+			dominant = phase
+		}
+	}
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	cacheStatus := info.CacheStatus
+	if cacheStatus == "" {
+		cacheStatus = "-"
+	}
+	round := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+	logf(r, "Slow request: %s %s from %s took %v (status %d, %d bytes, cache %s; queue %v, hedge %v, disk %v, network %v; %s dominated)",
+		r.Method, r.URL.Path, clientIP(r), round(elapsed), status, rec.bytes, cacheStatus,
+		round(phases[0].d), round(phases[1].d), round(phases[2].d), round(phases[3].d), dominant.name)
+}
@@ -0,0 +1,176 @@
+package fileserver
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the snapshot encoding changes incompatibly.
+const snapshotVersion = 1
+
+// snapshotHeader starts every cache snapshot file.
+type snapshotHeader struct {
+	Version int
+	Created time.Time
+	Entries int
+}
+
+// snapshotEntry is one cached file. Data is empty in index-only snapshots.
+type snapshotEntry struct {
+	Key     string
+	Stored  time.Time
+	Expires time.Time
+	Data    []byte
+	RawSize int64 // uncompressed length if Data is zstd-compressed
+}
+
+// SaveSnapshot writes the cache index to path, including the cached bytes when
+// withContents is set. Index-only snapshots skip variants, since those are
+// derived on demand anyway. The file is replaced atomically.
+func SaveSnapshot(cache *MemoryCache, path string, withContents bool) (int, error) {
+	var entries []snapshotEntry
+	for _, item := range cache.Items() {
+		entry := snapshotEntry{Key: item.Key, Stored: item.Stored, Expires: item.Expires}
+		if withContents {
+			entry.Data, entry.RawSize = item.Data, item.RawSize
+		} else if strings.Contains(item.Key, variantSep) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		enc := gob.NewEncoder(bw)
+		err := enc.Encode(snapshotHeader{Version: snapshotVersion, Created: time.Now(), Entries: len(entries)})
+		for i := 0; err == nil && i < len(entries); i++ {
+			err = enc.Encode(&entries[i])
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	_, err := writeFileAtomic(path, pr)
+	pr.CloseWithError(err)
+	return len(entries), err
+}
+
+// readSnapshot decodes the snapshot at path.
+func readSnapshot(path string) ([]snapshotEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	entries := make([]snapshotEntry, 0, header.Entries)
+	for i := 0; i < header.Entries; i++ {
+		var entry snapshotEntry
+		if err := dec.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// WarmFromSnapshot restores the cache from a snapshot written by SaveSnapshot.
+// Entries that have expired, or whose file is gone or changed since they were
+// cached, are skipped. Contents stored in the snapshot are loaded immediately;
+// index-only entries are re-read from disk in the background, through the
+// normal read slots, so a restart doesn't send every client to a cold origin.
+func (h *FileHandler) WarmFromSnapshot(path string) error {
+	entries, err := readSnapshot(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	now := time.Now()
+	var restored int
+	var reread []snapshotEntry
+	// Entries are most recently used first; insert the coldest first so the
+	// hottest end up at the front of the LRU.
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if (!entry.Expires.IsZero() && !entry.Expires.After(now)) || !h.snapshotFresh(entry) {
+			continue
+		}
+		if entry.Data == nil {
+			reread = append(reread, entry)
+			continue
+		}
+		h.cache.setPacked(entry.Key, entry.Data, snapshotTTL(entry, now), entry.RawSize)
+		restored++
+	}
+	log.Printf("Cache snapshot %s: restored %d entries, re-reading %d from disk", path, restored, len(reread))
+
+	if len(reread) > 0 {
+		go h.rereadSnapshot(reread)
+	}
+	return nil
+}
+
+// rereadSnapshot loads index-only snapshot entries from disk.
+func (h *FileHandler) rereadSnapshot(entries []snapshotEntry) {
+	start := time.Now()
+	loaded := 0
+	for _, entry := range entries {
+		if h.ctx.Err() != nil {
+			return
+		}
+		if _, ok := h.cache.Get(entry.Key); ok {
+			continue
+		}
+		cfg := h.cfg.Load()
+		if err := h.acquireRead(h.ctx, cfg); err != nil {
+			continue
+		}
+		data, err := h.doRead(h.ctx, cfg, h.storage, h.storageName(entry.Key), h.maxItemBytes(cfg), nil, nil)
+		h.reads.release()
+		if err != nil {
+			continue
+		}
+		if ttl := snapshotTTL(entry, time.Now()); shouldCacheCompressed(cfg, entry.Key, data) {
+			h.cache.SetCompressed(entry.Key, data, ttl)
+		} else {
+			h.cache.SetWithTTL(entry.Key, data, ttl)
+		}
+		loaded++
+	}
+	log.Printf("Cache warm-up finished: %d of %d files re-read in %v", loaded, len(entries), time.Since(start).Round(time.Millisecond))
+}
+
+// snapshotFresh reports whether the file behind entry is unchanged since it was cached.
+func (h *FileHandler) snapshotFresh(entry snapshotEntry) bool {
+	base, _, _ := strings.Cut(entry.Key, variantSep)
+	info, err := h.storage.Stat(h.storageName(base))
+	return err == nil && !info.IsDir() && !info.ModTime().After(entry.Stored)
+}
+
+// snapshotTTL is the lifetime entry had left, or zero if it never expires.
+func snapshotTTL(entry snapshotEntry, now time.Time) time.Duration {
+	if entry.Expires.IsZero() {
+		return 0
+	}
+	return max(entry.Expires.Sub(now), time.Millisecond)
+}
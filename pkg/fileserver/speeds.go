@@ -0,0 +1,53 @@
+package fileserver
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	// speedHistorySize is how many recent reads the adaptive threshold considers.
+	speedHistorySize = 512
+	// speedHistoryMin is how many reads must be recorded before the adaptive
+	// threshold replaces -minSpeedMbps.
+	speedHistoryMin = 20
+)
+
+// speedHistory keeps the throughput (Mbps) of the most recent disk reads in a
+// ring buffer, so the hedging threshold can follow storage conditions.
+type speedHistory struct {
+	mu      sync.Mutex
+	samples []float64
+	next    int
+}
+
+func newSpeedHistory() *speedHistory {
+	return &speedHistory{samples: make([]float64, 0, speedHistorySize)}
+}
+
+// record adds the speed of a completed read, replacing the oldest once full.
+func (s *speedHistory) record(mbps float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.samples) < speedHistorySize {
+		s.samples = append(s.samples, mbps)
+		return
+	}
+	s.samples[s.next] = mbps
+	s.next = (s.next + 1) % speedHistorySize
+}
+
+// percentile returns the p-th percentile (0-100) of the recorded speeds. It
+// reports false until enough reads have been seen.
+func (s *speedHistory) percentile(p float64) (float64, bool) {
+	s.mu.Lock()
+	sorted := append([]float64(nil), s.samples...)
+	s.mu.Unlock()
+
+	if len(sorted) < speedHistoryMin {
+		return 0, false
+	}
+	sort.Float64s(sorted)
+	return sorted[int(p/100*float64(len(sorted)-1))], true
+}
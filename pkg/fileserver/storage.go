@@ -0,0 +1,94 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Storage is where FileHandler reads the served tree from. Names are
+// slash-separated and relative to the root, as with io/fs ("." is the root).
+// A missing file must be reported with an error wrapping fs.ErrNotExist in
+// an *fs.PathError, so os.IsNotExist recognizes it. Writes (uploads, WebDAV,
+// pull-through fills) always go to the local -dir.
+type Storage interface {
+	Open(name string) (StorageFile, error)
+	Stat(name string) (fs.FileInfo, error)
+	// ReadRange reads length bytes at off; it returns fewer only at the end of the file.
+	ReadRange(name string, off, length int64) ([]byte, error)
+	List(name string) ([]fs.DirEntry, error)
+}
+
+// StorageFile is an open file. Local files are *os.File, which lets the read
+// path use fadvise and io_uring on them.
+type StorageFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (fs.FileInfo, error)
+}
+
+// localStorage serves a directory on the local filesystem.
+type localStorage struct {
+	root string
+}
+
+// NewLocalStorage returns a Storage reading files under root.
+func NewLocalStorage(root string) Storage {
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) String() string { return s.root }
+
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *localStorage) Open(name string) (StorageFile, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *localStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+func (s *localStorage) ReadRange(name string, off, length int64) ([]byte, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, length)
+	n, err := io.ReadFull(io.NewSectionReader(f, off, length), data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (s *localStorage) List(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(s.path(name))
+}
+
+// newStorage returns the Storage configured by -storage, or -dir itself.
+func newStorage(cfg *Config) (Storage, error) {
+	if cfg.Storage == "" {
+		return NewLocalStorage(cfg.Dir), nil
+	}
+	return newS3Storage(cfg)
+}
+
+// storageName maps a path under the handler's base directory, as used for
+// cache keys, to its Storage name.
+func (h *FileHandler) storageName(filePath string) string {
+	rel, err := filepath.Rel(h.baseDir, filePath)
+	if err != nil {
+		return filepath.ToSlash(filePath)
+	}
+	return filepath.ToSlash(rel)
+}
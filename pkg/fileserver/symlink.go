@@ -0,0 +1,71 @@
+package fileserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies.
+const (
+	SymlinkDeny       = "deny"               // no path component may be a symlink
+	SymlinkWithinRoot = "follow-within-root" // symlinks may not lead outside -dir
+	SymlinkFollowAll  = "follow-all"         // symlinks are followed anywhere
+)
+
+// realPath returns the absolute path of p with all symlinks resolved.
+func realPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// symlinkAllowed reports whether -symlinkPolicy permits serving or writing
+// filePath. A path that doesn't exist yet is judged by its deepest existing
+// ancestor, so uploads can't be steered through a symlinked directory either.
+func (h *FileHandler) symlinkAllowed(cfg *Config, filePath string) bool {
+	if cfg.SymlinkPolicy == SymlinkFollowAll {
+		return true
+	}
+	root := h.realBase
+	if root == "" {
+		var err error
+		if root, err = realPath(h.baseDir); err != nil {
+			return false
+		}
+	}
+	absBase, err := filepath.Abs(h.baseDir)
+	if err != nil {
+		return false
+	}
+	existing, err := filepath.Abs(filePath)
+	if err != nil {
+		return false
+	}
+
+	var resolved string
+	for {
+		resolved, err = filepath.EvalSymlinks(existing)
+		if err == nil {
+			break
+		}
+		// A dangling symlink would be followed by a write
+		if _, lerr := os.Lstat(existing); !os.IsNotExist(err) || lerr == nil {
+			return false
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return false
+		}
+		existing = parent
+	}
+
+	if cfg.SymlinkPolicy == SymlinkDeny {
+		// Only the root itself may be a symlink
+		rel, err := filepath.Rel(absBase, existing)
+		return err == nil && resolved == filepath.Join(root, rel)
+	}
+	return resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator))
+}
@@ -0,0 +1,68 @@
+package fileserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSymlinkPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	h := newTestHandler(t, nil)
+	outside := t.TempDir()
+	writeTestFile(t, outside, "secret.txt", "secret")
+	writeTestFile(t, h.baseDir, "docs/a.txt", "a")
+	for link, target := range map[string]string{
+		"inside":   filepath.Join(h.baseDir, "docs"),
+		"outside":  outside,
+		"escape":   filepath.Join(outside, "secret.txt"),
+		"dangling": filepath.Join(outside, "missing.txt"),
+	} {
+		if err := os.Symlink(target, filepath.Join(h.baseDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path                        string
+		deny, withinRoot, followAll bool
+	}{
+		{"/docs/a.txt", true, true, true},
+		{"/docs/new.txt", true, true, true},
+		{"/inside/a.txt", false, true, true},
+		{"/outside/secret.txt", false, false, true},
+		{"/outside/new.txt", false, false, true}, // an upload through the link
+		{"/escape", false, false, true},
+		{"/dangling", false, false, true}, // a write would create the target
+	}
+	for _, tt := range tests {
+		for policy, want := range map[string]bool{
+			SymlinkDeny:       tt.deny,
+			SymlinkWithinRoot: tt.withinRoot,
+			SymlinkFollowAll:  tt.followAll,
+		} {
+			cfg := DefaultConfig()
+			cfg.SymlinkPolicy = policy
+			if got := h.symlinkAllowed(cfg, filepath.Join(h.baseDir, tt.path)); got != want {
+				t.Errorf("%s: symlinkAllowed(%s) = %v, want %v", policy, tt.path, got, want)
+			}
+		}
+	}
+
+	if w := serveTest(h, http.MethodGet, "/outside/secret.txt", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("GET through a symlink out of the root = %d, want 403", w.Code)
+	}
+	if w := serveTest(h, http.MethodPut, "/outside/new.txt", "", "x"); w.Code != http.StatusForbidden {
+		t.Errorf("PUT through a symlink out of the root = %d, want 403", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); err == nil {
+		t.Error("PUT wrote outside the root")
+	}
+	if w := serveTest(h, http.MethodGet, "/inside/a.txt", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET through a symlink within the root = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,125 @@
+package fileserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleChunk is the largest write passed to the connection at once, so
+// limiters can interleave many slow clients fairly.
+const throttleChunk = 32 * 1024
+
+// mbpsToBytes converts Mbps (as used by -minSpeedMbps) to bytes per second.
+func mbpsToBytes(mbps float64) rate.Limit {
+	if mbps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(mbps * 1024 * 1024 / 8)
+}
+
+// throttleBurst sizes a bucket to about 100ms of traffic but never below one chunk.
+func throttleBurst(limit rate.Limit) int {
+	if burst := int(limit / 10); burst > throttleChunk && limit != rate.Inf {
+		return burst
+	}
+	return throttleChunk
+}
+
+// Throttle shapes response bodies with a per-connection and a global bandwidth cap.
+type Throttle struct {
+	cfg    atomic.Pointer[Config]
+	global *rate.Limiter
+}
+
+// connThrottleKey holds the lazily created limiter shared by all requests on one connection.
+type connThrottleKey struct{}
+
+type connThrottle struct {
+	once    sync.Once
+	limiter *rate.Limiter
+}
+
+// NewThrottle creates the bandwidth shaper. Zero caps disable it.
+func NewThrottle(cfg *Config) *Throttle {
+	t := &Throttle{global: rate.NewLimiter(rate.Inf, throttleChunk)}
+	t.Reload(cfg)
+	return t
+}
+
+// Reload applies new caps. The global cap changes immediately; the per-connection
+// cap applies to connections accepted afterwards.
+func (t *Throttle) Reload(cfg *Config) {
+	t.cfg.Store(cfg)
+	limit := mbpsToBytes(cfg.MaxMbpsTotal)
+	t.global.SetLimit(limit)
+	t.global.SetBurst(throttleBurst(limit))
+}
+
+// ConnContext is installed as http.Server.ConnContext so requests sharing a
+// connection (keep-alive, HTTP/2 streams) also share its bandwidth cap.
+func (t *Throttle) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connThrottleKey{}, &connThrottle{})
+}
+
+// Wrap returns next with its response body rate limited.
+func (t *Throttle) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := t.cfg.Load()
+		var limiters []*rate.Limiter
+		if cfg.MaxMbpsPerConn > 0 {
+			limit := mbpsToBytes(cfg.MaxMbpsPerConn)
+			newLimiter := func() *rate.Limiter { return rate.NewLimiter(limit, throttleBurst(limit)) }
+			// Listeners without ConnContext (HTTP/3) fall back to a per-request cap
+			if ct, ok := r.Context().Value(connThrottleKey{}).(*connThrottle); ok {
+				ct.once.Do(func() { ct.limiter = newLimiter() })
+				limiters = append(limiters, ct.limiter)
+			} else {
+				limiters = append(limiters, newLimiter())
+			}
+		}
+		if cfg.MaxMbpsTotal > 0 {
+			limiters = append(limiters, t.global)
+		}
+		if len(limiters) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}, r)
+	})
+}
+
+// throttledWriter waits on every limiter before passing each chunk through.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), throttleChunk)
+		for _, limiter := range tw.limiters {
+			if err := limiter.WaitN(tw.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
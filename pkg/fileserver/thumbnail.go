@@ -0,0 +1,166 @@
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// maxThumbnailSourcePixels bounds the images decoded for resizing, so a small
+// file with huge declared dimensions can't exhaust memory.
+const maxThumbnailSourcePixels = 50_000_000
+
+// thumbnailTypes are the image types that can be resized.
+var thumbnailTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// wantsThumbnail reports whether r asks for a resized variant of an image.
+func wantsThumbnail(r *http.Request, cfg *Config, urlPath string) bool {
+	query := r.URL.Query()
+	return (query.Has("w") || query.Has("h")) && thumbnailTypes[mimeTypeFor(cfg, urlPath)]
+}
+
+// thumbnailParams are the normalized ?w=&h=&q= of a resize request.
+type thumbnailParams struct {
+	width, height, quality int
+}
+
+func parseThumbnailParams(r *http.Request, cfg *Config) (thumbnailParams, error) {
+	query := r.URL.Query()
+	p := thumbnailParams{quality: 85}
+	for _, f := range []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{
+		{"w", &p.width, 1, cfg.ThumbnailMaxSize},
+		{"h", &p.height, 1, cfg.ThumbnailMaxSize},
+		{"q", &p.quality, 1, 100},
+	} {
+		if !query.Has(f.name) {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(f.name))
+		if err != nil || n < f.min || n > f.max {
+			return p, fmt.Errorf("%s must be between %d and %d", f.name, f.min, f.max)
+		}
+		*f.dst = n
+	}
+	return p, nil
+}
+
+// resizeImage scales the image in data to fit within p.width x p.height,
+// keeping its aspect ratio, and re-encodes it in its original format. Images
+// are never enlarged; ones that already fit are returned as is.
+func resizeImage(data []byte, p thumbnailParams) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("image is %dx%d, too large to resize", config.Width, config.Height)
+	}
+
+	scale := 1.0
+	if p.width > 0 {
+		scale = min(scale, float64(p.width)/float64(config.Width))
+	}
+	if p.height > 0 {
+		scale = min(scale, float64(p.height)/float64(config.Height))
+	}
+	width := max(int(float64(config.Width)*scale+0.5), 1)
+	height := max(int(float64(config.Height)*scale+0.5), 1)
+	if width == config.Width && height == config.Height {
+		return data, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: p.quality})
+	case "png":
+		err = png.Encode(&out, dst)
+	case "gif":
+		// Only the first frame survives; animated GIFs become stills
+		err = gif.Encode(&out, dst, nil)
+	default:
+		err = fmt.Errorf("unsupported image format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// serveThumbnail answers ?w=&h=&q= on an image with a resized copy. Variants
+// are cached under the normalized parameters, next to the original, so they
+// are dropped along with it.
+func (h *FileHandler) serveThumbnail(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) {
+	p, err := parseThumbnailParams(r, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := h.storage.Stat(h.storageName(filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			h.notFound(w, r, cfg, urlPath)
+		} else {
+			serveReadError(w, r, urlPath, err)
+		}
+		return
+	}
+
+	data, err := h.load(r, cfg, urlPath, filePath)
+	switch {
+	case errors.Is(err, errTooLargeToCache):
+		http.Error(w, "Image too large to resize", http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errIsDirectory):
+		http.Error(w, "Resizing is only available for images", http.StatusBadRequest)
+		return
+	case os.IsNotExist(err):
+		h.notFound(w, r, cfg, urlPath)
+		return
+	case err != nil:
+		serveReadError(w, r, urlPath, err)
+		return
+	}
+
+	key := VariantKey(filePath, fmt.Sprintf("thumb:%dx%d:q%d", p.width, p.height, p.quality))
+	thumb, ok := h.cache.Get(key)
+	if !ok {
+		val, err, _ := h.sfGroup.Do(key, func() (interface{}, error) {
+			thumb, err := resizeImage(data, p)
+			if err != nil {
+				return nil, err
+			}
+			h.store(cfg, urlPath, key, thumb)
+			return thumb, nil
+		})
+		if err != nil {
+			http.Error(w, "Cannot resize image: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		thumb = val.([]byte)
+	}
+
+	w.Header().Set("Content-Type", mimeTypeFor(cfg, urlPath))
+	setCacheControl(w, cfg, urlPath)
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(thumb))
+}
@@ -0,0 +1,90 @@
+package fileserver
+
+import (
+	"log"
+	"os"
+)
+
+// CacheTier is a cache shared by several instances, consulted after a memory
+// miss and before reading from storage. Keys are Storage names. Errors are
+// never fatal: callers log them and carry on as if the tier were empty.
+type CacheTier interface {
+	// Get reports ok=false for a missing key.
+	Get(key string) (data []byte, ok bool, err error)
+	Set(key string, data []byte) error
+	Delete(key string) error
+	// DeletePrefix removes every key starting with prefix; "" removes all of them.
+	DeletePrefix(prefix string) error
+}
+
+// Write policies for uploads when a cache tier is configured.
+const (
+	// WriteAround drops the old entry; the next read fills the tier again.
+	WriteAround = "write-around"
+	// WriteThrough stores the new content right away.
+	WriteThrough = "write-through"
+)
+
+// newCacheTier returns the tier configured by -redis, or nil.
+func newCacheTier(cfg *Config) (CacheTier, error) {
+	if cfg.Redis == "" {
+		return nil, nil
+	}
+	return newRedisTier(cfg)
+}
+
+// tierGet looks name up in the cache tier, if any.
+func (h *FileHandler) tierGet(name string) ([]byte, bool) {
+	if h.tier == nil {
+		return nil, false
+	}
+	data, ok, err := h.tier.Get(name)
+	if err != nil {
+		log.Printf("Cache tier: reading %s failed: %v", name, err)
+		return nil, false
+	}
+	return data, ok
+}
+
+// tierFill stores a file just read from storage in the cache tier without
+// holding up the request.
+func (h *FileHandler) tierFill(cfg *Config, name string, data []byte) {
+	if h.tier == nil || int64(len(data)) > cfg.RedisMaxItemBytes {
+		return
+	}
+	go func() {
+		if err := h.tier.Set(name, data); err != nil {
+			log.Printf("Cache tier: storing %s failed: %v", name, err)
+		}
+	}()
+}
+
+// tierWrite updates the cache tier after filePath was written or removed,
+// following -redisWritePolicy.
+func (h *FileHandler) tierWrite(filePath string, tree bool) {
+	if h.tier == nil {
+		return
+	}
+	cfg := h.cfg.Load()
+	name := h.storageName(filePath)
+	if cfg.RedisWritePolicy == WriteThrough && !tree {
+		if info, err := os.Stat(filePath); err == nil && info.Mode().IsRegular() && info.Size() <= cfg.RedisMaxItemBytes {
+			if data, err := os.ReadFile(filePath); err == nil {
+				err := h.tier.Set(name, data)
+				if err == nil {
+					return
+				}
+				// Don't leave the old content behind
+				log.Printf("Cache tier: storing %s failed: %v", name, err)
+			}
+		}
+	}
+	if err := h.tier.Delete(name); err != nil {
+		log.Printf("Cache tier: dropping %s failed: %v", name, err)
+	}
+	if tree {
+		if err := h.tier.DeletePrefix(name + "/"); err != nil {
+			log.Printf("Cache tier: dropping %s/ failed: %v", name, err)
+		}
+	}
+}
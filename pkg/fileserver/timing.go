@@ -0,0 +1,56 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestTiming breaks down where a request spent its time.
+type requestTiming struct {
+	Cache time.Duration // cache lookup
+	Read  time.Duration // waiting for the disk read on a miss, all attempts included
+	Queue time.Duration // part of Read spent waiting for a read slot
+	Hedge time.Duration // delay before the first hedged attempt started
+	Age   time.Duration // age of the cached copy served
+}
+
+// timingOf returns the timing record of r. Requests without a requestInfo get
+// a throwaway one, so callers needn't check.
+func timingOf(r *http.Request) *requestTiming {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return &info.Timing
+	}
+	return &requestTiming{}
+}
+
+// setDiagnosticHeaders reports how r was served: X-Cache with the cache status,
+// Age for responses from the cache, and Server-Timing with the cache lookup,
+// disk read and hedge delay durations.
+func setDiagnosticHeaders(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !cfg.DiagnosticHeaders || !ok || info.CacheStatus == "" {
+		return
+	}
+	w.Header().Set("X-Cache", info.CacheStatus)
+	if info.CacheStatus == CacheHit || info.CacheStatus == CacheStale {
+		w.Header().Set("Age", strconv.FormatInt(int64(info.Timing.Age/time.Second), 10))
+	}
+
+	t := info.Timing
+	metrics := []string{serverTimingMetric("cache", t.Cache)}
+	if t.Read > 0 {
+		metrics = append(metrics, serverTimingMetric("disk", t.Read))
+	}
+	if t.Hedge > 0 {
+		metrics = append(metrics, serverTimingMetric("hedge", t.Hedge))
+	}
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
+
+// serverTimingMetric formats one Server-Timing entry; durations are in milliseconds.
+func serverTimingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
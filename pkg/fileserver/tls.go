@@ -0,0 +1,89 @@
+package fileserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion maps a version string such as "1.2" to its crypto/tls constant.
+func parseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+	}
+	return v, nil
+}
+
+// parseCipherSuites maps IANA cipher suite names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+// to their IDs. Suites known to be insecure are accepted but must be named explicitly.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newACMEManager returns an autocert manager for cfg.ACMEDomains, or nil when ACME is disabled.
+// Certificates are persisted in cfg.ACMECacheDir so restarts don't hit Let's Encrypt rate limits.
+func newACMEManager(cfg *Config) *autocert.Manager {
+	if len(cfg.ACMEDomains) == 0 {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+	}
+}
+
+// buildTLSConfig returns the server TLS settings, or nil when TLS is disabled.
+// With an ACME manager, certificates are obtained on demand instead of loaded from files.
+func buildTLSConfig(cfg *Config, acmeManager *autocert.Manager) (*tls.Config, error) {
+	if cfg.TLSCert == "" && acmeManager == nil {
+		return nil, nil
+	}
+
+	minVersion, err := parseTLSVersion(cfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{MinVersion: minVersion}
+	if acmeManager != nil {
+		// Includes the acme-tls/1 ALPN protocol for TLS-ALPN-01 challenges.
+		tlsCfg = acmeManager.TLSConfig()
+		tlsCfg.MinVersion = minVersion
+	}
+
+	if len(cfg.TLSCipherSuites) > 0 {
+		// Only applies to TLS 1.0-1.2; TLS 1.3 suites are not configurable in Go.
+		tlsCfg.CipherSuites, err = parseCipherSuites(cfg.TLSCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tlsCfg, nil
+}
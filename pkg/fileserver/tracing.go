@@ -0,0 +1,369 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer records OpenTelemetry spans for requests and exports them in batches
+// to an OTLP/HTTP collector (JSON encoding). Incoming W3C traceparent headers
+// are honoured, so the server's spans join the caller's trace.
+type Tracer struct {
+	endpoint string
+	service  string
+	ratio    float64
+	client   *http.Client
+
+	queue chan *Span
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// NewTracer returns nil when no -otlpEndpoint is configured.
+func NewTracer(cfg *Config) *Tracer {
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	endpoint := strings.TrimSuffix(cfg.OTLPEndpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	t := &Tracer{
+		endpoint: endpoint,
+		service:  cfg.OTelServiceName,
+		ratio:    cfg.TraceSampleRatio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, 4*traceBatchSize),
+		done:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+func (t *Tracer) String() string {
+	return t.endpoint
+}
+
+// Close exports the spans still queued and stops the exporter.
+func (t *Tracer) Close() {
+	close(t.done)
+	t.wg.Wait()
+}
+
+// Wrap starts a server span for every request, continuing the caller's trace
+// if it sent a sampled traceparent.
+func (t *Tracer) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := t.startRequest(r)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = withRequestInfo(r)
+		r = r.WithContext(contextWithSpan(r.Context(), span))
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttr("http.response.status_code", status)
+		span.SetAttr("http.response.body.size", rec.bytes)
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok && info.CacheStatus != "" {
+			span.SetAttr("cache.status", info.CacheStatus)
+		}
+		if status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+		span.End()
+	})
+}
+
+// startRequest returns the server span for r, or nil if it isn't sampled.
+func (t *Tracer) startRequest(r *http.Request) *Span {
+	span := &Span{tracer: t, name: r.Method, kind: spanKindServer, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	} else {
+		rand.Read(span.traceID[:])
+		// Like OTel's ratio sampler, decide on the trace ID so all spans agree
+		if t.ratio < 1 && float64(binary.BigEndian.Uint64(span.traceID[8:])>>1) >= t.ratio*(1<<63) {
+			return nil
+		}
+	}
+	rand.Read(span.spanID[:])
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("url.path", r.URL.Path)
+	span.SetAttr("client.address", clientIP(r))
+	if id := requestIDOf(r); id != "" {
+		span.SetAttr("http.request.id", id)
+	}
+	if ua := r.UserAgent(); ua != "" {
+		span.SetAttr("user_agent.original", ua)
+	}
+	return span
+}
+
+// parseTraceparent decodes a W3C traceparent header ("00-<trace>-<span>-<flags>").
+func parseTraceparent(header string) (traceID [16]byte, spanID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, spanID, false, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return traceID, spanID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, spanID, false, false
+	}
+	return traceID, spanID, flags&1 == 1, true
+}
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// Span is one timed operation of a trace. All methods are no-ops on a nil
+// Span, so unsampled requests can be instrumented unconditionally.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []spanAttr
+	err   string
+}
+
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+type spanKey struct{}
+
+func contextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// spanFromContext returns the span of ctx, or nil outside a sampled request.
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// startSpan starts a child of the span in ctx, or returns nil if there is none.
+func startSpan(ctx context.Context, name string) *Span {
+	return spanFromContext(ctx).Child(name)
+}
+
+// Child starts a span under s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, name: name, kind: spanKindInternal, start: time.Now()}
+	rand.Read(child.spanID[:])
+	return child
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, spanAttr{key, value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed, unless err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Spans are dropped rather
+// than slowing down requests when the exporter falls behind.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	select {
+	case s.tracer.queue <- s:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	failing := false
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.export(batch)
+		switch {
+		case err != nil && !failing:
+			log.Printf("Exporting spans to %s failed, dropping them until it recovers: %v", t.endpoint, err)
+		case err == nil && failing:
+			log.Printf("Exporting spans to %s recovered", t.endpoint)
+		}
+		failing = err != nil
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export posts spans as an OTLP ExportTraceServiceRequest in JSON.
+func (t *Tracer) export(spans []*Span) error {
+	type keyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	type status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            status     `json:"status"`
+	}
+	value := func(v interface{}) map[string]interface{} {
+		switch v := v.(type) {
+		case string:
+			return map[string]interface{}{"stringValue": v}
+		case bool:
+			return map[string]interface{}{"boolValue": v}
+		case int:
+			return map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			return map[string]interface{}{"doubleValue": v}
+		case time.Duration:
+			return map[string]interface{}{"doubleValue": float64(v) / float64(time.Millisecond)}
+		default:
+			return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+	}
+
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, keyValue{a.key, value(a.value)})
+		}
+		if s.err != "" {
+			o.Status = status{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []keyValue{{"service.name", value(t.service)}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "fileserver"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
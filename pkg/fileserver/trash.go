@@ -0,0 +1,203 @@
+package fileserver
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trashStampFormat is the deletion time suffixed to the name of every file in
+// the trash, in local time.
+const trashStampFormat = "20060102-150405.000"
+
+// trashPurgeInterval is the longest time between two trash purges.
+const trashPurgeInterval = time.Hour
+
+var (
+	errNotInTrash    = errors.New("no such file in the trash")
+	errRestoreExists = errors.New("a file already exists at the original path")
+)
+
+// TrashEntry is a file in the trash.
+type TrashEntry struct {
+	ID      string    `json:"id"`   // path under the trash directory, naming the entry in the admin API
+	Path    string    `json:"path"` // where it was deleted from
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size"`
+}
+
+// parseTrashName splits the name of a file in the trash into its original
+// name and deletion time.
+func parseTrashName(name string) (string, time.Time, bool) {
+	i := len(name) - len(trashStampFormat) - 1
+	if i < 1 || name[i] != '.' {
+		return "", time.Time{}, false
+	}
+	deleted, err := time.ParseInLocation(trashStampFormat, name[i+1:], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[:i], deleted, true
+}
+
+// Trash lists the files in the trash, oldest first.
+func (h *FileHandler) Trash() ([]TrashEntry, error) {
+	entries := []TrashEntry{}
+	err := h.walkTrash(func(entry TrashEntry, _ string) {
+		entries = append(entries, entry)
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.Before(entries[j].Deleted) })
+	return entries, err
+}
+
+// walkTrash calls fn with every file in the trash and its location on disk.
+// Files not named like moveToTrash names them are left alone.
+func (h *FileHandler) walkTrash(fn func(entry TrashEntry, trashPath string)) error {
+	root := filepath.Join(h.baseDir, trashDirName)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, deleted, ok := parseTrashName(d.Name())
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Purged meanwhile
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		id := filepath.ToSlash(rel)
+		fn(TrashEntry{
+			ID:      id,
+			Path:    "/" + filepath.ToSlash(filepath.Join(filepath.Dir(rel), name)),
+			Deleted: deleted,
+			Size:    info.Size(),
+		}, p)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // Nothing was ever deleted
+	}
+	return err
+}
+
+// trashPath resolves the trash entry id to its file on disk and the path it
+// was deleted from.
+func (h *FileHandler) trashPath(id string) (string, string, error) {
+	rel := filepath.Clean("/" + id)
+	name, _, ok := parseTrashName(filepath.Base(rel))
+	if !ok || rel == "/" {
+		return "", "", errNotInTrash
+	}
+	trashPath := filepath.Join(h.baseDir, trashDirName, rel)
+	if info, err := os.Stat(trashPath); err != nil || info.IsDir() {
+		return "", "", errNotInTrash
+	}
+	return trashPath, filepath.Join(filepath.Dir(rel), name), nil
+}
+
+// RestoreTrash moves the trash entry id back to where it was deleted from and
+// returns that path. It fails with errRestoreExists rather than replace a
+// file created there since.
+func (h *FileHandler) RestoreTrash(id string) (string, error) {
+	trashPath, urlPath, err := h.trashPath(id)
+	if err != nil {
+		return "", err
+	}
+	filePath := filepath.Join(h.baseDir, urlPath)
+	if _, err := os.Lstat(filePath); err == nil {
+		return "", errRestoreExists
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(trashPath, filePath); err != nil {
+		return "", err
+	}
+	h.invalidate(filePath)
+	removeEmptyTrashDirs(filepath.Join(h.baseDir, trashDirName), filepath.Dir(trashPath))
+	return filepath.ToSlash(urlPath), nil
+}
+
+// PurgeTrash deletes the trash entry id for good.
+func (h *FileHandler) PurgeTrash(id string) error {
+	trashPath, _, err := h.trashPath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(trashPath); err != nil {
+		return err
+	}
+	removeEmptyTrashDirs(filepath.Join(h.baseDir, trashDirName), filepath.Dir(trashPath))
+	return nil
+}
+
+// purgeTrash deletes the files that have been in the trash for longer than
+// retention, or all of them if retention is 0, returning how many it deleted.
+func (h *FileHandler) purgeTrash(retention time.Duration) (int, error) {
+	root := filepath.Join(h.baseDir, trashDirName)
+	cutoff := time.Now().Add(-retention)
+	var purged int
+	err := h.walkTrash(func(entry TrashEntry, trashPath string) {
+		if retention > 0 && entry.Deleted.After(cutoff) {
+			return
+		}
+		if err := os.Remove(trashPath); err != nil {
+			log.Printf("Warning: Failed to purge %s from the trash: %v", entry.ID, err)
+			return
+		}
+		purged++
+		removeEmptyTrashDirs(root, filepath.Dir(trashPath))
+	})
+	return purged, err
+}
+
+// removeEmptyTrashDirs removes dir and its parents up to the trash root as
+// long as they are empty.
+func removeEmptyTrashDirs(root, dir string) {
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// StartTrashPurger periodically deletes files that have been in the trash for
+// longer than -trashRetention. It follows config reloads and stops with Close.
+func (h *FileHandler) StartTrashPurger() {
+	go func() {
+		for {
+			interval := trashPurgeInterval
+			if retention := h.cfg.Load().TrashRetention; retention > 0 {
+				// Keep files at most about a tenth longer than asked
+				interval = min(max(retention/10, time.Second), trashPurgeInterval)
+			}
+			select {
+			case <-time.After(interval):
+			case <-h.ctx.Done():
+				return
+			}
+			retention := h.cfg.Load().TrashRetention
+			if retention <= 0 {
+				continue
+			}
+			purged, err := h.purgeTrash(retention)
+			if err != nil {
+				log.Printf("Warning: Purging the trash failed: %v", err)
+			}
+			if purged > 0 {
+				log.Printf("Purged %d files from the trash after %v", purged, retention)
+			}
+		}
+	}()
+}
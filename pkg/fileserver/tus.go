@@ -0,0 +1,383 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tusDirName holds in-progress tus uploads under the served root. It is never served.
+const tusDirName = ".tus"
+
+const tusVersion = "1.0.0"
+
+// TusHandler implements the tus.io resumable upload protocol (core, creation and
+// termination extensions) under /tus/. Chunks are appended to a staging file in
+// tusDirName, which is atomically renamed to its destination once complete.
+type TusHandler struct {
+	h     *FileHandler
+	dir   string
+	locks sync.Map // upload ID -> *sync.Mutex
+}
+
+func NewTusHandler(h *FileHandler) *TusHandler {
+	return &TusHandler{
+		h:   h,
+		dir: filepath.Join(h.baseDir, tusDirName),
+	}
+}
+
+// tusUpload is the metadata persisted next to each staging file.
+type tusUpload struct {
+	Length   int64             `json:"length"`
+	Path     string            `json:"path"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Owner is the user who created the upload, charged for it under -quotas.
+	Owner string `json:"owner,omitempty"`
+}
+
+func (t *TusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := t.h.cfg.Load()
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		if cfg.MaxUploadBytes > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.MaxUploadBytes, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return
+	}
+	if !t.h.authorizeWrite(w, r, cfg) {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tus"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t.create(w, r, cfg)
+		return
+	}
+	if !isValidUploadID(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		t.head(w, r, id)
+	case http.MethodPatch:
+		t.patch(w, r, id)
+	case http.MethodDelete:
+		t.terminate(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// create starts a new upload. The destination comes from the "path" metadata
+// key, or "filename" to store at the root.
+func (t *TusHandler) create(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if cfg.MaxUploadBytes > 0 && length > cfg.MaxUploadBytes {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	dest := metadata["path"]
+	if dest == "" {
+		dest = metadata["filename"]
+	}
+	dest = path.Clean("/" + dest)
+	if dest == "/" || isInternalPath(dest) {
+		http.Error(w, "Upload-Metadata must name a destination path or filename", http.StatusBadRequest)
+		return
+	}
+	if isHiddenPath(cfg, dest) {
+		http.Error(w, http.StatusText(cfg.HiddenStatus), cfg.HiddenStatus)
+		return
+	}
+	if !t.h.checkACL(w, r, cfg, dest) {
+		return
+	}
+	// The request URL names the tus endpoint, not the file; check that too
+	if err := authorizePaths(r)(dest); err != nil {
+		t.h.writeError(w, r, dest, err)
+		return
+	}
+	if !t.h.symlinkAllowed(cfg, filepath.Join(t.h.baseDir, filepath.FromSlash(dest))) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	charge, err := t.h.quotas.charge(cfg, dest, authenticatedUser(r))
+	if err == nil && !charge.allows(length) {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		t.h.writeError(w, r, dest, err)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		log.Printf("tus: failed to generate upload ID: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	upload := &tusUpload{Length: length, Path: dest, Metadata: metadata, Owner: authenticatedUser(r)}
+	if err := t.save(id, upload); err != nil {
+		log.Printf("tus: failed to create upload %s: %v", id, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// A zero-length upload is complete as soon as it is created.
+	if length == 0 {
+		if err := t.finish(r, cfg, id, upload); err != nil {
+			t.h.writeError(w, r, dest, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", externalPath(cfg, "/tus/"+id))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (t *TusHandler) head(w http.ResponseWriter, r *http.Request, id string) {
+	upload, offset, err := t.load(id)
+	if err != nil {
+		t.notFoundOrError(w, r, id, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch appends the request body at Upload-Offset, which must equal the current size.
+func (t *TusHandler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	mu := t.lock(id)
+	if !mu.TryLock() {
+		http.Error(w, "Upload is busy", http.StatusConflict)
+		return
+	}
+	defer mu.Unlock()
+
+	upload, offset, err := t.load(id)
+	if err != nil {
+		t.notFoundOrError(w, r, id, err)
+		return
+	}
+	if clientOffset != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(t.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.notFoundOrError(w, r, id, err)
+		return
+	}
+	// Bytes received before a disconnect stay on disk so the client can resume from there.
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	syncErr := f.Sync()
+	f.Close()
+	offset += n
+
+	if copyErr != nil || syncErr != nil {
+		log.Printf("tus: upload %s interrupted at %d/%d bytes: %v", id, offset, upload.Length, errors.Join(copyErr, syncErr))
+		http.Error(w, "Upload interrupted", http.StatusInternalServerError)
+		return
+	}
+
+	if offset == upload.Length {
+		if err := t.finish(r, t.h.cfg.Load(), id, upload); err != nil {
+			t.h.writeError(w, r, upload.Path, err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *TusHandler) terminate(w http.ResponseWriter, r *http.Request, id string) {
+	mu := t.lock(id)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := os.Stat(t.infoPath(id)); err != nil {
+		t.notFoundOrError(w, r, id, err)
+		return
+	}
+	t.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish moves a completed upload to its destination and invalidates the cache.
+// The ACL and auth rules are evaluated again for r, which sent the last bytes,
+// in case they changed since the upload was created. An upload that no longer
+// fits its quotas stays staged; one rejected by -uploadScan is dropped. Like
+// chunked uploads, it keeps the file it replaces in the trash with
+// -trashOverwrites.
+func (t *TusHandler) finish(r *http.Request, cfg *Config, id string, upload *tusUpload) error {
+	if err := aclError(r, cfg, upload.Path); err != nil {
+		return err
+	}
+	if err := authorizePaths(r)(upload.Path); err != nil {
+		return err
+	}
+	filePath := filepath.Join(t.h.baseDir, filepath.FromSlash(upload.Path))
+	if !t.h.symlinkAllowed(cfg, filePath) {
+		return os.ErrPermission
+	}
+	charge, err := t.h.quotas.charge(cfg, upload.Path, upload.Owner)
+	if err == nil && !charge.allows(upload.Length) {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.h.placeUpload(cfg, upload.Path, upload.Owner, filePath, t.dataPath(id)); err != nil {
+		if errors.Is(err, errUploadRejected) {
+			t.remove(id)
+		}
+		return err
+	}
+	charge.commit(upload.Length)
+	t.remove(id)
+	t.h.invalidate(filePath)
+	log.Printf("Stored %s (tus upload %s)", upload.Path, id)
+	return nil
+}
+
+func (t *TusHandler) save(id string, upload *tusUpload) error {
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(t.dataPath(id), nil, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(t.infoPath(id), raw, 0644)
+}
+
+// load returns the upload's metadata and current offset (the staging file size).
+func (t *TusHandler) load(id string) (*tusUpload, int64, error) {
+	raw, err := os.ReadFile(t.infoPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(raw, &upload); err != nil {
+		return nil, 0, err
+	}
+	info, err := os.Stat(t.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &upload, info.Size(), nil
+}
+
+func (t *TusHandler) remove(id string) {
+	os.Remove(t.dataPath(id))
+	os.Remove(t.infoPath(id))
+	t.locks.Delete(id)
+}
+
+func (t *TusHandler) lock(id string) *sync.Mutex {
+	mu, _ := t.locks.LoadOrStore(id, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+func (t *TusHandler) notFoundOrError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("tus: upload %s: %v", id, err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+func (t *TusHandler) dataPath(id string) string { return filepath.Join(t.dir, id) }
+func (t *TusHandler) infoPath(id string) string { return filepath.Join(t.dir, id+".json") }
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func isValidUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,85 @@
+package fileserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The destination of a tus upload is checked against the auth rules and the
+// paths claim of a JWT, though the request URL only names /tus/.
+func TestTusDestinationAuth(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.Tus = true
+		cfg.JWTSecret = "k"
+		cfg.AuthRules = []AuthRule{
+			{Prefix: "/", JWT: true},
+			{Prefix: "/private/", Tokens: []string{"s3cret"}},
+		}
+	})
+	a, err := NewAuthenticator(h.cfg.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tus := a.Wrap(NewTusHandler(h))
+	sign := func(paths ...string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, pathClaims{
+			Paths:            paths,
+			RegisteredClaims: jwt.RegisteredClaims{Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		}).SignedString([]byte("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	token := sign("/tus", "/public/")
+
+	tests := []struct {
+		dest, token string
+		want        int
+	}{
+		{"/public/a.txt", token, http.StatusCreated},
+		{"/other/a.txt", token, http.StatusUnauthorized}, // outside the paths claim
+		{"/private/a.txt", token, http.StatusUnauthorized},
+		{"/private/a.txt", sign("/tus", "/private/"), http.StatusUnauthorized}, // /private/ wants its own token
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/tus/", nil)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Length", "0")
+		req.Header.Set("Upload-Metadata", "path "+base64.StdEncoding.EncodeToString([]byte(tt.dest)))
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		tus.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("tus upload to %s = %d, want %d", tt.dest, w.Code, tt.want)
+		}
+	}
+}
+
+func TestTusACL(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.Tus = true
+		cfg.ACL = []ACLRule{{Pattern: "*.key", Action: ACLDeny}, {Pattern: "/private/**", Action: ACLAuth}}
+	})
+	tus := NewTusHandler(h)
+	for dest, want := range map[string]int{
+		"/a.txt":         http.StatusCreated,
+		"/certs/new.key": http.StatusForbidden,
+		"/private/a.txt": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/tus/", nil)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Length", "1")
+		req.Header.Set("Upload-Metadata", "path "+base64.StdEncoding.EncodeToString([]byte(dest)))
+		w := httptest.NewRecorder()
+		tus.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("tus upload to %s = %d, want %d", dest, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package fileserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// authorizeWrite rejects the request unless writes are enabled and, when a
+// write token is configured, the request carries it as a bearer token or as
+// the Basic auth password (for WebDAV clients that only speak Basic). Users
+// signed in through an auth rule may write without it, so their uploads are
+// charged to them under -quotas.
+func (h *FileHandler) authorizeWrite(w http.ResponseWriter, r *http.Request, cfg *Config) bool {
+	if cfg.ReadOnly {
+		http.Error(w, "Server is read-only", http.StatusMethodNotAllowed)
+		return false
+	}
+	if cfg.WriteToken == "" || authenticatedUser(r) != "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.WriteToken)) != 1 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="write"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="write"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// invalidate drops everything cached for filePath after it changed on disk,
+// here and on all peers. All write paths go through here so they stay
+// consistent with each other.
+func (h *FileHandler) invalidate(filePath string) {
+	h.cache.Delete(filePath)
+	h.tierWrite(filePath, false)
+	if h.peers != nil {
+		h.peers.Invalidate("/"+h.storageName(filePath), false)
+	}
+}
+
+// invalidateTree is like invalidate but also covers everything below filePath
+// when it is (or was) a directory.
+func (h *FileHandler) invalidateTree(filePath string) {
+	h.dropTree(filePath)
+	h.tierWrite(filePath, true)
+	if h.peers != nil {
+		h.peers.Invalidate("/"+h.storageName(filePath), true)
+	}
+}
+
+// dropTree removes filePath and everything below it from this instance's cache.
+func (h *FileHandler) dropTree(filePath string) {
+	h.cache.Delete(filePath)
+	h.cache.DeletePrefix(filePath + string(filepath.Separator))
+}
+
+// handlePut creates or replaces the file at urlPath with the request body.
+func (h *FileHandler) handlePut(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "Cannot PUT a directory", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Range") != "" {
+		h.handlePutChunk(w, r, cfg, urlPath)
+		return
+	}
+
+	filePath := filepath.Join(h.baseDir, urlPath)
+	_, statErr := os.Stat(filePath)
+	existed := statErr == nil
+
+	body := io.Reader(r.Body)
+	if cfg.MaxUploadBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBytes)
+	}
+	if _, err := h.storeUpload(r, cfg, urlPath, filePath, body, r.ContentLength); err != nil {
+		h.writeError(w, r, urlPath, err)
+		return
+	}
+	h.invalidate(filePath)
+	logf(r, "Stored %s", urlPath)
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", externalPath(cfg, urlPath))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlePost stores every file part of a multipart/form-data body into the
+// directory at urlPath, or with ?finalize completes a chunked upload to urlPath.
+func (h *FileHandler) handlePost(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath string) {
+	if r.URL.Query().Has("finalize") {
+		h.finalizeChunks(w, r, cfg, urlPath)
+		return
+	}
+	if cfg.MaxUploadBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBytes)
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	dirPath := filepath.Join(h.baseDir, urlPath)
+	stored := []string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.writeError(w, r, urlPath, err)
+			return
+		}
+
+		name := filepath.Base(part.FileName())
+		if part.FileName() == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+			part.Close()
+			continue // Not a file field
+		}
+
+		if isHiddenPath(cfg, path.Join(urlPath, name)) {
+			part.Close()
+			http.Error(w, http.StatusText(cfg.HiddenStatus), cfg.HiddenStatus)
+			return
+		}
+
+		filePath := filepath.Join(dirPath, name)
+		_, err = h.storeUpload(r, cfg, path.Join(urlPath, name), filePath, part, -1)
+		part.Close()
+		if err != nil {
+			h.writeError(w, r, urlPath, err)
+			return
+		}
+		h.invalidate(filePath)
+		stored = append(stored, externalPath(cfg, path.Join(urlPath, name)))
+		logf(r, "Stored %s", path.Join(urlPath, name))
+	}
+
+	if len(stored) == 0 {
+		http.Error(w, "No files in request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string][]string{"stored": stored})
+}
+
+// writeError maps filesystem and body errors from write operations to HTTP responses.
+func (h *FileHandler) writeError(w http.ResponseWriter, r *http.Request, urlPath string, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errIsDirectory):
+		http.Error(w, "Target is a directory", http.StatusConflict)
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+	case errors.Is(err, errUploadRejected):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errScanFailed):
+		http.Error(w, "Upload scanner unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, errUnauthorized), errors.Is(err, errAuthRequired):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case os.IsPermission(err), errors.Is(err, errForbidden):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		logf(r, "Error writing %s: %v", urlPath, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+var errIsDirectory = errors.New("target is a directory")
+
+// storeUpload writes the file uploaded by req like writeFileAtomic, within
+// -quotas, passing -uploadScan and first keeping the file it replaces in the
+// trash with -trashOverwrites. size is the length of body, or -1 if unknown.
+func (h *FileHandler) storeUpload(req *http.Request, cfg *Config, urlPath, filePath string, body io.Reader, size int64) (int64, error) {
+	user := authenticatedUser(req)
+	charge, err := h.quotas.charge(cfg, urlPath, user)
+	if err == nil && !charge.allows(size) {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		return 0, err
+	}
+	var kept string
+	if cfg.TrashOverwrites {
+		if kept, err = h.keepInTrash(urlPath, filePath); err != nil {
+			return 0, err
+		}
+	}
+	n, err := writeFileChecked(filePath, charge.limit(body), func(tmpPath string) error {
+		return h.scanUpload(cfg, urlPath, user, tmpPath)
+	})
+	if err != nil {
+		if kept != "" {
+			os.Remove(kept) // Nothing was replaced
+		}
+		return n, err
+	}
+	charge.commit(n)
+	return n, nil
+}
+
+// writeFileAtomic writes r to a temporary file next to filePath and renames it
+// into place, so readers never observe a partially written file.
+func writeFileAtomic(filePath string, r io.Reader) (int64, error) {
+	return writeFileChecked(filePath, r, nil)
+}
+
+// writeFileChecked is writeFileAtomic calling check, if set, with the
+// complete temporary file before it is moved into place. An error from check
+// aborts the write.
+func writeFileChecked(filePath string, r io.Reader, check func(tmpPath string) error) (int64, error) {
+	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		return 0, errIsDirectory
+	}
+
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(dir, stagingPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	// Clean up the temp file on any failure; after a successful rename this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return n, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return n, err
+	}
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return n, err
+	}
+	if check != nil {
+		if err := check(tmp.Name()); err != nil {
+			return n, err
+		}
+	}
+	return n, os.Rename(tmp.Name(), filePath)
+}
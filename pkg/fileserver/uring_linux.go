@@ -0,0 +1,293 @@
+package fileserver
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal io_uring binding: just enough to queue vectored reads and reap
+// their completions. x/sys/unix has no io_uring wrappers.
+
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	iouringOffSQRing = 0
+	iouringOffCQRing = 0x8000000
+	iouringOffSQEs   = 0x10000000
+
+	iouringFeatSingleMmap = 1 << 0
+	iouringEnterGetEvents = 1 << 0
+	iouringOpReadv        = 1
+	uringReadChunk        = 1024 * 1024
+)
+
+type uringSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQRingOffsets
+	cqOff                                                                  uringCQRingOffsets
+}
+
+type uringSQE struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	_        [3]uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is a single io_uring instance with its rings mapped.
+type uring struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqeMem  []byte
+	pending uint32 // SQEs queued but not yet passed to io_uring_enter
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []uringSQE
+
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []uringCQE
+}
+
+func newURing(entries uint32) (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &uring{fd: int(fd)}
+
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	if p.features&iouringFeatSingleMmap != 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+	var err error
+	if r.sqRing, err = r.mmap(iouringOffSQRing, sqSize); err != nil {
+		return nil, err
+	}
+	if p.features&iouringFeatSingleMmap != 0 {
+		r.cqRing = r.sqRing
+	} else if r.cqRing, err = r.mmap(iouringOffCQRing, cqSize); err != nil {
+		return nil, err
+	}
+	if r.sqeMem, err = r.mmap(iouringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{}))); err != nil {
+		return nil, err
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+// mmap maps a ring region; on failure the ring is closed.
+func (r *uring) mmap(offset int64, size int) ([]byte, error) {
+	mem, err := unix.Mmap(r.fd, offset, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return mem, nil
+}
+
+// push queues an SQE; the caller ensures no more than the ring's entries are
+// in flight.
+func (r *uring) push(sqe uringSQE) {
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & *r.sqMask
+	r.sqes[idx] = sqe
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.pending++
+}
+
+// wait submits queued SQEs, blocks until at least one completion is available
+// and passes every available completion to fn.
+func (r *uring) wait(fn func(userData uint64, res int32)) error {
+	for {
+		_, _, errno := unix.Syscall6(sysIOUringEnter, uintptr(r.fd), uintptr(r.pending), 1, iouringEnterGetEvents, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+		break
+	}
+	r.pending = 0
+
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqe := r.cqes[head&*r.cqMask]
+		fn(cqe.userData, cqe.res)
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return nil
+}
+
+func (r *uring) close() {
+	if r.sqeMem != nil {
+		unix.Munmap(r.sqeMem)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		unix.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		unix.Munmap(r.sqRing)
+	}
+	unix.Close(r.fd)
+}
+
+// uringSlot is one chunk-sized read, in flight or waiting to be consumed.
+type uringSlot struct {
+	buf  []byte
+	iov  unix.Iovec
+	done bool
+	res  int32
+	pos  int
+}
+
+// uringReader reads a file sequentially through io_uring, keeping up to depth
+// chunk reads at successive offsets in flight so the device always has work
+// queued while the caller consumes earlier chunks.
+type uringReader struct {
+	ring     *uring
+	fd       int32
+	size     int64
+	next     int64 // offset of the next read to queue
+	slots    []uringSlot
+	head     int // slot holding the next bytes to return
+	queued   int
+	inflight int
+	err      error
+}
+
+// newURingReader sets up a ring for reading f, whose size at open was size.
+func newURingReader(f *os.File, size int64, depth int) (*uringReader, error) {
+	ring, err := newURing(uint32(depth))
+	if err != nil {
+		return nil, err
+	}
+	return &uringReader{
+		ring:  ring,
+		fd:    int32(f.Fd()),
+		size:  size,
+		slots: make([]uringSlot, depth),
+	}, nil
+}
+
+// fill queues reads up to the depth. It stops past the size seen at open,
+// except that one read is always queued so a file that grew is read to its end.
+func (r *uringReader) fill() {
+	for r.queued < len(r.slots) && (r.next <= r.size || r.queued == 0) {
+		i := (r.head + r.queued) % len(r.slots)
+		s := &r.slots[i]
+		if s.buf == nil {
+			s.buf = make([]byte, uringReadChunk)
+		}
+		s.iov.Base = &s.buf[0]
+		s.iov.SetLen(len(s.buf))
+		s.done, s.res, s.pos = false, 0, 0
+		r.ring.push(uringSQE{
+			opcode:   iouringOpReadv,
+			fd:       r.fd,
+			off:      uint64(r.next),
+			addr:     uint64(uintptr(unsafe.Pointer(&s.iov))),
+			len:      1,
+			userData: uint64(i),
+		})
+		r.next += int64(len(s.buf))
+		r.queued++
+		r.inflight++
+	}
+}
+
+func (r *uringReader) complete(userData uint64, res int32) {
+	s := &r.slots[userData]
+	s.done, s.res = true, res
+	r.inflight--
+}
+
+func (r *uringReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	r.fill()
+	s := &r.slots[r.head]
+	for !s.done {
+		if err := r.ring.wait(r.complete); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	if s.res < 0 {
+		r.err = os.NewSyscallError("readv", syscall.Errno(-s.res))
+		return 0, r.err
+	}
+
+	n := copy(p, s.buf[s.pos:s.res])
+	s.pos += n
+	if s.pos == int(s.res) {
+		r.head = (r.head + 1) % len(r.slots)
+		r.queued--
+		// A short read is the end of the file; reads queued after it are discarded
+		if int(s.res) < len(s.buf) {
+			r.err = io.EOF
+			if n == 0 {
+				return 0, io.EOF
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close waits for reads still in flight, since the kernel writes into their
+// buffers, then tears down the ring.
+func (r *uringReader) Close() error {
+	for r.inflight > 0 {
+		if err := r.ring.wait(r.complete); err != nil {
+			// Leak the ring rather than unmap memory the kernel may still use
+			return err
+		}
+	}
+	r.ring.close()
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// uringReader is only implemented on Linux.
+type uringReader struct{ io.Reader }
+
+func newURingReader(f *os.File, size int64, depth int) (*uringReader, error) {
+	return nil, errors.New("io_uring is only available on Linux")
+}
+
+func (r *uringReader) Close() error { return nil }
@@ -0,0 +1,103 @@
+package fileserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VirtualHost serves Dir to requests whose Host header is Host, with its own
+// memory cache of CacheSizeBytes (0 = the same size as -cacheSizeBytes).
+type VirtualHost struct {
+	Host           string `yaml:"host"`
+	Dir            string `yaml:"dir"`
+	CacheSizeBytes int64  `yaml:"cacheSizeBytes"`
+}
+
+func (vh VirtualHost) String() string {
+	s := vh.Host + "=" + vh.Dir
+	if vh.CacheSizeBytes > 0 {
+		s += "@" + strconv.FormatInt(vh.CacheSizeBytes, 10)
+	}
+	return s
+}
+
+// ParseVirtualHosts parses a comma-separated list of host=dir pairs, each
+// optionally followed by @cacheSizeBytes, e.g.
+// "downloads.example.com=/srv/dl,media.example.com=/srv/media@536870912".
+func ParseVirtualHosts(s string) ([]VirtualHost, error) {
+	var hosts []VirtualHost
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		host, dir, ok := strings.Cut(part, "=")
+		if !ok || host == "" || dir == "" {
+			return nil, fmt.Errorf("invalid virtual host %q: expected host=dir[@cacheSizeBytes]", part)
+		}
+		vh := VirtualHost{Host: strings.ToLower(host), Dir: dir}
+		if i := strings.LastIndex(dir, "@"); i >= 0 {
+			size, err := strconv.ParseInt(dir[i+1:], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cache size in virtual host %q: %w", part, err)
+			}
+			vh.Dir, vh.CacheSizeBytes = dir[:i], size
+		}
+		hosts = append(hosts, vh)
+	}
+	return hosts, nil
+}
+
+// hostConfig derives the settings for a virtual host from cfg. Mirrors,
+// -storage and the cache snapshot describe the default root and don't carry over.
+func hostConfig(cfg *Config, vh VirtualHost) *Config {
+	hc := *cfg
+	hc.Dir = vh.Dir
+	if vh.CacheSizeBytes > 0 {
+		hc.CacheSizeBytes = vh.CacheSizeBytes
+	}
+	hc.MirrorDirs = nil
+	hc.CacheSnapshot = ""
+	hc.Storage = ""
+	hc.VirtualHosts = nil
+	// Keep each host's files apart in a shared Redis
+	hc.RedisPrefix += strings.ToLower(vh.Host) + ":"
+	return &hc
+}
+
+// hostRouter dispatches requests to a handler by Host header, falling back
+// to the default root for unknown hosts.
+type hostRouter struct {
+	hosts    map[string]http.Handler
+	fallback http.Handler
+}
+
+func (hr *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := hr.hosts[requestHost(r)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	hr.fallback.ServeHTTP(w, r)
+}
+
+// requestHost returns the lowercased Host header without its port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// virtualHostsKey identifies the hosts and their directories, which only
+// change on restart; cache sizes are reloadable.
+func virtualHostsKey(hosts []VirtualHost) string {
+	parts := make([]string, 0, len(hosts))
+	for _, vh := range hosts {
+		parts = append(parts, strings.ToLower(vh.Host)+"="+vh.Dir)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,180 @@
+package fileserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warmupRecentPrefix selects the most recently modified files instead of a
+// manifest file, as in "recent:500".
+const warmupRecentPrefix = "recent:"
+
+// parseWarmupRecent returns N of a "recent:N" manifest.
+func parseWarmupRecent(manifest string) (n int, ok bool, err error) {
+	rest, ok := strings.CutPrefix(manifest, warmupRecentPrefix)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err = strconv.Atoi(rest)
+	if err != nil || n <= 0 {
+		return 0, true, fmt.Errorf("%q: want %sN with N > 0", manifest, warmupRecentPrefix)
+	}
+	return n, true, nil
+}
+
+// Warmup reads the files named by -warmupManifest into the cache in the
+// background, at most -warmupConcurrency at a time, so a freshly started
+// instance doesn't serve its first requests cold. The manifest is a file with
+// one URL path per line (blank lines and # comments are ignored), or
+// "recent:N" for the N most recently modified files. Files that are already
+// cached, too large to cache or gone are skipped.
+func (h *FileHandler) Warmup(cfg *Config) error {
+	var paths []string
+	var err error
+	if n, ok, _ := parseWarmupRecent(cfg.WarmupManifest); ok {
+		paths, err = h.recentFiles(cfg, n)
+	} else {
+		paths, err = readWarmupManifest(cfg, cfg.WarmupManifest)
+	}
+	if err != nil {
+		return err
+	}
+	go h.warmup(cfg, paths)
+	return nil
+}
+
+func (h *FileHandler) warmup(cfg *Config, paths []string) {
+	start := time.Now()
+	var loaded atomic.Int64
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.WarmupConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for urlPath := range work {
+				if h.warmupFile(cfg, urlPath) {
+					loaded.Add(1)
+				}
+			}
+		}()
+	}
+feed:
+	for _, urlPath := range paths {
+		select {
+		case work <- urlPath:
+		case <-h.ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	log.Printf("Cache warm-up from %s finished: %d of %d files loaded in %v", cfg.WarmupManifest, loaded.Load(), len(paths), time.Since(start).Round(time.Millisecond))
+}
+
+// warmupFile loads one file into the cache, reporting whether it was read.
+func (h *FileHandler) warmupFile(cfg *Config, urlPath string) bool {
+	filePath := filepath.Join(h.baseDir, filepath.FromSlash(urlPath))
+	if _, _, ok := h.cache.Peek(filePath); ok || !h.symlinkAllowed(cfg, filePath) {
+		return false
+	}
+	results, _ := h.fetchShared(cfg, urlPath, filePath, nil)
+	res := <-results
+	switch err := res.Err; {
+	case err == nil:
+		h.store(cfg, urlPath, filePath, res.Val.(*readResult).data)
+		return true
+	case os.IsNotExist(err), errors.Is(err, errTooLargeToCache), errors.Is(err, errIsDirectory):
+	default:
+		log.Printf("Warm-up: error reading %s: %v", urlPath, err)
+	}
+	return false
+}
+
+// readWarmupManifest returns the URL paths listed in the manifest file name.
+func readWarmupManifest(cfg *Config, name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urlPath := path.Clean("/" + line)
+		if urlPath == "/" || isInternalPath(urlPath) || isHiddenPath(cfg, urlPath) {
+			continue
+		}
+		paths = append(paths, urlPath)
+	}
+	return paths, scanner.Err()
+}
+
+// recentFiles returns the URL paths of the n most recently modified files
+// that fit in the cache, newest first.
+func (h *FileHandler) recentFiles(cfg *Config, n int) ([]string, error) {
+	type file struct {
+		urlPath string
+		modTime time.Time
+	}
+	var files []file
+	keepNewest := func() {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+		if len(files) > n {
+			files = files[:n]
+		}
+	}
+	maxBytes := h.maxItemBytes(cfg)
+	var walk func(urlPath string) error
+	walk = func(urlPath string) error {
+		des, err := h.storage.List(h.storageName(filepath.Join(h.baseDir, filepath.FromSlash(urlPath))))
+		if err != nil {
+			return err
+		}
+		for _, de := range des {
+			child := path.Join(urlPath, de.Name())
+			if isInternalPath(child) || isHiddenPath(cfg, child) {
+				continue
+			}
+			if de.IsDir() {
+				if err := walk(child); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				continue
+			}
+			info, err := de.Info()
+			if err != nil || !info.Mode().IsRegular() || (maxBytes > 0 && info.Size() > maxBytes) {
+				continue
+			}
+			// Trim as we go so huge trees don't have to be held in memory
+			if files = append(files, file{child, info.ModTime()}); len(files) >= 2*n {
+				keepNewest()
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return nil, err
+	}
+	keepNewest()
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.urlPath
+	}
+	return paths, nil
+}
@@ -0,0 +1,104 @@
+package fileserver
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// CacheInvalidator watches the served directory tree and drops cache entries
+// for files that are modified, renamed or removed on disk.
+type CacheInvalidator struct {
+	watcher *fsnotify.Watcher
+	cache   *MemoryCache
+	done    chan struct{}
+}
+
+// NewCacheInvalidator registers watches on baseDir and all of its subdirectories.
+// fsnotify is not recursive, so directories created later are added as they appear.
+func NewCacheInvalidator(baseDir string, cache *MemoryCache) (*CacheInvalidator, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	ci := &CacheInvalidator{
+		watcher: watcher,
+		cache:   cache,
+		done:    make(chan struct{}),
+	}
+	if err := ci.addRecursive(baseDir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go ci.run()
+	return ci, nil
+}
+
+// Close stops watching and waits for the event loop to exit.
+func (ci *CacheInvalidator) Close() error {
+	err := ci.watcher.Close()
+	<-ci.done
+	return err
+}
+
+func (ci *CacheInvalidator) addRecursive(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Directories can vanish between the event and the walk; skip them.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return ci.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (ci *CacheInvalidator) run() {
+	defer close(ci.done)
+	for {
+		select {
+		case event, ok := <-ci.watcher.Events:
+			if !ok {
+				return
+			}
+			ci.handleEvent(event)
+		case err, ok := <-ci.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("File watcher error: %v", err)
+		}
+	}
+}
+
+func (ci *CacheInvalidator) handleEvent(event fsnotify.Event) {
+	// Cache keys are built with filepath.Join, which cleans the path;
+	// event names may carry a leading "./" from the watched root.
+	name := filepath.Clean(event.Name)
+
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			if err := ci.addRecursive(name); err != nil {
+				log.Printf("Failed to watch new directory %s: %v", name, err)
+			}
+		}
+	}
+
+	if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) ||
+		event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		ci.cache.Delete(name)
+		// A renamed or removed directory takes every cached file below it along.
+		if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+			ci.cache.DeletePrefix(name + string(filepath.Separator))
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package fileserver
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// WebDAVHandler serves the same directory over WebDAV under /dav/. Read methods
+// are open; everything that mutates the tree requires the write permission.
+func (h *FileHandler) WebDAVHandler() http.Handler {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: &invalidatingFS{Dir: webdav.Dir(h.baseDir), h: h},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := h.cfg.Load()
+		urlPath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/dav"))
+		if isHiddenPath(cfg, urlPath) {
+			http.Error(w, http.StatusText(cfg.HiddenStatus), cfg.HiddenStatus)
+			return
+		}
+		if !h.checkACL(w, r, cfg, urlPath) {
+			return
+		}
+		// Listings leave out what the client couldn't open by name
+		authorized := authorizePaths(r)
+		visible := func(p string) bool {
+			return !isInternalPath(p) && !isHiddenPath(cfg, p) && aclError(r, cfg, p) == nil && authorized(p) == nil
+		}
+		r = r.WithContext(context.WithValue(r.Context(), davVisibleKey{}, visible))
+		switch r.Method {
+		case http.MethodOptions:
+		case http.MethodGet, http.MethodHead, "PROPFIND":
+			// Signed-URL mode covers reads over WebDAV too
+			if cfg.SignKey != "" {
+				if err := verifySignedURL(cfg.SignKey, urlPath, r.URL.Query(), time.Now()); err != nil {
+					http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+					return
+				}
+			}
+		default:
+			if !h.authorizeWrite(w, r, cfg) {
+				return
+			}
+			// COPY and MOVE write to a second path, which must be as open as the first
+			if dest, ok := davDestination(r); ok && (r.Method == "COPY" || r.Method == "MOVE") {
+				if isHiddenPath(cfg, dest) {
+					http.Error(w, http.StatusText(cfg.HiddenStatus), cfg.HiddenStatus)
+					return
+				}
+				if err := aclError(r, cfg, dest); err != nil {
+					h.writeError(w, r, dest, err)
+					return
+				}
+				if err := authorized(dest); err != nil {
+					h.writeError(w, r, dest, err)
+					return
+				}
+			}
+			write := &davWrite{user: authenticatedUser(r)}
+			r = r.WithContext(context.WithValue(r.Context(), davWriteKey{}, write))
+			w = &davResponseWriter{ResponseWriter: w, r: r, h: h, urlPath: urlPath, write: write}
+		}
+		dav.ServeHTTP(w, r)
+	})
+}
+
+// davDestination returns the path named by the Destination header of a COPY
+// or MOVE request, stripped of /dav like the request path.
+func davDestination(r *http.Request) (string, bool) {
+	dest := r.Header.Get("Destination")
+	if dest == "" {
+		return "", false
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", false
+	}
+	p, ok := strings.CutPrefix(u.Path, "/dav")
+	if !ok {
+		return "", false
+	}
+	return path.Clean("/" + p), true
+}
+
+// davVisibleKey is the context key under which a WebDAV request carries the
+// check its directory listings filter entries with.
+type davVisibleKey struct{}
+
+// davWriteKey is the context key under which a WebDAV write request carries
+// its *davWrite.
+type davWriteKey struct{}
+
+// davWrite passes the user behind a WebDAV write to the file system, and back
+// from it the reason the write failed, which golang.org/x/net/webdav would
+// otherwise answer with a generic status.
+type davWrite struct {
+	user string
+	err  error
+}
+
+// fail records err as the reason the write failed and returns it.
+func (dw *davWrite) fail(err error) error {
+	dw.err = err
+	return err
+}
+
+// davWriteFrom returns the *davWrite of the request ctx belongs to.
+func davWriteFrom(ctx context.Context) *davWrite {
+	if dw, ok := ctx.Value(davWriteKey{}).(*davWrite); ok {
+		return dw
+	}
+	return &davWrite{}
+}
+
+// davResponseWriter answers a failed write with writeError once the file
+// system has recorded why it failed, e.g. 507 for an exceeded quota.
+type davResponseWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	h        *FileHandler
+	urlPath  string
+	write    *davWrite
+	answered bool
+}
+
+func (w *davResponseWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest && w.write.err != nil {
+		w.h.writeError(w.ResponseWriter, w.r, w.urlPath, w.write.err)
+		w.answered = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *davResponseWriter) Write(p []byte) (int, error) {
+	if w.answered {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// invalidatingFS wraps a webdav.Dir and invalidates cache entries for every
+// path it modifies, so WebDAV writes behave like the PUT/DELETE API.
+type invalidatingFS struct {
+	webdav.Dir
+	h *FileHandler
+}
+
+// filePath maps a WebDAV name to the cache key used by FileHandler.
+func (fs *invalidatingFS) filePath(name string) string {
+	return filepath.Join(fs.h.baseDir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// symlinkAllowed applies -symlinkPolicy to a WebDAV name.
+func (fs *invalidatingFS) symlinkAllowed(name string) bool {
+	return fs.h.symlinkAllowed(fs.h.cfg.Load(), fs.filePath(name))
+}
+
+func (fs *invalidatingFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isInternalPath(path.Clean("/" + name)) {
+		return os.ErrPermission
+	}
+	if !fs.symlinkAllowed(name) {
+		return os.ErrPermission
+	}
+	return fs.Dir.Mkdir(ctx, name, perm)
+}
+
+func (fs *invalidatingFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if isInternalPath(path.Clean("/" + name)) {
+		return nil, os.ErrNotExist
+	}
+	if !fs.symlinkAllowed(name) {
+		return nil, os.ErrPermission
+	}
+	if flag&os.O_TRUNC != 0 {
+		// PUT and COPY replace the whole file
+		return fs.stage(ctx, name)
+	}
+	f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		if visible, ok := ctx.Value(davVisibleKey{}).(func(string) bool); ok {
+			return &listedFile{File: f, urlPath: path.Clean("/" + name), visible: visible}, nil
+		}
+		return f, nil
+	}
+	return &invalidatingFile{File: f, onClose: func() { fs.h.invalidate(fs.filePath(name)) }}, nil
+}
+
+func (fs *invalidatingFS) RemoveAll(ctx context.Context, name string) error {
+	if isInternalPath(path.Clean("/" + name)) {
+		return os.ErrNotExist
+	}
+	if !fs.symlinkAllowed(name) {
+		return os.ErrPermission
+	}
+	var err error
+	if urlPath := path.Clean("/" + name); fs.h.cfg.Load().SoftDelete && urlPath != "/" {
+		err = fs.h.moveTreeToTrash(urlPath, fs.filePath(name))
+	} else {
+		err = fs.Dir.RemoveAll(ctx, name)
+	}
+	if err == nil {
+		fs.h.quotas.moved(path.Clean("/"+name), "")
+	}
+	fs.h.invalidateTree(fs.filePath(name))
+	return err
+}
+
+func (fs *invalidatingFS) Rename(ctx context.Context, oldName, newName string) error {
+	if isInternalPath(path.Clean("/"+oldName)) || isInternalPath(path.Clean("/"+newName)) {
+		return os.ErrPermission
+	}
+	if isHiddenPath(fs.h.cfg.Load(), path.Clean("/"+newName)) {
+		return os.ErrPermission
+	}
+	if !fs.symlinkAllowed(oldName) || !fs.symlinkAllowed(newName) {
+		return os.ErrPermission
+	}
+	oldPath, newPath := path.Clean("/"+oldName), path.Clean("/"+newName)
+	if err := fs.h.quotas.chargeMove(fs.h.cfg.Load(), oldPath, newPath, fs.filePath(oldName)); err != nil {
+		return davWriteFrom(ctx).fail(err)
+	}
+	err := fs.Dir.Rename(ctx, oldName, newName)
+	if err == nil {
+		fs.h.quotas.moved(oldPath, newPath)
+	}
+	fs.h.invalidateTree(fs.filePath(oldName))
+	fs.h.invalidateTree(fs.filePath(newName))
+	return err
+}
+
+func (fs *invalidatingFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isInternalPath(path.Clean("/" + name)) {
+		return nil, os.ErrNotExist
+	}
+	if !fs.symlinkAllowed(name) {
+		return nil, os.ErrPermission
+	}
+	return fs.Dir.Stat(ctx, name)
+}
+
+// stage opens a temporary file next to name for a WebDAV upload, which
+// replaces name when it is closed if it fits -quotas and passes -uploadScan,
+// like a PUT.
+func (fs *invalidatingFS) stage(ctx context.Context, name string) (webdav.File, error) {
+	cfg := fs.h.cfg.Load()
+	write := davWriteFrom(ctx)
+	urlPath, filePath := path.Clean("/"+name), fs.filePath(name)
+	charge, err := fs.h.quotas.charge(cfg, urlPath, write.user)
+	if err != nil {
+		return nil, write.fail(err)
+	}
+	// A missing parent fails here, as it would without staging
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), stagingPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &stagedFile{File: tmp, tmp: tmp, h: fs.h, write: write, urlPath: urlPath, filePath: filePath, charge: charge}, nil
+}
+
+// stagedFile is a WebDAV upload in progress.
+type stagedFile struct {
+	webdav.File // Hides the *os.File's ReadFrom, so every byte goes through Write
+	tmp         *os.File
+	h           *FileHandler
+	write       *davWrite
+	urlPath     string
+	filePath    string
+	charge      *quotaCharge
+	size        int64
+}
+
+func (f *stagedFile) Write(p []byte) (int, error) {
+	n, err := f.tmp.Write(p)
+	f.size += int64(n)
+	if err == nil && !f.charge.allows(f.size) {
+		err = f.write.fail(errQuotaExceeded)
+	}
+	return n, err
+}
+
+func (f *stagedFile) Close() error {
+	defer os.Remove(f.tmp.Name()) // No-op once moved into place
+	err := f.tmp.Sync()
+	if closeErr := f.tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !f.charge.allows(f.size) {
+		err = errQuotaExceeded
+	}
+	if err == nil {
+		err = f.h.placeUpload(f.h.cfg.Load(), f.urlPath, f.write.user, f.filePath, f.tmp.Name())
+	}
+	if err != nil {
+		return f.write.fail(err)
+	}
+	f.charge.commit(f.size)
+	f.h.invalidate(f.filePath)
+	return nil
+}
+
+// listedFile leaves the entries a client may not see out of its directory
+// listing, so PROPFIND shows what GET would serve.
+type listedFile struct {
+	webdav.File
+	urlPath string
+	visible func(urlPath string) bool
+}
+
+func (f *listedFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	kept := infos[:0]
+	for _, info := range infos {
+		if f.visible(path.Join(f.urlPath, info.Name())) {
+			kept = append(kept, info)
+		}
+	}
+	return kept, err
+}
+
+// invalidatingFile runs onClose after the underlying file has been written and closed.
+type invalidatingFile struct {
+	webdav.File
+	onClose func()
+}
+
+func (f *invalidatingFile) Close() error {
+	err := f.File.Close()
+	f.onClose()
+	return err
+}
@@ -0,0 +1,125 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// WebDAV destinations and listings follow the ACL and auth rules like the
+// paths in request URLs.
+func TestWebDAVRules(t *testing.T) {
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.WebDAV = true
+		cfg.HideDotfiles = true
+		cfg.ACL = []ACLRule{{Pattern: "/denied/**", Action: ACLDeny}}
+		cfg.AuthRules = []AuthRule{{Prefix: "/private/", Tokens: []string{"s3cret"}}}
+	})
+	a, err := NewAuthenticator(h.cfg.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dav := a.Wrap(h.WebDAVHandler())
+	for _, name := range []string{"pub/a.txt", "denied/b.txt", "private/c.txt", ".env"} {
+		writeTestFile(t, h.baseDir, name, "x")
+	}
+
+	send := func(method, target, token string, header map[string]string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		dav.ServeHTTP(w, req)
+		return w.Code
+	}
+	tests := []struct {
+		method, dest, token string
+		want                int
+	}{
+		{"MOVE", "/dav/denied/a.txt", "", http.StatusForbidden},
+		{"COPY", "/dav/denied/a.txt", "", http.StatusForbidden},
+		{"MOVE", "/dav/private/a.txt", "", http.StatusUnauthorized},
+		{"COPY", "/dav/private/a.txt", "wrong", http.StatusUnauthorized},
+		{"COPY", "/dav/private/a.txt", "s3cret", http.StatusCreated},
+		{"COPY", "/dav/pub/b.txt", "", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if got := send(tt.method, "/dav/pub/a.txt", tt.token, map[string]string{"Destination": tt.dest}); got != tt.want {
+			t.Errorf("%s to %s with token %q = %d, want %d", tt.method, tt.dest, tt.token, got, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	req.Header.Set("Depth", "infinity")
+	w := httptest.NewRecorder()
+	dav.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND = %d, want 207", w.Code)
+	}
+	listing := w.Body.String()
+	if !strings.Contains(listing, "/dav/pub/a.txt") {
+		t.Error("PROPFIND left out an open file")
+	}
+	for _, name := range []string{"/dav/denied/", "/dav/private/", "/dav/.env"} {
+		if strings.Contains(listing, name) {
+			t.Errorf("PROPFIND listed %s", name)
+		}
+	}
+}
+
+// WebDAV writes go through the same quota, scanning and trash checks as PUT.
+func TestWebDAVWrites(t *testing.T) {
+	scanner := testScanner(t)
+	h := newTestHandler(t, func(cfg *Config) {
+		cfg.WebDAV = true
+		cfg.Quotas = []QuotaRule{{Dir: "/a", Bytes: 10}}
+		cfg.UploadScan = scanner
+		cfg.SoftDelete = true
+	})
+	dav := h.WebDAVHandler()
+	writeTestFile(t, h.baseDir, "b/big.txt", "0123456789ab")
+	if err := os.Mkdir(filepath.Join(h.baseDir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPut, "/dav/a/x.txt", "12345678", http.StatusCreated},
+		{http.MethodPut, "/dav/a/y.txt", "123", http.StatusInsufficientStorage},
+		{http.MethodPut, "/dav/b/bad.txt", "EVIL", http.StatusUnprocessableEntity},
+		{http.MethodPut, "/dav/b/good.txt", "fine", http.StatusCreated},
+		{http.MethodDelete, "/dav/b/good.txt", "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if w := serveTest(dav, tt.method, tt.path, "", tt.body); w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+	for _, name := range []string{"a/y.txt", "b/bad.txt", "b/good.txt"} {
+		if _, err := os.Stat(filepath.Join(h.baseDir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s exists", name)
+		}
+	}
+	if trashed, _ := filepath.Glob(filepath.Join(h.baseDir, trashDirName, "b", "good.txt.*")); len(trashed) != 1 {
+		t.Errorf("WebDAV DELETE left %v in the trash, want the deleted file", trashed)
+	}
+
+	// Moving 12 bytes into /a would overfill it
+	req := httptest.NewRequest("MOVE", "/dav/b/big.txt", nil)
+	req.Header.Set("Destination", "/dav/a/big.txt")
+	w := httptest.NewRecorder()
+	dav.ServeHTTP(w, req)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("MOVE into a full directory = %d, want 507", w.Code)
+	}
+}
@@ -0,0 +1,157 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/md4"
+)
+
+// zsyncManifest builds a zsync 0.6.2 control file for the size bytes read
+// from r. Clients compare its per-block checksums against their old copy and
+// fetch only the blocks that changed, with Range requests on the file itself.
+// Block size and hash lengths follow zsyncmake's defaults.
+func zsyncManifest(r io.Reader, name string, size int64, modTime time.Time) ([]byte, error) {
+	blockSize := 2048
+	if size >= 100_000_000 {
+		blockSize = 4096
+	}
+	seqMatches := 1
+	if size > int64(blockSize) {
+		seqMatches = 2
+	}
+	logLen := math.Log(float64(max(size, 1)))
+	blocksLog := math.Log(float64(1 + size/int64(blockSize)))
+	rsumBytes := int(math.Ceil(((logLen+math.Log(float64(blockSize)))/math.Ln2 - 8.6) / float64(seqMatches) / 8))
+	rsumBytes = min(max(rsumBytes, 2), 4)
+	checksumBytes := int(math.Ceil((20 + (logLen+blocksLog)/math.Ln2) / float64(seqMatches) / 8))
+	checksumBytes = min(max(checksumBytes, int((7.9+(20+blocksLog/math.Ln2))/8)), 16)
+
+	sha := sha1.New()
+	var sums bytes.Buffer
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n == 0 {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		sha.Write(block[:n])
+		clear(block[n:]) // The last block is zero-padded
+
+		var a, b uint16
+		for i, c := range block {
+			a += uint16(c)
+			b += uint16(blockSize-i) * uint16(c)
+		}
+		var rsum [4]byte
+		binary.BigEndian.PutUint16(rsum[:2], a)
+		binary.BigEndian.PutUint16(rsum[2:], b)
+		sums.Write(rsum[4-rsumBytes:])
+		strong := md4.New()
+		strong.Write(block)
+		sums.Write(strong.Sum(nil)[:checksumBytes])
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "zsync: 0.6.2\nFilename: %s\nMTime: %s\nBlocksize: %d\nLength: %d\nHash-Lengths: %d,%d,%d\nURL: %s\nSHA-1: %s\n\n",
+		name, modTime.Format("Mon, 02 Jan 2006 15:04:05 -0700"), blockSize, size,
+		seqMatches, rsumBytes, checksumBytes, url.PathEscape(name), hex.EncodeToString(sha.Sum(nil)))
+	out.Write(sums.Bytes())
+	return out.Bytes(), nil
+}
+
+// serveZsync answers ?zsync with the file's zsync control file. Manifests are
+// cached like checksums: with the file if it is cached, otherwise keyed by
+// size and modification time.
+func (h *FileHandler) serveZsync(w http.ResponseWriter, r *http.Request, cfg *Config, urlPath, filePath string) {
+	info, err := h.storage.Stat(h.storageName(filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			serveReadError(w, r, urlPath, err)
+		}
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "zsync manifests are only available for files", http.StatusBadRequest)
+		return
+	}
+
+	name := path.Base(urlPath)
+	var key string
+	var compute func() ([]byte, error)
+	data, err := h.load(r, cfg, urlPath, filePath)
+	switch {
+	case err == nil:
+		key = VariantKey(filePath, "zsync")
+		compute = func() ([]byte, error) {
+			return zsyncManifest(bytes.NewReader(data), name, int64(len(data)), info.ModTime())
+		}
+	case errors.Is(err, errTooLargeToCache):
+		key = VariantKey(filePath, fmt.Sprintf("zsync:%d:%d", info.Size(), info.ModTime().UnixNano()))
+		compute = func() ([]byte, error) {
+			// Hashing a huge file can outlast -readDeadline; only shutdown aborts it
+			if err := h.acquireRead(h.ctx, cfg); err != nil {
+				return nil, err
+			}
+			defer h.reads.release()
+			file, err := h.storage.Open(h.storageName(filePath))
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			return zsyncManifest(file, name, info.Size(), info.ModTime())
+		}
+	default:
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			serveReadError(w, r, urlPath, err)
+		}
+		return
+	}
+
+	manifest, ok := h.cache.Get(key)
+	if !ok {
+		val, err, _ := h.sfGroup.Do(key, func() (interface{}, error) {
+			manifest, err := compute()
+			if err != nil {
+				return nil, err
+			}
+			h.store(cfg, urlPath, key, manifest)
+			return manifest, nil
+		})
+		if err != nil {
+			serveReadError(w, r, urlPath, err)
+			return
+		}
+		manifest = val.([]byte)
+	}
+
+	w.Header().Set("Content-Type", "application/x-zsync")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zsync"))
+	setCacheControl(w, cfg, urlPath)
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(manifest))
+}